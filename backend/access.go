@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long signed static urls stay valid for. Expiry times are rounded up to
+// the hour, so a book's url, and the browser's cache of its files, stay the same for a while.
+const STATIC_URL_LIFETIME = 6 * time.Hour
+
+// Shortest SIGNING_KEY, in bytes.
+const MIN_SIGNING_KEY_SIZE = 32
+
+// Generate a random key to sign static urls, tokens and sessions with.
+// Anything signed with it becomes invalid once the server restarts.
+func newSigningKey() []byte {
+	key := make([]byte, MIN_SIGNING_KEY_SIZE)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// Only let users that have the book with the id in the route's path
+// in their collection through. Other users get ErrBookNotFound,
+// so the ids of books they don't have can't be discovered.
+func (s *Server) requireReader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userId, err := s.getUserId(r)
+		if err != nil {
+			respondWithError(w, r, ErrUnauthenticated.Wrap(err))
+			return
+		}
+		bookId, err := getPathId(r)
+		if err != nil {
+			respondWithError(w, r, ErrBadRequest.Wrap(err))
+			return
+		}
+
+		_, err = s.store.GetUserBook(r.Context(), userId, bookId)
+		if errors.Is(err, ErrNotFound) {
+			respondWithError(w, r, ErrBookNotFound.Wrap(err))
+			return
+		} else if err != nil {
+			respondWithError(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Only let users that confirmed they own their email through,
+// when the server requires it. Other users get ErrEmailUnverified.
+func (s *Server) requireVerified(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireVerification {
+			next.ServeHTTP(w, r)
+			return
+		}
+		userId, err := s.getUserId(r)
+		if err != nil {
+			respondWithError(w, r, ErrUnauthenticated.Wrap(err))
+			return
+		}
+
+		user, err := s.store.GetUser(r.Context(), userId)
+		if errors.Is(err, ErrNotFound) {
+			respondWithError(w, r, ErrUnauthenticated.Wrap(err))
+			return
+		} else if err != nil {
+			respondWithError(w, r, err)
+			return
+		} else if !user.Verified {
+			respondWithError(w, r, ErrEmailUnverified)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The directory a book was extracted into, relative to the extract directory.
+func bookDirectory(book Book) string {
+	if len(book.Files) == 0 {
+		return ""
+	}
+	directory, _, _ := strings.Cut(book.Files[0], "/")
+	return directory
+}
+
+// Sign a message made of parts. The first part says what the signature is for,
+// so a signature for one purpose can't be used for another.
+func (s *Server) sign(parts ...string) string {
+	mac := hmac.New(sha256.New, s.signingKey)
+	mac.Write([]byte(strings.Join(parts, "\n")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Server) staticSignature(directory string, expires int64) string {
+	return s.sign("static", directory, strconv.FormatInt(expires, 10))
+}
+
+// Sign the url path that the files in a book directory are served from.
+// Files are at the returned prefix followed by their path (ex. Dune/cover.jpeg).
+func (s *Server) signStaticUrl(directory string, now time.Time) string {
+	expires := now.Add(STATIC_URL_LIFETIME).Truncate(time.Hour).Add(time.Hour).Unix()
+	return "/static/" + strconv.FormatInt(expires, 10) + "." + s.staticSignature(directory, expires) + "/"
+}
+
+// Check that a static url token was signed for the directory and hasn't expired.
+func (s *Server) verifyStaticToken(token, directory string, now time.Time) bool {
+	expiresText, signature, found := strings.Cut(token, ".")
+	expires, err := strconv.ParseInt(expiresText, 10, 64)
+	if !found || err != nil || now.Unix() >= expires {
+		return false
+	}
+	expected := s.staticSignature(directory, expires)
+	return hmac.Equal([]byte(signature), []byte(expected))
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"time"
+)
+
+// Purposes of the single use tokens mailed to users.
+const (
+	TOKEN_RESET_PASSWORD = "reset-password"
+	TOKEN_CONFIRM_EMAIL  = "confirm-email"
+)
+
+// How long the links mailed to users stay valid for.
+const (
+	RESET_PASSWORD_LIFETIME = time.Hour
+	CONFIRM_EMAIL_LIFETIME  = 24 * time.Hour
+)
+
+// Origin of the frontend, which the links mailed to users point to.
+var FRONTEND_ORIGIN = "http://localhost:5173"
+
+// Only the hash of a token is stored, so tokens
+// can't be used by someone reading the database.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomToken() (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+// Create a single use token for a user, replacing their previous
+// token with the same purpose, and return it.
+func newToken(ctx context.Context, store Store, userId int, purpose, email string, lifetime time.Duration) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	t := Token{
+		Hash:    hashToken(token),
+		UserId:  userId,
+		Purpose: purpose,
+		Email:   email,
+		Expires: time.Now().Add(lifetime),
+	}
+	return token, store.CreateToken(ctx, t)
+}
+
+// Use a token, so it can't be used again. Returns ErrInvalidToken
+// if the token doesn't exist, has another purpose or has expired.
+func useToken(ctx context.Context, store Store, token, purpose string) (Token, error) {
+	t, err := store.UseToken(ctx, hashToken(token), purpose)
+	if errors.Is(err, ErrNotFound) {
+		return Token{}, ErrInvalidToken.Wrap(err)
+	} else if err != nil {
+		return Token{}, err
+	}
+	if time.Now().After(t.Expires) {
+		return Token{}, ErrInvalidToken
+	}
+	return t, nil
+}
+
+// A link to a frontend page with a token in its query.
+func tokenLink(page, token string) string {
+	return FRONTEND_ORIGIN + page + "?token=" + url.QueryEscape(token)
+}
+
+func isValidEmail(email string) bool {
+	address, err := mail.ParseAddress(email)
+	return err == nil && address.Address == email
+}
+
+func samePassword(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// The mail with the link confirming that the user owns an email,
+// see POST /api/v1/email/confirm.
+func confirmEmailMail(email, token string) Mail {
+	return Mail{
+		To:      email,
+		Subject: "Confirm your email",
+		Body: fmt.Sprintf("Follow this link to confirm that %s is the email of your Page account. "+
+			"The link expires in a day.\n\n%s\n\nIf you didn't ask for this, you can ignore this mail.\n",
+			email, tokenLink("/account/email", token)),
+	}
+}
+
+// Send a mail to the user with a timeout.
+func (s *Server) sendMail(ctx context.Context, m Mail) error {
+	ctx, cancel := context.WithTimeout(ctx, MAIL_TIMEOUT)
+	defer cancel()
+	return s.mailer.Send(ctx, m)
+}
+
+// GET /api/v1/me
+//
+// Request payload: Cookie with name set to "userId" and value set to the user's session.
+//
+// Response: {"Email": "", "Verified": false, "Settings": {"UseReaderTheme": false}}
+//
+// Get the user's email, whether they confirmed that they own it and their settings.
+func (s *Server) GetAccount(w http.ResponseWriter, r *http.Request) {
+	userId, err := s.getUserId(r)
+	if err != nil {
+		respondWithError(w, r, ErrUnauthenticated.Wrap(err))
+		return
+	}
+
+	user, err := s.store.GetUser(r.Context(), userId)
+	if errors.Is(err, ErrNotFound) {
+		respondWithError(w, r, ErrUnauthenticated.Wrap(err))
+		return
+	} else if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(AccountResponse{Email: user.Email, Verified: user.Verified, Settings: user.Settings})
+}
+
+// PUT /api/v1/me/settings
+//
+// Request payload:
+// {"UseReaderTheme": false}
+// Cookie with name set to "userId" and value set to the user's session.
+//
+// Response: {"UseReaderTheme": false}
+//
+// Replace the user's settings, which apply on every device they use.
+func (s *Server) UpdateSettings(w http.ResponseWriter, r *http.Request) {
+	userId, err := s.getUserId(r)
+	if err != nil {
+		respondWithError(w, r, ErrUnauthenticated.Wrap(err))
+		return
+	}
+	var settings Settings
+	if err := getRequestJson(w, r, &settings); err != nil {
+		respondWithError(w, r, ErrBadRequest.Wrap(err))
+		return
+	}
+
+	err = s.store.UpdateSettings(r.Context(), userId, settings)
+	if errors.Is(err, ErrNotFound) {
+		respondWithError(w, r, ErrUnauthenticated.Wrap(err))
+		return
+	} else if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(settings)
+}
+
+// POST /api/v1/me/verification
+//
+// Request payload: Cookie with name set to "userId" and value set to the user's session.
+//
+// Response: Empty json response, with the 202 status code when a link was mailed.
+//
+// Mail a new link confirming the user's email to them, replacing the previous one.
+// Nothing is mailed when the user is already verified.
+func (s *Server) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	userId, err := s.getUserId(r)
+	if err != nil {
+		respondWithError(w, r, ErrUnauthenticated.Wrap(err))
+		return
+	}
+
+	var user User
+	var token string
+	err = s.store.WithTx(r.Context(), func(tx Store) error {
+		user, err = tx.GetUser(r.Context(), userId)
+		if errors.Is(err, ErrNotFound) {
+			return ErrUnauthenticated.Wrap(err)
+		} else if err != nil || user.Verified {
+			return err
+		}
+		token, err = newToken(r.Context(), tx, userId, TOKEN_CONFIRM_EMAIL, user.Email, CONFIRM_EMAIL_LIFETIME)
+		return err
+	})
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+
+	if !user.Verified {
+		if err := s.sendMail(r.Context(), confirmEmailMail(user.Email, token)); err != nil {
+			respondWithError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+	json.NewEncoder(w).Encode(EmptyResponse{})
+}
+
+// PUT /api/v1/me/password
+//
+// Request payload:
+// {"CurrentPassword": "", "NewPassword": ""}
+// Cookie with name set to "userId" and value set to the user's session.
+//
+// Response: Empty json response.
+//
+// Change the user's password, which requires their current password.
+// Links mailed to the user before stop working and their sessions on
+// other devices end, while the session making the request is renewed.
+func (s *Server) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	userId, err := s.getUserId(r)
+	if err != nil {
+		respondWithError(w, r, ErrUnauthenticated.Wrap(err))
+		return
+	}
+	var request PasswordChangeRequest
+	if err := getRequestJson(w, r, &request); err != nil {
+		respondWithError(w, r, ErrBadRequest.Wrap(err))
+		return
+	}
+	if request.CurrentPassword == "" || request.NewPassword == "" {
+		respondWithError(w, r, ErrBadRequest)
+		return
+	}
+
+	var user User
+	err = s.store.WithTx(r.Context(), func(tx Store) error {
+		user, err = tx.GetUser(r.Context(), userId)
+		if errors.Is(err, ErrNotFound) {
+			return ErrUnauthenticated.Wrap(err)
+		} else if err != nil {
+			return err
+		}
+		if !samePassword(user.Password, request.CurrentPassword) {
+			return ErrInvalidCredentials
+		}
+
+		if err := tx.UpdatePassword(r.Context(), userId, request.NewPassword); err != nil {
+			return err
+		}
+		if err := tx.RemoveTokens(r.Context(), userId); err != nil {
+			return err
+		}
+		user, err = tx.GetUser(r.Context(), userId)
+		return err
+	})
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+
+	s.startSession(w, r, user)
+	json.NewEncoder(w).Encode(EmptyResponse{})
+}
+
+// PUT /api/v1/me/email
+//
+// Request payload:
+// {"Password": "", "Email": ""}
+// Cookie with name set to "userId" and value set to the user's session.
+//
+// Response: Empty json response with the 202 status code.
+//
+// Change the user's email, which requires their password. The email only
+// changes once it's confirmed with the link mailed to the new address,
+// see POST /api/v1/email/confirm.
+func (s *Server) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	userId, err := s.getUserId(r)
+	if err != nil {
+		respondWithError(w, r, ErrUnauthenticated.Wrap(err))
+		return
+	}
+	var request EmailChangeRequest
+	if err := getRequestJson(w, r, &request); err != nil {
+		respondWithError(w, r, ErrBadRequest.Wrap(err))
+		return
+	}
+	if request.Password == "" || !isValidEmail(request.Email) {
+		respondWithError(w, r, ErrBadRequest)
+		return
+	}
+
+	var token string
+	err = s.store.WithTx(r.Context(), func(tx Store) error {
+		user, err := tx.GetUser(r.Context(), userId)
+		if errors.Is(err, ErrNotFound) {
+			return ErrUnauthenticated.Wrap(err)
+		} else if err != nil {
+			return err
+		}
+		if !samePassword(user.Password, request.Password) {
+			return ErrInvalidCredentials
+		}
+
+		other, err := tx.GetUserByEmail(r.Context(), request.Email)
+		if err == nil && other.Id != userId {
+			return ErrDuplicateAccount
+		} else if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		token, err = newToken(r.Context(), tx, userId, TOKEN_CONFIRM_EMAIL, request.Email, CONFIRM_EMAIL_LIFETIME)
+		return err
+	})
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+
+	if err := s.sendMail(r.Context(), confirmEmailMail(request.Email, token)); err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(EmptyResponse{})
+}
+
+// POST /api/v1/email/confirm
+//
+// Request payload: {"Token": ""}
+//
+// Response: Empty json response.
+//
+// Confirm that the user owns an email with the token from the link mailed
+// to it, make it the user's email and mark the user as verified.
+// The token can only be used once.
+func (s *Server) ConfirmEmail(w http.ResponseWriter, r *http.Request) {
+	var request EmailConfirmRequest
+	if err := getRequestJson(w, r, &request); err != nil {
+		respondWithError(w, r, ErrBadRequest.Wrap(err))
+		return
+	}
+
+	err := s.store.WithTx(r.Context(), func(tx Store) error {
+		token, err := useToken(r.Context(), tx, request.Token, TOKEN_CONFIRM_EMAIL)
+		if err != nil {
+			return err
+		}
+		err = tx.VerifyEmail(r.Context(), token.UserId, token.Email)
+		if errors.Is(err, ErrDuplicate) {
+			return ErrDuplicateAccount.Wrap(err)
+		} else if errors.Is(err, ErrNotFound) {
+			return ErrInvalidToken.Wrap(err)
+		}
+		return err
+	})
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(EmptyResponse{})
+}
+
+// POST /api/v1/password/reset
+//
+// Request payload: {"Email": ""}
+//
+// Response: Empty json response with the 202 status code.
+//
+// Mail a link to reset the password of the account with the email.
+// The response is the same when there's no such account, so it
+// doesn't tell whether an email has an account.
+func (s *Server) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var request PasswordResetRequest
+	if err := getRequestJson(w, r, &request); err != nil {
+		respondWithError(w, r, ErrBadRequest.Wrap(err))
+		return
+	}
+	if request.Email == "" {
+		respondWithError(w, r, ErrBadRequest)
+		return
+	}
+
+	var token string
+	err := s.store.WithTx(r.Context(), func(tx Store) error {
+		user, err := tx.GetUserByEmail(r.Context(), request.Email)
+		if err != nil {
+			return err
+		}
+		token, err = newToken(r.Context(), tx, user.Id, TOKEN_RESET_PASSWORD, user.Email, RESET_PASSWORD_LIFETIME)
+		return err
+	})
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		respondWithError(w, r, err)
+		return
+	}
+
+	if err == nil {
+		err = s.sendMail(r.Context(), Mail{
+			To:      request.Email,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("Follow this link to choose a new password for your Page account. "+
+				"The link expires in an hour.\n\n%s\n\nIf you didn't ask for this, you can ignore this mail.\n",
+				tokenLink("/auth/reset", token)),
+		})
+		if err != nil {
+			respondWithError(w, r, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(EmptyResponse{})
+}
+
+// POST /api/v1/password/reset/confirm
+//
+// Request payload: {"Token": "", "Password": ""}
+//
+// Response: Empty json response.
+//
+// Set the user's password with the token from the link mailed to them
+// by POST /api/v1/password/reset. Every link mailed to the user stops working,
+// their sessions end and their api tokens are revoked, so whoever knew the old
+// password loses access.
+func (s *Server) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var request PasswordResetConfirmRequest
+	if err := getRequestJson(w, r, &request); err != nil {
+		respondWithError(w, r, ErrBadRequest.Wrap(err))
+		return
+	}
+	if request.Password == "" {
+		respondWithError(w, r, ErrBadRequest)
+		return
+	}
+
+	err := s.store.WithTx(r.Context(), func(tx Store) error {
+		token, err := useToken(r.Context(), tx, request.Token, TOKEN_RESET_PASSWORD)
+		if err != nil {
+			return err
+		}
+		err = tx.UpdatePassword(r.Context(), token.UserId, request.Password)
+		if errors.Is(err, ErrNotFound) {
+			return ErrInvalidToken.Wrap(err)
+		} else if err != nil {
+			return err
+		}
+		if err := tx.RemoveTokens(r.Context(), token.UserId); err != nil {
+			return err
+		}
+		return tx.RemoveApiTokens(r.Context(), token.UserId)
+	})
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(EmptyResponse{})
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var TOKEN_LINK = regexp.MustCompile(`\?token=([A-Za-z0-9_-]+)`)
+
+// Get the token in the last link mailed by the server.
+func (s testServer) lastToken(t *testing.T) string {
+	t.Helper()
+	matches := TOKEN_LINK.FindAllStringSubmatch(s.mails.String(), -1)
+	if len(matches) == 0 {
+		t.Fatalf("No link in the mails:\n%s", s.mails.String())
+	}
+	return matches[len(matches)-1][1]
+}
+
+func TestChangePassword(t *testing.T) {
+	s := newTestServer(t)
+	userId, _ := s.store.CreateUser(ctx, "reader@example.com", "hash")
+	url := "/api/v1/me/password"
+
+	w := s.request("PUT", url, bytes.NewBufferString(`{"CurrentPassword": "wrong", "NewPassword": "new"}`), userId)
+	assertError(t, w, ErrInvalidCredentials)
+	w = s.request("PUT", url, bytes.NewBufferString(`{"CurrentPassword": "hash"}`), userId)
+	assertError(t, w, ErrBadRequest)
+	w = s.request("PUT", url, bytes.NewBufferString(`{"CurrentPassword": "hash", "NewPassword": "new"}`), 0)
+	assertError(t, w, ErrUnauthenticated)
+
+	// Links mailed and sessions started before the password changed stop working,
+	// except for the session that changed it
+	s.request("POST", "/api/v1/password/reset", bytes.NewBufferString(`{"Email": "reader@example.com"}`), 0)
+	token := s.lastToken(t)
+	session := s.sessionCookie(userId)
+	w = s.request("PUT", url, bytes.NewBufferString(`{"CurrentPassword": "hash", "NewPassword": "new"}`), userId)
+	assertEq(t, w.Code, http.StatusOK)
+	assertEq(t, s.sessionUser(w), userId)
+	found, err := s.store.GetUserId(ctx, "reader@example.com", "new")
+	assertEq(t, found, userId)
+	assertEq(t, err, nil)
+
+	r := httptest.NewRequest("GET", "/api/v1/me", nil)
+	r.AddCookie(session)
+	w = httptest.NewRecorder()
+	s.handler.ServeHTTP(w, r)
+	assertError(t, w, ErrUnauthenticated)
+
+	body := `{"Token": "` + token + `", "Password": "other"}`
+	w = s.request("POST", "/api/v1/password/reset/confirm", bytes.NewBufferString(body), 0)
+	assertError(t, w, ErrInvalidToken)
+}
+
+func TestSettings(t *testing.T) {
+	s := newTestServer(t)
+	userId, _ := s.store.CreateUser(ctx, "reader@example.com", "hash")
+	url := "/api/v1/me/settings"
+
+	w := s.request("PUT", url, bytes.NewBufferString(`{"UseReaderTheme": true}`), 0)
+	assertError(t, w, ErrUnauthenticated)
+	w = s.request("PUT", url, bytes.NewBufferString(`{"UseReaderTheme": "yes"}`), userId)
+	assertError(t, w, ErrBadRequest)
+
+	w = s.request("PUT", url, bytes.NewBufferString(`{"UseReaderTheme": true}`), userId)
+	assertEq(t, decode[Settings](t, w), Settings{UseReaderTheme: true})
+	w = s.request("GET", "/api/v1/me", nil, userId)
+	assertEq(t, decode[AccountResponse](t, w).Settings, Settings{UseReaderTheme: true})
+}
+
+func TestChangeEmail(t *testing.T) {
+	s := newTestServer(t)
+	userId, _ := s.store.CreateUser(ctx, "reader@example.com", "hash")
+	s.store.CreateUser(ctx, "taken@example.com", "hash")
+	url := "/api/v1/me/email"
+
+	requests := []struct {
+		body string
+		err  *APIError
+	}{
+		{`{"Password": "hash", "Email": "not an email"}`, ErrBadRequest},
+		{`{"Password": "hash", "Email": "Reader <new@example.com>"}`, ErrBadRequest},
+		{`{"Password": "wrong", "Email": "new@example.com"}`, ErrInvalidCredentials},
+		{`{"Password": "hash", "Email": "taken@example.com"}`, ErrDuplicateAccount},
+	}
+	for _, request := range requests {
+		w := s.request("PUT", url, bytes.NewBufferString(request.body), userId)
+		assertError(t, w, request.err)
+	}
+	assertEq(t, s.mails.Len(), 0)
+
+	// The email only changes once it's confirmed
+	w := s.request("PUT", url, bytes.NewBufferString(`{"Password": "hash", "Email": "new@example.com"}`), userId)
+	assertEq(t, w.Code, http.StatusAccepted)
+	if !strings.Contains(s.mails.String(), "To: new@example.com\r\n") {
+		t.Fatalf("Mail wasn't sent to the new address:\n%s", s.mails.String())
+	}
+	user, _ := s.store.GetUser(ctx, userId)
+	assertEq(t, user.Email, "reader@example.com")
+
+	body := bytes.NewBufferString(`{"Token": "` + s.lastToken(t) + `"}`)
+	w = s.request("POST", "/api/v1/email/confirm", body, 0)
+	assertEq(t, w.Code, http.StatusOK)
+	user, _ = s.store.GetUser(ctx, userId)
+	assertEq(t, user.Email, "new@example.com")
+
+	// Tokens can only be used once
+	body = bytes.NewBufferString(`{"Token": "` + s.lastToken(t) + `"}`)
+	w = s.request("POST", "/api/v1/email/confirm", body, 0)
+	assertError(t, w, ErrInvalidToken)
+}
+
+func TestPasswordReset(t *testing.T) {
+	s := newTestServer(t)
+	userId, _ := s.store.CreateUser(ctx, "reader@example.com", "hash")
+	url := "/api/v1/password/reset"
+
+	// Emails without an account get the same response, without a mail
+	w := s.request("POST", url, bytes.NewBufferString(`{"Email": "unknown@example.com"}`), 0)
+	assertEq(t, w.Code, http.StatusAccepted)
+	assertEq(t, s.mails.Len(), 0)
+	w = s.request("POST", url, bytes.NewBufferString(`{"Email": ""}`), 0)
+	assertError(t, w, ErrBadRequest)
+
+	w = s.request("POST", url, bytes.NewBufferString(`{"Email": "reader@example.com"}`), 0)
+	assertEq(t, w.Code, http.StatusAccepted)
+	token := s.lastToken(t)
+	session := s.sessionCookie(userId)
+	apiToken := s.createToken(t, userId, `{"Name": "Sync", "Scopes": ["library:read"]}`).Token
+
+	requests := []struct {
+		body string
+		err  *APIError
+	}{
+		{`{"Token": "` + token + `"}`, ErrBadRequest},
+		{`{"Token": "wrong", "Password": "new"}`, ErrInvalidToken},
+		{`{"Token": "` + token + `", "Password": "new"}`, nil},
+		{`{"Token": "` + token + `", "Password": "other"}`, ErrInvalidToken},
+	}
+	for _, request := range requests {
+		w = s.request("POST", url+"/confirm", bytes.NewBufferString(request.body), 0)
+		if request.err != nil {
+			assertError(t, w, request.err)
+		} else {
+			assertEq(t, w.Code, http.StatusOK)
+		}
+	}
+	found, err := s.store.GetUserId(ctx, "reader@example.com", "new")
+	assertEq(t, found, userId)
+	assertEq(t, err, nil)
+
+	// Whoever knew the old password is logged out, and their api tokens revoked
+	r := httptest.NewRequest("GET", "/api/v1/me", nil)
+	r.AddCookie(session)
+	w = httptest.NewRecorder()
+	s.handler.ServeHTTP(w, r)
+	assertError(t, w, ErrUnauthenticated)
+	w = s.requestWithToken("GET", "/api/v1/series", nil, apiToken)
+	assertEq(t, w.Code, http.StatusUnauthorized)
+	assertEq(t, s.request("GET", "/api/v1/me", nil, userId).Code, http.StatusOK)
+
+	// Tokens expire
+	expired, _ := newToken(ctx, s.store, userId, TOKEN_RESET_PASSWORD, "reader@example.com", -time.Minute)
+	body := `{"Token": "` + expired + `", "Password": "other"}`
+	w = s.request("POST", url+"/confirm", bytes.NewBufferString(body), 0)
+	assertError(t, w, ErrInvalidToken)
+
+	// Tokens can't be used for another purpose
+	s.request("PUT", "/api/v1/me/email", bytes.NewBufferString(`{"Password": "new", "Email": "new@example.com"}`), userId)
+	body = `{"Token": "` + s.lastToken(t) + `", "Password": "other"}`
+	w = s.request("POST", url+"/confirm", bytes.NewBufferString(body), 0)
+	assertError(t, w, ErrInvalidToken)
+}
+
+type failingMailer struct{}
+
+func (failingMailer) Send(ctx context.Context, mail Mail) error {
+	return errors.New("Failed to send")
+}
+
+func TestEmailVerification(t *testing.T) {
+	s := newTestServer(t)
+	s.requireVerification = true
+	credentials := `{"email": "reader@example.com", "password": "hash"}`
+
+	w := s.request("POST", "/api/v1/users", bytes.NewBufferString(credentials), 0)
+	assertEq(t, w.Code, http.StatusOK)
+	userId := s.sessionUser(w)
+	first := s.lastToken(t)
+	w = s.request("GET", "/api/v1/me", nil, userId)
+	assertEq(t, decode[AccountResponse](t, w), AccountResponse{Email: "reader@example.com"})
+	w = s.request("POST", "/api/v1/users", bytes.NewBufferString(`{"email": "reader", "password": "hash"}`), 0)
+	assertError(t, w, ErrBadRequest)
+
+	// Unverified users can't add books
+	w = s.upload(t, "Dune.epub", readDune(t), userId)
+	assertError(t, w, ErrEmailUnverified)
+	w = s.request("PUT", "/api/v1/me/books/1", nil, userId)
+	assertError(t, w, ErrEmailUnverified)
+
+	// Sending the link again replaces the previous one
+	w = s.request("POST", "/api/v1/me/verification", nil, userId)
+	assertEq(t, w.Code, http.StatusAccepted)
+	w = s.request("POST", "/api/v1/email/confirm", bytes.NewBufferString(`{"Token": "`+first+`"}`), 0)
+	assertError(t, w, ErrInvalidToken)
+	w = s.request("POST", "/api/v1/email/confirm", bytes.NewBufferString(`{"Token": "`+s.lastToken(t)+`"}`), 0)
+	assertEq(t, w.Code, http.StatusOK)
+
+	w = s.request("GET", "/api/v1/me", nil, userId)
+	assertEq(t, decode[AccountResponse](t, w), AccountResponse{Email: "reader@example.com", Verified: true})
+	sent := s.mails.Len()
+	w = s.request("POST", "/api/v1/me/verification", nil, userId)
+	assertEq(t, w.Code, http.StatusOK)
+	assertEq(t, s.mails.Len(), sent)
+	w = s.upload(t, "Dune.epub", readDune(t), userId)
+	assertEq(t, w.Code, http.StatusOK)
+
+	// Accounts are created even when the mail can't be sent
+	s.mailer = failingMailer{}
+	w = s.request("POST", "/api/v1/users", bytes.NewBufferString(`{"email": "other@example.com", "password": "hash"}`), 0)
+	assertEq(t, w.Code, http.StatusOK)
+	_, err := s.store.GetUserByEmail(ctx, "other@example.com")
+	assertEq(t, err, nil)
+}
@@ -0,0 +1,124 @@
+package main
+
+import "github.com/aabiji/page/backend/epub"
+
+// Request and response payloads of the api. Each one matches
+// the schema of the same name in openapi.json.
+
+type Credentials struct {
+	Email string `json:"email"`
+	// Password should be hashed using the SHA256
+	// algorithm in the frontend side
+	Password string `json:"password"`
+}
+
+type EmptyResponse struct{}
+
+type AccountResponse struct {
+	Email    string
+	Verified bool // Whether the user confirmed they own their email
+	Settings Settings
+}
+
+// Passwords are hashed by the frontend, like in Credentials.
+
+type PasswordChangeRequest struct {
+	CurrentPassword string
+	NewPassword     string
+}
+
+type EmailChangeRequest struct {
+	Password string
+	Email    string // Only used once confirmed with the link mailed to it
+}
+
+type EmailConfirmRequest struct {
+	Token string
+}
+
+type PasswordResetRequest struct {
+	Email string
+}
+
+type PasswordResetConfirmRequest struct {
+	Token    string
+	Password string
+}
+
+type ApiTokenRequest struct {
+	Name          string
+	Scopes        []string // See API_TOKEN_SCOPES
+	ExpiresInDays int      `json:",omitempty"` // The token never expires when it's 0
+}
+
+// Times are unix timestamps, which are 0 when they're omitted.
+type ApiTokenResponse struct {
+	Id       int
+	Name     string
+	Scopes   []string
+	Created  int64
+	Expires  int64  `json:",omitempty"` // Omitted when the token never expires
+	LastUsed int64  `json:",omitempty"` // Omitted when the token was never used
+	Token    string `json:",omitempty"` // Only returned when the token is created
+}
+
+type ShareRequest struct {
+	ExpiresInDays int `json:",omitempty"` // SHARE_DAYS when it's 0
+}
+
+// Times are unix timestamps.
+type ShareResponse struct {
+	Id      int
+	BookId  int
+	Created int64
+	Expires int64
+	Token   string `json:",omitempty"` // Only returned when the share is created
+}
+
+// An OpenID Connect provider users can log in with.
+type ProviderResponse struct {
+	Name        string // Identifies the provider in GET /api/v1/auth/{provider}/login
+	DisplayName string
+}
+
+type ErrorResponse struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Details   any    `json:"details"`
+	RequestId string `json:"requestId"`
+}
+
+type UploadResponse struct {
+	BookId     int
+	Validation epub.Report
+}
+
+type UserBookResponse struct {
+	CurrentPage   int
+	ScrollOffsets []int
+}
+
+type ProgressRequest struct {
+	CurrentPage   int   // Index of the file being read
+	ScrollOffsets []int // Vertical scroll offset within each of the book's files
+}
+
+type BookResponse struct {
+	CoverImagePath  string
+	Files           []string
+	TableOfContents []epub.Section
+	Info            epub.Metadata
+	// Signed url path the book's files are served from until it expires,
+	// followed by their path (ex. /static/{token}/ + Dune/cover.jpeg)
+	StaticUrl string
+}
+
+type HealthResponse struct {
+	Status string
+}
+
+// Each check is "ok" or "unavailable" when it failed.
+type ReadinessResponse struct {
+	Database string
+	Storage  string
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Scopes of api tokens. Each scope allows the routes wrapped with it in mapEndpoints.
+const (
+	SCOPE_LIBRARY_READ   = "library:read"   // Read the books in the user's collection and the series
+	SCOPE_LIBRARY_WRITE  = "library:write"  // Add and remove books from the user's collection
+	SCOPE_PROGRESS_WRITE = "progress:write" // Save the user's reading progress
+)
+
+var API_TOKEN_SCOPES = []string{SCOPE_LIBRARY_READ, SCOPE_LIBRARY_WRITE, SCOPE_PROGRESS_WRITE}
+
+// Tokens start with a prefix, so secret scanners can recognize leaked tokens.
+const API_TOKEN_PREFIX = "page_"
+
+const (
+	MAX_API_TOKEN_NAME = 100         // Longest token name, in bytes
+	MAX_API_TOKEN_DAYS = 10 * 365    // Longest a token can be valid for
+	API_TOKEN_USE_RATE = time.Minute // How often a token's last use is recorded
+)
+
+type apiTokenKey struct{}
+
+// A handler that api tokens with the scope can use. Other routes only accept the USERID cookie.
+type scopedHandler struct {
+	scope string
+	next  http.Handler
+}
+
+func (h scopedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.next.ServeHTTP(w, r)
+}
+
+func requireScope(scope string, next http.Handler) http.Handler {
+	return scopedHandler{scope, next}
+}
+
+// Authenticate requests with an api token in the Authorization header
+// (ex. "Bearer page_..."), instead of the USERID cookie. Tokens can only
+// be used on routes that require one of their scopes, see requireScope.
+func (s *Server) authenticateTokens(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Errors are described in the WWW-Authenticate header (RFC 6750 section 3)
+		scheme, raw, _ := strings.Cut(header, " ")
+		if !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(raw) == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_request"`)
+			respondWithError(w, r, ErrUnauthenticated.Wrap(errors.New("Unsupported authorization")))
+			return
+		}
+		token, err := s.store.GetApiToken(r.Context(), hashToken(strings.TrimSpace(raw)))
+		if err == nil && !token.Expires.IsZero() && time.Now().After(token.Expires) {
+			err = fmt.Errorf("%w: the token expired", ErrNotFound)
+		}
+		if errors.Is(err, ErrNotFound) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			respondWithError(w, r, ErrUnauthenticated.Wrap(err))
+			return
+		} else if err != nil {
+			respondWithError(w, r, err)
+			return
+		}
+		recordUser(r, token.UserId)
+
+		handler, scoped := mux.CurrentRoute(r).GetHandler().(scopedHandler)
+		if !scoped || !slices.Contains(token.Scopes, handler.scope) {
+			if scoped {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, handler.scope))
+			}
+			respondWithError(w, r, ErrInsufficientScope)
+			return
+		}
+
+		now := time.Now()
+		if now.Sub(token.LastUsed) >= API_TOKEN_USE_RATE {
+			if err := s.store.SetApiTokenUsed(r.Context(), token.Id, now); err != nil {
+				s.logger.Warn("Recording an api token's use", "error", err)
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiTokenKey{}, token)))
+	})
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func apiTokenResponse(token ApiToken) ApiTokenResponse {
+	return ApiTokenResponse{
+		Id:       token.Id,
+		Name:     token.Name,
+		Scopes:   token.Scopes,
+		Created:  token.Created.Unix(),
+		Expires:  unixOrZero(token.Expires),
+		LastUsed: unixOrZero(token.LastUsed),
+	}
+}
+
+// POST /api/v1/me/tokens
+//
+// Request payload:
+// {"Name": "", "Scopes": [""], "ExpiresInDays": 0}
+// Cookie with name set to "userId" and value set to the user's session.
+//
+// Response: {"Id": 0, "Name": "", "Scopes": [""], "Created": 0, "Expires": 0, "Token": ""} with the 201 status code.
+//
+// Create an api token for scripts and other clients, which send it in the
+// Authorization header as "Bearer {Token}". Only a hash of the token is stored,
+// so it's only returned here. Tokens without ExpiresInDays never expire.
+func (s *Server) CreateApiToken(w http.ResponseWriter, r *http.Request) {
+	userId, err := s.getUserId(r)
+	if err != nil {
+		respondWithError(w, r, ErrUnauthenticated.Wrap(err))
+		return
+	}
+	var request ApiTokenRequest
+	if err := getRequestJson(w, r, &request); err != nil {
+		respondWithError(w, r, ErrBadRequest.Wrap(err))
+		return
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" || len(request.Name) > MAX_API_TOKEN_NAME || len(request.Scopes) == 0 ||
+		request.ExpiresInDays < 0 || request.ExpiresInDays > MAX_API_TOKEN_DAYS {
+		respondWithError(w, r, ErrBadRequest)
+		return
+	}
+	for i, scope := range request.Scopes {
+		if !slices.Contains(API_TOKEN_SCOPES, scope) || slices.Contains(request.Scopes[:i], scope) {
+			respondWithError(w, r, ErrBadRequest.Wrap(fmt.Errorf("Invalid scope %q", scope)))
+			return
+		}
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+	secret = API_TOKEN_PREFIX + secret
+	token := ApiToken{
+		UserId:  userId,
+		Name:    request.Name,
+		Hash:    hashToken(secret),
+		Scopes:  request.Scopes,
+		Created: time.Now(),
+	}
+	if request.ExpiresInDays > 0 {
+		token.Expires = token.Created.AddDate(0, 0, request.ExpiresInDays)
+	}
+	token.Id, err = s.store.CreateApiToken(r.Context(), token)
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+
+	response := apiTokenResponse(token)
+	response.Token = secret
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// GET /api/v1/me/tokens
+//
+// Request payload: Cookie with name set to "userId" and value set to the user's session.
+//
+// Response: [{"Id": 0, "Name": "", "Scopes": [""], "Created": 0, "Expires": 0, "LastUsed": 0}]
+//
+// Get the user's api tokens, oldest first, along with when they were last used.
+func (s *Server) GetApiTokens(w http.ResponseWriter, r *http.Request) {
+	userId, err := s.getUserId(r)
+	if err != nil {
+		respondWithError(w, r, ErrUnauthenticated.Wrap(err))
+		return
+	}
+
+	tokens, err := s.store.GetApiTokens(r.Context(), userId)
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+	response := []ApiTokenResponse{}
+	for _, token := range tokens {
+		response = append(response, apiTokenResponse(token))
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// DELETE /api/v1/me/tokens/{id}
+//
+// Request payload: Cookie with name set to "userId" and value set to the user's session.
+//
+// Response: Empty json response.
+//
+// Revoke one of the user's api tokens, which stops working right away.
+func (s *Server) RevokeApiToken(w http.ResponseWriter, r *http.Request) {
+	userId, err := s.getUserId(r)
+	if err != nil {
+		respondWithError(w, r, ErrUnauthenticated.Wrap(err))
+		return
+	}
+	id, err := getPathId(r)
+	if err != nil {
+		respondWithError(w, r, ErrBadRequest.Wrap(err))
+		return
+	}
+
+	err = s.store.RemoveApiToken(r.Context(), userId, id)
+	if errors.Is(err, ErrNotFound) {
+		respondWithError(w, r, ErrApiTokenNotFound.Wrap(err))
+		return
+	} else if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(EmptyResponse{})
+}
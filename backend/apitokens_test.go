@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Send a request to the server with an api token instead of the USERID cookie.
+func (s testServer) requestWithToken(method, url string, body io.Reader, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, body)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, r)
+	return w
+}
+
+// Create an api token as the user, failing if it isn't created.
+func (s testServer) createToken(t *testing.T, userId int, request string) ApiTokenResponse {
+	t.Helper()
+	w := s.request("POST", "/api/v1/me/tokens", bytes.NewBufferString(request), userId)
+	assertEq(t, w.Code, http.StatusCreated)
+	return decode[ApiTokenResponse](t, w)
+}
+
+func TestCreateApiToken(t *testing.T) {
+	s := newTestServer(t)
+	userId, _ := s.store.CreateUser(ctx, "reader@example.com", "hash")
+
+	token := s.createToken(t, userId, `{"Name": " Sync script ", "Scopes": ["library:read"], "ExpiresInDays": 30}`)
+	assertEq(t, token.Name, "Sync script")
+	assertEq(t, token.Scopes, []string{SCOPE_LIBRARY_READ})
+	assertEq(t, strings.HasPrefix(token.Token, API_TOKEN_PREFIX), true)
+	assertEq(t, token.Expires, time.Unix(token.Created, 0).AddDate(0, 0, 30).Unix())
+
+	// Only the hash is stored, so listing the tokens doesn't return the secret
+	stored, _ := s.store.GetApiTokens(ctx, userId)
+	assertEq(t, stored[0].Hash, hashToken(token.Token))
+	w := s.request("GET", "/api/v1/me/tokens", nil, userId)
+	token.Token = ""
+	assertEq(t, decode[[]ApiTokenResponse](t, w), []ApiTokenResponse{token})
+
+	invalid := []string{
+		`{"Name": "", "Scopes": ["library:read"]}`,
+		`{"Name": "` + strings.Repeat("a", MAX_API_TOKEN_NAME+1) + `", "Scopes": ["library:read"]}`,
+		`{"Name": "script", "Scopes": []}`,
+		`{"Name": "script", "Scopes": ["admin"]}`,
+		`{"Name": "script", "Scopes": ["library:read", "library:read"]}`,
+		`{"Name": "script", "Scopes": ["library:read"], "ExpiresInDays": -1}`,
+		`{"Name": "script", "Scopes": ["library:read"], "ExpiresInDays": ` + strconv.Itoa(MAX_API_TOKEN_DAYS+1) + `}`,
+		`not json`,
+	}
+	for _, body := range invalid {
+		w := s.request("POST", "/api/v1/me/tokens", bytes.NewBufferString(body), userId)
+		assertError(t, w, ErrBadRequest)
+	}
+	w = s.request("POST", "/api/v1/me/tokens", bytes.NewBufferString(`{"Name": "script", "Scopes": ["library:read"]}`), 0)
+	assertError(t, w, ErrUnauthenticated)
+}
+
+func TestApiTokenScopes(t *testing.T) {
+	s := newTestServer(t)
+	userId, _ := s.store.CreateUser(ctx, "reader@example.com", "hash")
+	read := s.createToken(t, userId, `{"Name": "reader", "Scopes": ["library:read"]}`).Token
+	progress := s.createToken(t, userId, `{"Name": "progress", "Scopes": ["progress:write"]}`).Token
+
+	// Tokens act as their user on the routes their scopes allow
+	w := s.requestWithToken("GET", "/api/v1/me/books/1000", nil, read)
+	assertError(t, w, ErrUserBookNotFound)
+	w = s.requestWithToken("GET", "/api/v1/series", nil, read)
+	assertEq(t, w.Code, http.StatusOK)
+	body := `{"CurrentPage": 2, "ScrollOffsets": [0]}`
+	w = s.requestWithToken("PUT", "/api/v1/me/books/1000/progress", bytes.NewBufferString(body), progress)
+	assertError(t, w, ErrUserBookNotFound)
+
+	w = s.requestWithToken("PUT", "/api/v1/me/books/1000/progress", bytes.NewBufferString(body), read)
+	assertError(t, w, ErrInsufficientScope)
+	assertEq(t, w.Header().Get("WWW-Authenticate"), `Bearer error="insufficient_scope", scope="progress:write"`)
+	w = s.requestWithToken("DELETE", "/api/v1/me/books/1000", nil, read)
+	assertError(t, w, ErrInsufficientScope)
+
+	// Routes without a scope, like managing the account and its tokens, only accept the cookie
+	for _, route := range []string{"GET /api/v1/me", "GET /api/v1/me/tokens", "DELETE /api/v1/me", "POST /user/delete"} {
+		method, url, _ := strings.Cut(route, " ")
+		w = s.requestWithToken(method, url, nil, read)
+		assertError(t, w, ErrInsufficientScope)
+	}
+	w = s.requestWithToken("POST", "/api/v1/me/tokens", bytes.NewBufferString(`{"Name": "more", "Scopes": ["library:write"]}`), read)
+	assertError(t, w, ErrInsufficientScope)
+	_, err := s.store.GetUser(ctx, userId)
+	assertEq(t, err, nil)
+}
+
+func TestInvalidApiTokens(t *testing.T) {
+	s := newTestServer(t)
+	userId, _ := s.store.CreateUser(ctx, "reader@example.com", "hash")
+	token := s.createToken(t, userId, `{"Name": "script", "Scopes": ["library:read"], "ExpiresInDays": 1}`)
+
+	w := s.requestWithToken("GET", "/api/v1/series", nil, API_TOKEN_PREFIX+"unknown")
+	assertError(t, w, ErrUnauthenticated)
+	assertEq(t, w.Header().Get("WWW-Authenticate"), `Bearer error="invalid_token"`)
+
+	r := httptest.NewRequest("GET", "/api/v1/series", nil)
+	r.Header.Set("Authorization", "Basic "+token.Token)
+	w = httptest.NewRecorder()
+	s.handler.ServeHTTP(w, r)
+	assertError(t, w, ErrUnauthenticated)
+	assertEq(t, w.Header().Get("WWW-Authenticate"), `Bearer error="invalid_request"`)
+
+	// Expired tokens stop working
+	s.store.mutex.Lock()
+	s.store.apiTokens[0].Expires = time.Now().Add(-time.Second)
+	s.store.mutex.Unlock()
+	w = s.requestWithToken("GET", "/api/v1/series", nil, token.Token)
+	assertError(t, w, ErrUnauthenticated)
+}
+
+func TestApiTokenLastUsed(t *testing.T) {
+	s := newTestServer(t)
+	userId, _ := s.store.CreateUser(ctx, "reader@example.com", "hash")
+	token := s.createToken(t, userId, `{"Name": "script", "Scopes": ["library:read"]}`)
+	assertEq(t, token.LastUsed, int64(0))
+
+	before := time.Now().Unix()
+	s.requestWithToken("GET", "/api/v1/series", nil, token.Token)
+	w := s.request("GET", "/api/v1/me/tokens", nil, userId)
+	lastUsed := decode[[]ApiTokenResponse](t, w)[0].LastUsed
+	assertEq(t, lastUsed >= before && lastUsed <= time.Now().Unix(), true)
+
+	// Uses are only recorded once in a while
+	stored, _ := s.store.GetApiTokens(ctx, userId)
+	s.requestWithToken("GET", "/api/v1/series", nil, token.Token)
+	again, _ := s.store.GetApiTokens(ctx, userId)
+	assertEq(t, again[0].LastUsed, stored[0].LastUsed)
+}
+
+func TestRevokeApiToken(t *testing.T) {
+	s := newTestServer(t)
+	userId, _ := s.store.CreateUser(ctx, "reader@example.com", "hash")
+	otherId, _ := s.store.CreateUser(ctx, "other@example.com", "hash")
+	token := s.createToken(t, userId, `{"Name": "script", "Scopes": ["library:read"]}`)
+	url := "/api/v1/me/tokens/" + strconv.Itoa(token.Id)
+
+	// Users can only revoke their own tokens
+	w := s.request("DELETE", url, nil, otherId)
+	assertError(t, w, ErrApiTokenNotFound)
+	w = s.requestWithToken("GET", "/api/v1/series", nil, token.Token)
+	assertEq(t, w.Code, http.StatusOK)
+
+	w = s.request("DELETE", url, nil, userId)
+	assertEq(t, w.Code, http.StatusOK)
+	w = s.requestWithToken("GET", "/api/v1/series", nil, token.Token)
+	assertError(t, w, ErrUnauthenticated)
+	w = s.request("DELETE", url, nil, userId)
+	assertError(t, w, ErrApiTokenNotFound)
+	w = s.request("DELETE", "/api/v1/me/tokens/abc", nil, userId)
+	assertError(t, w, ErrBadRequest)
+
+	// Deleting the account revokes its tokens
+	token = s.createToken(t, userId, `{"Name": "script", "Scopes": ["library:read"]}`)
+	s.request("DELETE", "/api/v1/me", nil, userId)
+	w = s.requestWithToken("GET", "/api/v1/series", nil, token.Token)
+	assertError(t, w, ErrUnauthenticated)
+}
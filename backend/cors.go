@@ -19,20 +19,26 @@ func AllowRequests(allowedOrigin string, handler http.Handler) http.Handler {
 		origin := r.Header.Get("origin")
 		allowedOrigin := origin == allowedOrigin
 		allowHeader := "Content-Type, withCredentials, Authorization"
+		exposeHeader := "Deprecation, Link, Retry-After, " + REQUEST_ID_HEADER
 
 		if allowedOrigin {
 			w.Header().Add("Origin", "Vary")
 			w.Header().Add("Access-Control-Allow-Origin", origin)
 			w.Header().Set("Access-Control-Allow-Credentials", "true")
 			w.Header().Add("Access-Control-Allow-Headers", allowHeader)
+			w.Header().Set("Access-Control-Expose-Headers", exposeHeader)
 		}
 
+		// Preflight requests are answered here, since routes
+		// don't accept OPTIONS requests
 		if isPreflightRequest(r) {
 			method := r.Header.Get("Access-Control-Request-Method")
 			methodsStr := strings.Join(allowedMethods, ", ")
 			if allowedOrigin && slices.Contains(allowedMethods, method) {
 				w.Header().Set("Access-Control-Allow-Methods", methodsStr)
 			}
+			w.WriteHeader(http.StatusNoContent)
+			return
 		}
 
 		handler.ServeHTTP(w, r)
@@ -0,0 +1,228 @@
+package epub
+
+import (
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Confidence that a candidate is the cover, depending on how it was found.
+const (
+	COVER_IMAGE_PROPERTY = 1.0 // <item properties="cover-image">
+	COVER_META           = 0.9 // <meta name="cover" content="">
+	COVER_LANDMARK       = 0.8 // <a epub:type="cover"> in the nav document's landmarks
+	COVER_GUIDE          = 0.8 // <reference type="cover">
+	COVER_MANIFEST_NAME  = 0.6 // Image item whose id or href mentions "cover"
+	COVER_SPINE_NAME     = 0.5 // First spine item whose id or href mentions "cover"
+	COVER_SPINE_IMAGE    = 0.3 // First spine item that's an image without much text
+)
+
+// A possible cover along with how confident we are that it's the cover.
+// The path is relative to the root of the extracted epub and is either
+// an image or a document displaying the cover image.
+type coverCandidate struct {
+	path       string
+	confidence float64
+}
+
+// Resolve a href found in the file at base to a path relative to the
+// root of the extracted epub. Returns an empty string for external links
+// and paths that escape the epub.
+func ResolvePath(base, href string) string {
+	link, err := url.Parse(strings.TrimSpace(href))
+	if err != nil || link.Scheme != "" || link.Host != "" || link.Path == "" {
+		return ""
+	}
+
+	resolved := link.Path
+	if !strings.HasPrefix(resolved, "/") {
+		resolved = path.Join(path.Dir(base), resolved)
+	}
+	resolved = strings.TrimPrefix(path.Clean(resolved), "/")
+	if resolved == "." || resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return ""
+	}
+	return resolved
+}
+
+// Check if a path relative to the root of the extracted epub exists.
+func (e *Epub) exists(relativePath string) bool {
+	root := filepath.Join(EXTRACT_DIRECTORY, e.Name)
+	_, err := os.Stat(filepath.Join(root, filepath.FromSlash(relativePath)))
+	return relativePath != "" && err == nil
+}
+
+func isImage(file string) bool {
+	extension := strings.ToLower(path.Ext(file))
+	return contains([]string{".jpg", ".jpeg", ".png", ".gif", ".webp", ".svg"}, extension)
+}
+
+func isDocument(file string) bool {
+	extension := strings.ToLower(path.Ext(file))
+	return contains([]string{".xhtml", ".html", ".htm", ".xml"}, extension)
+}
+
+// Text content of a html node and its children.
+func textContent(root *html.Node) string {
+	if root.Type == html.TextNode {
+		return root.Data
+	}
+	var text string
+	for node := root.FirstChild; node != nil; node = node.NextSibling {
+		if node.Data != "style" && node.Data != "script" {
+			text += textContent(node)
+		}
+	}
+	return text
+}
+
+// Find the image displayed by a cover document, either through <img src="">
+// or through an svg <image xlink:href="">. Returns the image's path
+// relative to the root of the extracted epub and the document's text.
+func (e *Epub) documentImage(documentPath string) (string, string) {
+	absolute := filepath.Join(EXTRACT_DIRECTORY, e.Name, filepath.FromSlash(documentPath))
+	document, err := parseHTML(absolute)
+	if err != nil {
+		return "", ""
+	}
+
+	src := ""
+	if node := findNode(document, "img"); node != nil {
+		src = findAttribute(node, "src", "")
+	}
+	if node := findNode(document, "image"); src == "" && node != nil {
+		src = findAttribute(node, "href", "") // Matches both href and xlink:href
+	}
+
+	text := ""
+	if body := findNode(document, "body"); body != nil {
+		text = strings.TrimSpace(textContent(body))
+	}
+	return ResolvePath(documentPath, src), text
+}
+
+// Get the cover candidates declared in the package document.
+func (e *Epub) coverCandidates(p Package) []coverCandidate {
+	var candidates []coverCandidate
+	add := func(href string, confidence float64) {
+		if resolved := ResolvePath(e.contentFilename, href); resolved != "" {
+			candidates = append(candidates, coverCandidate{resolved, confidence})
+		}
+	}
+
+	items := make(map[string]Item)
+	for _, i := range p.Manifest.Items {
+		items[i.Id] = i
+	}
+
+	for _, i := range p.Manifest.Items {
+		properties := strings.Fields(i.Properties)
+		if contains(properties, "cover-image") {
+			add(i.Path, COVER_IMAGE_PROPERTY)
+		}
+		if contains(properties, "nav") {
+			for _, href := range e.landmarks(ResolvePath(e.contentFilename, i.Path), "cover") {
+				candidates = append(candidates, coverCandidate{href, COVER_LANDMARK})
+			}
+		}
+		name := strings.ToLower(i.Id + " " + i.Path)
+		if strings.Contains(name, "cover") && strings.HasPrefix(i.MediaType, "image/") {
+			add(i.Path, COVER_MANIFEST_NAME)
+		}
+	}
+
+	for _, m := range p.Metadata.Meta {
+		if m.Name != "cover" {
+			continue
+		}
+		// The content should be a manifest id, but some epubs use a path
+		if item, exists := items[m.Content]; exists {
+			add(item.Path, COVER_META)
+		} else {
+			add(m.Content, COVER_META)
+		}
+	}
+
+	for _, r := range p.Guide.References {
+		if strings.ToLower(r.Type) == "cover" {
+			add(r.Path, COVER_GUIDE)
+		}
+	}
+
+	if len(p.Spine.ITemRefs) > 0 {
+		first := items[p.Spine.ITemRefs[0].Ref]
+		name := strings.ToLower(first.Id + " " + first.Path)
+		if strings.Contains(name, "cover") {
+			add(first.Path, COVER_SPINE_NAME)
+		} else {
+			add(first.Path, COVER_SPINE_IMAGE)
+		}
+	}
+
+	return candidates
+}
+
+// Get the paths linked from a nav document's landmarks with a certain epub:type.
+func (e *Epub) landmarks(navPath, epubType string) []string {
+	absolute := filepath.Join(EXTRACT_DIRECTORY, e.Name, filepath.FromSlash(navPath))
+	document, err := parseHTML(absolute)
+	if navPath == "" || err != nil {
+		return nil
+	}
+
+	var links []string
+	var walk func(node *html.Node, inLandmarks bool)
+	walk = func(node *html.Node, inLandmarks bool) {
+		if node.Type == html.ElementNode {
+			types := strings.Fields(findAttribute(node, "epub:type", ""))
+			if node.Data == "nav" && contains(types, "landmarks") {
+				inLandmarks = true
+			}
+			if node.Data == "a" && inLandmarks && contains(types, epubType) {
+				if href := ResolvePath(navPath, findAttribute(node, "href", "")); href != "" {
+					links = append(links, href)
+				}
+			}
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child, inLandmarks)
+		}
+	}
+	walk(document, false)
+	return links
+}
+
+// Find the epub's cover image by checking every convention used by epub 2.0
+// and epub 3.0 files and keeping the image we're most confident about.
+// Cover documents are followed to the image they display.
+func (e *Epub) findCover(p Package) {
+	var images []coverCandidate
+	for _, c := range e.coverCandidates(p) {
+		switch {
+		case isImage(c.path) && e.exists(c.path):
+			images = append(images, c)
+		case isDocument(c.path) && e.exists(c.path):
+			image, text := e.documentImage(c.path)
+			// Only trust a guessed spine item if it's mostly an image
+			if c.confidence == COVER_SPINE_IMAGE && len(text) > 200 {
+				continue
+			}
+			if image != "" && e.exists(image) {
+				images = append(images, coverCandidate{image, c.confidence})
+			}
+		}
+	}
+
+	sort.SliceStable(images, func(i, j int) bool {
+		return images[i].confidence > images[j].confidence
+	})
+	if len(images) > 0 {
+		e.CoverImagePath = path.Join(e.Name, images[0].path)
+		e.CoverConfidence = images[0].confidence
+	}
+}
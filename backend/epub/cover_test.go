@@ -0,0 +1,182 @@
+package epub
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Build a content.opf from the manifest items, spine itemrefs and extra metadata/guide nodes.
+func testPackage(version, metadata, manifest, spine, guide string) string {
+	return fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="%s" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:title>Cover test</dc:title>
+    <dc:identifier id="id">urn:uuid:0b8a8fb3-6c4d-4bcf-a2f0-bd0f1fd3c6e5</dc:identifier>
+    %s
+  </metadata>
+  <manifest>%s</manifest>
+  <spine>%s</spine>
+  <guide>%s</guide>
+</package>`, version, metadata, manifest, spine, guide)
+}
+
+func testDocument(body string) string {
+	return `<?xml version="1.0" encoding="utf-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><title>Test</title></head>
+<body>` + body + `</body>
+</html>`
+}
+
+func TestCoverDetection(t *testing.T) {
+	t.Parallel()
+	chapter := `<item id="chapter" href="Text/chapter.xhtml" media-type="application/xhtml+xml"/>`
+	chapterRef := `<itemref idref="chapter"/>`
+	chapterText := testDocument("<p>" + strings.Repeat("It was a dark and stormy night. ", 20) + "</p>")
+
+	tests := []struct {
+		name       string
+		files      map[string]string
+		cover      string
+		confidence float64
+	}{
+		{
+			name: "Epub3Property",
+			files: map[string]string{
+				"OEBPS/content.opf": testPackage("3.0", "",
+					chapter+`<item id="img" href="Images/front.jpg" media-type="image/jpeg" properties="cover-image"/>`,
+					chapterRef, ""),
+				"OEBPS/Images/front.jpg": "jpeg",
+			},
+			cover:      "Epub3Property/OEBPS/Images/front.jpg",
+			confidence: COVER_IMAGE_PROPERTY,
+		},
+		{
+			name: "Epub2Meta",
+			files: map[string]string{
+				"OEBPS/content.opf": testPackage("2.0", `<meta name="cover" content="front-image"/>`,
+					chapter+`<item id="front-image" href="../front.png" media-type="image/png"/>`,
+					chapterRef, ""),
+				"front.png": "png",
+			},
+			cover:      "Epub2Meta/front.png",
+			confidence: COVER_META,
+		},
+		{
+			name: "GuideSvgCover",
+			files: map[string]string{
+				"OEBPS/content.opf": testPackage("2.0", "",
+					chapter+`<item id="titlepage" href="Text/titlepage.xhtml" media-type="application/xhtml+xml"/>
+					<item id="art" href="Images/art.jpeg" media-type="image/jpeg"/>`,
+					chapterRef, `<reference type="cover" href="Text/titlepage.xhtml#top" title="Cover"/>`),
+				"OEBPS/Text/titlepage.xhtml": testDocument(`
+					<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink">
+					  <image width="600" height="800" xlink:href="../Images/art.jpeg"/>
+					</svg>`),
+				"OEBPS/Images/art.jpeg":    "jpeg",
+				"OEBPS/Text/chapter.xhtml": chapterText,
+			},
+			cover:      "GuideSvgCover/OEBPS/Images/art.jpeg",
+			confidence: COVER_GUIDE,
+		},
+		{
+			name: "Landmarks",
+			files: map[string]string{
+				"OEBPS/content.opf": testPackage("3.0", "",
+					chapter+`<item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+					<item id="jacket" href="Text/jacket.xhtml" media-type="application/xhtml+xml"/>
+					<item id="art" href="Images/art%20work.jpg" media-type="image/jpeg"/>`,
+					chapterRef, ""),
+				"OEBPS/nav.xhtml": testDocument(`
+					<nav epub:type="toc"><ol><li><a href="Text/chapter.xhtml">Chapter</a></li></ol></nav>
+					<nav epub:type="landmarks"><ol>
+					  <li><a epub:type="cover" href="Text/jacket.xhtml">Cover</a></li>
+					  <li><a epub:type="bodymatter" href="Text/chapter.xhtml">Start</a></li>
+					</ol></nav>`),
+				"OEBPS/Text/jacket.xhtml":   testDocument(`<div><img src="../Images/art%20work.jpg" alt=""/></div>`),
+				"OEBPS/Images/art work.jpg": "jpeg",
+				"OEBPS/Text/chapter.xhtml":  chapterText,
+			},
+			cover:      "Landmarks/OEBPS/Images/art work.jpg",
+			confidence: COVER_LANDMARK,
+		},
+		{
+			name: "HighestConfidenceWins",
+			files: map[string]string{
+				"OEBPS/content.opf": testPackage("3.0", `<meta name="cover" content="old"/>`,
+					chapter+`<item id="old" href="old-cover.jpg" media-type="image/jpeg"/>
+					<item id="new" href="new.jpg" media-type="image/jpeg" properties="cover-image"/>`,
+					chapterRef, ""),
+				"OEBPS/old-cover.jpg": "jpeg",
+				"OEBPS/new.jpg":       "jpeg",
+			},
+			cover:      "HighestConfidenceWins/OEBPS/new.jpg",
+			confidence: COVER_IMAGE_PROPERTY,
+		},
+		{
+			name: "MissingFileSkipped",
+			files: map[string]string{
+				"OEBPS/content.opf": testPackage("3.0", `<meta name="cover" content="exists"/>`,
+					chapter+`<item id="missing" href="missing.jpg" media-type="image/jpeg" properties="cover-image"/>
+					<item id="exists" href="exists.gif" media-type="image/gif"/>`,
+					chapterRef, ""),
+				"OEBPS/exists.gif": "gif",
+			},
+			cover:      "MissingFileSkipped/OEBPS/exists.gif",
+			confidence: COVER_META,
+		},
+		{
+			name: "SpineImagePage",
+			files: map[string]string{
+				"OEBPS/content.opf": testPackage("2.0", "",
+					`<item id="front" href="front.xhtml" media-type="application/xhtml+xml"/>
+					<item id="img" href="i/0001.png" media-type="image/png"/>`+chapter,
+					`<itemref idref="front"/>`+chapterRef, ""),
+				"OEBPS/front.xhtml":        testDocument(`<p><img src="i/0001.png"/></p>`),
+				"OEBPS/i/0001.png":         "png",
+				"OEBPS/Text/chapter.xhtml": chapterText,
+			},
+			cover:      "SpineImagePage/OEBPS/i/0001.png",
+			confidence: COVER_SPINE_IMAGE,
+		},
+		{
+			name: "NoCover",
+			files: map[string]string{
+				"OEBPS/content.opf": testPackage("2.0", "", chapter, chapterRef, ""),
+				"OEBPS/Text/chapter.xhtml": testDocument(
+					"<p><img src='figure.png'/>" + strings.Repeat("A figure in a chapter. ", 20) + "</p>"),
+				"OEBPS/Text/figure.png": "png",
+			},
+			cover:      "",
+			confidence: 0,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			if _, exists := test.files["OEBPS/Text/chapter.xhtml"]; !exists {
+				test.files["OEBPS/Text/chapter.xhtml"] = chapterText
+			}
+			filename := createEpub(t, t.TempDir(), test.name, test.files)
+
+			e, err := New(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEq(t, e.CoverImagePath, test.cover)
+			assertEq(t, e.CoverConfidence, test.confidence)
+		})
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	assertEq(t, ResolvePath("OEBPS/Text/a.xhtml", "../Images/b.jpg"), "OEBPS/Images/b.jpg")
+	assertEq(t, ResolvePath("OEBPS/Text/a.xhtml", "b.xhtml#note-1"), "OEBPS/Text/b.xhtml")
+	assertEq(t, ResolvePath("content.opf", "cover%20art.jpg"), "cover art.jpg")
+	assertEq(t, ResolvePath("OEBPS/content.opf", "../../escape.jpg"), "")
+	assertEq(t, ResolvePath("OEBPS/content.opf", "https://example.com/cover.jpg"), "")
+	assertEq(t, ResolvePath("OEBPS/content.opf", ""), "")
+}
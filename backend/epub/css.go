@@ -0,0 +1,369 @@
+package epub
+
+import (
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Options for processing the css of every document in the spine.
+type CSSOptions struct {
+	// Class added to each document's body and prefixed to every selector,
+	// so the book's css can't style anything outside of the book.
+	// Scoping is disabled when empty.
+	Scope string
+	// Url path that the extracted epubs are served from.
+	StaticPrefix string
+	// Properties that fight the reader's theme. Declarations that set them
+	// are moved into a separate stylesheet that readers can turn off.
+	ThemeProperties map[string]bool
+	// Properties that fight the reader's theme only when set to a fixed length.
+	FixedLengthProperties map[string]bool
+}
+
+var CSS_OPTIONS = CSSOptions{
+	Scope:                 "page-book",
+	StaticPrefix:          "/static/",
+	ThemeProperties:       toSet("font-family font color background-color background line-height"),
+	FixedLengthProperties: toSet("width min-width max-width height min-height max-height"),
+}
+
+// At-rules whose blocks contain other rules rather than declarations.
+var groupingRules = toSet("@media @supports @document @-moz-document @layer @container")
+
+var (
+	cssCommentRegex     = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	cssFixedLengthRegex = regexp.MustCompile(`(?i)^-?[\d.]+(px|pt|pc|cm|mm|in|q)$`)
+)
+
+// A css rule. Statements are at-rules without a block (ex. @import).
+// Grouping at-rules (ex. @media) have children, every other rule has declarations.
+type cssRule struct {
+	prelude      string
+	declarations string
+	children     []cssRule
+	statement    bool
+}
+
+// Split s on sep, ignoring separators inside strings, parentheses and brackets.
+func splitTopLevel(s string, sep byte) []string {
+	var parts []string
+	var quote byte
+	depth, start := 0, 0
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(' || c == '[':
+			depth++
+		case c == ')' || c == ']':
+			depth--
+		case c == sep && depth <= 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// Parse a stylesheet into a list of rules. Malformed css is skipped
+// in the same way browsers would skip it.
+func parseCSS(css string) []cssRule {
+	css = cssCommentRegex.ReplaceAllString(css, "")
+	var rules []cssRule
+	var quote byte
+	start := 0
+
+	for i := 0; i < len(css); i++ {
+		c := css[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ';':
+			prelude := strings.TrimSpace(css[start:i])
+			if strings.HasPrefix(prelude, "@") {
+				rules = append(rules, cssRule{prelude: prelude, statement: true})
+			}
+			start = i + 1
+		case c == '}': // Unbalanced closing brace
+			start = i + 1
+		case c == '{':
+			end := matchingBrace(css, i)
+			prelude := strings.TrimSpace(css[start:i])
+			body := css[i+1 : end]
+			name := strings.ToLower(strings.Fields(prelude + " ")[0])
+
+			if groupingRules[name] {
+				rules = append(rules, cssRule{prelude: prelude, children: parseCSS(body)})
+			} else {
+				rules = append(rules, cssRule{prelude: prelude, declarations: strings.TrimSpace(body)})
+			}
+			i = end
+			start = end + 1
+		}
+	}
+	return rules
+}
+
+// Index of the brace closing the block opened at open, or the end of the css.
+func matchingBrace(css string, open int) int {
+	var quote byte
+	depth := 0
+	for i := open; i < len(css); i++ {
+		c := css[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(css)
+}
+
+func renderCSS(rules []cssRule) string {
+	var css strings.Builder
+	for _, r := range rules {
+		switch {
+		case r.statement:
+			css.WriteString(r.prelude + ";\n")
+		case r.children != nil:
+			css.WriteString(r.prelude + " {\n" + renderCSS(r.children) + "}\n")
+		default:
+			css.WriteString(r.prelude + " { " + r.declarations + " }\n")
+		}
+	}
+	return css.String()
+}
+
+// Check if a selector starts with a compound selector for an element (ex. "body.dark p").
+func hasCompound(selector, element string) bool {
+	if len(selector) < len(element) || !strings.EqualFold(selector[:len(element)], element) {
+		return false
+	}
+	rest := selector[len(element):]
+	return rest == "" || strings.ContainsAny(rest[:1], " \t\n.#[:>+~")
+}
+
+// Prefix a selector with the scope. Selectors targeting
+// the root element or the body target the scope instead.
+func scopeSelector(selector, scope string) string {
+	selector = strings.TrimSpace(selector)
+
+	for _, root := range []string{"html", ":root"} {
+		if !hasCompound(selector, root) {
+			continue
+		}
+		rest := selector[len(root):]
+		if rest == "" || !strings.ContainsAny(rest[:1], " \t\n>") {
+			return "." + scope + rest // ex. "html.night"
+		}
+		selector = strings.TrimLeft(rest, " \t\n>") // ex. "html > body p"
+	}
+
+	if hasCompound(selector, "body") {
+		return "." + scope + selector[len("body"):]
+	}
+	return "." + scope + " " + selector
+}
+
+// Check if a declaration fights the reader's theme.
+func (o *CSSOptions) fightsTheme(property, value string) bool {
+	property = strings.ToLower(strings.TrimSpace(property))
+	value = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "!important"))
+	if o.ThemeProperties[property] {
+		return true
+	}
+	return o.FixedLengthProperties[property] && cssFixedLengthRegex.MatchString(value)
+}
+
+// Split declarations into the ones that fight the reader's theme and the rest.
+func (o *CSSOptions) splitDeclarations(declarations string) (string, string) {
+	var book, theme []string
+	for _, d := range splitTopLevel(declarations, ';') {
+		d = strings.TrimSpace(d)
+		property, value, found := strings.Cut(d, ":")
+		if d == "" || !found {
+			continue
+		}
+		if o.fightsTheme(property, value) {
+			theme = append(theme, d)
+		} else {
+			book = append(book, d)
+		}
+	}
+
+	join := func(d []string) string {
+		if len(d) == 0 {
+			return ""
+		}
+		return strings.Join(d, "; ") + ";"
+	}
+	return join(book), join(theme)
+}
+
+// Scope and split the rules into the book's stylesheet and
+// the stylesheet of declarations that fight the reader's theme.
+func (o *CSSOptions) splitRules(rules []cssRule) ([]cssRule, []cssRule) {
+	var book, theme []cssRule
+	for _, r := range rules {
+		name := strings.ToLower(strings.Fields(r.prelude + " ")[0])
+		switch {
+		case r.statement:
+			book = append(book, r)
+		case r.children != nil:
+			bookChildren, themeChildren := o.splitRules(r.children)
+			book = append(book, cssRule{prelude: r.prelude, children: bookChildren})
+			if len(themeChildren) > 0 {
+				theme = append(theme, cssRule{prelude: r.prelude, children: themeChildren})
+			}
+		case strings.HasPrefix(name, "@"):
+			// Keep @font-face, @page, @keyframes and the like as they are
+			book = append(book, r)
+		default:
+			prelude := r.prelude
+			if o.Scope != "" {
+				selectors := splitTopLevel(prelude, ',')
+				for i := range selectors {
+					selectors[i] = scopeSelector(selectors[i], o.Scope)
+				}
+				prelude = strings.Join(selectors, ", ")
+			}
+
+			bookDeclarations, themeDeclarations := o.splitDeclarations(r.declarations)
+			book = append(book, cssRule{prelude: prelude, declarations: bookDeclarations})
+			if themeDeclarations != "" {
+				theme = append(theme, cssRule{prelude: prelude, declarations: themeDeclarations})
+			}
+		}
+	}
+	return book, theme
+}
+
+// Url path to a file inside the extracted epub.
+func (e *Epub) staticURL(relativePath string) string {
+	segments := strings.Split(path.Join(e.Name, relativePath), "/")
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+	return CSS_OPTIONS.StaticPrefix + strings.Join(segments, "/")
+}
+
+// Rewrite the relative urls in css found in the file at base into static urls.
+func (e *Epub) rewriteURLs(css, base string) string {
+	return cssURLRegex.ReplaceAllStringFunc(css, func(value string) string {
+		match := cssURLRegex.FindStringSubmatch(value)
+		link := strings.TrimSpace(match[1] + match[2] + match[3])
+		if strings.HasPrefix(link, "#") {
+			return value // Reference to an svg element in the document
+		}
+		resolved := ResolvePath(base, link)
+		if resolved == "" {
+			return value
+		}
+		fragment := ""
+		if u, err := url.Parse(link); err == nil && u.Fragment != "" {
+			fragment = "#" + u.Fragment
+		}
+		return `url("` + e.staticURL(resolved) + fragment + `")`
+	})
+}
+
+// Parse the stylesheet at a path relative to the root of the extracted epub.
+// Imported stylesheets are inlined, wrapped in @media blocks if the import
+// has a media query. Visited holds the stylesheets that were already imported.
+func (e *Epub) loadStylesheet(relativePath, media string, visited map[string]bool) []cssRule {
+	if relativePath == "" || visited[relativePath] {
+		return nil
+	}
+	visited[relativePath] = true
+
+	file := filepath.Join(EXTRACT_DIRECTORY, e.Name, filepath.FromSlash(relativePath))
+	css, err := os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	return e.processStylesheet(string(css), relativePath, media, visited)
+}
+
+// Resolve the imports and rewrite the urls of css found in the file at base.
+func (e *Epub) processStylesheet(css, base, media string, visited map[string]bool) []cssRule {
+	var rules []cssRule
+	for _, r := range parseCSS(css) {
+		name := strings.ToLower(strings.Fields(r.prelude + " ")[0])
+		switch {
+		case r.statement && name == "@charset":
+			continue
+		case r.statement && name == "@import":
+			match := cssImportRegex.FindStringSubmatch(r.prelude + ";")
+			if match != nil {
+				target := ResolvePath(base, match[1])
+				rules = append(rules, e.loadStylesheet(target, importMediaQuery(r.prelude), visited)...)
+			}
+		default:
+			rules = append(rules, e.rewriteRuleURLs(r, base))
+		}
+	}
+
+	if media = strings.TrimSpace(media); media != "" && strings.ToLower(media) != "all" {
+		return []cssRule{{prelude: "@media " + media, children: rules}}
+	}
+	return rules
+}
+
+func (e *Epub) rewriteRuleURLs(r cssRule, base string) cssRule {
+	r.declarations = e.rewriteURLs(r.declarations, base)
+	for i := range r.children {
+		r.children[i] = e.rewriteRuleURLs(r.children[i], base)
+	}
+	return r
+}
+
+// Get the media query of an @import rule (ex. "screen" in @import "a.css" screen;).
+func importMediaQuery(rule string) string {
+	rule = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(rule), ";"))
+	rule = strings.TrimSpace(strings.TrimPrefix(rule, "@import"))
+	if strings.HasPrefix(strings.ToLower(rule), "url(") {
+		end := strings.Index(rule, ")")
+		if end == -1 {
+			return ""
+		}
+		return strings.TrimSpace(rule[end+1:])
+	}
+	if len(rule) > 0 && (rule[0] == '"' || rule[0] == '\'') {
+		end := strings.IndexByte(rule[1:], rule[0])
+		if end == -1 {
+			return ""
+		}
+		return strings.TrimSpace(rule[end+2:])
+	}
+	return ""
+}
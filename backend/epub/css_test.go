@@ -0,0 +1,88 @@
+package epub
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScopeSelector(t *testing.T) {
+	tests := map[string]string{
+		"p":             ".page-book p",
+		"body":          ".page-book",
+		"BODY.night p":  ".page-book.night p",
+		"html":          ".page-book",
+		"html body > p": ".page-book > p",
+		":root":         ".page-book",
+		"html.dark h1":  ".page-book.dark h1",
+		"bodytext":      ".page-book bodytext",
+		" a:hover ":     ".page-book a:hover",
+	}
+	for selector, want := range tests {
+		assertEq(t, scopeSelector(selector, "page-book"), want)
+	}
+}
+
+func TestThemeSplit(t *testing.T) {
+	options := CSSOptions{
+		Scope:                 "page-book",
+		ThemeProperties:       toSet("font-family color"),
+		FixedLengthProperties: toSet("width"),
+	}
+	rules := parseCSS(`
+	/* comment { } */
+	p, :is(h1, h2) { font-family: "Times; New Roman"; width: 500px; text-indent: 1em }
+	div { width: 50% }
+	@media screen and (min-width: 600px) { body { color: red !important; margin: 0 } }
+	@font-face { font-family: Book; src: url(a.ttf) }`)
+	book, theme := options.splitRules(rules)
+
+	assertEq(t, renderCSS(book), `.page-book p, .page-book :is(h1, h2) { text-indent: 1em; }
+.page-book div { width: 50%; }
+@media screen and (min-width: 600px) {
+.page-book { margin: 0; }
+}
+@font-face { font-family: Book; src: url(a.ttf) }
+`)
+	assertEq(t, renderCSS(theme), `.page-book p, .page-book :is(h1, h2) { font-family: "Times; New Roman"; width: 500px; }
+@media screen and (min-width: 600px) {
+.page-book { color: red !important; }
+}
+`)
+}
+
+func TestStylesheetProcessing(t *testing.T) {
+	t.Parallel()
+	e := Epub{Name: "Css Test"}
+	files := map[string]string{
+		"OEBPS/Styles/main.css": `@charset "utf-8";
+			@import url("fonts.css");
+			@import 'print.css' print;
+			@import "main.css";
+			p { background: url(../Images/bg%20one.png) }`,
+		"OEBPS/Styles/fonts.css": `@font-face { src: url("../Fonts/serif.otf#v1") }`,
+		"OEBPS/Styles/print.css": `@import "main.css"; img { display: none }`,
+	}
+	for path, contents := range files {
+		path = filepath.Join(EXTRACT_DIRECTORY, e.Name, filepath.FromSlash(path))
+		os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rules := e.loadStylesheet("OEBPS/Styles/main.css", "", make(map[string]bool))
+	assertEq(t, strings.Split(renderCSS(rules), "\n"), []string{
+		`@font-face { src: url("/static/Css%20Test/OEBPS/Fonts/serif.otf#v1") }`,
+		`@media print {`,
+		`img { display: none }`,
+		`}`,
+		`p { background: url("/static/Css%20Test/OEBPS/Images/bg%20one.png") }`,
+		``,
+	})
+
+	// Css already inside the document is relative to the document
+	rules = e.processStylesheet(`h1 { background: url(cover.png) }`, "OEBPS/Text/a.xhtml", "screen", map[string]bool{})
+	assertEq(t, renderCSS(rules), "@media screen {\nh1 { background: url(\"/static/Css%20Test/OEBPS/Text/cover.png\") }\n}\n")
+}
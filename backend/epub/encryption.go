@@ -0,0 +1,123 @@
+package epub
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Font obfuscation algorithms. Obfuscated fonts aren't encrypted, their
+// first bytes are xored with a key derived from the book's identifier.
+const (
+	IDPF_OBFUSCATION  = "http://www.idpf.org/2008/embedding"
+	ADOBE_OBFUSCATION = "http://ns.adobe.com/pdf/enc#RC"
+)
+
+// Returned when the epub has resources encrypted with DRM, which can't be read.
+var ErrEncrypted = errors.New("Epub contains DRM encrypted resources")
+
+// The identifier referenced by the package's unique-identifier attribute.
+func uniqueIdentifier(p Package) string {
+	for _, i := range p.Metadata.Identifiers {
+		if i.Id == p.UniqueIdentifier {
+			return strings.TrimSpace(i.Value)
+		}
+	}
+	if len(p.Metadata.Identifiers) > 0 {
+		return strings.TrimSpace(p.Metadata.Identifiers[0].Value)
+	}
+	return ""
+}
+
+// The IDPF key is the sha1 hash of the unique identifier without whitespace.
+func idpfKey(p Package) []byte {
+	identifier := strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\n' || r == '\r' {
+			return -1
+		}
+		return r
+	}, uniqueIdentifier(p))
+
+	hash := sha1.Sum([]byte(identifier))
+	return hash[:]
+}
+
+// The Adobe key is the 16 bytes of the book's uuid identifier.
+func adobeKey(p Package) ([]byte, error) {
+	candidates := []string{uniqueIdentifier(p)}
+	for _, i := range p.Metadata.Identifiers {
+		candidates = append(candidates, strings.TrimSpace(i.Value))
+	}
+
+	for _, c := range candidates {
+		c = strings.TrimPrefix(strings.ToLower(c), "urn:uuid:")
+		c = strings.ReplaceAll(c, "-", "")
+		if key, err := hex.DecodeString(c); err == nil && len(key) == 16 {
+			return key, nil
+		}
+	}
+	return nil, errors.New("Adobe obfuscated font without a uuid identifier")
+}
+
+// Xor the first length bytes of data with the key repeated.
+func deobfuscate(data, key []byte, length int) {
+	for i := 0; i < length && i < len(data); i++ {
+		data[i] ^= key[i%len(key)]
+	}
+}
+
+// Deobfuscate the fonts listed in META-INF/encryption.xml in place.
+// Returns ErrEncrypted if any resource is encrypted rather than obfuscated.
+func (e *Epub) deobfuscateFonts(p Package) error {
+	root := filepath.Join(EXTRACT_DIRECTORY, e.Name)
+	encryptionPath := filepath.Join(root, "META-INF", "encryption.xml")
+	if _, err := os.Stat(encryptionPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	encryption, err := parseXML[Encryption](encryptionPath)
+	if err != nil {
+		return err
+	}
+
+	for _, data := range encryption.Data {
+		var key []byte
+		var length int
+		switch data.Method.Algorithm {
+		case IDPF_OBFUSCATION:
+			key, length = idpfKey(p), 1040
+		case ADOBE_OBFUSCATION:
+			if key, err = adobeKey(p); err != nil {
+				return err
+			}
+			length = 1024
+		default:
+			return fmt.Errorf("%w (%s)", ErrEncrypted, data.Reference.URI)
+		}
+
+		// Cipher references are relative to the root of the container
+		path := ResolvePath("", data.Reference.URI)
+		if path == "" {
+			continue
+		}
+
+		file := filepath.Join(root, filepath.FromSlash(path))
+		font, err := os.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue // The manifest can list fonts that don't exist
+		} else if err != nil {
+			return err
+		}
+
+		deobfuscate(font, key, length)
+		if err := os.WriteFile(file, font, 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package epub
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testEncryption(algorithm, uri string) string {
+	return `<?xml version="1.0"?>
+<encryption xmlns="urn:oasis:names:tc:opendocument:xmlns:container" xmlns:enc="http://www.w3.org/2001/04/xmlenc#">
+  <enc:EncryptedData>
+    <enc:EncryptionMethod Algorithm="` + algorithm + `"/>
+    <enc:CipherData><enc:CipherReference URI="` + uri + `"/></enc:CipherData>
+  </enc:EncryptedData>
+</encryption>`
+}
+
+func TestFontDeobfuscation(t *testing.T) {
+	t.Parallel()
+	font := bytes.Repeat([]byte("OTTO font data "), 100)
+	identifier := "urn:uuid:0b8a8fb3-6c4d-4bcf-a2f0-bd0f1fd3c6e5"
+	manifest := `<item id="chapter" href="Text/chapter.xhtml" media-type="application/xhtml+xml"/>
+		<item id="font" href="Fonts/serif%20bold.otf" media-type="font/otf"/>`
+	opf := testPackage("3.0", "", manifest, `<itemref idref="chapter"/>`, "")
+
+	idpf := idpfKey(Package{UniqueIdentifier: "id", Metadata: PackageMetadata{
+		Identifiers: []Element{{Id: "id", Value: "  " + identifier + "\n"}},
+	}})
+	adobe, err := adobeKey(Package{Metadata: PackageMetadata{Identifiers: []Element{{Value: identifier}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, algorithm string
+		key             []byte
+		length          int
+	}{
+		{"Idpf", IDPF_OBFUSCATION, idpf, 1040},
+		{"Adobe", ADOBE_OBFUSCATION, adobe, 1024},
+	}
+	for _, test := range tests {
+		obfuscated := bytes.Clone(font)
+		deobfuscate(obfuscated, test.key, test.length)
+
+		filename := createEpub(t, t.TempDir(), test.name, map[string]string{
+			"META-INF/encryption.xml":    testEncryption(test.algorithm, "OEBPS/Fonts/serif%20bold.otf"),
+			"OEBPS/content.opf":          opf,
+			"OEBPS/Text/chapter.xhtml":   testDocument("<p>Chapter</p>"),
+			"OEBPS/Fonts/serif bold.otf": string(obfuscated),
+		})
+		if _, err := New(filename); err != nil {
+			t.Fatal(err)
+		}
+
+		path := filepath.Join(EXTRACT_DIRECTORY, test.name, "OEBPS", "Fonts", "serif bold.otf")
+		deobfuscated, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEq(t, deobfuscated, font)
+	}
+}
+
+func TestDRMEncryptedEpub(t *testing.T) {
+	t.Parallel()
+	filename := createEpub(t, t.TempDir(), "Drm", map[string]string{
+		"META-INF/encryption.xml": testEncryption("http://www.w3.org/2001/04/xmlenc#aes128-cbc", "OEBPS/Text/chapter.xhtml"),
+		"OEBPS/content.opf": testPackage("2.0", "",
+			`<item id="chapter" href="Text/chapter.xhtml" media-type="application/xhtml+xml"/>`,
+			`<itemref idref="chapter"/>`, ""),
+		"OEBPS/Text/chapter.xhtml": "\x8f\x01encrypted",
+	})
+
+	if _, err := New(filename); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("Found %v, want %v", err, ErrEncrypted)
+	}
+}
@@ -10,11 +10,22 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 )
 
 // The directory where the epub files will be extracted into.
 var EXTRACT_DIRECTORY string
 
+// Called with the time each stage of New took, when set.
+// The stages are "validate", "unzip", "container", "content" and "toc".
+var STAGE_HOOK func(stage string, duration time.Duration)
+
+func timeStage(stage string, start time.Time) {
+	if STAGE_HOOK != nil {
+		STAGE_HOOK(stage, time.Since(start))
+	}
+}
+
 type Section struct {
 	Path string `json:"Path"`
 	Name string `json:"Name"`
@@ -26,50 +37,75 @@ type Epub struct {
 	Files               []string
 	TableOfContents     []Section
 	CoverImagePath      string
+	CoverConfidence     float64 // How confident we are that CoverImagePath is the cover (0 to 1)
+	Report              Report
 	tableOfContentsPath string
 	contentFilename     string
-	coverPath           string
 }
 
+// Extract and process an epub file. Ingestion is lenient: the epub is read
+// unless its validation report has fatal issues, in which case the returned
+// epub only holds the report.
 func New(filename string) (Epub, error) {
 	if !strings.Contains(filename, ".epub") {
-		return Epub{}, errors.New("Invalid epub file")
+		return Epub{}, ErrInvalid
 	}
 
-	e := Epub{Name: getFileBase(filename)}
-
-	if err := unzip(filename, e.absolutePath("")); err != nil {
-		return Epub{}, err
+	start := time.Now()
+	e := Epub{Name: getFileBase(filename), Report: Validate(filename)}
+	timeStage("validate", start)
+	if issue := e.Report.Fatal(); issue != nil {
+		return Epub{Report: e.Report}, fmt.Errorf("%w: %s", ErrInvalid, issue.Message)
 	}
-	if err := e.verifyMimetype(); err != nil {
-		return Epub{}, err
+
+	start = time.Now()
+	err := extract(filename, e.absolutePath(""))
+	timeStage("unzip", start)
+	if err != nil {
+		return Epub{Report: e.Report}, err
 	}
-	if err := e.parseContainer(); err != nil {
-		return Epub{}, err
+
+	start = time.Now()
+	err = e.parseContainer()
+	timeStage("container", start)
+	if err != nil {
+		os.RemoveAll(e.absolutePath(""))
+		return Epub{Report: e.Report}, err
 	}
-	if err := e.parseContent(); err != nil {
-		return Epub{}, err
+
+	start = time.Now()
+	err = e.parseContent()
+	timeStage("content", start)
+	if err != nil {
+		os.RemoveAll(e.absolutePath(""))
+		return Epub{Report: e.Report}, err
 	}
+
+	// An unreadable table of contents is in the report and shouldn't prevent reading
+	start = time.Now()
 	if err := e.parseTableOfContents(); err != nil {
-		return Epub{}, err
+		e.TableOfContents = []Section{}
 	}
+	timeStage("toc", start)
 
 	return e, nil
 }
 
 func (e *Epub) Debug() {
-	fmt.Printf("%s by %s in %s\n", e.Info.Title, e.Info.Author, e.Info.Date)
+	fmt.Printf("%s by %s in %v\n", e.Info.Title, e.Info.Author, e.Info.Published)
 	fmt.Printf("Description: %s\n", e.Info.Description)
-	fmt.Printf("Cover image: %s\n", e.absolutePath(e.CoverImagePath))
+	fmt.Printf("Cover image: %s (confidence %.1f)\n", e.absolutePath(e.CoverImagePath), e.CoverConfidence)
 	fmt.Printf("Subjects: %v\n", e.Info.Subjects)
 	fmt.Printf("Publisher: %s\n", e.Info.Publisher)
-	fmt.Printf("Language: %s\n", e.Info.Language)
+	fmt.Printf("Languages: %v\n", e.Info.Languages)
 	fmt.Printf("Relation: %s\n", e.Info.Relation)
 	fmt.Printf("Coverage: %s\n", e.Info.Coverage)
 	fmt.Printf("Source: %s\n", e.Info.Source)
 	fmt.Printf("Rights: %s\n", e.Info.Rights)
-	fmt.Printf("Contributor: %s\n", e.Info.Contributor)
-	fmt.Printf("Identifier: %s\n", e.Info.Identifier)
+	fmt.Printf("Creators: %v\n", e.Info.Creators)
+	fmt.Printf("Contributors: %v\n", e.Info.Contributors)
+	fmt.Printf("Identifiers: %v\n", e.Info.Identifiers)
+	fmt.Printf("Modified: %v\n", e.Info.Modified)
 	fmt.Println("Files: ")
 	for _, f := range e.Files {
 		fmt.Printf("URL Path %s | Local Path %s\n", f, e.absolutePath(f))
@@ -91,6 +127,9 @@ func (e *Epub) absolutePath(file string) string {
 
 	var foundPath string
 	filepath.WalkDir(basePath, func(path string, info fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // Unreadable or missing directory
+		}
 		if !info.IsDir() && targetFile == info.Name() {
 			foundPath = path
 			return filepath.SkipAll
@@ -110,21 +149,6 @@ func (e *Epub) urlPath(file string) string {
 	return strings.Replace(s, replace, "", -1)
 }
 
-func (e *Epub) verifyMimetype() error {
-	path := e.absolutePath("mimetype")
-
-	mimetype, err := os.ReadFile(path)
-	if err != nil {
-		return err
-	}
-
-	if string(mimetype) != "application/epub+zip" {
-		return errors.New("Invalid epub file")
-	}
-
-	return nil
-}
-
 func (e *Epub) parseContainer() error {
 	c, err := parseXML[Container](e.absolutePath("META-INF/container.xml"))
 	if err != nil {
@@ -132,90 +156,34 @@ func (e *Epub) parseContainer() error {
 	}
 
 	e.contentFilename = c.Rootfiles.Rootfile.FullPath
-	if c.Rootfiles.Rootfile.MediaType != "application/oebps-package+xml" {
-		return errors.New("Invalid epub file")
-	}
-
 	return nil
 }
 
-// Traverse the xml to find a path to the epub's cover.
-func (e *Epub) getCoverPath(p Package, items map[string]string) {
-	for _, r := range p.Guide.References {
-		if r.Type == "cover" {
-			e.coverPath = r.Path
-			break
-		}
-	}
-
-	// If there's no references in the guide node check if the meta nodes
-	if e.coverPath == "" {
-		for _, m := range p.Metadata.Meta {
-			if m.Name == "cover" {
-				e.coverPath = m.Content
-				break
-			}
-		}
-	}
-
-	// If the result from searching the meta nodes isn't a file
-	// use the result as key to get a file
-	if !strings.Contains(e.coverPath, ".") {
-		e.coverPath = items[e.coverPath]
-	}
-}
-
-// Get an absolute path to the epub's cover image.
-func (e *Epub) getCoverImagePath() error {
-	fileParts := strings.Split(e.coverPath, ".")
-	extension := fileParts[len(fileParts)-1]
-	if extension != "xhtml" && extension != "html" {
-		e.CoverImagePath = e.urlPath(e.coverPath)
-		return nil // Cover image path is already found
-	}
-
-	e.coverPath = e.absolutePath(e.coverPath)
-	document, err := parseHTML(e.coverPath)
-	if err != nil {
-		return err
-	}
-
-	imageNode := findNode(document, "img")
-	if imageNode == nil {
-		imageNode = findNode(document, "image")
-	}
-
-	if imageNode == nil {
-		return nil // Epub doesn't have cover image
-	}
-
-	e.CoverImagePath = findAttribute(imageNode, "src", "")
-	if e.CoverImagePath == "" {
-		e.CoverImagePath = findAttribute(imageNode, "href", "")
+// Collect the css from the stylesheets linked in, and the style elements of,
+// a document's head. The nodes the css was collected from are removed.
+func (e *Epub) collectCSS(root *html.Node, documentPath string) ([]cssRule, error) {
+	head := findNode(root, "head")
+	if head == nil {
+		return nil, errors.New(fmt.Sprintf("<head></head> not found"))
 	}
 
-	return nil
-}
-
-// Get the contents of the css files linked in a html document's head node.
-func (e *Epub) getLinkedCSS(head *html.Node) (string, error) {
-	var css string
+	var rules []cssRule
 	var nodesToRemove []*html.Node
+	visited := make(map[string]bool)
 
 	for node := head.FirstChild; node != nil; node = node.NextSibling {
-		if node.Data != "link" || findAttribute(node, "rel", "stylesheet") == "" {
+		media := findAttribute(node, "media", "")
+		rel := strings.Fields(strings.ToLower(findAttribute(node, "rel", "")))
+
+		if node.Data == "link" && contains(rel, "stylesheet") && !contains(rel, "alternate") {
+			href := ResolvePath(documentPath, findAttribute(node, "href", ""))
+			rules = append(rules, e.loadStylesheet(href, media, visited)...)
+		} else if node.Data == "style" {
+			css := e.processStylesheet(textContent(node), documentPath, media, visited)
+			rules = append(rules, css...)
+		} else {
 			continue
 		}
-
-		relativeCssPath := findAttribute(node, "href", "")
-		cssPath := e.absolutePath(relativeCssPath)
-
-		cssFile, err := os.ReadFile(cssPath)
-		if err != nil {
-			return "", err
-		}
-
-		css += string(cssFile)
 		nodesToRemove = append(nodesToRemove, node)
 	}
 
@@ -223,25 +191,34 @@ func (e *Epub) getLinkedCSS(head *html.Node) (string, error) {
 		head.RemoveChild(n)
 	}
 
-	return css, nil
+	return rules, nil
 }
 
-// Inject a style node containing css into the file's html document
-func (e *Epub) injectCSS(root *html.Node) error {
+// Inject the document's css into its head. Declarations that fight
+// the reader's theme go into a separate <style data-page="theme">
+// so that readers can turn them off.
+func (e *Epub) injectCSS(root *html.Node, rules []cssRule) {
 	head := findNode(root, "head")
-	if head == nil {
-		return errors.New(fmt.Sprintf("<head></head> not found"))
-	}
+	book, theme := CSS_OPTIONS.splitRules(rules)
+
+	for _, stylesheet := range []struct {
+		name  string
+		rules []cssRule
+	}{{"book", book}, {"theme", theme}} {
+		css := renderCSS(stylesheet.rules)
+		if SANITIZER != nil {
+			css = SANITIZER.SanitizeCSS(css)
+		}
 
-	css, err := e.getLinkedCSS(head)
-	if err != nil {
-		return err
+		attributes := []html.Attribute{{Key: "data-page", Val: stylesheet.name}}
+		style := html.Node{Type: html.ElementNode, Data: "style", Attr: attributes}
+		style.AppendChild(&html.Node{Type: html.TextNode, Data: css})
+		head.AppendChild(&style)
 	}
 
-	style := html.Node{Type: html.ElementNode, Data: "style"}
-	style.AppendChild(&html.Node{Type: html.TextNode, Data: css})
-	head.AppendChild(&style)
-	return nil
+	if body := findNode(root, "body"); body != nil && CSS_OPTIONS.Scope != "" {
+		addClass(body, CSS_OPTIONS.Scope)
+	}
 }
 
 func (e *Epub) fixLinks(root *html.Node) error {
@@ -262,7 +239,7 @@ func (e *Epub) fixLinks(root *html.Node) error {
 			return nil
 		}
 		setAttribute(root, "href", e.urlPath(link))
-	} else if root.Type == html.ElementNode && root.Data == "image" || root.Data == "img" {
+	} else if root.Type == html.ElementNode && (root.Data == "image" || root.Data == "img") {
 		var imgSrc string
 		if root.Data == "image" {
 			imgSrc = "href"
@@ -281,7 +258,9 @@ func (e *Epub) fixLinks(root *html.Node) error {
 	return nil
 }
 
-// Replace a html file with a html document that embeds all of its styling.
+// Replace a html file with a html document that embeds all of its styling,
+// with its imports resolved, its urls rewritten and its selectors scoped.
+// Remove scripts and other unsafe content from the document.
 // Replace relative paths to images within the document with absolute paths.
 // Replace relative paths to files within the document with the url paths.
 func (e *Epub) processFile(relativePath string) (string, error) {
@@ -294,11 +273,16 @@ func (e *Epub) processFile(relativePath string) (string, error) {
 		return "", err
 	}
 
-	err = e.injectCSS(document)
+	css, err := e.collectCSS(document, ResolvePath(e.contentFilename, relativePath))
 	if err != nil {
 		return "", err
 	}
 
+	if SANITIZER != nil {
+		SANITIZER.Sanitize(document)
+	}
+	e.injectCSS(document, css)
+
 	err = e.fixLinks(document)
 	if err != nil {
 		return "", err
@@ -337,13 +321,25 @@ func (e *Epub) parseContent() error {
 		return err
 	}
 
+	if err := e.deobfuscateFonts(p); err != nil {
+		return err
+	}
+
 	// Get the list of ebook files
 	items := make(map[string]string)
 	for _, i := range p.Manifest.Items {
 		items[i.Id] = i.Path
 	}
 
+	// Find the cover before the documents' links are rewritten
+	e.findCover(p)
+
 	for _, i := range p.Spine.ITemRefs {
+		// Missing spine items are in the report, skip them
+		if !e.exists(ResolvePath(e.contentFilename, items[i.Ref])) {
+			continue
+		}
+
 		fileUrlPath, err := e.processFile(items[i.Ref])
 		if err != nil {
 			return err
@@ -351,16 +347,15 @@ func (e *Epub) parseContent() error {
 		e.Files = append(e.Files, fileUrlPath)
 	}
 
-	e.Info = p.Metadata
+	e.Info = newMetadata(p.Metadata)
 	e.cleanDescription()
 	if len(e.Info.Subjects) == 0 {
 		e.Info.Subjects = append(e.Info.Subjects, "")
 	}
 
-	e.getCoverPath(p, items)
-	e.getCoverImagePath()
-
-	e.tableOfContentsPath = e.absolutePath(items[p.Spine.TableOfContents])
+	if p.Spine.TableOfContents != "" {
+		e.tableOfContentsPath = e.absolutePath(items[p.Spine.TableOfContents])
+	}
 	return nil
 }
 
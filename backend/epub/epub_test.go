@@ -1,21 +1,109 @@
 package epub
 
 import (
+	"archive/zip"
+	"bytes"
 	"fmt"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"testing"
+	"time"
 )
 
+// Extract every epub into a temporary directory so tests don't write into
+// the repository. Each test uses epubs with unique names so they can run in parallel.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "epub-test")
+	if err != nil {
+		panic(err)
+	}
+	EXTRACT_DIRECTORY = dir
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
 func assertEq(t *testing.T, a any, b any) {
 	if !reflect.DeepEqual(a, b) {
 		t.Errorf("Found %v, want %v", a, b)
 	}
 }
 
+const testContainer = `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>`
+
+// Build a zip archive containing exactly the given files. The mimetype, if
+// there is one, is the first file and is stored uncompressed as the spec requires.
+func buildEpub(files map[string]string) ([]byte, error) {
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+
+	if mimetype, exists := files["mimetype"]; exists {
+		w, err := archive.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+		if err != nil {
+			return nil, err
+		}
+		w.Write([]byte(mimetype))
+	}
+
+	paths := []string{}
+	for path := range files {
+		if path != "mimetype" {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		w, err := archive.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write([]byte(files[path])); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Write an epub archive containing the mimetype, a container.xml pointing to
+// OEBPS/content.opf and files into dir. Returns the path to the archive.
+// The defaults are only added when files doesn't already contain them.
+func createEpub(t *testing.T, dir, name string, files map[string]string) string {
+	defaults := map[string]string{
+		"mimetype":               "application/epub+zip",
+		"META-INF/container.xml": testContainer,
+	}
+	for path, contents := range defaults {
+		if _, exists := files[path]; !exists {
+			files[path] = contents
+		}
+	}
+
+	data, err := buildEpub(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, name+".epub")
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
 func TestEpubProcessing(t *testing.T) {
-	EXTRACT_DIRECTORY = "../../test_files"
+	t.Parallel()
 
 	e, err := New("../../test_files/Dune.epub")
 	if err != nil {
@@ -39,12 +127,19 @@ func TestEpubProcessing(t *testing.T) {
 		t.Errorf(fmt.Sprintf("%v", err))
 	}
 
-	assertEq(t, e.Info.Language, "UND")
+	assertEq(t, e.Info.Languages, []string{"UND"})
 	assertEq(t, e.CoverImagePath, "Dune/cover.jpeg")
-	assertEq(t, e.Info.Contributor, "calibre (0.6.52) [http://calibre-ebook.com]")
-	assertEq(t, e.Info.Identifier, "7e87f9a1-8a4f-459a-8e58-e7032f0c67c6")
-	assertEq(t, e.Info.Date, "2010-06-03T04:00:00+00:00")
+	assertEq(t, e.Info.Contributors, []Creator{
+		{Name: "calibre (0.6.52) [http://calibre-ebook.com]", Role: "bkp"},
+	})
+	assertEq(t, e.Info.Identifiers, []Identifier{
+		{Value: "7e87f9a1-8a4f-459a-8e58-e7032f0c67c6", Scheme: UUID},
+	})
+	assertEq(t, e.Info.Published.Format(time.RFC3339), "2010-06-03T04:00:00Z")
 	assertEq(t, e.Info.Author, "Herbert, Frank")
+	assertEq(t, e.Info.Creators, []Creator{
+		{Name: "Herbert, Frank", FileAs: "Frank, Herbert,", Role: "aut"},
+	})
 	assertEq(t, e.Info.Title, "Dune")
 	assertEq(t, e.tableOfContentsPath, EXTRACT_DIRECTORY+"/Dune/toc.ncx")
 	assertEq(t, e.contentFilename, "content.opf")
@@ -56,3 +151,74 @@ func TestEpubProcessing(t *testing.T) {
 	})
 	assertEq(t, e.Files, []string{"Dune/titlepage.xhtml", "Dune/OEBPS/title.xhtml", "Dune/OEBPS/part1.xhtml", "Dune/OEBPS/part2_split_000.xhtml", "Dune/OEBPS/part2_split_001.xhtml", "Dune/OEBPS/part2_split_002.xhtml", "Dune/OEBPS/part3_split_000.xhtml", "Dune/OEBPS/part3_split_001.xhtml", "Dune/OEBPS/part4_split_000.xhtml", "Dune/OEBPS/part4_split_001.xhtml"})
 }
+
+// Not parallel, since RemovePartialExtractions would remove
+// the partial directories of epubs extracted by other tests.
+func TestExtract(t *testing.T) {
+	outdir := filepath.Join(EXTRACT_DIRECTORY, "Extracted")
+	os.MkdirAll(outdir, os.ModePerm)
+	os.WriteFile(filepath.Join(outdir, "old.txt"), []byte("old"), 0644)
+	partials := filepath.Join(EXTRACT_DIRECTORY, PARTIAL_EXTRACTION_PREFIX+"*")
+
+	write := func(files map[string]string) string {
+		data, err := buildEpub(files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filename := filepath.Join(t.TempDir(), "archive.zip")
+		os.WriteFile(filename, data, 0644)
+		return filename
+	}
+
+	// A failed extraction leaves the existing directory untouched
+	err := extract(write(map[string]string{"new.txt": "new", "../escaped.txt": ""}), outdir)
+	if err == nil {
+		t.Fatal("Extracted an archive with an escaping path")
+	}
+	if _, err := os.Stat(filepath.Join(outdir, "old.txt")); err != nil {
+		t.Error(err)
+	}
+	found, _ := filepath.Glob(partials)
+	assertEq(t, len(found), 0)
+
+	// A successful extraction replaces the directory's contents
+	if err := extract(write(map[string]string{"new.txt": "new"}), outdir); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(outdir)
+	assertEq(t, len(entries), 1)
+	assertEq(t, entries[0].Name(), "new.txt")
+
+	// Partial directories of other servers are only removed once they're old
+	killed := filepath.Join(EXTRACT_DIRECTORY, PARTIAL_EXTRACTION_PREFIX+"killed-Book-1")
+	running := filepath.Join(EXTRACT_DIRECTORY, PARTIAL_EXTRACTION_PREFIX+"running-Book-1")
+	own := filepath.Join(EXTRACT_DIRECTORY, PARTIAL_EXTRACTION_PREFIX+instanceId+"-Book-1")
+	for _, partial := range []string{killed, running, own} {
+		os.MkdirAll(filepath.Join(partial, "OEBPS"), os.ModePerm)
+	}
+	old := time.Now().Add(-PARTIAL_EXTRACTION_MAX_AGE - time.Minute)
+	os.Chtimes(killed, old, old)
+	if err := RemovePartialExtractions(); err != nil {
+		t.Fatal(err)
+	}
+	found, _ = filepath.Glob(partials)
+	assertEq(t, found, []string{running})
+	os.RemoveAll(running)
+	if _, err := os.Stat(outdir); err != nil {
+		t.Error(err)
+	}
+}
+
+// Not parallel, since STAGE_HOOK would be called by epubs parsed in other tests.
+func TestStageHook(t *testing.T) {
+	stages := []string{}
+	STAGE_HOOK = func(stage string, duration time.Duration) {
+		stages = append(stages, stage)
+	}
+	defer func() { STAGE_HOOK = nil }()
+
+	if _, err := New("../../test_files/Dune.epub"); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, stages, []string{"validate", "unzip", "container", "content", "toc"})
+}
@@ -0,0 +1,336 @@
+package epub
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+const testNCX = `<?xml version="1.0" encoding="utf-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+  <navMap>
+    <navPoint id="p1" playOrder="1">
+      <navLabel><text>Chapter</text></navLabel>
+      <content src="Text/chapter.xhtml"/>
+    </navPoint>
+  </navMap>
+</ncx>`
+
+// A table of contents whose entries link back to the table of contents
+// and to the package document, nested depth levels deep.
+func cyclicNCX(depth int) string {
+	points := ""
+	for i := 0; i < depth; i++ {
+		points = `<navPoint><navLabel><text>Loop</text></navLabel><content src="toc.ncx#p"/>` + points + `</navPoint>`
+	}
+	return `<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/"><navMap>
+		<navPoint id="p"><navLabel><text>Self</text></navLabel><content src="toc.ncx"/>` + points + `</navPoint>
+		<navPoint><navLabel><text>Package</text></navLabel><content src="content.opf"/></navPoint>
+	</navMap></ncx>`
+}
+
+// A malformed epub. Fatal epubs can't be read at all,
+// the others should be read despite their issues.
+type malformedEpub struct {
+	name  string
+	files map[string]string
+	fatal bool
+}
+
+// Generate epubs that break the spec in the ways epubs found in the wild do.
+func malformedEpubs() []malformedEpub {
+	chapter := `<item id="chapter" href="Text/chapter.xhtml" media-type="application/xhtml+xml"/>`
+	chapterRef := `<itemref idref="chapter"/>`
+	opf := testPackage("2.0", "", chapter, chapterRef, "")
+	document := testDocument("<p>Chapter</p>")
+	huge := strings.Repeat("a", 1<<20)
+
+	return []malformedEpub{
+		{name: "EmptyArchive", files: map[string]string{}, fatal: true},
+		{
+			name: "MissingContainer",
+			files: map[string]string{
+				"mimetype":                 "application/epub+zip",
+				"OEBPS/content.opf":        opf,
+				"OEBPS/Text/chapter.xhtml": document,
+			},
+			fatal: true,
+		},
+		{
+			name: "WrongRootfileMediaType",
+			files: map[string]string{
+				"mimetype": "application/epub+zip",
+				"META-INF/container.xml": strings.Replace(testContainer,
+					"application/oebps-package+xml", "text/plain", 1),
+				"OEBPS/content.opf":        opf,
+				"OEBPS/Text/chapter.xhtml": document,
+			},
+		},
+		{
+			name: "RootfileOutsideArchive",
+			files: map[string]string{
+				"mimetype":               "application/epub+zip",
+				"META-INF/container.xml": strings.Replace(testContainer, "OEBPS/content.opf", "../content.opf", 1),
+			},
+			fatal: true,
+		},
+		{
+			name: "MissingPackage",
+			files: map[string]string{
+				"mimetype":               "application/epub+zip",
+				"META-INF/container.xml": testContainer,
+			},
+			fatal: true,
+		},
+		{
+			name: "TruncatedPackage",
+			files: map[string]string{
+				"mimetype":               "application/epub+zip",
+				"META-INF/container.xml": testContainer,
+				"OEBPS/content.opf":      opf[:len(opf)/2],
+			},
+			fatal: true,
+		},
+		{
+			name: "CyclicNCX",
+			files: map[string]string{
+				"mimetype":               "application/epub+zip",
+				"META-INF/container.xml": testContainer,
+				"OEBPS/content.opf": strings.Replace(
+					testPackage("2.0", "", chapter+`<item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>`, chapterRef, ""),
+					"<spine>", `<spine toc="ncx">`, 1),
+				"OEBPS/toc.ncx":            cyclicNCX(1000),
+				"OEBPS/Text/chapter.xhtml": document,
+			},
+		},
+		{
+			name: "HugeAttributes",
+			files: map[string]string{
+				"mimetype":               "application/epub+zip",
+				"META-INF/container.xml": testContainer,
+				"OEBPS/content.opf": testPackage("3.0", `<meta name="`+huge+`" content="`+huge+`"/>`,
+					chapter+`<item id="`+huge+`" href="`+huge+`.png" media-type="image/png"/>`, chapterRef, ""),
+				"OEBPS/Text/chapter.xhtml": testDocument(`<p class="` + huge + `"><a href="#` + huge + `">Link</a>
+					<img src="` + huge + `.png"/></p>`),
+			},
+		},
+		{
+			name: "ZipSlip",
+			files: map[string]string{
+				"mimetype":                 "application/epub+zip",
+				"META-INF/container.xml":   testContainer,
+				"OEBPS/content.opf":        opf,
+				"OEBPS/Text/chapter.xhtml": document,
+				"../../escaped.xhtml":      document,
+			},
+			fatal: true,
+		},
+		{
+			name: "ManifestOutsideArchive",
+			files: map[string]string{
+				"mimetype":               "application/epub+zip",
+				"META-INF/container.xml": testContainer,
+				"OEBPS/content.opf": testPackage("2.0", "",
+					chapter+`<item id="passwd" href="../../../../etc/passwd" media-type="application/xhtml+xml"/>`,
+					chapterRef+`<itemref idref="passwd"/>`, ""),
+				"OEBPS/Text/chapter.xhtml": document,
+			},
+		},
+		{
+			name: "BinaryDocument",
+			files: map[string]string{
+				"mimetype":                 "application/epub+zip",
+				"META-INF/container.xml":   testContainer,
+				"OEBPS/content.opf":        opf,
+				"OEBPS/Text/chapter.xhtml": "\x00\xff\xfe<html\x00><body>\x8f</",
+			},
+		},
+	}
+}
+
+func TestMalformedEpubs(t *testing.T) {
+	t.Parallel()
+	for _, test := range malformedEpubs() {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			data, err := buildEpub(test.files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			filename := filepath.Join(t.TempDir(), test.name+".epub")
+			if err := os.WriteFile(filename, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			e, err := New(filename)
+			if test.fatal && !errors.Is(err, ErrInvalid) {
+				t.Errorf("Found %v, want %v", err, ErrInvalid)
+			} else if !test.fatal && err != nil {
+				t.Fatal(err)
+			}
+			assertEq(t, e.Report.Fatal() != nil, test.fatal)
+		})
+	}
+
+	// Nothing can be extracted outside of the epub's directory
+	if _, err := os.Stat(filepath.Join(EXTRACT_DIRECTORY, "..", "escaped.xhtml")); err == nil {
+		t.Error("ZipSlip was extracted outside of the extract directory")
+	}
+}
+
+func TestUnzipRejectsEscapingPaths(t *testing.T) {
+	t.Parallel()
+	for _, name := range []string{"../escaped.txt", "/absolute.txt", "a/../../escaped.txt"} {
+		data, err := buildEpub(map[string]string{name: "escaped"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		filename := filepath.Join(t.TempDir(), "slip.zip")
+		if err := os.WriteFile(filename, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		root := t.TempDir()
+		if err := unzip(filename, filepath.Join(root, "out", "nested")); err == nil {
+			t.Errorf("%q was extracted", name)
+		}
+		if _, err := os.Stat(filepath.Join(root, "out", "escaped.txt")); err == nil {
+			t.Errorf("%q was extracted outside of the output directory", name)
+		}
+	}
+}
+
+// Add the generated malformed epubs and a valid epub to a fuzz target's seed corpus.
+func addEpubSeeds(f *testing.F) {
+	for _, m := range malformedEpubs() {
+		data, err := buildEpub(m.files)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+
+	valid, err := buildEpub(map[string]string{
+		"mimetype":                "application/epub+zip",
+		"META-INF/container.xml":  testContainer,
+		"META-INF/encryption.xml": testEncryption(IDPF_OBFUSCATION, "OEBPS/font.otf"),
+		"OEBPS/content.opf": strings.Replace(testPackage("3.0", `<meta name="cover" content="img"/>`,
+			`<item id="chapter" href="Text/chapter.xhtml" media-type="application/xhtml+xml"/>
+			<item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+			<item id="img" href="cover.png" media-type="image/png"/>
+			<item id="css" href="style.css" media-type="text/css"/>`,
+			`<itemref idref="chapter"/>`, ""), "<spine>", `<spine toc="ncx">`, 1),
+		"OEBPS/toc.ncx":   testNCX,
+		"OEBPS/cover.png": "png",
+		"OEBPS/font.otf":  "font",
+		"OEBPS/style.css": `@import "style.css"; body { color: red; background: url(cover.png) }`,
+		"OEBPS/Text/chapter.xhtml": testDocument(`<link rel="stylesheet" href="../style.css"/>
+			<p id="a"><a href="#a">Link</a><img src="../cover.png"/></p>`),
+	})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(valid)
+	f.Add([]byte("PK\x03\x04 not a zip"))
+}
+
+func FuzzParseXML(f *testing.F) {
+	f.Add([]byte(testContainer))
+	f.Add([]byte(testPackage("3.0", `<meta refines="#id" property="identifier-type" scheme="onix:codelist5">15</meta>`,
+		`<item id="chapter" href="chapter.xhtml" media-type="application/xhtml+xml"/>`, `<itemref idref="chapter"/>`, "")))
+	f.Add([]byte(testNCX))
+	f.Add([]byte(cyclicNCX(10)))
+	f.Add([]byte(testEncryption(ADOBE_OBFUSCATION, "font.otf")))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		filename := filepath.Join(t.TempDir(), "file.xml")
+		if err := os.WriteFile(filename, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		parseXML[Container](filename)
+		parseXML[NCX](filename)
+		parseXML[Encryption](filename)
+		if p, err := parseXML[Package](filename); err == nil {
+			newMetadata(p.Metadata)
+			idpfKey(p)
+			adobeKey(p)
+		}
+	})
+}
+
+func FuzzUnzip(f *testing.F) {
+	addEpubSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		filename := filepath.Join(t.TempDir(), "archive.zip")
+		if err := os.WriteFile(filename, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		root := t.TempDir()
+		unzip(filename, filepath.Join(root, "out"))
+
+		// Nothing can be extracted outside of the output directory
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if entry.Name() != "out" {
+				t.Errorf("%q was extracted outside of the output directory", entry.Name())
+			}
+		}
+	})
+}
+
+func FuzzFixLinks(f *testing.F) {
+	f.Add(testDocument(`<a href="chapter.xhtml#note">Note</a><img src="../Images/a.png"/>`))
+	f.Add(`<svg><image href="cover.jpg"/></svg><a href="https://example.com">Site</a>`)
+	f.Add(`<a href=""><img><image>img</image></a>`)
+
+	f.Fuzz(func(t *testing.T, document string) {
+		root, err := html.Parse(strings.NewReader(document))
+		if err != nil {
+			return
+		}
+
+		e := Epub{Name: "Fuzz Links"}
+		if err := e.fixLinks(root); err != nil {
+			t.Fatal(err)
+		}
+		var rendered strings.Builder
+		if err := html.Render(&rendered, root); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func FuzzNew(f *testing.F) {
+	addEpubSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		filename := filepath.Join(t.TempDir(), "Fuzz.epub")
+		if err := os.WriteFile(filename, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(filepath.Join(EXTRACT_DIRECTORY, "Fuzz"))
+
+		e, err := New(filename)
+		if (e.Report.Fatal() != nil) != errors.Is(err, ErrInvalid) {
+			t.Errorf("Fatal issue %v returned error %v", e.Report.Fatal(), err)
+		}
+		if err != nil {
+			return
+		}
+
+		for _, file := range e.Files {
+			if _, err := os.Stat(filepath.Join(EXTRACT_DIRECTORY, file)); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+}
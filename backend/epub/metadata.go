@@ -0,0 +1,308 @@
+package epub
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Identifier schemes that can be detected from a <dc:identifier>.
+const (
+	ISBN = "ISBN"
+	UUID = "UUID"
+	ASIN = "ASIN"
+	DOI  = "DOI"
+)
+
+type Creator struct {
+	Name   string
+	FileAs string // Name used when sorting (ex. "Herbert, Frank")
+	Role   string // MARC relator code (ex. "aut", "edt", "bkp")
+}
+
+type Identifier struct {
+	Value  string
+	Scheme string
+}
+
+// A series or set the book belongs to. Index is the book's position
+// in the series and can be fractional (ex. 1.5 for a novella).
+type Series struct {
+	Name  string
+	Index float64
+	Type  string // "series" or "set" when known
+}
+
+type Metadata struct {
+	Title        string
+	Author       string // Name of the primary creator
+	Creators     []Creator
+	Contributors []Creator
+	Identifiers  []Identifier
+	Languages    []string
+	Published    *time.Time `json:",omitempty"`
+	Modified     *time.Time `json:",omitempty"`
+	Rights       string
+	Source       string
+	Coverage     string
+	Relation     string
+	Publisher    string
+	Description  string
+	Subjects     []string
+	Series       []Series
+}
+
+var (
+	uuidRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	asinRegex = regexp.MustCompile(`^B[0-9A-Z]{9}$`)
+	doiRegex  = regexp.MustCompile(`^10\.\d{4,9}/\S+$`)
+)
+
+// Layouts used by dc:date and dcterms:modified, from most to least precise.
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+// Parse a w3c datetime string. Returns nil if the date is malformed.
+func parseDate(s string) *time.Time {
+	s = strings.TrimSpace(s)
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return &t
+		}
+	}
+	return nil
+}
+
+// Check an isbn 10 or isbn 13 checksum. The digits should not contain hyphens.
+func validISBN(digits string) bool {
+	sum := 0
+	switch len(digits) {
+	case 10:
+		for i, c := range digits {
+			value := int(c - '0')
+			if c == 'X' && i == 9 {
+				value = 10
+			} else if c < '0' || c > '9' {
+				return false
+			}
+			sum += (10 - i) * value
+		}
+		return sum%11 == 0
+	case 13:
+		for i, c := range digits {
+			if c < '0' || c > '9' {
+				return false
+			}
+			weight := 1
+			if i%2 == 1 {
+				weight = 3
+			}
+			sum += weight * int(c-'0')
+		}
+		return sum%10 == 0
+	}
+	return false
+}
+
+// Normalize an identifier's value and detect its scheme using, in order,
+// the urn prefix, the declared scheme and the shape of the value itself.
+func newIdentifier(value, scheme string) Identifier {
+	value = strings.TrimSpace(value)
+	lower := strings.ToLower(value)
+	prefixes := map[string]string{
+		"urn:uuid:": UUID, "urn:isbn:": ISBN, "isbn:": ISBN,
+		"urn:asin:": ASIN, "asin:": ASIN, "urn:doi:": DOI, "doi:": DOI,
+	}
+	for prefix, s := range prefixes {
+		if strings.HasPrefix(lower, prefix) {
+			value = value[len(prefix):]
+			scheme = s
+			break
+		}
+	}
+
+	switch strings.ToLower(scheme) {
+	case "isbn", "15", "02": // ONIX codelist 5 codes for isbn 13 and 10
+		scheme = ISBN
+	case "uuid":
+		scheme = UUID
+	case "asin", "mobi-asin", "amazon":
+		scheme = ASIN
+	case "doi", "06":
+		scheme = DOI
+	}
+
+	digits := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(value))
+	switch {
+	case scheme == ISBN || (scheme != UUID && validISBN(digits)):
+		return Identifier{Value: digits, Scheme: ISBN}
+	case uuidRegex.MatchString(value):
+		return Identifier{Value: strings.ToLower(value), Scheme: UUID}
+	case asinRegex.MatchString(value) && (scheme == "" || scheme == ASIN):
+		return Identifier{Value: value, Scheme: ASIN}
+	case doiRegex.MatchString(value):
+		return Identifier{Value: value, Scheme: DOI}
+	}
+	return Identifier{Value: value, Scheme: scheme}
+}
+
+// Apply epub 3.0 <meta refines="#id"> refinements to the epub 2.0
+// attributes of the elements they refine.
+func applyRefinements(elements []Element, meta []Meta) []Element {
+	refined := make([]Element, len(elements))
+	copy(refined, elements)
+
+	for i := range refined {
+		if refined[i].Id == "" {
+			continue
+		}
+		for _, m := range meta {
+			if strings.TrimPrefix(m.Refines, "#") != refined[i].Id {
+				continue
+			}
+			value := strings.TrimSpace(m.Value)
+			switch m.Property {
+			case "role":
+				refined[i].Role = value
+			case "file-as":
+				refined[i].FileAs = value
+			case "identifier-type":
+				refined[i].Scheme = value
+			}
+		}
+	}
+	return refined
+}
+
+func newCreators(elements []Element) []Creator {
+	creators := []Creator{}
+	for _, e := range elements {
+		name := strings.TrimSpace(e.Value)
+		if name == "" {
+			continue
+		}
+		creators = append(creators, Creator{Name: name, FileAs: e.FileAs, Role: e.Role})
+	}
+	return creators
+}
+
+// Get the series the book belongs to from calibre's <meta name="calibre:series">
+// and epub 3.0's <meta property="belongs-to-collection">.
+func newSeries(meta []Meta) []Series {
+	series := []Series{}
+	calibre := Series{}
+
+	for _, m := range meta {
+		switch {
+		case m.Name == "calibre:series":
+			calibre.Name = strings.TrimSpace(m.Content)
+			calibre.Type = "series"
+		case m.Name == "calibre:series_index":
+			calibre.Index, _ = strconv.ParseFloat(strings.TrimSpace(m.Content), 64)
+		case m.Property == "belongs-to-collection" && m.Refines == "":
+			collection := Series{Name: strings.TrimSpace(m.Value)}
+			for _, r := range meta {
+				if m.Id == "" || strings.TrimPrefix(r.Refines, "#") != m.Id {
+					continue
+				}
+				value := strings.TrimSpace(r.Value)
+				switch r.Property {
+				case "collection-type":
+					collection.Type = value
+				case "group-position":
+					collection.Index, _ = strconv.ParseFloat(value, 64)
+				}
+			}
+			if collection.Name != "" {
+				series = append(series, collection)
+			}
+		}
+	}
+
+	// Calibre mirrors its series into a collection in epub 3.0 files
+	if calibre.Name != "" {
+		for _, s := range series {
+			if s.Name == calibre.Name {
+				return series
+			}
+		}
+		series = append(series, calibre)
+	}
+	return series
+}
+
+// Build the epub's metadata from the package's <metadata> node.
+func newMetadata(p PackageMetadata) Metadata {
+	m := Metadata{
+		Rights:      p.Rights,
+		Source:      p.Source,
+		Coverage:    p.Coverage,
+		Relation:    p.Relation,
+		Publisher:   p.Publisher,
+		Description: p.Description,
+		Languages:   []string{},
+		Identifiers: []Identifier{},
+		Subjects:    []string{},
+	}
+
+	if len(p.Titles) > 0 {
+		m.Title = strings.TrimSpace(p.Titles[0].Value)
+	}
+
+	m.Creators = newCreators(applyRefinements(p.Creators, p.Meta))
+	m.Contributors = newCreators(applyRefinements(p.Contributors, p.Meta))
+	for _, c := range m.Creators {
+		if c.Role == "aut" {
+			m.Author = c.Name
+			break
+		}
+	}
+	if m.Author == "" && len(m.Creators) > 0 {
+		m.Author = m.Creators[0].Name
+	}
+
+	for _, i := range applyRefinements(p.Identifiers, p.Meta) {
+		if strings.TrimSpace(i.Value) != "" {
+			m.Identifiers = append(m.Identifiers, newIdentifier(i.Value, i.Scheme))
+		}
+	}
+
+	for _, l := range p.Languages {
+		if language := strings.TrimSpace(l.Value); language != "" {
+			m.Languages = append(m.Languages, language)
+		}
+	}
+
+	for _, s := range p.Subjects {
+		if subject := strings.TrimSpace(s.Value); subject != "" {
+			m.Subjects = append(m.Subjects, subject)
+		}
+	}
+
+	for _, d := range p.Dates {
+		switch d.Event {
+		case "", "publication", "original-publication":
+			if m.Published == nil {
+				m.Published = parseDate(d.Value)
+			}
+		case "modification":
+			m.Modified = parseDate(d.Value)
+		}
+	}
+	for _, meta := range p.Meta {
+		if meta.Property == "dcterms:modified" {
+			m.Modified = parseDate(meta.Value)
+		}
+	}
+
+	m.Series = newSeries(p.Meta)
+
+	return m
+}
@@ -0,0 +1,85 @@
+package epub
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+func TestIdentifierSchemes(t *testing.T) {
+	tests := []struct {
+		value, scheme string
+		want          Identifier
+	}{
+		{"urn:uuid:7E87F9A1-8A4F-459A-8E58-E7032F0C67C6", "", Identifier{"7e87f9a1-8a4f-459a-8e58-e7032f0c67c6", UUID}},
+		{"978-0-441-17271-9", "", Identifier{"9780441172719", ISBN}},
+		{"urn:isbn:0441172717", "", Identifier{"0441172717", ISBN}},
+		{"0441172717", "ISBN", Identifier{"0441172717", ISBN}},
+		{"B00B7NPRY8", "", Identifier{"B00B7NPRY8", ASIN}},
+		{"B00B7NPRY8", "MOBI-ASIN", Identifier{"B00B7NPRY8", ASIN}},
+		{"10.1000/182", "", Identifier{"10.1000/182", DOI}},
+		{"1234", "calibre", Identifier{"1234", "calibre"}},
+	}
+
+	for _, test := range tests {
+		assertEq(t, newIdentifier(test.value, test.scheme), test.want)
+	}
+}
+
+func TestEpub3Refinements(t *testing.T) {
+	opf := `
+	<metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+	  <dc:title>Dune</dc:title>
+	  <dc:creator id="ill">John Schoenherr</dc:creator>
+	  <dc:creator id="author">Frank Herbert</dc:creator>
+	  <meta refines="#author" property="role" scheme="marc:relators">aut</meta>
+	  <meta refines="#author" property="file-as">Herbert, Frank</meta>
+	  <meta refines="#ill" property="role" scheme="marc:relators">ill</meta>
+	  <dc:identifier id="pub-id">9780441172719</dc:identifier>
+	  <meta refines="#pub-id" property="identifier-type" scheme="onix:codelist5">15</meta>
+	  <dc:language>en</dc:language>
+	  <dc:language>fr</dc:language>
+	  <dc:date>1965-08</dc:date>
+	  <meta property="dcterms:modified">2020-01-02T03:04:05Z</meta>
+	</metadata>`
+
+	var p PackageMetadata
+	if err := xml.Unmarshal([]byte(opf), &p); err != nil {
+		t.Fatal(err)
+	}
+	m := newMetadata(p)
+
+	assertEq(t, m.Title, "Dune")
+	assertEq(t, m.Author, "Frank Herbert")
+	assertEq(t, m.Creators, []Creator{
+		{Name: "John Schoenherr", Role: "ill"},
+		{Name: "Frank Herbert", FileAs: "Herbert, Frank", Role: "aut"},
+	})
+	assertEq(t, m.Identifiers, []Identifier{{Value: "9780441172719", Scheme: ISBN}})
+	assertEq(t, m.Languages, []string{"en", "fr"})
+	assertEq(t, *m.Published, time.Date(1965, 8, 1, 0, 0, 0, 0, time.UTC))
+	assertEq(t, *m.Modified, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+}
+
+func TestSeries(t *testing.T) {
+	calibre := []Meta{
+		{Name: "calibre:series", Content: "Dune Chronicles"},
+		{Name: "calibre:series_index", Content: "1.5"},
+	}
+	assertEq(t, newSeries(calibre), []Series{{Name: "Dune Chronicles", Index: 1.5, Type: "series"}})
+
+	// The index is meaningless without a series name
+	assertEq(t, newSeries(calibre[1:]), []Series{})
+
+	epub3 := []Meta{
+		{Id: "c01", Property: "belongs-to-collection", Value: "Dune Chronicles"},
+		{Refines: "#c01", Property: "collection-type", Value: "series"},
+		{Refines: "#c01", Property: "group-position", Value: "2"},
+		{Id: "c02", Property: "belongs-to-collection", Value: "Hugo Award Winners"},
+		{Refines: "#c02", Property: "collection-type", Value: "set"},
+	}
+	assertEq(t, newSeries(append(epub3, calibre...)), []Series{
+		{Name: "Dune Chronicles", Index: 2, Type: "series"},
+		{Name: "Hugo Award Winners", Type: "set"},
+	})
+}
@@ -0,0 +1,211 @@
+package epub
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Allow-list based sanitizer for the xhtml documents inside epub files.
+// Elements that aren't allowed are replaced by their children, unless
+// they're dropped, in which case their children are removed with them.
+type Sanitizer struct {
+	Elements      map[string]bool // Allowed elements
+	DropElements  map[string]bool // Elements removed along with their contents
+	Attributes    map[string]bool // Attributes allowed on every allowed element
+	URLAttributes map[string]bool // Attributes whose values are urls
+	URLSchemes    map[string]bool // Allowed schemes for absolute urls
+	DataURLTypes  []string        // Allowed media type prefixes for data urls
+}
+
+// The sanitizer applied to every document in the spine when an epub is processed.
+var SANITIZER = NewSanitizer()
+
+func toSet(values string) map[string]bool {
+	set := make(map[string]bool)
+	for _, v := range strings.Fields(values) {
+		set[v] = true
+	}
+	return set
+}
+
+// Create a sanitizer allowing the xhtml, svg and mathml
+// elements and attributes commonly found in ebooks.
+func NewSanitizer() *Sanitizer {
+	xhtml := `html head title style body a abbr address article aside audio b bdi bdo
+		big blockquote br caption center cite code col colgroup dd del details dfn div dl dt em
+		figcaption figure footer h1 h2 h3 h4 h5 h6 header hgroup hr i img ins kbd li main mark
+		nav ol p picture pre q rp rt ruby s samp section small source span strike strong sub
+		summary sup table tbody td tfoot th thead time tr track tt u ul var video wbr`
+	svg := `svg g defs desc symbol use image path rect circle ellipse line polyline polygon
+		text tspan textPath title linearGradient radialGradient stop clipPath mask pattern
+		marker filter feGaussianBlur feOffset feBlend feColorMatrix feFlood feComposite feMerge
+		feMergeNode switch`
+	mathml := `math mi mn mo ms mtext mrow msup msub msubsup mfrac msqrt mroot mtable mtr
+		mtd mlabeledtr mstyle mspace mpadded mphantom munder mover munderover menclose mfenced
+		merror semantics annotation`
+	attributes := `id class style title lang xml:lang dir epub:type role alt width height
+		align valign border cellpadding cellspacing colspan rowspan span start reversed type
+		value datetime cite href src srcset poster controls loop muted preload kind label
+		srclang default name xmlns xmlns:xlink xmlns:epub xlink:href xlink:title
+		viewBox preserveAspectRatio x y x1 y1 x2 y2 cx cy r rx ry d points transform fill
+		fill-opacity fill-rule stroke stroke-width stroke-opacity stroke-linecap stroke-linejoin
+		stroke-dasharray opacity offset stop-color stop-opacity gradientUnits gradientTransform
+		clip-path mask font-family font-size font-weight font-style text-anchor
+		dominant-baseline dx dy version baseProfile
+		mathvariant mathsize mathcolor mathbackground display displaystyle scriptlevel
+		fence separator separators stretchy symmetric largeop movablelimits accent
+		accentunder lspace rspace linethickness columnalign rowalign columnspan encoding
+		notation open close`
+
+	return &Sanitizer{
+		Elements: toSet(xhtml + " " + svg + " " + mathml),
+		DropElements: toSet(`script noscript iframe frame frameset object embed applet form
+			input button select textarea option base meta link template foreignObject
+			annotation-xml set animate animateMotion animateTransform`),
+		Attributes:    toSet(attributes),
+		URLAttributes: toSet("href src poster cite xlink:href srcset"),
+		URLSchemes:    toSet("http https mailto"),
+		DataURLTypes:  []string{"image/", "font/", "application/font", "application/x-font"},
+	}
+}
+
+// The attribute's key including its namespace prefix (ex. "xlink:href").
+func attributeKey(attr html.Attribute) string {
+	if attr.Namespace != "" {
+		return attr.Namespace + ":" + attr.Key
+	}
+	return attr.Key
+}
+
+// Check if a url only references resources inside the epub,
+// a website, or data of an allowed media type.
+func (s *Sanitizer) allowedURL(value string) bool {
+	value = strings.TrimSpace(value)
+	lower := strings.ToLower(value)
+	if strings.HasPrefix(lower, "data:") {
+		for _, mediaType := range s.DataURLTypes {
+			if strings.HasPrefix(lower[len("data:"):], mediaType) {
+				return !strings.HasPrefix(lower, "data:image/svg")
+			}
+		}
+		return false
+	}
+
+	// Browsers ignore control characters and whitespace in schemes (ex. "java\tscript:")
+	cleaned := strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, value)
+
+	link, err := url.Parse(cleaned)
+	if err != nil {
+		return false
+	}
+	return link.Scheme == "" || s.URLSchemes[strings.ToLower(link.Scheme)]
+}
+
+var (
+	cssURLRegex     = regexp.MustCompile(`(?i)url\(\s*(?:"([^"]*)"|'([^']*)'|([^)]*))\s*\)`)
+	cssImportRegex  = regexp.MustCompile(`(?i)@import\s+(?:url\()?\s*["']?([^"')\s;]*)["']?\s*\)?[^;]*;?`)
+	cssBadDeclRegex = regexp.MustCompile(`(?i)[^{};]*(expression\s*\(|-moz-binding|behavior\s*:|javascript:)[^{};]*;?`)
+)
+
+// Remove css that can run scripts or load resources from outside the epub.
+func (s *Sanitizer) SanitizeCSS(css string) string {
+	// Css is rendered as is inside <style>, so it must not be able to close it
+	css = strings.ReplaceAll(css, "</", "<\\/")
+	css = cssBadDeclRegex.ReplaceAllString(css, "")
+
+	css = cssImportRegex.ReplaceAllStringFunc(css, func(rule string) string {
+		link := cssImportRegex.FindStringSubmatch(rule)[1]
+		if u, err := url.Parse(link); err != nil || u.Scheme != "" || u.Host != "" {
+			return ""
+		}
+		return rule
+	})
+
+	return cssURLRegex.ReplaceAllStringFunc(css, func(value string) string {
+		match := cssURLRegex.FindStringSubmatch(value)
+		link := match[1] + match[2] + match[3]
+		u, err := url.Parse(strings.TrimSpace(link))
+		external := err != nil || u.Scheme != "" || u.Host != ""
+		if external && !(strings.HasPrefix(strings.ToLower(link), "data:") && s.allowedURL(link)) {
+			return "none"
+		}
+		return value
+	})
+}
+
+func (s *Sanitizer) sanitizeAttributes(node *html.Node) {
+	var attributes []html.Attribute
+	for _, attr := range node.Attr {
+		key := attributeKey(attr)
+		if strings.HasPrefix(strings.ToLower(attr.Key), "on") || !s.Attributes[key] {
+			continue
+		}
+
+		if key == "srcset" {
+			allowed := true
+			for _, candidate := range strings.Split(attr.Val, ",") {
+				fields := strings.Fields(candidate)
+				allowed = allowed && (len(fields) == 0 || s.allowedURL(fields[0]))
+			}
+			if !allowed {
+				continue
+			}
+		} else if s.URLAttributes[key] && !s.allowedURL(attr.Val) {
+			continue
+		}
+
+		if key == "style" {
+			attr.Val = s.SanitizeCSS(attr.Val)
+		}
+		attributes = append(attributes, attr)
+	}
+	node.Attr = attributes
+}
+
+// Sanitize a html document in place.
+func (s *Sanitizer) Sanitize(root *html.Node) {
+	for node := root.FirstChild; node != nil; {
+		next := node.NextSibling
+
+		switch node.Type {
+		case html.CommentNode:
+			root.RemoveChild(node)
+		case html.ElementNode:
+			if s.DropElements[node.Data] {
+				root.RemoveChild(node)
+				break
+			}
+
+			s.Sanitize(node)
+			if node.Data == "style" {
+				for child := node.FirstChild; child != nil; child = child.NextSibling {
+					child.Data = s.SanitizeCSS(child.Data)
+				}
+			}
+
+			if s.Elements[node.Data] {
+				s.sanitizeAttributes(node)
+				break
+			}
+
+			// Replace the element with its (already sanitized) children
+			for child := node.FirstChild; child != nil; {
+				nextChild := child.NextSibling
+				node.RemoveChild(child)
+				root.InsertBefore(child, node)
+				child = nextChild
+			}
+			root.RemoveChild(node)
+		}
+
+		node = next
+	}
+}
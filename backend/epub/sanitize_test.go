@@ -0,0 +1,62 @@
+package epub
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+func sanitizeString(t *testing.T, s *Sanitizer, body string) string {
+	document, err := html.Parse(strings.NewReader("<html><head></head><body>" + body + "</body></html>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Sanitize(document)
+
+	var output bytes.Buffer
+	if err := html.Render(&output, findNode(document, "body")); err != nil {
+		t.Fatal(err)
+	}
+	rendered := strings.TrimPrefix(output.String(), "<body>")
+	return strings.TrimSuffix(rendered, "</body>")
+}
+
+func TestSanitizer(t *testing.T) {
+	s := NewSanitizer()
+	tests := []struct{ input, want string }{
+		{`<p onclick="steal()">Hi<script>steal()</script></p>`, `<p>Hi</p>`},
+		{`<a href="javascript:steal()">x</a>`, `<a>x</a>`},
+		{`<a href=" JaVa&#x09;script:steal()">x</a>`, `<a>x</a>`},
+		{`<a href="chapter2.xhtml#note">x</a>`, `<a href="chapter2.xhtml#note">x</a>`},
+		{`<a href="https://example.com">x</a>`, `<a href="https://example.com">x</a>`},
+		{`<iframe src="https://evil.com"></iframe><form><input name="a"/></form>`, ``},
+		{`<blink><em>old</em></blink>`, `<em>old</em>`},
+		{`<img src="data:image/png;base64,AAAA" onerror="steal()"/>`, `<img src="data:image/png;base64,AAAA"/>`},
+		{`<img src="data:text/html;base64,AAAA"/>`, `<img/>`},
+		{`<img srcset="a.jpg 1x, javascript:b 2x"/>`, `<img/>`},
+		{`<p style="color: red; background: url(https://tracker.com/a.png)">x</p>`,
+			`<p style="color: red; background: none">x</p>`},
+		{`<p style="width: expression(steal())">x</p>`, `<p style="">x</p>`},
+		{`<!-- comment --><span>x</span>`, `<span>x</span>`},
+		{`<svg viewBox="0 0 10 10"><image xlink:href="cover.jpg"/><a xlink:href="javascript:steal()"><text>x</text></a></svg>`,
+			`<svg viewBox="0 0 10 10"><image xlink:href="cover.jpg"></image><a><text>x</text></a></svg>`},
+		{`<svg><set attributeName="href" to="javascript:steal()"/><foreignObject><p>x</p></foreignObject></svg>`, `<svg></svg>`},
+		{`<math><maction actiontype="statusline"><mi>x</mi></maction><annotation-xml encoding="SVG1.1"><svg></svg></annotation-xml></math>`,
+			`<math><mi>x</mi></math>`},
+	}
+
+	for _, test := range tests {
+		assertEq(t, sanitizeString(t, s, test.input), test.want)
+	}
+}
+
+func TestSanitizeCSS(t *testing.T) {
+	s := NewSanitizer()
+	assertEq(t, s.SanitizeCSS(`@font-face { src: url("../Fonts/a.ttf"); }`), `@font-face { src: url("../Fonts/a.ttf"); }`)
+	assertEq(t, s.SanitizeCSS(`@import url("https://evil.com/a.css");p { color: red }`), `p { color: red }`)
+	assertEq(t, s.SanitizeCSS(`@import "local.css";`), `@import "local.css";`)
+	assertEq(t, s.SanitizeCSS(`p { background: url('//evil.com/a.png') }`), `p { background: none }`)
+	assertEq(t, s.SanitizeCSS(`p { -moz-binding: url(a.xml#b); color: red; }`), `p { color: red; }`)
+}
@@ -2,12 +2,19 @@ package epub
 
 import (
 	"archive/zip"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/xml"
+	"errors"
+	"fmt"
 	"golang.org/x/net/html"
 	"io"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 func contains(a []string, b string) bool {
@@ -40,6 +47,20 @@ func setAttribute(node *html.Node, attr string, val string) {
 	}
 }
 
+// Add a class to a node's class attribute
+func addClass(node *html.Node, class string) {
+	for i := range node.Attr {
+		if node.Attr[i].Key == "class" {
+			classes := strings.Fields(node.Attr[i].Val)
+			if !contains(classes, class) {
+				node.Attr[i].Val = strings.Join(append(classes, class), " ")
+			}
+			return
+		}
+	}
+	node.Attr = append(node.Attr, html.Attribute{Key: "class", Val: class})
+}
+
 func findNode(root *html.Node, tagName string) *html.Node {
 	if root == nil {
 		return nil
@@ -73,7 +94,7 @@ func parseHTML(filename string) (*html.Node, error) {
 	return document, nil
 }
 
-func parseXML[T Container | NCX | Package](filename string) (T, error) {
+func parseXML[T Container | NCX | Package | Encryption](filename string) (T, error) {
 	var t T
 
 	file, err := os.ReadFile(filename)
@@ -101,19 +122,142 @@ func getFileBase(filename string) string {
 	return strings.Split(parts[i], ".")[0]
 }
 
-// Unzip filename into outdir
+// Clean the path of a file in a zip archive.
+// Returns false if the path is absolute or escapes the archive.
+func zipPath(name string) (string, bool) {
+	cleaned := path.Clean(name)
+	invalid := cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") ||
+		path.IsAbs(name) || strings.Contains(name, "\x00")
+	return cleaned, !invalid
+}
+
+// Limits on the files in an epub once uncompressed, so that
+// a small archive can't decompress into more than the server can hold.
+var (
+	MAX_FILE_SIZE uint64 = 256 << 20 // Largest file, in bytes
+	MAX_EPUB_SIZE uint64 = 1 << 30   // Largest total of every file, in bytes
+)
+
+// Check the uncompressed sizes of the files in a zip archive against
+// MAX_FILE_SIZE and MAX_EPUB_SIZE, before any of them are read.
+func checkSizes(files []*zip.File) error {
+	var total uint64
+	for _, file := range files {
+		if file.UncompressedSize64 > MAX_FILE_SIZE {
+			return fmt.Errorf("%q is %d bytes uncompressed, over the %d byte limit",
+				file.Name, file.UncompressedSize64, MAX_FILE_SIZE)
+		}
+		total += file.UncompressedSize64
+		if total > MAX_EPUB_SIZE {
+			return fmt.Errorf("The files are over %d bytes uncompressed", MAX_EPUB_SIZE)
+		}
+	}
+	return nil
+}
+
+// Open a file in a zip archive, reading no more than the uncompressed size it
+// claims, which checkSizes limits.
+func openFile(file *zip.File) (io.ReadCloser, error) {
+	reader, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	limited := io.LimitReader(reader, int64(file.UncompressedSize64))
+	return struct {
+		io.Reader
+		io.Closer
+	}{limited, reader}, nil
+}
+
+// Prefix of the directories epubs are extracted into before being moved into place.
+const PARTIAL_EXTRACTION_PREFIX = ".partial-"
+
+// Partial directories older than this are left behind by servers that were
+// killed, since no extraction takes as long.
+const PARTIAL_EXTRACTION_MAX_AGE = 24 * time.Hour
+
+// Tells apart the partial directories of servers sharing EXTRACT_DIRECTORY.
+var instanceId = func() string {
+	random := make([]byte, 8)
+	rand.Read(random)
+	return hex.EncodeToString(random)
+}()
+
+// Unzip an epub into outdir, replacing its contents. The epub is extracted
+// into a partial directory first, so outdir is never left half extracted.
+func extract(filename, outdir string) error {
+	pattern := PARTIAL_EXTRACTION_PREFIX + instanceId + "-" + filepath.Base(outdir) + "-*"
+	partial, err := os.MkdirTemp(filepath.Dir(outdir), pattern)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(partial, 0755); err != nil {
+		os.RemoveAll(partial)
+		return err
+	}
+
+	if err := unzip(filename, partial); err != nil {
+		os.RemoveAll(partial)
+		return err
+	}
+	if err := os.RemoveAll(outdir); err != nil {
+		os.RemoveAll(partial)
+		return err
+	}
+	return os.Rename(partial, outdir)
+}
+
+// Remove the partial directories left behind by extractions that never
+// finished, such as when the server was killed during an upload. Only this
+// server's directories and those older than PARTIAL_EXTRACTION_MAX_AGE are
+// removed, so servers sharing EXTRACT_DIRECTORY keep their extractions.
+func RemovePartialExtractions() error {
+	partials, err := filepath.Glob(filepath.Join(EXTRACT_DIRECTORY, PARTIAL_EXTRACTION_PREFIX+"*"))
+	if err != nil {
+		return err
+	}
+	own := PARTIAL_EXTRACTION_PREFIX + instanceId + "-"
+	for _, partial := range partials {
+		info, err := os.Stat(partial)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // Moved into place or removed by its server
+		} else if err != nil {
+			return err
+		}
+		stale := time.Since(info.ModTime()) > PARTIAL_EXTRACTION_MAX_AGE
+		if !stale && !strings.HasPrefix(filepath.Base(partial), own) {
+			continue
+		}
+		if err := os.RemoveAll(partial); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unzip filename into outdir. Files whose paths would escape outdir
+// (ex. "../../.bashrc") and archives over the size limits are rejected.
 func unzip(filename, outdir string) error {
 	archive, err := zip.OpenReader(filename)
 	if err != nil {
 		return err
 	}
 	defer archive.Close()
+	if err := checkSizes(archive.File); err != nil {
+		return err
+	}
 
 	for _, file := range archive.File {
-		filePath := filepath.Join(outdir, file.Name)
+		name, valid := zipPath(file.Name)
+		if !valid {
+			return fmt.Errorf("Invalid path in zip archive: %q", file.Name)
+		}
+		filePath := filepath.Join(outdir, filepath.FromSlash(name))
 
 		if file.FileInfo().IsDir() {
-			os.MkdirAll(filePath, os.ModePerm)
+			if err := os.MkdirAll(filePath, os.ModePerm); err != nil {
+				return err
+			}
 			continue
 		}
 
@@ -122,24 +266,28 @@ func unzip(filename, outdir string) error {
 			return err
 		}
 
-		dest, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, file.Mode())
-		if err != nil {
+		if err := extractFile(file, filePath); err != nil {
 			return err
 		}
+	}
 
-		extractedFile, err := file.Open()
-		if err != nil {
-			return err
-		}
+	return nil
+}
 
-		_, err = io.Copy(dest, extractedFile)
-		if err != nil {
-			return err
-		}
+// Write the contents of a file in a zip archive to path.
+func extractFile(file *zip.File, path string) error {
+	dest, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
 
-		dest.Close()
-		extractedFile.Close()
+	extractedFile, err := openFile(file)
+	if err != nil {
+		return err
 	}
+	defer extractedFile.Close()
 
-	return nil
+	_, err = io.Copy(dest, extractedFile)
+	return err
 }
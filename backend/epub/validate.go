@@ -0,0 +1,328 @@
+package epub
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Issue severities. Fatal issues prevent the epub from being read, errors
+// break the epub specification and warnings are likely mistakes.
+const (
+	FATAL   = "fatal"
+	ERROR   = "error"
+	WARNING = "warning"
+)
+
+// Returned when an epub has fatal issues. The epub's report describes them.
+var ErrInvalid = errors.New("Invalid epub file")
+
+type Issue struct {
+	Severity string
+	Code     string
+	File     string
+	Line     int `json:",omitempty"`
+	Message  string
+}
+
+type Report struct {
+	Issues []Issue
+}
+
+func (r *Report) add(severity, code, file string, line int, format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	r.Issues = append(r.Issues, Issue{severity, code, file, line, message})
+}
+
+// Get the first fatal issue, or nil if the epub can be read.
+func (r *Report) Fatal() *Issue {
+	for i := range r.Issues {
+		if r.Issues[i].Severity == FATAL {
+			return &r.Issues[i]
+		}
+	}
+	return nil
+}
+
+type validator struct {
+	report Report
+	files  map[string]*zip.File
+}
+
+// A link found in a document, to be checked once every document has been read.
+type documentLink struct {
+	file, target, fragment string
+	line                   int
+}
+
+func (v *validator) read(name string) ([]byte, error) {
+	file, exists := v.files[name]
+	if !exists {
+		return nil, errors.New("File not found")
+	}
+	reader, err := openFile(file)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// Line number of an xml syntax error, or 0 for any other error.
+func errorLine(err error) int {
+	var syntaxError *xml.SyntaxError
+	if errors.As(err, &syntaxError) {
+		return syntaxError.Line
+	}
+	return 0
+}
+
+// Validate an epub file without extracting it.
+func Validate(filename string) Report {
+	v := validator{report: Report{Issues: []Issue{}}, files: make(map[string]*zip.File)}
+
+	archive, err := zip.OpenReader(filename)
+	if err != nil {
+		v.report.add(FATAL, "ZIP_INVALID", "", 0, "Not a zip archive: %v", err)
+		return v.report
+	}
+	defer archive.Close()
+
+	for _, f := range archive.File {
+		if _, valid := zipPath(f.Name); !valid {
+			v.report.add(FATAL, "PATH_INVALID", f.Name, 0, "File path escapes the epub")
+		}
+		v.files[f.Name] = f
+	}
+	if err := checkSizes(archive.File); err != nil {
+		v.report.add(FATAL, "ZIP_TOO_LARGE", "", 0, "%v", err)
+		return v.report
+	}
+
+	v.checkMimetype(archive.File)
+	if opfPath := v.checkContainer(); opfPath != "" {
+		v.checkPackage(opfPath)
+	}
+	return v.report
+}
+
+func (v *validator) checkMimetype(files []*zip.File) {
+	mimetype, err := v.read("mimetype")
+	if err != nil {
+		v.report.add(ERROR, "MIMETYPE_MISSING", "mimetype", 0, "The mimetype file is missing")
+		return
+	}
+
+	if files[0].Name != "mimetype" {
+		v.report.add(ERROR, "MIMETYPE_NOT_FIRST", "mimetype", 0, "The mimetype file must be the first file in the archive")
+	}
+	if v.files["mimetype"].Method != zip.Store {
+		v.report.add(ERROR, "MIMETYPE_COMPRESSED", "mimetype", 0, "The mimetype file must not be compressed")
+	}
+	if string(mimetype) != "application/epub+zip" {
+		v.report.add(ERROR, "MIMETYPE_INVALID", "mimetype", 0,
+			"The mimetype file must contain exactly \"application/epub+zip\", found %q", mimetype)
+	}
+}
+
+// Check the container and return the path to the package document.
+func (v *validator) checkContainer() string {
+	const file = "META-INF/container.xml"
+	data, err := v.read(file)
+	if err != nil {
+		v.report.add(FATAL, "CONTAINER_MISSING", file, 0, "The container file is missing")
+		return ""
+	}
+
+	var c Container
+	if err := xml.Unmarshal(data, &c); err != nil {
+		v.report.add(FATAL, "CONTAINER_INVALID", file, errorLine(err), "Can't parse the container: %v", err)
+		return ""
+	}
+
+	rootfile := c.Rootfiles.Rootfile
+	if rootfile.FullPath == "" {
+		v.report.add(FATAL, "ROOTFILE_MISSING", file, 0, "The container doesn't reference a package document")
+		return ""
+	}
+	if rootfile.MediaType != "application/oebps-package+xml" {
+		v.report.add(ERROR, "ROOTFILE_MEDIA_TYPE", file, 0,
+			"The rootfile's media type must be \"application/oebps-package+xml\", found %q", rootfile.MediaType)
+	}
+	if _, exists := v.files[rootfile.FullPath]; !exists {
+		v.report.add(FATAL, "PACKAGE_MISSING", rootfile.FullPath, 0, "The package document is missing")
+		return ""
+	}
+	return rootfile.FullPath
+}
+
+func (v *validator) checkPackage(opfPath string) {
+	data, _ := v.read(opfPath)
+	var p Package
+	if err := xml.Unmarshal(data, &p); err != nil {
+		v.report.add(FATAL, "PACKAGE_INVALID", opfPath, errorLine(err), "Can't parse the package document: %v", err)
+		return
+	}
+
+	if p.Version == "" {
+		v.report.add(WARNING, "PACKAGE_VERSION_MISSING", opfPath, 0, "The package doesn't declare an epub version")
+	}
+	v.checkMetadata(opfPath, p)
+
+	items := make(map[string]Item)
+	manifest := make(map[string]bool)
+	for _, i := range p.Manifest.Items {
+		if _, exists := items[i.Id]; exists {
+			v.report.add(ERROR, "MANIFEST_DUPLICATE_ID", opfPath, 0, "The manifest id %q is used more than once", i.Id)
+		}
+		items[i.Id] = i
+
+		resolved := ResolvePath(opfPath, i.Path)
+		manifest[resolved] = true
+		if i.MediaType == "" {
+			v.report.add(WARNING, "MANIFEST_MEDIA_TYPE_MISSING", opfPath, 0, "The manifest item %q has no media type", i.Id)
+		}
+		if _, exists := v.files[resolved]; !exists && !isRemote(i.Path) {
+			v.report.add(ERROR, "RESOURCE_MISSING", opfPath, 0, "The manifest item %q references the missing file %q", i.Id, i.Path)
+		}
+	}
+
+	if len(p.Spine.ITemRefs) == 0 {
+		v.report.add(FATAL, "SPINE_EMPTY", opfPath, 0, "The spine has no items to read")
+	}
+	for _, ref := range p.Spine.ITemRefs {
+		if _, exists := items[ref.Ref]; !exists {
+			v.report.add(ERROR, "SPINE_UNKNOWN_ITEM", opfPath, 0, "The spine references the unknown manifest item %q", ref.Ref)
+		}
+	}
+	if toc, exists := items[p.Spine.TableOfContents]; p.Spine.TableOfContents != "" && !exists {
+		v.report.add(WARNING, "TOC_UNKNOWN_ITEM", opfPath, 0, "The spine's toc references the unknown manifest item %q", p.Spine.TableOfContents)
+	} else if exists {
+		v.checkNCX(ResolvePath(opfPath, toc.Path))
+	}
+
+	ids := make(map[string]map[string]bool)
+	var links []documentLink
+	for _, i := range p.Manifest.Items {
+		if i.MediaType == "application/xhtml+xml" || i.MediaType == "text/html" {
+			documentPath := ResolvePath(opfPath, i.Path)
+			if _, exists := v.files[documentPath]; exists {
+				documentIds, documentLinks := v.checkDocument(documentPath)
+				ids[documentPath] = documentIds
+				links = append(links, documentLinks...)
+			}
+		}
+	}
+	v.checkLinks(links, ids, manifest)
+}
+
+func (v *validator) checkMetadata(opfPath string, p Package) {
+	m := p.Metadata
+	if len(m.Titles) == 0 || strings.TrimSpace(m.Titles[0].Value) == "" {
+		v.report.add(ERROR, "METADATA_TITLE_MISSING", opfPath, 0, "The package has no dc:title")
+	}
+	if len(m.Languages) == 0 {
+		v.report.add(ERROR, "METADATA_LANGUAGE_MISSING", opfPath, 0, "The package has no dc:language")
+	}
+	if len(m.Identifiers) == 0 {
+		v.report.add(ERROR, "METADATA_IDENTIFIER_MISSING", opfPath, 0, "The package has no dc:identifier")
+		return
+	}
+
+	for _, i := range m.Identifiers {
+		if i.Id == p.UniqueIdentifier {
+			return
+		}
+	}
+	v.report.add(ERROR, "UNIQUE_IDENTIFIER_INVALID", opfPath, 0,
+		"The package's unique-identifier %q doesn't reference a dc:identifier", p.UniqueIdentifier)
+}
+
+func (v *validator) checkNCX(ncxPath string) {
+	data, err := v.read(ncxPath)
+	if err != nil {
+		return // Already reported as a missing resource
+	}
+
+	var ncx NCX
+	if err := xml.Unmarshal(data, &ncx); err != nil {
+		v.report.add(ERROR, "NCX_INVALID", ncxPath, errorLine(err), "Can't parse the table of contents: %v", err)
+	}
+}
+
+func isRemote(href string) bool {
+	link, err := url.Parse(strings.TrimSpace(href))
+	return err == nil && (link.Scheme != "" || link.Host != "")
+}
+
+// Check that a document is well formed xhtml. Return the ids of its
+// elements and the links to other resources that it contains.
+func (v *validator) checkDocument(documentPath string) (map[string]bool, []documentLink) {
+	data, _ := v.read(documentPath)
+	ids := make(map[string]bool)
+	var links []documentLink
+
+	decoder := xml.NewDecoder(strings.NewReader(string(data)))
+	decoder.Entity = xml.HTMLEntity // Accept named entities such as &nbsp;
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			v.report.add(ERROR, "XHTML_INVALID", documentPath, errorLine(err), "The document isn't well formed: %v", err)
+			break
+		}
+
+		element, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		line, _ := decoder.InputPos()
+
+		for _, attr := range element.Attr {
+			if attr.Name.Local == "id" {
+				ids[attr.Value] = true
+			}
+
+			isLink := attr.Name.Local == "href" || (attr.Name.Local == "src" && element.Name.Local != "script")
+			if !isLink || attr.Value == "" || isRemote(attr.Value) {
+				continue
+			}
+
+			target := documentPath
+			if !strings.HasPrefix(attr.Value, "#") {
+				target = ResolvePath(documentPath, attr.Value)
+			}
+			fragment := ""
+			if link, err := url.Parse(attr.Value); err == nil {
+				fragment = link.Fragment
+			}
+			links = append(links, documentLink{documentPath, target, fragment, line})
+		}
+	}
+
+	return ids, links
+}
+
+func (v *validator) checkLinks(links []documentLink, ids map[string]map[string]bool, manifest map[string]bool) {
+	for _, l := range links {
+		if _, exists := v.files[l.target]; l.target == "" || !exists {
+			v.report.add(ERROR, "BROKEN_LINK", l.file, l.line, "Link to the missing file %q", l.target)
+			continue
+		}
+		if !manifest[l.target] {
+			v.report.add(WARNING, "RESOURCE_NOT_IN_MANIFEST", l.file, l.line, "%q isn't listed in the manifest", l.target)
+		}
+
+		documentIds, isDocument := ids[l.target]
+		if l.fragment != "" && isDocument && !documentIds[l.fragment] {
+			v.report.add(WARNING, "BROKEN_FRAGMENT", l.file, l.line,
+				"Link to the missing element %q in %q", l.fragment, path.Base(l.target))
+		}
+	}
+}
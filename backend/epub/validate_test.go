@@ -0,0 +1,164 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// The codes of the issues in a report, sorted.
+func issueCodes(r Report) []string {
+	codes := []string{}
+	for _, i := range r.Issues {
+		codes = append(codes, i.Code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+func TestValidDuneReport(t *testing.T) {
+	t.Parallel()
+	assertEq(t, issueCodes(Validate("../../test_files/Dune.epub")), []string{})
+}
+
+func TestValidation(t *testing.T) {
+	t.Parallel()
+	chapter := `<item id="chapter" href="Text/chapter.xhtml" media-type="application/xhtml+xml"/>`
+	chapterRef := `<itemref idref="chapter"/>`
+	language := `<dc:language>en</dc:language>`
+
+	tests := []struct {
+		name  string
+		files map[string]string
+		codes []string
+		fatal bool
+	}{
+		{
+			name: "Valid",
+			files: map[string]string{
+				"OEBPS/content.opf": testPackage("3.0", language,
+					chapter+`<item id="img" href="Images/a.png" media-type="image/png"/>`, chapterRef, ""),
+				"OEBPS/Text/chapter.xhtml": testDocument(`<p id="top"><img src="../Images/a.png"/><a href="#top">Top</a></p>`),
+				"OEBPS/Images/a.png":       "png",
+			},
+			codes: []string{},
+		},
+		{
+			name: "BrokenLinks",
+			files: map[string]string{
+				"OEBPS/content.opf": testPackage("3.0", language, chapter, chapterRef, ""),
+				"OEBPS/Text/chapter.xhtml": testDocument(`<p>&nbsp;<img src="../Images/missing.png"/>
+					<a href="#nowhere">x</a><a href="https://example.com">y</a><a href="extra.xhtml">z</a></p>`),
+				"OEBPS/Text/extra.xhtml": testDocument(""),
+			},
+			codes: []string{"BROKEN_FRAGMENT", "BROKEN_LINK", "RESOURCE_NOT_IN_MANIFEST"},
+		},
+		{
+			name: "BadMetadataAndManifest",
+			files: map[string]string{
+				"mimetype": "application/zip",
+				"OEBPS/content.opf": `<package xmlns="http://www.idpf.org/2007/opf" unique-identifier="nope">
+					<metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:identifier id="id">x</dc:identifier></metadata>
+					<manifest>` + chapter + `<item id="chapter" href="gone.xhtml"/></manifest>
+					<spine toc="ncx">` + chapterRef + `<itemref idref="ghost"/></spine></package>`,
+				"OEBPS/Text/chapter.xhtml": testDocument(`<p>Unclosed<br></p>`),
+			},
+			codes: []string{
+				"MANIFEST_DUPLICATE_ID", "MANIFEST_MEDIA_TYPE_MISSING", "METADATA_LANGUAGE_MISSING",
+				"METADATA_TITLE_MISSING", "MIMETYPE_INVALID", "PACKAGE_VERSION_MISSING",
+				"RESOURCE_MISSING", "SPINE_UNKNOWN_ITEM", "TOC_UNKNOWN_ITEM", "UNIQUE_IDENTIFIER_INVALID",
+				"XHTML_INVALID",
+			},
+		},
+		{
+			name: "MissingContainer",
+			files: map[string]string{
+				"META-INF/container.xml": "<container><rootfiles>",
+			},
+			codes: []string{"CONTAINER_INVALID"},
+			fatal: true,
+		},
+		{
+			name: "EmptySpine",
+			files: map[string]string{
+				"OEBPS/content.opf": testPackage("3.0", language, "", "", ""),
+			},
+			codes: []string{"SPINE_EMPTY"},
+			fatal: true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			filename := createEpub(t, t.TempDir(), test.name, test.files)
+			e, err := New(filename)
+			assertEq(t, issueCodes(e.Report), test.codes)
+			assertEq(t, errors.Is(err, ErrInvalid), test.fatal)
+			if !test.fatal && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestIssueLines(t *testing.T) {
+	t.Parallel()
+	filename := createEpub(t, t.TempDir(), "Lines", map[string]string{
+		"OEBPS/content.opf": testPackage("3.0", `<dc:language>en</dc:language>`,
+			`<item id="chapter" href="chapter.xhtml" media-type="application/xhtml+xml"/>`,
+			`<itemref idref="chapter"/>`, ""),
+		"OEBPS/chapter.xhtml": "<html>\n<body>\n<p>\n<img src='a.png'/>\n</p>\n</body>\n</html>",
+	})
+
+	assertEq(t, Validate(filename).Issues, []Issue{{
+		Severity: ERROR, Code: "BROKEN_LINK", File: "OEBPS/chapter.xhtml", Line: 4,
+		Message: `Link to the missing file "OEBPS/a.png"`,
+	}})
+}
+
+// Not parallel, since the size limits would apply to epubs parsed in other tests.
+func TestSizeLimits(t *testing.T) {
+	defer func(file, total uint64) { MAX_FILE_SIZE, MAX_EPUB_SIZE = file, total }(MAX_FILE_SIZE, MAX_EPUB_SIZE)
+	MAX_FILE_SIZE, MAX_EPUB_SIZE = 1024, 4096
+	dir := t.TempDir()
+
+	large := createEpub(t, dir, "Large", map[string]string{"OEBPS/large.txt": strings.Repeat("a", 2048)})
+	assertEq(t, issueCodes(Validate(large)), []string{"ZIP_TOO_LARGE"})
+	_, err := New(large)
+	assertEq(t, errors.Is(err, ErrInvalid), true)
+	if err := unzip(large, filepath.Join(dir, "large")); err == nil {
+		t.Error("Extracted a file over MAX_FILE_SIZE")
+	}
+
+	files := map[string]string{}
+	for i := 0; i < 5; i++ {
+		files[fmt.Sprintf("OEBPS/%d.txt", i)] = strings.Repeat("a", 1000)
+	}
+	many := createEpub(t, dir, "Many", files)
+	assertEq(t, issueCodes(Validate(many)), []string{"ZIP_TOO_LARGE"})
+	if err := unzip(many, filepath.Join(dir, "many")); err == nil {
+		t.Error("Extracted files over MAX_EPUB_SIZE")
+	}
+
+	// Files are never read past the size they claim
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+	data := strings.Repeat("a", 2048)
+	header := &zip.FileHeader{Name: "lying.txt", Method: zip.Store,
+		CRC32: crc32.ChecksumIEEE([]byte(data)), CompressedSize64: 2048, UncompressedSize64: 4}
+	w, _ := archive.CreateRaw(header)
+	w.Write([]byte(data))
+	archive.Close()
+	reader, _ := zip.NewReader(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+	v := validator{files: map[string]*zip.File{"lying.txt": reader.File[0]}}
+	read, _ := v.read("lying.txt")
+	assertEq(t, len(read) <= 4, true)
+}
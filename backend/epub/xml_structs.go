@@ -35,21 +35,22 @@ content.opf structure:
 	<package version="" xmlns="" unique-identifier="">
 	  <metadata xmlns:dc="" xmlns:opf="">
 	    <meta name="" content="" />
+	    <meta refines="" property="" scheme="" id=""></meta>
 	    <dc:title></dc:title>
-	    <dc:creator></dc:creator>
+	    <dc:creator id="" opf:role="" opf:file-as=""></dc:creator>
 	    <dc:subject></dc:subject>
 	    <dc:description></dc:description>
 	    <dc:publisher></dc:publisher>
-	    <dc:date></dc:date>
+	    <dc:date opf:event=""></dc:date>
 	    <dc:source></dc:source>
 	    <dc:relation></dc:relation>
 	    <dc:coverage></dc:coverage>
 	    <dc:contributor></dc:contributor>
 	    <dc:rights></dc:rights> <dc:language></dc:language>
-	    <dc:identifier id=""></dc:identifier>
+	    <dc:identifier id="" opf:scheme=""></dc:identifier>
 	  </metadata>
 	  <manifest>
-	    <item id="" href="" media-type="" />
+	    <item id="" href="" media-type="" properties="" />
 	    ...
 	  </manifest>
 	  <spine toc="">
@@ -63,34 +64,51 @@ content.opf structure:
 	</package>
 */
 type Meta struct {
-	XMLName xml.Name `xml:"meta"`
-	Name    string   `xml:"name,attr"`
-	Content string   `xml:"content,attr"`
-}
-
-type Metadata struct {
-	XMLName     xml.Name `xml:"metadata" json:"-"`
-	Language    string   `xml:"language"`
-	Author      string   `xml:"creator"`
-	Title       string   `xml:"title"`
-	Identifier  string   `xml:"identifier"`
-	Contributor string   `xml:"contributor"`
-	Rights      string   `xml:"rights"`
-	Source      string   `xml:"source"`
-	Coverage    string   `xml:"coverage"`
-	Relation    string   `xml:"relation"`
-	Publisher   string   `xml:"publisher"`
-	Description string   `xml:"description"`
-	Date        string   `xml:"date"`
-	Subjects    []string `xml:"subject"`
-	Meta        []Meta   `xml:"meta" json:"-"`
+	XMLName  xml.Name `xml:"meta"`
+	Name     string   `xml:"name,attr"`
+	Content  string   `xml:"content,attr"`
+	Id       string   `xml:"id,attr"`
+	Property string   `xml:"property,attr"`
+	Refines  string   `xml:"refines,attr"`
+	Scheme   string   `xml:"scheme,attr"`
+	Value    string   `xml:",chardata"`
+}
+
+// A dublin core element (ex. <dc:creator>). Epub 2.0 packages refine
+// the element using opf attributes, epub 3.0 packages use <meta refines="">.
+type Element struct {
+	Id     string `xml:"id,attr"`
+	Role   string `xml:"role,attr"`
+	FileAs string `xml:"file-as,attr"`
+	Scheme string `xml:"scheme,attr"`
+	Event  string `xml:"event,attr"`
+	Value  string `xml:",chardata"`
+}
+
+type PackageMetadata struct {
+	XMLName      xml.Name  `xml:"metadata"`
+	Titles       []Element `xml:"title"`
+	Creators     []Element `xml:"creator"`
+	Contributors []Element `xml:"contributor"`
+	Identifiers  []Element `xml:"identifier"`
+	Languages    []Element `xml:"language"`
+	Dates        []Element `xml:"date"`
+	Subjects     []Element `xml:"subject"`
+	Rights       string    `xml:"rights"`
+	Source       string    `xml:"source"`
+	Coverage     string    `xml:"coverage"`
+	Relation     string    `xml:"relation"`
+	Publisher    string    `xml:"publisher"`
+	Description  string    `xml:"description"`
+	Meta         []Meta    `xml:"meta"`
 }
 
 type Item struct {
-	XMLName   xml.Name `xml:"item"`
-	Path      string   `xml:"href,attr"`
-	Id        string   `xml:"id,attr"`
-	MediaType string   `xml:"media-type,attr"`
+	XMLName    xml.Name `xml:"item"`
+	Path       string   `xml:"href,attr"`
+	Id         string   `xml:"id,attr"`
+	MediaType  string   `xml:"media-type,attr"`
+	Properties string   `xml:"properties,attr"`
 }
 
 type Manifest struct {
@@ -122,11 +140,13 @@ type Guide struct {
 }
 
 type Package struct {
-	XMLName  xml.Name `xml:"package"`
-	Metadata Metadata `xml:"metadata"`
-	Manifest Manifest `xml:"manifest"`
-	Spine    Spine    `xml:"spine"`
-	Guide    Guide    `xml:"guide"`
+	XMLName          xml.Name        `xml:"package"`
+	Version          string          `xml:"version,attr"`
+	UniqueIdentifier string          `xml:"unique-identifier,attr"`
+	Metadata         PackageMetadata `xml:"metadata"`
+	Manifest         Manifest        `xml:"manifest"`
+	Spine            Spine           `xml:"spine"`
+	Guide            Guide           `xml:"guide"`
 }
 
 /*
@@ -189,3 +209,35 @@ type NCX struct {
 	Title DocTitle `xml:"docTitle"`
 	Map   NavMap   `xml:"navMap"`
 }
+
+/*
+encryption.xml structure:
+
+	<encryption xmlns="" xmlns:enc="">
+	  <enc:EncryptedData>
+	    <enc:EncryptionMethod Algorithm="" />
+	    <enc:CipherData>
+	      <enc:CipherReference URI="" />
+	    </enc:CipherData>
+	  </enc:EncryptedData>
+	  ...
+	</encryption>
+*/
+
+type EncryptionMethod struct {
+	Algorithm string `xml:"Algorithm,attr"`
+}
+
+type CipherReference struct {
+	URI string `xml:"URI,attr"`
+}
+
+type EncryptedData struct {
+	Method    EncryptionMethod `xml:"EncryptionMethod"`
+	Reference CipherReference  `xml:"CipherData>CipherReference"`
+}
+
+type Encryption struct {
+	XMLName xml.Name        `xml:"encryption"`
+	Data    []EncryptedData `xml:"EncryptedData"`
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// An error sent to clients as {"code": "", "message": "", "details": {}, "requestId": ""}.
+// Codes are stable and meant to be checked by programs, while messages are
+// meant for people and can change. The frontend mirrors the codes in ErrorCode.
+type APIError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// Wrap the error that caused the api error, which is logged but never sent
+// to the client. errors.As and errors.Is still find the api error.
+func (e *APIError) Wrap(cause error) error {
+	if cause == nil {
+		return e
+	}
+	return fmt.Errorf("%w: %w", e, cause)
+}
+
+var (
+	ErrBadRequest         = &APIError{http.StatusBadRequest, "BAD_REQUEST", "Bad client request."}
+	ErrInvalidToken       = &APIError{http.StatusBadRequest, "INVALID_TOKEN", "This link is invalid or has expired. Please ask for a new one."}
+	ErrUnauthenticated    = &APIError{http.StatusUnauthorized, "UNAUTHENTICATED", "Log in to continue."}
+	ErrInvalidCredentials = &APIError{http.StatusUnauthorized, "INVALID_CREDENTIALS", "Account not found. Forgot your password?"}
+	ErrExternalLogin      = &APIError{http.StatusUnauthorized, "EXTERNAL_LOGIN_FAILED", "Logging in with your provider failed. Please try again."}
+	ErrForbidden          = &APIError{http.StatusForbidden, "FORBIDDEN", "You don't have access to this."}
+	ErrEmailUnverified    = &APIError{http.StatusForbidden, "EMAIL_UNVERIFIED", "Confirm your email with the link we sent you to continue."}
+	ErrInsufficientScope  = &APIError{http.StatusForbidden, "INSUFFICIENT_SCOPE", "This api token doesn't allow this."}
+	ErrRouteNotFound      = &APIError{http.StatusNotFound, "ROUTE_NOT_FOUND", "Page not found."}
+	ErrBookNotFound       = &APIError{http.StatusNotFound, "BOOK_NOT_FOUND", "Book not found."}
+	ErrUserBookNotFound   = &APIError{http.StatusNotFound, "USER_BOOK_NOT_FOUND", "Book is not in the user's collection."}
+	ErrSeriesNotFound     = &APIError{http.StatusNotFound, "SERIES_NOT_FOUND", "Series not found."}
+	ErrApiTokenNotFound   = &APIError{http.StatusNotFound, "API_TOKEN_NOT_FOUND", "Api token not found."}
+	ErrShareNotFound      = &APIError{http.StatusNotFound, "SHARE_NOT_FOUND", "Share not found."}
+	ErrMethodNotAllowed   = &APIError{http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed."}
+	ErrDuplicateAccount   = &APIError{http.StatusConflict, "DUPLICATE_ACCOUNT", "Account already exists. Create a new one with a different email."}
+
+	ErrUploadTooLarge  = &APIError{http.StatusRequestEntityTooLarge, "UPLOAD_TOO_LARGE", "File is larger than the 100 megabyte limit."}
+	ErrUnsupportedFile = &APIError{http.StatusUnsupportedMediaType, "UNSUPPORTED_FILE", "Only epub files can be uploaded."}
+	ErrInvalidEpub     = &APIError{http.StatusUnprocessableEntity, "INVALID_EPUB", "Book is not a valid epub file."}
+	ErrDrmProtected    = &APIError{http.StatusUnprocessableEntity, "DRM_PROTECTED", "Book is protected by DRM and can't be read."}
+	ErrRateLimited     = &APIError{http.StatusTooManyRequests, "RATE_LIMITED", "Too many requests. Please try again later."}
+	ErrInternal        = &APIError{http.StatusInternalServerError, "INTERNAL_ERROR", "Internal server error. Please try again."}
+)
+
+// Add json containing the error to the http response and set its status code.
+// Errors that aren't api errors are sent as ErrInternal.
+// The full error is logged, but only the api error is sent to the client.
+func respondWithError(w http.ResponseWriter, r *http.Request, err error) {
+	respondWithErrorDetails(w, r, err, nil)
+}
+
+// Respond with an error along with details describing the error.
+func respondWithErrorDetails(w http.ResponseWriter, r *http.Request, err error, details any) {
+	recordError(r, err)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		apiErr = ErrInternal
+	}
+
+	response := ErrorResponse{
+		Code:      apiErr.Code,
+		Message:   apiErr.Message,
+		Details:   details,
+		RequestId: getRequestId(r),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.Status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Respond with an api error, for handlers that are registered with the router.
+func errorHandler(err *APIError) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respondWithError(w, r, err)
+	})
+}
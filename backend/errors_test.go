@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Codes are checked by the frontend, so they can't change.
+func TestErrorCodes(t *testing.T) {
+	codes := map[*APIError]string{
+		ErrBadRequest:         "BAD_REQUEST",
+		ErrEmailUnverified:    "EMAIL_UNVERIFIED",
+		ErrInvalidToken:       "INVALID_TOKEN",
+		ErrUnauthenticated:    "UNAUTHENTICATED",
+		ErrInvalidCredentials: "INVALID_CREDENTIALS",
+		ErrExternalLogin:      "EXTERNAL_LOGIN_FAILED",
+		ErrForbidden:          "FORBIDDEN",
+		ErrRouteNotFound:      "ROUTE_NOT_FOUND",
+		ErrBookNotFound:       "BOOK_NOT_FOUND",
+		ErrUserBookNotFound:   "USER_BOOK_NOT_FOUND",
+		ErrSeriesNotFound:     "SERIES_NOT_FOUND",
+		ErrApiTokenNotFound:   "API_TOKEN_NOT_FOUND",
+		ErrShareNotFound:      "SHARE_NOT_FOUND",
+		ErrInsufficientScope:  "INSUFFICIENT_SCOPE",
+		ErrMethodNotAllowed:   "METHOD_NOT_ALLOWED",
+		ErrDuplicateAccount:   "DUPLICATE_ACCOUNT",
+		ErrUploadTooLarge:     "UPLOAD_TOO_LARGE",
+		ErrUnsupportedFile:    "UNSUPPORTED_FILE",
+		ErrInvalidEpub:        "INVALID_EPUB",
+		ErrDrmProtected:       "DRM_PROTECTED",
+		ErrRateLimited:        "RATE_LIMITED",
+		ErrInternal:           "INTERNAL_ERROR",
+	}
+	for err, code := range codes {
+		assertEq(t, err.Code, code)
+	}
+}
+
+func TestRespondWithError(t *testing.T) {
+	// Causes are never sent to the client
+	cause := errors.New("connection refused by 10.0.0.1")
+	for _, test := range []struct {
+		err      error
+		expected *APIError
+	}{
+		{cause, ErrInternal},
+		{ErrBookNotFound.Wrap(cause), ErrBookNotFound},
+		{ErrBookNotFound.Wrap(nil), ErrBookNotFound},
+	} {
+		w := httptest.NewRecorder()
+		respondWithError(w, httptest.NewRequest("GET", "/", nil), test.err)
+		assertEq(t, w.Code, test.expected.Status)
+		assertEq(t, w.Header().Get("Content-Type"), "application/json")
+		response := decode[map[string]any](t, w)
+		assertEq(t, response, map[string]any{
+			"code":      test.expected.Code,
+			"message":   test.expected.Message,
+			"details":   nil,
+			"requestId": "",
+		})
+		if strings.Contains(w.Body.String(), "10.0.0.1") {
+			t.Errorf("Cause was sent to the client: %s", w.Body.String())
+		}
+	}
+
+	assertEq(t, errors.Is(ErrBookNotFound.Wrap(cause), ErrBookNotFound), true)
+	assertEq(t, errors.Is(ErrBookNotFound.Wrap(cause), cause), true)
+}
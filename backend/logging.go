@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const REQUEST_ID_HEADER = "X-Request-Id"
+
+// Create a logger writing to w in the format, either "text" (the default) or "json".
+// The level is one of "debug", "info" (the default), "warn" or "error".
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var logLevel slog.Level
+	if level != "" {
+		if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+			return nil, err
+		}
+	}
+	options := &slog.HandlerOptions{Level: logLevel}
+
+	switch format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	}
+	return nil, fmt.Errorf("Unknown log format %q", format)
+}
+
+// Information about a request that's filled in while it's handled.
+type requestLog struct {
+	id     string
+	userId int   // The user making the request, once they're authenticated
+	err    error // The error behind the error response, if there was one
+}
+
+type requestLogKey struct{}
+
+func getRequestLog(r *http.Request) *requestLog {
+	entry, _ := r.Context().Value(requestLogKey{}).(*requestLog)
+	return entry
+}
+
+// Get the id assigned to the request by the logging middleware.
+func getRequestId(r *http.Request) string {
+	if entry := getRequestLog(r); entry != nil {
+		return entry.id
+	}
+	return ""
+}
+
+// Record the error that caused the request to fail, so that it's logged.
+func recordError(r *http.Request, err error) {
+	if entry := getRequestLog(r); entry != nil && err != nil {
+		entry.err = err
+	}
+}
+
+// Record the user making the request, so that it's logged. Middleware
+// further in can't change the request logRequests holds, so they set it here.
+func recordUser(r *http.Request, userId int) {
+	if entry := getRequestLog(r); entry != nil {
+		entry.userId = userId
+	}
+}
+
+// Use the request id set by a proxy in front of the server, or generate a new one.
+func newRequestId(r *http.Request) string {
+	id := r.Header.Get(REQUEST_ID_HEADER)
+	valid := len(id) > 0 && len(id) <= 64
+	for _, c := range id {
+		if !strings.ContainsRune("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ-_.", c) {
+			valid = false
+		}
+	}
+	if valid {
+		return id
+	}
+
+	bytes := make([]byte, 8)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+// Response writer remembering the status code that was sent.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Middleware assigning every request an id, which is sent back in the
+// X-Request-Id header, and logging the request once it's been handled.
+// Failed requests are logged along with the error that caused them.
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &requestLog{id: newRequestId(r)}
+		r = r.WithContext(context.WithValue(r.Context(), requestLogKey{}, entry))
+		w.Header().Set(REQUEST_ID_HEADER, entry.id)
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		attributes := []any{
+			slog.String("requestId", entry.id),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", recorder.status),
+			slog.Duration("latency", time.Since(start)),
+		}
+		if entry.userId != 0 {
+			attributes = append(attributes, slog.Int("user", entry.userId))
+		}
+
+		level := slog.LevelInfo
+		if entry.err != nil {
+			attributes = append(attributes, slog.String("error", entry.err.Error()))
+			level = slog.LevelWarn
+		}
+		if recorder.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		s.logger.Log(r.Context(), level, "Request", attributes...)
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestRequestLogging(t *testing.T) {
+	var output bytes.Buffer
+	logger, err := newLogger(&output, "json", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t)
+	s.logger = logger
+	s.handler = s.Handler()
+	userId, _ := s.store.CreateUser(ctx, "reader@example.com", "hash")
+
+	// The cause of an error is logged, but not sent to the client
+	w := s.request("GET", "/api/v1/me/books/1", nil, userId)
+	assertError(t, w, ErrUserBookNotFound)
+	var entry map[string]any
+	if err := json.Unmarshal(output.Bytes(), &entry); err != nil {
+		t.Fatalf("%v: %s", err, output.String())
+	}
+	requestId := w.Header().Get(REQUEST_ID_HEADER)
+	assertEq(t, len(requestId), 16)
+	assertEq(t, entry["level"], "WARN")
+	assertEq(t, entry["requestId"], requestId)
+	assertEq(t, entry["method"], "GET")
+	assertEq(t, entry["path"], "/api/v1/me/books/1")
+	assertEq(t, entry["status"], float64(http.StatusNotFound))
+	assertEq(t, entry["user"], float64(userId))
+	assertEq(t, entry["error"], ErrUserBookNotFound.Message+": "+ErrNotFound.Error())
+	if _, exists := entry["latency"]; !exists {
+		t.Error("Latency wasn't logged")
+	}
+
+	// As is the user of requests authenticated with api tokens, even those the token can't make
+	token := s.createToken(t, userId, `{"Name": "Sync", "Scopes": ["library:read"]}`).Token
+	for url, status := range map[string]int{"/api/v1/series": http.StatusOK, "/api/v1/me/shares": http.StatusForbidden} {
+		output.Reset()
+		w = s.requestWithToken("GET", url, nil, token)
+		assertEq(t, w.Code, status)
+		entry = map[string]any{}
+		if err := json.Unmarshal(output.Bytes(), &entry); err != nil {
+			t.Fatalf("%v: %s", err, output.String())
+		}
+		assertEq(t, entry["user"], float64(userId))
+	}
+
+	// Request ids set by proxies are kept, unless they're invalid
+	for id, kept := range map[string]bool{"proxy-id.1": true, "has spaces": false, "": false} {
+		output.Reset()
+		r := httptest.NewRequest("GET", "/missing", nil)
+		r.Header.Set(REQUEST_ID_HEADER, id)
+		w := httptest.NewRecorder()
+		s.handler.ServeHTTP(w, r)
+		assertEq(t, w.Code, http.StatusNotFound)
+		assertEq(t, w.Header().Get(REQUEST_ID_HEADER) == id, kept)
+		if !bytes.Contains(output.Bytes(), []byte(strconv.Quote(w.Header().Get(REQUEST_ID_HEADER)))) {
+			t.Errorf("Request %q wasn't logged: %s", id, output.String())
+		}
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	var output bytes.Buffer
+	logger, err := newLogger(&output, "text", "warn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("Hidden")
+	logger.Warn("Shown")
+	assertEq(t, output.String() != "" && !bytes.Contains(output.Bytes(), []byte("Hidden")), true)
+
+	_, err = newLogger(&output, "xml", "")
+	assertEq(t, err != nil, true)
+	_, err = newLogger(&output, "json", "loud")
+	assertEq(t, err != nil, true)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aabiji/page/backend/oidc"
+	"github.com/gorilla/mux"
+)
+
+// Origin the server is reached at, which OpenID Connect providers redirect back to.
+var BACKEND_ORIGIN = "http://localhost:8080"
+
+// How long users have to log in at a provider.
+const LOGIN_LIFETIME = 10 * time.Minute
+
+// Cookie holding the login in progress, see loginState.
+const LOGIN_COOKIE = "oidcLogin"
+
+// Provider names are used in urls.
+var PROVIDER_NAME = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// Create the OpenID Connect providers users can log in with from a json array
+// of oidc.Config, such as the OIDC_PROVIDERS environment variable.
+// Providers redirect back to /api/v1/auth/{provider}/callback unless RedirectUrl is set.
+func newProviders(configs string) ([]*oidc.Provider, error) {
+	var parsed []oidc.Config
+	if err := json.Unmarshal([]byte(configs), &parsed); err != nil {
+		return nil, fmt.Errorf("Parsing the providers: %w", err)
+	}
+
+	providers := []*oidc.Provider{}
+	names := map[string]bool{}
+	for _, config := range parsed {
+		if !PROVIDER_NAME.MatchString(config.Name) || names[config.Name] {
+			return nil, fmt.Errorf("Provider names must be unique and only contain a-z, 0-9 and -, not %q", config.Name)
+		}
+		if config.Issuer == "" || config.ClientId == "" {
+			return nil, fmt.Errorf("Provider %s needs an Issuer and a ClientId", config.Name)
+		}
+		if config.DisplayName == "" {
+			config.DisplayName = config.Name
+		}
+		if config.RedirectUrl == "" {
+			config.RedirectUrl = BACKEND_ORIGIN + API_V1 + "/auth/" + config.Name + "/callback"
+		}
+		names[config.Name] = true
+		providers = append(providers, oidc.NewProvider(config))
+	}
+	return providers, nil
+}
+
+func (s *Server) getProvider(r *http.Request) (*oidc.Provider, error) {
+	name := mux.Vars(r)["provider"]
+	for _, provider := range s.providers {
+		if provider.Name == name {
+			return provider, nil
+		}
+	}
+	return nil, ErrRouteNotFound.Wrap(fmt.Errorf("No provider named %q", name))
+}
+
+// A login started at a provider, kept in a signed cookie until the provider
+// redirects back, so that the response can only complete that login.
+type loginState struct {
+	Provider string
+	State    string
+	Nonce    string
+	Verifier string // PKCE code verifier
+	Expires  int64
+}
+
+func (s *Server) encodeLoginState(login loginState) string {
+	encoded, _ := json.Marshal(login)
+	payload := base64.RawURLEncoding.EncodeToString(encoded)
+	return payload + "." + s.sign("login", payload)
+}
+
+func (s *Server) decodeLoginState(value string, now time.Time) (loginState, error) {
+	payload, signature, _ := strings.Cut(value, ".")
+	if !hmac.Equal([]byte(signature), []byte(s.sign("login", payload))) {
+		return loginState{}, errors.New("Invalid login cookie signature")
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return loginState{}, err
+	}
+	var login loginState
+	if err := json.Unmarshal(decoded, &login); err != nil {
+		return loginState{}, err
+	}
+	if now.Unix() >= login.Expires {
+		return loginState{}, errors.New("The login expired")
+	}
+	return login, nil
+}
+
+// The login cookie is only sent to the callback. It's sent along with the provider's
+// redirect, which is a cross site navigation, so it can't be SameSite=Strict.
+func setLoginCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     LOGIN_COOKIE,
+		Value:    value,
+		Path:     API_V1 + "/auth/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(BACKEND_ORIGIN, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Send the user back to the frontend's login page with the code of the error.
+func redirectWithError(w http.ResponseWriter, r *http.Request, err error) {
+	recordError(r, err)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		apiErr = ErrExternalLogin
+	}
+	http.Redirect(w, r, FRONTEND_ORIGIN+"/auth?error="+url.QueryEscape(apiErr.Code), http.StatusFound)
+}
+
+// GET /api/v1/auth/providers
+//
+// Response: [{"Name": "", "DisplayName": ""}]
+//
+// Get the OpenID Connect providers users can log in with.
+func (s *Server) GetProviders(w http.ResponseWriter, r *http.Request) {
+	providers := []ProviderResponse{}
+	for _, provider := range s.providers {
+		providers = append(providers, ProviderResponse{Name: provider.Name, DisplayName: provider.DisplayName})
+	}
+	json.NewEncoder(w).Encode(providers)
+}
+
+// GET /api/v1/auth/{provider}/login
+//
+// Response: A redirect to the provider's login page.
+//
+// Start logging in with an OpenID Connect provider. The provider
+// sends the user back to GET /api/v1/auth/{provider}/callback.
+func (s *Server) StartLogin(w http.ResponseWriter, r *http.Request) {
+	provider, err := s.getProvider(r)
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+
+	login := loginState{
+		Provider: provider.Name,
+		State:    oidc.RandomString(),
+		Nonce:    oidc.RandomString(),
+		Verifier: oidc.RandomString(),
+		Expires:  time.Now().Add(LOGIN_LIFETIME).Unix(),
+	}
+	loginUrl, err := provider.AuthCodeUrl(r.Context(), login.State, login.Nonce, login.Verifier)
+	if err != nil {
+		redirectWithError(w, r, ErrExternalLogin.Wrap(err))
+		return
+	}
+
+	setLoginCookie(w, s.encodeLoginState(login), int(LOGIN_LIFETIME.Seconds()))
+	http.Redirect(w, r, loginUrl, http.StatusFound)
+}
+
+// GET /api/v1/auth/{provider}/callback
+//
+// Request payload: The "code" and "state" query parameters set by the provider.
+//
+// Response: A redirect to the frontend along with a cookie containing the user's session,
+// or a redirect to the frontend's login page with the error's code in the "error" query parameter.
+//
+// Finish logging in with an OpenID Connect provider. Users are found by the
+// identity the provider vouches for. Identities that aren't linked yet are
+// linked to the logged in user, to the user with the same email if both the
+// provider and the user verified it, or to a new user with the email.
+func (s *Server) FinishLogin(w http.ResponseWriter, r *http.Request) {
+	provider, err := s.getProvider(r)
+	if err != nil {
+		redirectWithError(w, r, err)
+		return
+	}
+	cookie, err := r.Cookie(LOGIN_COOKIE)
+	if err != nil {
+		redirectWithError(w, r, ErrExternalLogin.Wrap(err))
+		return
+	}
+	setLoginCookie(w, "", -1) // The login can only be completed once
+
+	login, err := s.decodeLoginState(cookie.Value, time.Now())
+	if err != nil {
+		redirectWithError(w, r, ErrExternalLogin.Wrap(err))
+		return
+	}
+	query := r.URL.Query()
+	if login.Provider != provider.Name || !hmac.Equal([]byte(login.State), []byte(query.Get("state"))) {
+		redirectWithError(w, r, ErrExternalLogin.Wrap(errors.New("The state doesn't match the login")))
+		return
+	}
+	if query.Get("error") != "" {
+		err := fmt.Errorf("%s returned %s: %s", provider.Name, query.Get("error"), query.Get("error_description"))
+		redirectWithError(w, r, ErrExternalLogin.Wrap(err))
+		return
+	}
+
+	tokens, err := provider.Exchange(r.Context(), query.Get("code"), login.Verifier)
+	if err != nil {
+		redirectWithError(w, r, ErrExternalLogin.Wrap(err))
+		return
+	}
+	claims, err := provider.Verify(r.Context(), tokens.IdToken, login.Nonce)
+	if err != nil {
+		redirectWithError(w, r, ErrExternalLogin.Wrap(err))
+		return
+	}
+
+	var user User
+	err = s.store.WithTx(r.Context(), func(tx Store) error {
+		userId, err := s.linkIdentity(r, tx, provider.Name, claims)
+		if err != nil {
+			return err
+		}
+		user, err = tx.GetUser(r.Context(), userId)
+		return err
+	})
+	if err != nil {
+		redirectWithError(w, r, err)
+		return
+	}
+
+	s.startSession(w, r, user)
+	http.Redirect(w, r, FRONTEND_ORIGIN+"/", http.StatusFound)
+}
+
+// Get the user an identity is linked to, linking it first if it isn't, see FinishLogin.
+func (s *Server) linkIdentity(r *http.Request, tx Store, provider string, claims oidc.Claims) (int, error) {
+	userId, err := tx.GetIdentityUser(r.Context(), provider, claims.Subject)
+	if err == nil || !errors.Is(err, ErrNotFound) {
+		return userId, err
+	}
+
+	if current, err := s.getUserId(r); err == nil {
+		userId = current
+		if _, err := tx.GetUser(r.Context(), userId); err != nil {
+			return 0, err
+		}
+	} else if claims.EmailVerified {
+		user, err := tx.GetUserByEmail(r.Context(), claims.Email)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return 0, err
+		}
+		// Whoever signed up with an email they don't own can't be given
+		// the owner's identity, so only verified accounts are linked
+		if err == nil && !user.Verified {
+			return 0, ErrDuplicateAccount
+		}
+		userId = user.Id
+	}
+
+	if userId == 0 {
+		if !isValidEmail(claims.Email) {
+			return 0, ErrExternalLogin.Wrap(fmt.Errorf("%s didn't share a valid email", provider))
+		}
+		// The user can choose a password by resetting it
+		password, err := randomToken()
+		if err != nil {
+			return 0, err
+		}
+		userId, err = tx.CreateUser(r.Context(), claims.Email, password)
+		if errors.Is(err, ErrDuplicate) {
+			return 0, ErrDuplicateAccount.Wrap(err)
+		} else if err != nil {
+			return 0, err
+		}
+		if claims.EmailVerified {
+			if err := tx.VerifyEmail(r.Context(), userId, claims.Email); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	err = tx.AddIdentity(r.Context(), Identity{Provider: provider, Subject: claims.Subject, UserId: userId})
+	return userId, err
+}
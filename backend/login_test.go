@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/aabiji/page/backend/oidc/oidctest"
+)
+
+// Add a provider named "test" to the server, served by a local provider.
+func (s testServer) addProvider(t *testing.T) *oidctest.Provider {
+	idp, server := oidctest.NewServer("page", "secret")
+	t.Cleanup(server.Close)
+	providers, err := newProviders(`[{"Name": "test", "DisplayName": "Test", "Issuer": "` +
+		server.URL + `", "ClientId": "page", "ClientSecret": "secret"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.providers = providers
+	return idp
+}
+
+// Log in with the test provider, as the user or anonymously if userId is 0,
+// and return the callback's response.
+func (s testServer) login(t *testing.T, userId int) *httptest.ResponseRecorder {
+	t.Helper()
+	w := s.request("GET", "/api/v1/auth/test/login", nil, userId)
+	assertEq(t, w.Code, http.StatusFound)
+	cookies := w.Result().Cookies()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	response, err := client.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	callback, err := url.Parse(response.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", callback.RequestURI(), nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	if userId != 0 {
+		r.AddCookie(s.sessionCookie(userId))
+	}
+	w = httptest.NewRecorder()
+	s.handler.ServeHTTP(w, r)
+	return w
+}
+
+// Get the id of the user a login signed in, failing if it didn't.
+func (s testServer) loggedInUser(t *testing.T, w *httptest.ResponseRecorder) int {
+	t.Helper()
+	assertEq(t, w.Code, http.StatusFound)
+	assertEq(t, w.Header().Get("Location"), FRONTEND_ORIGIN+"/")
+	if userId := s.sessionUser(w); userId != 0 {
+		return userId
+	}
+	t.Fatalf("Login redirected to %s without a cookie", w.Header().Get("Location"))
+	return 0
+}
+
+func assertLoginError(t *testing.T, w *httptest.ResponseRecorder, err *APIError) {
+	t.Helper()
+	assertEq(t, w.Code, http.StatusFound)
+	assertEq(t, w.Header().Get("Location"), FRONTEND_ORIGIN+"/auth?error="+err.Code)
+}
+
+func TestLoginWithProvider(t *testing.T) {
+	s := newTestServer(t)
+	idp := s.addProvider(t)
+	w := s.request("GET", "/api/v1/auth/providers", nil, 0)
+	assertEq(t, decode[[]ProviderResponse](t, w), []ProviderResponse{{"test", "Test"}})
+
+	// New identities get an account, which is verified when the provider verified the email
+	idp.SetUser(oidctest.User{Subject: "1", Email: "new@example.com", EmailVerified: true})
+	userId := s.loggedInUser(t, s.login(t, 0))
+	user, _ := s.store.GetUser(ctx, userId)
+	assertEq(t, user.Email, "new@example.com")
+	assertEq(t, user.Verified, true)
+	assertEq(t, s.loggedInUser(t, s.login(t, 0)), userId)
+
+	// Or are linked to the account with the same verified email
+	existing, _ := s.store.CreateUser(ctx, "reader@example.com", "hash")
+	idp.SetUser(oidctest.User{Subject: "2", Email: "reader@example.com", EmailVerified: false})
+	assertLoginError(t, s.login(t, 0), ErrDuplicateAccount)
+	// Which the account has to have verified too, since anyone could've signed up with it
+	idp.SetUser(oidctest.User{Subject: "2", Email: "reader@example.com", EmailVerified: true})
+	assertLoginError(t, s.login(t, 0), ErrDuplicateAccount)
+	_, err := s.store.GetIdentityUser(ctx, "test", "2")
+	assertEq(t, err, ErrNotFound)
+	s.store.VerifyEmail(ctx, existing, "reader@example.com")
+	assertEq(t, s.loggedInUser(t, s.login(t, 0)), existing)
+
+	// Or to the logged in user, whatever their email
+	idp.SetUser(oidctest.User{Subject: "3", Email: "other@example.com", EmailVerified: true})
+	assertEq(t, s.loggedInUser(t, s.login(t, existing)), existing)
+	assertEq(t, s.loggedInUser(t, s.login(t, 0)), existing)
+
+	idp.SetUser(oidctest.User{Subject: "4", Email: "unverified@example.com"})
+	user, _ = s.store.GetUser(ctx, s.loggedInUser(t, s.login(t, 0)))
+	assertEq(t, user.Verified, false)
+	idp.SetUser(oidctest.User{Subject: "5"})
+	assertLoginError(t, s.login(t, 0), ErrExternalLogin)
+
+	// Deleting an account unlinks its identities
+	s.request("DELETE", "/api/v1/me", nil, existing)
+	_, err = s.store.GetIdentityUser(ctx, "test", "3")
+	assertEq(t, err, ErrNotFound)
+
+	w = s.request("GET", "/api/v1/auth/unknown/login", nil, 0)
+	assertError(t, w, ErrRouteNotFound)
+}
+
+func TestLoginState(t *testing.T) {
+	s := newTestServer(t)
+	s.addProvider(t)
+	w := s.request("GET", "/api/v1/auth/test/login", nil, 0)
+	cookie := w.Result().Cookies()[0]
+	assertEq(t, cookie.Name, LOGIN_COOKIE)
+	assertEq(t, cookie.HttpOnly, true)
+	state, _ := url.Parse(w.Header().Get("Location"))
+
+	callback := func(query string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/v1/auth/test/callback?"+query, nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		s.handler.ServeHTTP(w, r)
+		return w
+	}
+	valid := "code=wrong&state=" + state.Query().Get("state")
+	assertLoginError(t, callback(valid, nil), ErrExternalLogin)
+	assertLoginError(t, callback("code=wrong&state=other", cookie), ErrExternalLogin)
+	assertLoginError(t, callback(valid+"&error=access_denied", cookie), ErrExternalLogin)
+	tampered := *cookie
+	tampered.Value = "e30." + s.sign("other", "e30")
+	assertLoginError(t, callback(valid, &tampered), ErrExternalLogin)
+
+	// The cookie is removed once it's used
+	w = callback(valid, cookie)
+	assertLoginError(t, w, ErrExternalLogin)
+	assertEq(t, w.Result().Cookies()[0].MaxAge, -1)
+}
+
+func TestNewProviders(t *testing.T) {
+	providers, err := newProviders(`[{"Name": "company", "Issuer": "https://id.example.com", "ClientId": "page"}]`)
+	assertEq(t, err, nil)
+	assertEq(t, providers[0].DisplayName, "company")
+	assertEq(t, providers[0].RedirectUrl, BACKEND_ORIGIN+"/api/v1/auth/company/callback")
+
+	invalid := []string{
+		`{}`,
+		`[{"Name": "Company", "Issuer": "https://id.example.com", "ClientId": "page"}]`,
+		`[{"Name": "company", "ClientId": "page"}]`,
+		`[{"Name": "company", "Issuer": "https://id.example.com", "ClientId": "page"},
+		  {"Name": "company", "Issuer": "https://other.example.com", "ClientId": "page"}]`,
+	}
+	for _, configs := range invalid {
+		if _, err := newProviders(configs); err == nil {
+			t.Errorf("Created providers from %s", configs)
+		}
+	}
+}
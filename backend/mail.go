@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long sending a mail is allowed to take.
+const MAIL_TIMEOUT = 10 * time.Second
+
+// A plain text mail sent to a user.
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sends mails to users, see SMTPMailer and FileMailer.
+type Mailer interface {
+	Send(ctx context.Context, mail Mail) error
+}
+
+// Format a mail as a message with headers, as it's sent over SMTP.
+func formatMail(from string, mail Mail, now time.Time) ([]byte, error) {
+	for _, header := range []string{from, mail.To, mail.Subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return nil, fmt.Errorf("Mail header %q contains a line break", header)
+		}
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", from)
+	fmt.Fprintf(&message, "To: %s\r\n", mail.To)
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", mail.Subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	message.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	body := strings.ReplaceAll(mail.Body, "\r\n", "\n")
+	if !strings.HasSuffix(body, "\n") {
+		body += "\n"
+	}
+	message.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return message.Bytes(), nil
+}
+
+// Sends mails through an SMTP server, using STARTTLS when the server supports it.
+type SMTPMailer struct {
+	Addr     string // Address of the server (ex. smtp.example.com:587)
+	From     string
+	Username string // Mails are sent without authenticating when empty
+	Password string
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, mail Mail) error {
+	message, err := formatMail(m.From, mail, time.Now())
+	if err != nil {
+		return err
+	}
+	host, _, err := net.SplitHostPort(m.Addr)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, MAIL_TIMEOUT)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", m.Addr)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if m.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.Username, m.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(m.From); err != nil {
+		return err
+	}
+	if err := client.Rcpt(mail.To); err != nil {
+		return err
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(message); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// Writes mails to a file instead of sending them, for development and tests.
+type FileMailer struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+func NewFileMailer(writer io.Writer) *FileMailer {
+	return &FileMailer{writer: writer}
+}
+
+func (m *FileMailer) Send(ctx context.Context, mail Mail) error {
+	message, err := formatMail("page@localhost", mail, time.Now())
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, err = m.writer.Write(append(message, "\r\n"...))
+	return err
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatMail(t *testing.T) {
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	message, err := formatMail("page@example.com", Mail{"reader@example.com", "Hé", "Line\nLine\n"}, now)
+	assertEq(t, err, nil)
+	assertEq(t, string(message), strings.Join([]string{
+		"From: page@example.com",
+		"To: reader@example.com",
+		"Subject: =?utf-8?q?H=C3=A9?=",
+		"Date: Fri, 01 Mar 2024 12:00:00 +0000",
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"Content-Transfer-Encoding: 8bit",
+		"",
+		"Line",
+		"Line",
+		"",
+	}, "\r\n"))
+
+	// Line breaks would let users add headers
+	_, err = formatMail("page@example.com", Mail{"reader@example.com\r\nBcc: other@example.com", "", ""}, now)
+	if err == nil {
+		t.Error("Formatted a mail with a line break in a header")
+	}
+}
+
+// Receive a single mail like an SMTP server would, without
+// supporting STARTTLS or authentication, and return its contents.
+func serveSMTP(listener net.Listener) chan string {
+	received := make(chan string, 1)
+	go func() {
+		defer close(received)
+		c, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn := textproto.NewConn(c)
+		defer conn.Close()
+
+		conn.PrintfLine("220 localhost")
+		for {
+			line, err := conn.ReadLine()
+			if err != nil {
+				return
+			}
+			command, _, _ := strings.Cut(line, " ")
+			switch strings.ToUpper(command) {
+			case "EHLO":
+				conn.PrintfLine("250-localhost")
+				conn.PrintfLine("250 8BITMIME")
+			case "DATA":
+				conn.PrintfLine("354 Send the message")
+				message, _ := conn.ReadDotBytes()
+				received <- string(message)
+				conn.PrintfLine("250 Ok")
+			case "QUIT":
+				conn.PrintfLine("221 Bye")
+				return
+			default:
+				conn.PrintfLine("250 Ok")
+			}
+		}
+	}()
+	return received
+}
+
+func TestSMTPMailer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := serveSMTP(listener)
+
+	mailer := &SMTPMailer{Addr: listener.Addr().String(), From: "page@example.com"}
+	err = mailer.Send(ctx, Mail{To: "reader@example.com", Subject: "Hello", Body: "Hello there\n"})
+	assertEq(t, err, nil)
+	message := <-received
+	if !strings.Contains(message, "To: reader@example.com\n") || !strings.HasSuffix(message, "\nHello there\n") {
+		t.Errorf("Received %q", message)
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	var file bytes.Buffer
+	mailer := NewFileMailer(&file)
+	mailer.Send(ctx, Mail{To: "reader@example.com", Subject: "First", Body: "Hello"})
+	mailer.Send(ctx, Mail{To: "reader@example.com", Subject: "Second", Body: "Hello"})
+	assertEq(t, strings.Count(file.String(), "To: reader@example.com\r\n"), 2)
+	if !strings.Contains(file.String(), "Subject: Second\r\n") {
+		t.Errorf("Missing the second mail in:\n%s", file.String())
+	}
+}
+
+func TestNewMailer(t *testing.T) {
+	t.Setenv("SMTP_ADDR", "")
+	t.Setenv("MAIL_FILE", "")
+	_, err := newMailer(false)
+	assertEq(t, err != nil, true)
+	mailer, err := newMailer(true)
+	assertEq(t, err, nil)
+	assertEq(t, mailer != nil, true)
+
+	t.Setenv("MAIL_FILE", filepath.Join(t.TempDir(), "mails"))
+	_, err = newMailer(false)
+	assertEq(t, err, nil)
+}
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aabiji/page/backend/epub"
+)
+
+// In memory implementation of the UserStore, BookStore and UserBookStore.
+// Used in tests and when running the server without a database.
+type MemoryStore struct {
+	txMutex    sync.Mutex // Held for the duration of a transaction
+	mutex      sync.Mutex
+	users      []User
+	books      []Book
+	userBooks  []UserBook
+	tokens     []Token
+	apiTokens  []ApiToken
+	shares     []Share
+	identities []Identity
+	validation map[int]epub.Report
+	series     []Series
+	nextId     int
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{validation: make(map[int]epub.Report)}
+}
+
+func (m *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+// The store's contents, saved so that a failed transaction can be rolled back.
+type memorySnapshot struct {
+	users      []User
+	books      []Book
+	userBooks  []UserBook
+	tokens     []Token
+	apiTokens  []ApiToken
+	shares     []Share
+	identities []Identity
+	validation map[int]epub.Report
+	series     []Series
+	nextId     int
+}
+
+// Transactions are serialized and restore the store's contents when fn fails.
+// Writes made outside of transactions while one is running may be rolled back with it.
+func (m *MemoryStore) WithTx(ctx context.Context, fn func(tx Store) error) error {
+	m.txMutex.Lock()
+	defer m.txMutex.Unlock()
+
+	m.mutex.Lock()
+	snapshot := memorySnapshot{
+		clone(m.users), clone(m.books), clone(m.userBooks), clone(m.tokens),
+		clone(m.apiTokens), clone(m.shares), clone(m.identities), clone(m.validation), clone(m.series), m.nextId,
+	}
+	m.mutex.Unlock()
+
+	err := fn(memoryTx{m})
+	if err == nil {
+		err = ctx.Err() // Like a database, don't commit once the context is done
+	}
+	if err != nil {
+		m.mutex.Lock()
+		m.users, m.books, m.userBooks = snapshot.users, snapshot.books, snapshot.userBooks
+		m.tokens, m.apiTokens, m.shares = snapshot.tokens, snapshot.apiTokens, snapshot.shares
+		m.identities = snapshot.identities
+		m.validation, m.series, m.nextId = snapshot.validation, snapshot.series, snapshot.nextId
+		m.mutex.Unlock()
+	}
+	return err
+}
+
+// A MemoryStore inside a transaction, where nested transactions join the outer one.
+type memoryTx struct {
+	*MemoryStore
+}
+
+func (tx memoryTx) WithTx(ctx context.Context, fn func(tx Store) error) error {
+	return fn(tx)
+}
+
+// Ids start at 1 like serial columns.
+func (m *MemoryStore) newId() int {
+	m.nextId++
+	return m.nextId
+}
+
+// Deep copy a value so callers can't modify the store's copy.
+func clone[T any](value T) T {
+	var copied T
+	encoded, _ := json.Marshal(value)
+	json.Unmarshal(encoded, &copied)
+	return copied
+}
+
+func (m *MemoryStore) CreateUser(ctx context.Context, email, password string) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, u := range m.users {
+		if u.Email == email {
+			return 0, ErrDuplicate
+		}
+	}
+	user := User{Id: m.newId(), Email: email, Password: password}
+	m.users = append(m.users, user)
+	return user.Id, nil
+}
+
+func (m *MemoryStore) GetUserId(ctx context.Context, email, password string) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, u := range m.users {
+		if u.Email == email && u.Password == password {
+			return u.Id, nil
+		}
+	}
+	return 0, ErrNotFound
+}
+
+func (m *MemoryStore) GetUser(ctx context.Context, userId int) (User, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, u := range m.users {
+		if u.Id == userId {
+			return u, nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+func (m *MemoryStore) GetUserByEmail(ctx context.Context, email string) (User, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, u := range m.users {
+		if u.Email == email {
+			return u, nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+func (m *MemoryStore) VerifyEmail(ctx context.Context, userId int, email string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, u := range m.users {
+		if u.Email == email && u.Id != userId {
+			return ErrDuplicate
+		}
+	}
+	for i, u := range m.users {
+		if u.Id == userId {
+			m.users[i].Email, m.users[i].Verified = email, true
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *MemoryStore) UpdatePassword(ctx context.Context, userId int, password string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for i, u := range m.users {
+		if u.Id == userId {
+			m.users[i].Password = password
+			m.users[i].Sessions++
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *MemoryStore) UpdateSettings(ctx context.Context, userId int, settings Settings) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for i, u := range m.users {
+		if u.Id == userId {
+			m.users[i].Settings = settings
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *MemoryStore) CountUsers(ctx context.Context) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.users), nil
+}
+
+func (m *MemoryStore) DeleteUser(ctx context.Context, userId int) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	users := []User{}
+	for _, u := range m.users {
+		if u.Id != userId {
+			users = append(users, u)
+		}
+	}
+	m.users = users
+	return nil
+}
+
+func (m *MemoryStore) InsertBook(ctx context.Context, book Book) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, b := range m.books {
+		if book.Hash != "" && b.Hash == book.Hash {
+			return 0, ErrDuplicate
+		}
+	}
+
+	book = clone(book)
+	book.BookId = m.newId()
+	m.books = append(m.books, book)
+
+	for _, s := range book.Info.Series {
+		m.addToSeries(book, s)
+	}
+	return book.BookId, nil
+}
+
+// Add a book to a series, creating the series if needed.
+func (m *MemoryStore) addToSeries(book Book, s epub.Series) {
+	i := 0
+	for i < len(m.series) && m.series[i].Name != s.Name {
+		i++
+	}
+	if i == len(m.series) {
+		m.series = append(m.series, Series{SeriesId: m.newId(), Name: s.Name})
+	}
+
+	for _, b := range m.series[i].Books {
+		if b.BookId == book.BookId {
+			return
+		}
+	}
+	entry := SeriesBook{BookId: book.BookId, Title: book.Title, Position: s.Index}
+	m.series[i].Books = append(m.series[i].Books, entry)
+}
+
+func (m *MemoryStore) CountBooks(ctx context.Context) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.books), nil
+}
+
+func (m *MemoryStore) GetBook(ctx context.Context, bookId int) (Book, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, b := range m.books {
+		if b.BookId == bookId {
+			return clone(b), nil
+		}
+	}
+	return Book{}, ErrNotFound
+}
+
+func (m *MemoryStore) GetBookByHash(ctx context.Context, hash string) (Book, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, b := range m.books {
+		if hash != "" && b.Hash == hash {
+			return clone(b), nil
+		}
+	}
+	return Book{}, ErrNotFound
+}
+
+func (m *MemoryStore) SetValidation(ctx context.Context, bookId int, report epub.Report) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.validation[bookId] = clone(report)
+	return nil
+}
+
+func (m *MemoryStore) GetValidation(ctx context.Context, bookId int) (epub.Report, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	report, exists := m.validation[bookId]
+	if !exists {
+		return epub.Report{}, ErrNotFound
+	}
+	return clone(report), nil
+}
+
+func (m *MemoryStore) GetAllSeries(ctx context.Context, userId int) ([]Series, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	series := []Series{}
+	for _, s := range clone(m.series) {
+		books := []SeriesBook{}
+		for _, book := range s.Books {
+			for _, ub := range m.userBooks {
+				if ub.UserId == userId && ub.BookId == book.BookId {
+					books = append(books, book)
+				}
+			}
+		}
+		if len(books) > 0 {
+			s.Books = books
+			series = append(series, s)
+		}
+	}
+	sort.SliceStable(series, func(i, j int) bool {
+		if series[i].Name != series[j].Name {
+			return series[i].Name < series[j].Name
+		}
+		return series[i].SeriesId < series[j].SeriesId
+	})
+	for _, s := range series {
+		sort.SliceStable(s.Books, func(i, j int) bool {
+			if s.Books[i].Position != s.Books[j].Position {
+				return s.Books[i].Position < s.Books[j].Position
+			}
+			return s.Books[i].Title < s.Books[j].Title
+		})
+	}
+	return series, nil
+}
+
+func (m *MemoryStore) GetSeries(ctx context.Context, userId, seriesId int) (Series, error) {
+	series, _ := m.GetAllSeries(ctx, userId)
+	for _, s := range series {
+		if s.SeriesId == seriesId {
+			return s, nil
+		}
+	}
+	return Series{}, ErrNotFound
+}
+
+func (m *MemoryStore) AddUserBook(ctx context.Context, userBook UserBook) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, ub := range m.userBooks {
+		if ub.UserId == userBook.UserId && ub.BookId == userBook.BookId {
+			return false, nil
+		}
+	}
+	m.userBooks = append(m.userBooks, clone(userBook))
+	return true, nil
+}
+
+func (m *MemoryStore) GetUserBook(ctx context.Context, userId, bookId int) (UserBook, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, ub := range m.userBooks {
+		if ub.UserId == userId && ub.BookId == bookId {
+			return clone(ub), nil
+		}
+	}
+	return UserBook{}, ErrNotFound
+}
+
+func (m *MemoryStore) UpdateProgress(ctx context.Context, userBook UserBook) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for i, ub := range m.userBooks {
+		if ub.UserId == userBook.UserId && ub.BookId == userBook.BookId {
+			m.userBooks[i] = clone(userBook)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// Remove the user books for which remove returns true.
+func (m *MemoryStore) removeUserBooks(remove func(UserBook) bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	userBooks := []UserBook{}
+	for _, ub := range m.userBooks {
+		if !remove(ub) {
+			userBooks = append(userBooks, ub)
+		}
+	}
+	m.userBooks = userBooks
+}
+
+func (m *MemoryStore) RemoveUserBook(ctx context.Context, userId, bookId int) error {
+	m.removeUserBooks(func(ub UserBook) bool {
+		return ub.UserId == userId && ub.BookId == bookId
+	})
+	return nil
+}
+
+func (m *MemoryStore) RemoveUserBooks(ctx context.Context, userId int) error {
+	m.removeUserBooks(func(ub UserBook) bool { return ub.UserId == userId })
+	return nil
+}
+
+// Remove the tokens for which remove returns true. The mutex must be held.
+func (m *MemoryStore) removeTokens(remove func(Token) bool) {
+	tokens := []Token{}
+	for _, t := range m.tokens {
+		if !remove(t) {
+			tokens = append(tokens, t)
+		}
+	}
+	m.tokens = tokens
+}
+
+func (m *MemoryStore) CreateToken(ctx context.Context, token Token) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.removeTokens(func(t Token) bool {
+		return t.UserId == token.UserId && t.Purpose == token.Purpose
+	})
+	m.tokens = append(m.tokens, token)
+	return nil
+}
+
+func (m *MemoryStore) UseToken(ctx context.Context, hash, purpose string) (Token, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, t := range m.tokens {
+		if t.Hash == hash && t.Purpose == purpose {
+			m.removeTokens(func(other Token) bool { return other.Hash == hash })
+			return t, nil
+		}
+	}
+	return Token{}, ErrNotFound
+}
+
+func (m *MemoryStore) RemoveTokens(ctx context.Context, userId int) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.removeTokens(func(t Token) bool { return t.UserId == userId })
+	return nil
+}
+
+func (m *MemoryStore) AddIdentity(ctx context.Context, identity Identity) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, i := range m.identities {
+		if i.Provider == identity.Provider && i.Subject == identity.Subject {
+			return ErrDuplicate
+		}
+	}
+	m.identities = append(m.identities, identity)
+	return nil
+}
+
+func (m *MemoryStore) GetIdentityUser(ctx context.Context, provider, subject string) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, i := range m.identities {
+		if i.Provider == provider && i.Subject == subject {
+			return i.UserId, nil
+		}
+	}
+	return 0, ErrNotFound
+}
+
+func (m *MemoryStore) RemoveIdentities(ctx context.Context, userId int) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	identities := []Identity{}
+	for _, i := range m.identities {
+		if i.UserId != userId {
+			identities = append(identities, i)
+		}
+	}
+	m.identities = identities
+	return nil
+}
+
+func (m *MemoryStore) CreateApiToken(ctx context.Context, token ApiToken) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.nextId++
+	token.Id = m.nextId
+	token.Scopes = clone(token.Scopes)
+	m.apiTokens = append(m.apiTokens, token)
+	return token.Id, nil
+}
+
+func (m *MemoryStore) GetApiToken(ctx context.Context, hash string) (ApiToken, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, t := range m.apiTokens {
+		if t.Hash == hash {
+			t.Scopes = clone(t.Scopes)
+			return t, nil
+		}
+	}
+	return ApiToken{}, ErrNotFound
+}
+
+func (m *MemoryStore) GetApiTokens(ctx context.Context, userId int) ([]ApiToken, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	tokens := []ApiToken{}
+	for _, t := range m.apiTokens {
+		if t.UserId == userId {
+			t.Scopes = clone(t.Scopes)
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens, nil
+}
+
+func (m *MemoryStore) SetApiTokenUsed(ctx context.Context, id int, used time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for i := range m.apiTokens {
+		if m.apiTokens[i].Id == id {
+			m.apiTokens[i].LastUsed = used
+		}
+	}
+	return nil
+}
+
+// Remove the api tokens for which remove returns true and return how many were removed.
+// The mutex must be held.
+func (m *MemoryStore) removeApiTokens(remove func(ApiToken) bool) int {
+	tokens := []ApiToken{}
+	for _, t := range m.apiTokens {
+		if !remove(t) {
+			tokens = append(tokens, t)
+		}
+	}
+	removed := len(m.apiTokens) - len(tokens)
+	m.apiTokens = tokens
+	return removed
+}
+
+func (m *MemoryStore) RemoveApiToken(ctx context.Context, userId, id int) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.removeApiTokens(func(t ApiToken) bool { return t.UserId == userId && t.Id == id }) == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m *MemoryStore) RemoveApiTokens(ctx context.Context, userId int) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.removeApiTokens(func(t ApiToken) bool { return t.UserId == userId })
+	return nil
+}
+
+func (m *MemoryStore) CreateShare(ctx context.Context, share Share) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.nextId++
+	share.Id = m.nextId
+	m.shares = append(m.shares, share)
+	return share.Id, nil
+}
+
+func (m *MemoryStore) GetShare(ctx context.Context, hash string) (Share, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, s := range m.shares {
+		if s.Hash == hash {
+			return s, nil
+		}
+	}
+	return Share{}, ErrNotFound
+}
+
+func (m *MemoryStore) GetShares(ctx context.Context, userId int) ([]Share, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	shares := []Share{}
+	for _, s := range m.shares {
+		if s.UserId == userId {
+			shares = append(shares, s)
+		}
+	}
+	return shares, nil
+}
+
+// Remove the shares for which remove returns true and return how many were removed.
+// The mutex must be held.
+func (m *MemoryStore) removeShares(remove func(Share) bool) int {
+	shares := []Share{}
+	for _, s := range m.shares {
+		if !remove(s) {
+			shares = append(shares, s)
+		}
+	}
+	removed := len(m.shares) - len(shares)
+	m.shares = shares
+	return removed
+}
+
+func (m *MemoryStore) RemoveShare(ctx context.Context, userId, id int) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.removeShares(func(s Share) bool { return s.UserId == userId && s.Id == id }) == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m *MemoryStore) RemoveShares(ctx context.Context, userId int) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.removeShares(func(s Share) bool { return s.UserId == userId })
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aabiji/page/backend/epub"
+	"github.com/gorilla/mux"
+)
+
+// Upper bounds in seconds of the buckets of the request latency histograms.
+var REQUEST_BUCKETS = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Upper bounds in seconds of the buckets of the ingestion stage histograms.
+var STAGE_BUCKETS = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64 // Number of observations in each bucket, excluding the +Inf bucket
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(value float64) {
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+type requestLabels struct {
+	method string
+	route  string
+	status int
+}
+
+type routeLabels struct {
+	method string
+	route  string
+}
+
+// Metrics collected while the server is running. Metrics that can be
+// read from the database or the disk are collected when they're scraped.
+type Metrics struct {
+	mutex     sync.Mutex
+	requests  map[requestLabels]uint64
+	latencies map[routeLabels]*histogram
+	stages    map[string]*histogram
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:  make(map[requestLabels]uint64),
+		latencies: make(map[routeLabels]*histogram),
+		stages:    make(map[string]*histogram),
+	}
+}
+
+func (m *Metrics) observeRequest(method, route string, status int, latency time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.requests[requestLabels{method, route, status}]++
+	labels := routeLabels{method, route}
+	if m.latencies[labels] == nil {
+		m.latencies[labels] = newHistogram(REQUEST_BUCKETS)
+	}
+	m.latencies[labels].observe(latency.Seconds())
+}
+
+// Record the time a stage of epub.New took. Used as the epub.STAGE_HOOK.
+func (m *Metrics) observeStage(stage string, duration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.stages[stage] == nil {
+		m.stages[stage] = newHistogram(STAGE_BUCKETS)
+	}
+	m.stages[stage].observe(duration.Seconds())
+}
+
+// Middleware counting requests and timing them by their route template
+// (ex. /book/get/{id}), so that the number of series stays bounded.
+func (s *Server) measureRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		s.metrics.observeRequest(r.Method, route, recorder.status, time.Since(start))
+	})
+}
+
+// Format label names and values (ex. {route="/series",status="200"}).
+func formatLabels(pairs ...string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	labels := []string{}
+	for i := 0; i < len(pairs); i += 2 {
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, pairs[i], escape.Replace(pairs[i+1])))
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// Write the HELP and TYPE lines of a metric.
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeSample(w io.Writer, name, labels string, value float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, formatValue(value))
+}
+
+// Write the buckets, sum and count of a histogram, whose labels are pairs.
+func writeHistogram(w io.Writer, name string, h *histogram, pairs ...string) {
+	for i, bound := range h.buckets {
+		labels := formatLabels(append(pairs, "le", formatValue(bound))...)
+		writeSample(w, name+"_bucket", labels, float64(h.counts[i]))
+	}
+	writeSample(w, name+"_bucket", formatLabels(append(pairs, "le", "+Inf")...), float64(h.count))
+	writeSample(w, name+"_sum", formatLabels(pairs...), h.sum)
+	writeSample(w, name+"_count", formatLabels(pairs...), float64(h.count))
+}
+
+// Write the metrics collected while running in the Prometheus text format.
+// Series are sorted so the output is stable.
+func (m *Metrics) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	requests := []requestLabels{}
+	for labels := range m.requests {
+		requests = append(requests, labels)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, b := requests[i], requests[j]
+		if a.route != b.route {
+			return a.route < b.route
+		} else if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+	writeHeader(w, "page_http_requests_total", "counter", "Number of HTTP requests by route template and status code.")
+	for _, l := range requests {
+		labels := formatLabels("method", l.method, "route", l.route, "status", strconv.Itoa(l.status))
+		writeSample(w, "page_http_requests_total", labels, float64(m.requests[l]))
+	}
+
+	routes := []routeLabels{}
+	for labels := range m.latencies {
+		routes = append(routes, labels)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].route != routes[j].route {
+			return routes[i].route < routes[j].route
+		}
+		return routes[i].method < routes[j].method
+	})
+	name := "page_http_request_duration_seconds"
+	writeHeader(w, name, "histogram", "Latency of HTTP requests by route template.")
+	for _, l := range routes {
+		writeHistogram(w, name, m.latencies[l], "method", l.method, "route", l.route)
+	}
+
+	stages := []string{}
+	for stage := range m.stages {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+	name = "page_ingestion_stage_duration_seconds"
+	writeHeader(w, name, "histogram", "Time taken by each stage of processing an uploaded epub.")
+	for _, stage := range stages {
+		writeHistogram(w, name, m.stages[stage], "stage", stage)
+	}
+}
+
+// Implemented by stores backed by a database connection pool.
+type poolStatsReporter interface {
+	PoolStats() PoolStats
+}
+
+// GET /metrics
+//
+// Response: The server's metrics in the Prometheus text exposition format.
+//
+// Get request counts and latencies, the time taken by each stage of processing
+// uploaded epubs, database connection pool statistics, the number of bytes
+// stored on disk and the number of users and books.
+func (s *Server) GetMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.metrics.write(w)
+
+	if reporter, ok := s.store.(poolStatsReporter); ok {
+		stats := reporter.PoolStats()
+		writeHeader(w, "page_db_max_connections", "gauge", "Maximum size of the database connection pool.")
+		writeSample(w, "page_db_max_connections", "", float64(stats.MaxConns))
+		writeHeader(w, "page_db_connections", "gauge", "Number of open database connections by state.")
+		writeSample(w, "page_db_connections", formatLabels("state", "acquired"), float64(stats.AcquiredConns))
+		writeSample(w, "page_db_connections", formatLabels("state", "idle"), float64(stats.IdleConns))
+		writeHeader(w, "page_db_connection_waits_total", "counter", "Number of times a database connection had to be waited for.")
+		writeSample(w, "page_db_connection_waits_total", "", float64(stats.WaitCount))
+	}
+
+	writeHeader(w, "page_storage_bytes", "gauge", "Size of the files stored on disk by directory.")
+	directories := []struct {
+		name string
+		size func() (int64, error)
+	}{
+		{"books", func() (int64, error) { return directorySize(epub.EXTRACT_DIRECTORY) }},
+		{"storage", s.storage.Size},
+		{"uploads", func() (int64, error) { return directorySize(FILE_UPLOAD_DIRECTORY) }},
+	}
+	for _, directory := range directories {
+		if size, err := directory.size(); err == nil {
+			writeSample(w, "page_storage_bytes", formatLabels("directory", directory.name), float64(size))
+		} else {
+			s.logger.Warn("Measuring storage", "directory", directory.name, "error", err)
+		}
+	}
+
+	if users, err := s.store.CountUsers(r.Context()); err == nil {
+		writeHeader(w, "page_users", "gauge", "Number of user accounts.")
+		writeSample(w, "page_users", "", float64(users))
+	} else {
+		s.logger.Warn("Counting users", "error", err)
+	}
+	if books, err := s.store.CountBooks(r.Context()); err == nil {
+		writeHeader(w, "page_books", "gauge", "Number of books.")
+		writeSample(w, "page_books", "", float64(books))
+	} else {
+		s.logger.Warn("Counting books", "error", err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aabiji/page/backend/epub"
+)
+
+func TestMetrics(t *testing.T) {
+	s := newTestServer(t)
+	epub.STAGE_HOOK = s.metrics.observeStage
+	defer func() { epub.STAGE_HOOK = nil }()
+
+	userId, _ := s.store.CreateUser(ctx, "reader@example.com", "hash")
+	w := s.upload(t, "Dune.epub", readDune(t), userId)
+	bookId := decode[struct{ BookId int }](t, w).BookId
+	s.request("GET", "/api/v1/books/"+strconv.Itoa(bookId), nil, userId)
+	s.request("GET", "/api/v1/books/abc", nil, userId)
+	s.request("GET", "/api/v1/books/abc", nil, userId)
+	s.request("GET", "/missing", nil, 0)
+
+	w = s.request("GET", "/metrics", nil, 0)
+	assertEq(t, w.Code, http.StatusOK)
+	assertEq(t, w.Header().Get("Content-Type"), "text/plain; version=0.0.4; charset=utf-8")
+	lines := map[string]bool{}
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		lines[line] = true
+	}
+
+	expected := []string{
+		"# TYPE page_http_requests_total counter",
+		`page_http_requests_total{method="GET",route="/api/v1/books/{id}",status="200"} 1`,
+		`page_http_requests_total{method="GET",route="/api/v1/books/{id}",status="400"} 2`,
+		`page_http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+		`page_http_requests_total{method="POST",route="/api/v1/me/books",status="200"} 1`,
+		"# TYPE page_http_request_duration_seconds histogram",
+		`page_http_request_duration_seconds_bucket{method="GET",route="/api/v1/books/{id}",le="+Inf"} 3`,
+		`page_http_request_duration_seconds_count{method="GET",route="/api/v1/books/{id}"} 3`,
+		`page_ingestion_stage_duration_seconds_bucket{stage="unzip",le="+Inf"} 1`,
+		`page_ingestion_stage_duration_seconds_count{stage="toc"} 1`,
+		"page_users 1",
+		"page_books 1",
+	}
+	for _, line := range expected {
+		if !lines[line] {
+			t.Errorf("Missing %q in:\n%s", line, w.Body.String())
+		}
+	}
+	for _, prefix := range []string{`page_storage_bytes{directory="books"} `, `page_storage_bytes{directory="storage"} `} {
+		if !strings.Contains(w.Body.String(), prefix) || strings.Contains(w.Body.String(), prefix+"0\n") {
+			t.Errorf("Missing %q in:\n%s", prefix, w.Body.String())
+		}
+	}
+	// The memory store doesn't have a connection pool
+	if strings.Contains(w.Body.String(), "page_db_connections") {
+		t.Error("Found pool statistics for the memory store")
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{0.1, 1})
+	for _, value := range []float64{0.05, 0.1, 0.5, 2} {
+		h.observe(value)
+	}
+	var output strings.Builder
+	writeHistogram(&output, "latency", h, "route", `/"quoted"`)
+	assertEq(t, output.String(), strings.Join([]string{
+		`latency_bucket{route="/\"quoted\"",le="0.1"} 2`,
+		`latency_bucket{route="/\"quoted\"",le="1"} 3`,
+		`latency_bucket{route="/\"quoted\"",le="+Inf"} 4`,
+		`latency_sum{route="/\"quoted\""} 2.65`,
+		`latency_count{route="/\"quoted\""} 4`,
+	}, "\n")+"\n")
+}
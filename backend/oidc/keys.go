@@ -0,0 +1,229 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// How long a provider's signing keys are cached for.
+const KEYS_LIFETIME = time.Hour
+
+// The least time between fetches of the keys when a token is signed with an unknown key.
+// Providers add new keys before signing with them, so the cached keys are
+// refreshed when they rotate, but forged tokens can't make the server hammer them.
+const KEYS_MIN_REFRESH = time.Minute
+
+// The smallest RSA keys that are accepted.
+const MIN_RSA_BITS = 2048
+
+// The provider's signing keys, fetched from its jwks_uri.
+type keySet struct {
+	keys    []publicKey
+	fetched time.Time
+}
+
+type publicKey struct {
+	id        string
+	algorithm string // Only set when the key is restricted to an algorithm
+	key       crypto.PublicKey
+}
+
+// A key in a JSON Web Key Set (RFC 7517). Only RSA and elliptic curve keys are supported.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Get the key a token was signed with, fetching the keys when
+// they're stale or when they don't include the key.
+func (p *Provider) key(ctx context.Context, id, algorithm string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	age := p.now().Sub(p.keys.fetched)
+	if age < KEYS_LIFETIME {
+		if key, found := p.keys.find(id, algorithm); found {
+			return key, nil
+		}
+		if age < KEYS_MIN_REFRESH {
+			return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, id)
+		}
+	}
+
+	if err := p.fetchKeys(ctx); err != nil {
+		return nil, err
+	}
+	if key, found := p.keys.find(id, algorithm); found {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, id)
+}
+
+// Replace the cached keys with the provider's current keys. Must be called with p.mu held.
+func (p *Provider) fetchKeys(ctx context.Context) error {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return err
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJson(ctx, metadata.JwksUri, &set); err != nil {
+		return fmt.Errorf("Fetching the keys of %s: %w", p.Issuer, err)
+	}
+
+	keys := []publicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue // Keys the server can't use don't stop it from using the others
+		}
+		keys = append(keys, publicKey{id: jwk.Kid, algorithm: jwk.Alg, key: key})
+	}
+	p.keys = keySet{keys: keys, fetched: p.now()}
+	return nil
+}
+
+// Find the key with the id that can be used with the algorithm. Tokens without
+// a key id can only be verified when a single key can be used with the algorithm.
+func (s keySet) find(id, algorithm string) (crypto.PublicKey, bool) {
+	var matches []crypto.PublicKey
+	for _, key := range s.keys {
+		if (id == "" || key.id == id) && key.supports(algorithm) {
+			matches = append(matches, key.key)
+		}
+	}
+	if len(matches) == 0 || (id == "" && len(matches) > 1) {
+		return nil, false
+	}
+	return matches[0], true
+}
+
+func (k publicKey) supports(algorithm string) bool {
+	if k.algorithm != "" && k.algorithm != algorithm {
+		return false
+	}
+	switch key := k.key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(algorithm, "RS")
+	case *ecdsa.PublicKey:
+		curves := map[string]elliptic.Curve{"ES256": elliptic.P256(), "ES384": elliptic.P384(), "ES512": elliptic.P521()}
+		return curves[algorithm] == key.Curve
+	}
+	return false
+}
+
+func decodeBase64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBase64(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBase64(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+		if key.N.BitLen() < MIN_RSA_BITS || !exponent.IsInt64() || key.E < 3 || key.E%2 == 0 {
+			return nil, errors.New("Invalid RSA key")
+		}
+		return key, nil
+
+	case "EC":
+		curves := map[string]struct {
+			curve elliptic.Curve
+			ecdh  ecdh.Curve
+		}{
+			"P-256": {elliptic.P256(), ecdh.P256()},
+			"P-384": {elliptic.P384(), ecdh.P384()},
+			"P-521": {elliptic.P521(), ecdh.P521()},
+		}
+		curve, found := curves[jwk.Crv]
+		if !found {
+			return nil, fmt.Errorf("Unsupported curve %q", jwk.Crv)
+		}
+		x, err := decodeBase64(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBase64(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		// Parsing the uncompressed point checks that it's on the curve
+		size := (curve.curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, errors.New("Invalid elliptic curve key")
+		}
+		point := append(append([]byte{4}, x...), y...)
+		if _, err := curve.ecdh.NewPublicKey(point); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve.curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("Unsupported key type %q", jwk.Kty)
+}
+
+// Hash functions of the supported signing algorithms.
+var ALGORITHMS = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// Check a JSON Web Signature (RFC 7515) made with the key and algorithm.
+func verifySignature(key crypto.PublicKey, algorithm string, signed, signature []byte) error {
+	hash := ALGORITHMS[algorithm]
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+	case *ecdsa.PublicKey:
+		// The signature is r followed by s, each the size of the curve
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("Invalid signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("Invalid signature")
+		}
+		return nil
+	}
+	return errors.New("Unsupported key")
+}
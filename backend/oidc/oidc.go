@@ -0,0 +1,217 @@
+// Package oidc signs users in with OpenID Connect providers using the
+// authorization code flow with PKCE, and validates the ID tokens they issue.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The longest a request to a provider is allowed to take.
+const REQUEST_TIMEOUT = 10 * time.Second
+
+// The largest response read from a provider.
+const MAX_RESPONSE_SIZE = 1 << 20
+
+var ErrInvalidToken = errors.New("Invalid ID token")
+
+// How the server is registered with a provider.
+type Config struct {
+	Name         string // Identifies the provider in urls, ex. "company"
+	DisplayName  string // Shown to users, ex. "Company SSO"
+	Issuer       string // Url the discovery document is served under
+	ClientId     string
+	ClientSecret string   // Empty for public clients
+	RedirectUrl  string   // Where the provider sends users back with the authorization code
+	Scopes       []string // Requested along with "openid", "email" by default
+}
+
+// The parts of a provider's discovery document that are used.
+type Metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+// The response of the token endpoint.
+type Tokens struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	IdToken     string `json:"id_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// An OpenID Connect provider. Its discovery document is fetched once
+// and its signing keys are cached, see keys.go.
+type Provider struct {
+	Config
+	client *http.Client
+	now    func() time.Time
+
+	mu       sync.Mutex // Held while the discovery document or the keys are fetched
+	metadata *Metadata
+	keys     keySet
+}
+
+func NewProvider(config Config) *Provider {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"email"}
+	}
+	return &Provider{
+		Config: config,
+		client: &http.Client{Timeout: REQUEST_TIMEOUT},
+		now:    time.Now,
+	}
+}
+
+// Get json from a provider's endpoint.
+func (p *Provider) getJson(ctx context.Context, url string, data any) error {
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	response, err := p.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", url, response.Status)
+	}
+	return json.NewDecoder(io.LimitReader(response.Body, MAX_RESPONSE_SIZE)).Decode(data)
+}
+
+// Get the provider's discovery document, which is only fetched once it succeeds.
+func (p *Provider) Discover(ctx context.Context) (Metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.discover(ctx)
+}
+
+// Must be called with p.mu held.
+func (p *Provider) discover(ctx context.Context) (Metadata, error) {
+	if p.metadata != nil {
+		return *p.metadata, nil
+	}
+
+	var metadata Metadata
+	url := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJson(ctx, url, &metadata); err != nil {
+		return Metadata{}, fmt.Errorf("Discovering %s: %w", p.Issuer, err)
+	}
+	// Stops a provider from issuing tokens in the name of another one
+	if metadata.Issuer != p.Issuer {
+		return Metadata{}, fmt.Errorf("Discovering %s: the document is for %s", p.Issuer, metadata.Issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JwksUri == "" {
+		return Metadata{}, fmt.Errorf("Discovering %s: endpoints are missing", p.Issuer)
+	}
+	p.metadata = &metadata
+	return metadata, nil
+}
+
+// Generate a random string, such as a PKCE code verifier, a state or a nonce.
+func RandomString() string {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(random)
+}
+
+// The PKCE code challenge of a code verifier, using the S256 method.
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// The url of the provider's login page, which redirects back to RedirectUrl
+// with the state and an authorization code. The nonce ends up in the ID token,
+// and the code can only be exchanged along with the verifier.
+func (p *Provider) AuthCodeUrl(ctx context.Context, state, nonce, verifier string) (string, error) {
+	metadata, err := p.Discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	endpoint, err := url.Parse(metadata.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+
+	query := endpoint.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientId)
+	query.Set("redirect_uri", p.RedirectUrl)
+	query.Set("scope", strings.Join(append([]string{"openid"}, p.Scopes...), " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", CodeChallenge(verifier))
+	query.Set("code_challenge_method", "S256")
+	endpoint.RawQuery = query.Encode()
+	return endpoint.String(), nil
+}
+
+// Exchange an authorization code for the user's tokens. The ID token
+// still has to be validated with Verify.
+func (p *Provider) Exchange(ctx context.Context, code, verifier string) (Tokens, error) {
+	metadata, err := p.Discover(ctx)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectUrl)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", p.ClientId)
+	request, err := http.NewRequestWithContext(ctx, "POST", metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Tokens{}, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		// Credentials are form encoded before being used in basic auth (RFC 6749 section 2.3.1)
+		request.SetBasicAuth(url.QueryEscape(p.ClientId), url.QueryEscape(p.ClientSecret))
+	}
+
+	response, err := p.client.Do(request)
+	if err != nil {
+		return Tokens{}, err
+	}
+	defer response.Body.Close()
+	body := io.LimitReader(response.Body, MAX_RESPONSE_SIZE)
+
+	if response.StatusCode != http.StatusOK {
+		var failure struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		json.NewDecoder(body).Decode(&failure)
+		return Tokens{}, fmt.Errorf("Exchanging the code returned %s: %s %s",
+			response.Status, failure.Error, failure.Description)
+	}
+
+	var tokens Tokens
+	if err := json.NewDecoder(body).Decode(&tokens); err != nil {
+		return Tokens{}, err
+	}
+	if tokens.IdToken == "" {
+		return Tokens{}, errors.New("Exchanging the code didn't return an ID token")
+	}
+	return tokens, nil
+}
@@ -0,0 +1,217 @@
+package oidc
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aabiji/page/backend/oidc/oidctest"
+)
+
+var ctx = context.Background()
+
+func newTestProvider(t *testing.T) (*Provider, *oidctest.Provider) {
+	idp, server := oidctest.NewServer("page", "secret")
+	t.Cleanup(server.Close)
+	p := NewProvider(Config{
+		Name:         "test",
+		Issuer:       server.URL,
+		ClientId:     "page",
+		ClientSecret: "secret",
+		RedirectUrl:  "http://localhost:8080/callback",
+	})
+	return p, idp
+}
+
+// Follow the login page's redirect and return the authorization code.
+func authorize(t *testing.T, p *Provider, state, nonce, verifier string) string {
+	t.Helper()
+	loginUrl, err := p.AuthCodeUrl(ctx, state, nonce, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	response, err := client.Get(loginUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	redirect, err := url.Parse(response.Header.Get("Location"))
+	if err != nil || !strings.HasPrefix(redirect.String(), p.RedirectUrl) {
+		t.Fatalf("Redirected to %q", response.Header.Get("Location"))
+	}
+	if redirect.Query().Get("state") != state {
+		t.Fatalf("Redirected with state %q", redirect.Query().Get("state"))
+	}
+	return redirect.Query().Get("code")
+}
+
+func TestLogin(t *testing.T) {
+	p, idp := newTestProvider(t)
+	idp.SetUser(oidctest.User{Subject: "42", Email: "reader@example.com", EmailVerified: true})
+
+	verifier := RandomString()
+	code := authorize(t, p, "state", "nonce", verifier)
+	tokens, err := p.Exchange(ctx, code, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := p.Verify(ctx, tokens.IdToken, "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "42" || claims.Email != "reader@example.com" || !claims.EmailVerified {
+		t.Errorf("Got claims %+v", claims)
+	}
+
+	// Codes can only be used once, and only with their verifier
+	if _, err := p.Exchange(ctx, code, verifier); err == nil {
+		t.Error("Exchanged a code twice")
+	}
+	code = authorize(t, p, "state", "nonce", verifier)
+	if _, err := p.Exchange(ctx, code, RandomString()); err == nil {
+		t.Error("Exchanged a code with the wrong verifier")
+	}
+
+	wrongSecret := NewProvider(p.Config)
+	wrongSecret.ClientSecret = "wrong"
+	code = authorize(t, wrongSecret, "state", "nonce", verifier)
+	if _, err := wrongSecret.Exchange(ctx, code, verifier); err == nil {
+		t.Error("Exchanged a code with the wrong client secret")
+	}
+}
+
+func TestDiscoveryIssuer(t *testing.T) {
+	p, _ := newTestProvider(t)
+	other := NewProvider(p.Config)
+	other.Issuer += "/"
+	if _, err := other.Discover(ctx); err == nil {
+		t.Error("Used a discovery document for another issuer")
+	}
+	if _, err := p.Discover(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	p, idp := newTestProvider(t)
+	user := oidctest.User{Subject: "42", Email: "reader@example.com"}
+	valid := idp.SignToken(idp.Claims(user, "nonce"))
+	if _, err := p.Verify(ctx, valid, "nonce"); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	changes := map[string]map[string]any{
+		"another issuer":         {"iss": "http://example.com"},
+		"another audience":       {"aud": "other"},
+		"no authorized party":    {"aud": []string{"page", "other"}},
+		"another authorized":     {"aud": []string{"page", "other"}, "azp": "other"},
+		"expired":                {"exp": now.Add(-2 * CLOCK_LEEWAY).Unix()},
+		"no expiry":              {"exp": nil},
+		"issued in the future":   {"iat": now.Add(2 * CLOCK_LEEWAY).Unix()},
+		"another nonce":          {"nonce": "other"},
+		"no subject":             {"sub": ""},
+		"wrong type of audience": {"aud": 1},
+	}
+	for name, change := range changes {
+		claims := idp.Claims(user, "nonce")
+		for claim, value := range change {
+			claims[claim] = value
+		}
+		_, err := p.Verify(ctx, idp.SignToken(claims), "nonce")
+		if !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Verifying a token with %s returned %v", name, err)
+		}
+	}
+
+	// Within the leeway, the audience can include others trusted by the client
+	claims := idp.Claims(user, "nonce")
+	claims["exp"] = now.Add(-CLOCK_LEEWAY / 2).Unix()
+	claims["aud"] = []string{"page", "other"}
+	claims["azp"] = "page"
+	if _, err := p.Verify(ctx, idp.SignToken(claims), "nonce"); err != nil {
+		t.Error(err)
+	}
+
+	parts := strings.Split(valid, ".")
+	forged := map[string]string{
+		"tampered claims":   parts[0] + "." + encode(`{"iss": "`+p.Issuer+`", "sub": "1"}`) + "." + parts[2],
+		"no signature":      encode(`{"alg": "none"}`) + "." + parts[1] + ".",
+		"an hmac signature": encode(`{"alg": "HS256"}`) + "." + parts[1] + "." + parts[2],
+		"missing parts":     parts[0] + "." + parts[1],
+	}
+	for name, token := range forged {
+		if _, err := p.Verify(ctx, token, "nonce"); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Verifying a token with %s returned %v", name, err)
+		}
+	}
+}
+
+func encode(s string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func TestKeyRotation(t *testing.T) {
+	p, idp := newTestProvider(t)
+	now := time.Now()
+	p.now = func() time.Time { return now }
+	user := oidctest.User{Subject: "42"}
+	verify := func(token string) error {
+		_, err := p.Verify(ctx, token, "nonce")
+		return err
+	}
+
+	// Keys are cached
+	claims := idp.Claims(user, "nonce")
+	claims["exp"] = now.Add(2 * KEYS_LIFETIME).Unix()
+	old := idp.SignToken(claims)
+	for i := 0; i < 2; i++ {
+		if err := verify(old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if idp.KeyRequests() != 1 {
+		t.Fatalf("Fetched the keys %d times", idp.KeyRequests())
+	}
+
+	// Tokens signed with unknown keys only refresh the keys once in a while
+	idp.RotateKey("ES256")
+	rotated := idp.SignToken(idp.Claims(user, "nonce"))
+	if err := verify(rotated); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("Verified a token with an unknown key: %v", err)
+	}
+	now = now.Add(KEYS_MIN_REFRESH)
+	if err := verify(rotated); err != nil {
+		t.Fatal(err)
+	}
+	if idp.KeyRequests() != 2 {
+		t.Fatalf("Fetched the keys %d times", idp.KeyRequests())
+	}
+
+	// Removed keys stop working once the keys expire
+	idp.RemoveOldKeys()
+	if err := verify(old); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(KEYS_LIFETIME)
+	if err := verify(old); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("Verified a token with a removed key: %v", err)
+	}
+	claims = idp.Claims(user, "nonce")
+	claims["exp"] = now.Add(time.Hour).Unix()
+	if err := verify(idp.SignToken(claims)); err != nil {
+		t.Fatal(err)
+	}
+	if idp.KeyRequests() != 3 {
+		t.Fatalf("Fetched the keys %d times", idp.KeyRequests())
+	}
+}
@@ -0,0 +1,332 @@
+// Package oidctest runs an OpenID Connect provider that signs in a configured
+// user without asking for credentials, for tests and local development.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long authorization codes and ID tokens stay valid for.
+const (
+	CODE_LIFETIME  = time.Minute
+	TOKEN_LIFETIME = time.Hour
+)
+
+// The user signed in by the provider.
+type User struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+type signingKey struct {
+	id        string
+	algorithm string // RS256 or ES256
+	private   crypto.Signer
+}
+
+// An authorization code waiting to be exchanged.
+type grant struct {
+	redirectUri string
+	challenge   string
+	nonce       string
+	user        User
+	expires     time.Time
+}
+
+// A provider serving the discovery document along with the
+// /authorize, /token and /jwks endpoints under its issuer.
+type Provider struct {
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+
+	mu          sync.Mutex
+	user        User
+	keys        []signingKey // The last key signs tokens
+	codes       map[string]grant
+	keyRequests int
+}
+
+// Create a provider signing tokens with an RS256 key, which signs in
+// the user with subject "1" and email "reader@example.com".
+func New(issuer, clientId, clientSecret string) *Provider {
+	p := &Provider{
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientId:     clientId,
+		ClientSecret: clientSecret,
+		user:         User{Subject: "1", Email: "reader@example.com", EmailVerified: true},
+		codes:        map[string]grant{},
+	}
+	p.RotateKey("RS256")
+	return p
+}
+
+// Start a provider on a local port. The server must be closed when done.
+func NewServer(clientId, clientSecret string) (*Provider, *httptest.Server) {
+	p := New("", clientId, clientSecret)
+	server := httptest.NewServer(p)
+	p.Issuer = server.URL
+	return p, server
+}
+
+// Set the user signed in by the following authorization requests.
+func (p *Provider) SetUser(user User) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.user = user
+}
+
+func randomString(size int) string {
+	random := make([]byte, size)
+	if _, err := rand.Read(random); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(random)
+}
+
+// Sign the following tokens with a new key using the algorithm, RS256 or ES256,
+// and return its id. Previous keys are still published until RemoveOldKeys.
+func (p *Provider) RotateKey(algorithm string) string {
+	key := signingKey{id: randomString(8), algorithm: algorithm}
+	var err error
+	switch algorithm {
+	case "RS256":
+		key.private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		key.private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		err = fmt.Errorf("Unsupported algorithm %q", algorithm)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = append(p.keys, key)
+	return key.id
+}
+
+// Stop publishing every key but the one signing tokens.
+func (p *Provider) RemoveOldKeys() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = p.keys[len(p.keys)-1:]
+}
+
+// The number of times the keys were fetched.
+func (p *Provider) KeyRequests() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.keyRequests
+}
+
+// The claims of an ID token issued now for the user.
+func (p *Provider) Claims(user User, nonce string) map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":            p.Issuer,
+		"sub":            user.Subject,
+		"aud":            p.ClientId,
+		"exp":            now.Add(TOKEN_LIFETIME).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          nonce,
+		"email":          user.Email,
+		"email_verified": user.EmailVerified,
+	}
+}
+
+func encode(data any) string {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// Sign an ID token containing the claims with the current key.
+func (p *Provider) SignToken(claims map[string]any) string {
+	p.mu.Lock()
+	key := p.keys[len(p.keys)-1]
+	p.mu.Unlock()
+
+	signed := encode(map[string]string{"alg": key.algorithm, "kid": key.id, "typ": "JWT"}) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	var err error
+	switch private := key.private.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, private, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, private, digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (p *Provider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		p.discovery(w, r)
+	case "/authorize":
+		p.authorize(w, r)
+	case "/token":
+		p.token(w, r)
+	case "/jwks":
+		p.jwks(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func respondWithJson(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+// Respond with an OAuth2 error (RFC 6749 section 5.2).
+func respondWithError(w http.ResponseWriter, status int, code, description string) {
+	respondWithJson(w, status, map[string]string{"error": code, "error_description": description})
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, r *http.Request) {
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"issuer":                                p.Issuer,
+		"authorization_endpoint":                p.Issuer + "/authorize",
+		"token_endpoint":                        p.Issuer + "/token",
+		"jwks_uri":                              p.Issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256", "ES256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+// Sign the user in right away and redirect back with an authorization code.
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != p.ClientId {
+		http.Error(w, "Unknown client", http.StatusBadRequest)
+		return
+	}
+	redirect, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || !redirect.IsAbs() {
+		http.Error(w, "Invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	response := redirect.Query()
+	response.Set("state", query.Get("state"))
+	scopes := strings.Fields(query.Get("scope"))
+	if query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" ||
+		query.Get("code_challenge") == "" || len(scopes) == 0 || scopes[0] != "openid" {
+		response.Set("error", "invalid_request")
+	} else {
+		code := randomString(16)
+		p.mu.Lock()
+		p.codes[code] = grant{
+			redirectUri: query.Get("redirect_uri"),
+			challenge:   query.Get("code_challenge"),
+			nonce:       query.Get("nonce"),
+			user:        p.user,
+			expires:     time.Now().Add(CODE_LIFETIME),
+		}
+		p.mu.Unlock()
+		response.Set("code", code)
+	}
+	redirect.RawQuery = response.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// Exchange an authorization code for an ID token.
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.Method != "POST" {
+		respondWithError(w, http.StatusBadRequest, "invalid_request", "")
+		return
+	}
+	clientId, clientSecret, found := r.BasicAuth()
+	if found {
+		clientId, _ = url.QueryUnescape(clientId)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientId, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientId != p.ClientId || clientSecret != p.ClientSecret {
+		respondWithError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		respondWithError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+		return
+	}
+
+	p.mu.Lock()
+	code := r.PostForm.Get("code")
+	g, found := p.codes[code]
+	delete(p.codes, code) // Codes can only be used once
+	p.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case !found || time.Now().After(g.expires):
+		respondWithError(w, http.StatusBadRequest, "invalid_grant", "Unknown or expired code")
+	case g.redirectUri != r.PostForm.Get("redirect_uri"):
+		respondWithError(w, http.StatusBadRequest, "invalid_grant", "Wrong redirect_uri")
+	case base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge:
+		respondWithError(w, http.StatusBadRequest, "invalid_grant", "Wrong code_verifier")
+	default:
+		respondWithJson(w, http.StatusOK, map[string]any{
+			"access_token": randomString(16),
+			"token_type":   "Bearer",
+			"expires_in":   int(TOKEN_LIFETIME.Seconds()),
+			"id_token":     p.SignToken(p.Claims(g.user, g.nonce)),
+		})
+	}
+}
+
+// Publish the public keys as a JSON Web Key Set.
+func (p *Provider) jwks(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keyRequests++
+
+	keys := []map[string]string{}
+	for _, key := range p.keys {
+		jwk := map[string]string{"kid": key.id, "alg": key.algorithm, "use": "sig"}
+		switch public := key.private.Public().(type) {
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case *ecdsa.PublicKey:
+			jwk["kty"] = "EC"
+			jwk["crv"] = "P-256"
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(public.X.FillBytes(make([]byte, 32)))
+			jwk["y"] = base64.RawURLEncoding.EncodeToString(public.Y.FillBytes(make([]byte, 32)))
+		}
+		keys = append(keys, jwk)
+	}
+	respondWithJson(w, http.StatusOK, map[string]any{"keys": keys})
+}
@@ -0,0 +1,115 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// How far apart the clocks of the server and providers are allowed to be.
+const CLOCK_LEEWAY = time.Minute
+
+// The claims of an ID token that are used.
+type Claims struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"` // The user's id at the provider, which never changes
+	Audience        audience `json:"aud"`
+	AuthorizedParty string   `json:"azp"`
+	Expires         int64    `json:"exp"`
+	IssuedAt        int64    `json:"iat"`
+	Nonce           string   `json:"nonce"`
+	Email           string   `json:"email"`
+	EmailVerified   bool     `json:"email_verified"`
+}
+
+// The aud claim is either a string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+func (a audience) contains(clientId string) bool {
+	for _, id := range a {
+		if id == clientId {
+			return true
+		}
+	}
+	return false
+}
+
+func invalid(format string, args ...any) error {
+	return fmt.Errorf("%w: "+format, append([]any{ErrInvalidToken}, args...)...)
+}
+
+// Validate an ID token issued by the provider for the server, following
+// OpenID Connect Core section 3.1.3.7, and return its claims. The nonce
+// must be the one the login was started with, see AuthCodeUrl.
+// Errors caused by the token wrap ErrInvalidToken.
+func (p *Provider) Verify(ctx context.Context, idToken, nonce string) (Claims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return Claims{}, invalid("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJson(parts[0], &header); err != nil {
+		return Claims{}, invalid("malformed header: %v", err)
+	}
+	// Tokens must be signed with the provider's keys, so "none" and HMAC aren't accepted
+	if _, supported := ALGORITHMS[header.Alg]; !supported {
+		return Claims{}, invalid("unsupported algorithm %q", header.Alg)
+	}
+	key, err := p.key(ctx, header.Kid, header.Alg)
+	if err != nil {
+		return Claims{}, err
+	}
+	signature, err := decodeBase64(parts[2])
+	if err != nil {
+		return Claims{}, invalid("malformed signature: %v", err)
+	}
+	if err := verifySignature(key, header.Alg, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return Claims{}, invalid("%v", err)
+	}
+
+	var claims Claims
+	if err := decodeJson(parts[1], &claims); err != nil {
+		return Claims{}, invalid("malformed claims: %v", err)
+	}
+	now := p.now()
+	switch {
+	case claims.Issuer != p.Issuer:
+		return Claims{}, invalid("issued by %q", claims.Issuer)
+	case !claims.Audience.contains(p.ClientId):
+		return Claims{}, invalid("issued for %q", claims.Audience)
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != p.ClientId:
+		return Claims{}, invalid("authorized party is %q", claims.AuthorizedParty)
+	case claims.Expires == 0 || now.Add(-CLOCK_LEEWAY).Unix() >= claims.Expires:
+		return Claims{}, invalid("expired")
+	case now.Add(CLOCK_LEEWAY).Unix() < claims.IssuedAt:
+		return Claims{}, invalid("issued in the future")
+	case claims.Nonce != nonce:
+		return Claims{}, invalid("wrong nonce")
+	case claims.Subject == "":
+		return Claims{}, invalid("missing subject")
+	}
+	return claims, nil
+}
+
+func decodeJson(part string, data any) error {
+	decoded, err := decodeBase64(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(decoded, data)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+//go:generate go run ./tools/genclient -spec openapi.json -out ../frontend/src/lib/api.ts
+
+// The OpenAPI document describing the api, which is the source of truth
+// for the handlers, their payloads and the frontend's generated client.
+//
+//go:embed openapi.json
+var OPENAPI_SPEC []byte
+
+// GET /openapi.json
+//
+// Response: The OpenAPI document describing the api.
+func (s *Server) GetOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(OPENAPI_SPEC)
+}
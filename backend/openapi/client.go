@@ -0,0 +1,212 @@
+package openapi
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const clientHeader = `// Generated from backend/openapi.json by backend/tools/genclient. Don't edit.
+// Regenerate it by running go generate in the backend directory.
+
+import { ApiError, backendOrigin, callApi } from "./utils";
+`
+
+var pathParameter = regexp.MustCompile(`\{(\w+)\}`)
+
+// Generate a typescript client containing an interface for every schema and a
+// function for every operation returning json, except deprecated ones. The functions
+// call callApi from utils.ts, so they resolve to the response or an ApiError.
+func GenerateClient(d *Document) ([]byte, error) {
+	var out strings.Builder
+	out.WriteString(clientHeader)
+
+	for _, name := range sortedKeys(d.Components.Schemas) {
+		out.WriteString("\n")
+		if err := writeInterface(&out, name, d.Components.Schemas[name]); err != nil {
+			return nil, fmt.Errorf("Schema %s: %w", name, err)
+		}
+	}
+
+	for _, path := range sortedKeys(d.Paths) {
+		for _, method := range sortedKeys(d.Paths[path]) {
+			operation := d.Paths[path][method]
+			if err := writeFunction(&out, d, path, method, operation); err != nil {
+				return nil, fmt.Errorf("%s %s: %w", method, path, err)
+			}
+		}
+	}
+	return []byte(out.String()), nil
+}
+
+// Add a comment to the output, if there is one.
+func writeComment(out *strings.Builder, indent, comment string) {
+	for _, line := range strings.Split(strings.TrimSpace(comment), "\n") {
+		if line != "" {
+			fmt.Fprintf(out, "%s// %s\n", indent, line)
+		}
+	}
+}
+
+func writeInterface(out *strings.Builder, name string, s *Schema) error {
+	writeComment(out, "", s.Description)
+	if s.Type != "object" || s.Properties == nil {
+		tsType, err := typescriptType(s)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "export type %s = %s;\n", name, tsType)
+		return nil
+	}
+
+	required := map[string]bool{}
+	for _, property := range s.Required {
+		required[property] = true
+	}
+
+	fmt.Fprintf(out, "export interface %s {\n", name)
+	for _, property := range sortedKeys(s.Properties) {
+		tsType, err := typescriptType(s.Properties[property])
+		if err != nil {
+			return fmt.Errorf("Property %s: %w", property, err)
+		}
+		optional := ""
+		if !required[property] {
+			optional = "?"
+		}
+		writeComment(out, "    ", s.Properties[property].Description)
+		fmt.Fprintf(out, "    %s%s: %s;\n", property, optional, tsType)
+	}
+	out.WriteString("}\n")
+	return nil
+}
+
+func typescriptType(s *Schema) (string, error) {
+	if s.Ref != "" {
+		return refName(s.Ref, "schemas")
+	}
+	if len(s.Enum) > 0 {
+		values := []string{}
+		for _, value := range s.Enum {
+			values = append(values, strconv.Quote(value))
+		}
+		return strings.Join(values, " | "), nil
+	}
+
+	switch s.Type {
+	case "":
+		return "any", nil
+	case "string":
+		return "string", nil
+	case "integer", "number":
+		return "number", nil
+	case "boolean":
+		return "boolean", nil
+	case "array":
+		if s.Items == nil {
+			return "", fmt.Errorf("Array without items")
+		}
+		items, err := typescriptType(s.Items)
+		if err != nil {
+			return "", err
+		}
+		if strings.Contains(items, " ") {
+			items = "(" + items + ")"
+		}
+		return items + "[]", nil
+	case "object":
+		if s.Properties == nil {
+			return "object", nil
+		}
+		return "", fmt.Errorf("Inline objects aren't supported, use a schema component")
+	}
+	return "", fmt.Errorf("Unsupported type %q", s.Type)
+}
+
+// Write a function calling an operation, which has the
+// path parameters, query parameters and body as arguments.
+func writeFunction(out *strings.Builder, d *Document, path, method string, o *Operation) error {
+	if o.Deprecated {
+		return nil
+	}
+	// The function returns the first success response
+	var success Response
+	var err error
+	for _, status := range []string{"200", "201", "202"} {
+		if response, exists := o.Responses[status]; exists {
+			if success, err = d.Response(response); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	responseType := ""
+	if media, exists := success.Content["application/json"]; exists {
+		if responseType, err = typescriptType(media.Schema); err != nil {
+			return err
+		}
+	}
+	if responseType == "" {
+		return nil // Only json responses are supported by callApi
+	}
+
+	arguments := []string{}
+	query := []string{}
+	for _, p := range o.Parameters {
+		p, err := d.Parameter(p)
+		if err != nil {
+			return err
+		}
+		tsType, err := typescriptType(p.Schema)
+		if err != nil {
+			return err
+		}
+		switch p.In {
+		case "path":
+			arguments = append(arguments, fmt.Sprintf("%s: %s", p.Name, tsType))
+		case "query":
+			arguments = append(arguments, fmt.Sprintf("%s?: %s", p.Name, tsType))
+			query = append(query, p.Name)
+		default:
+			return fmt.Errorf("Unsupported %s parameter %s", p.In, p.Name)
+		}
+	}
+
+	callArguments := []string{"url", strconv.Quote(strings.ToUpper(method))}
+	if o.RequestBody != nil {
+		if media, exists := o.RequestBody.Content["application/json"]; exists {
+			tsType, err := typescriptType(media.Schema)
+			if err != nil {
+				return err
+			}
+			arguments = append(arguments, "body: "+tsType)
+			callArguments = append(callArguments, "body")
+		} else if _, exists := o.RequestBody.Content["multipart/form-data"]; exists {
+			arguments = append(arguments, "body: FormData")
+			callArguments = append(callArguments, "body", "true")
+		} else {
+			return fmt.Errorf("Unsupported request body")
+		}
+	}
+	sort.SliceStable(arguments, func(i, j int) bool { // Optional arguments go last
+		return !strings.Contains(arguments[i], "?:") && strings.Contains(arguments[j], "?:")
+	})
+
+	out.WriteString("\n")
+	writeComment(out, "", o.Summary)
+	fmt.Fprintf(out, "export function %s(%s): Promise<%s | ApiError> {\n",
+		o.OperationId, strings.Join(arguments, ", "), responseType)
+	url := pathParameter.ReplaceAllString(path, "${$1}")
+	fmt.Fprintf(out, "    let url = `${backendOrigin}%s`;\n", url)
+	if len(query) > 0 {
+		out.WriteString("    let query = new URLSearchParams();\n")
+		for _, name := range query {
+			fmt.Fprintf(out, "    if (%s !== undefined) query.set(%q, String(%s));\n", name, name, name)
+		}
+		out.WriteString("    if (query.size > 0) url += `?${query}`;\n")
+	}
+	fmt.Fprintf(out, "    return callApi(%s);\n}\n", strings.Join(callArguments, ", "))
+	return nil
+}
@@ -0,0 +1,175 @@
+// Package openapi reads the parts of OpenAPI 3 documents used by
+// the server's api description and generates typed clients from them.
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type Document struct {
+	OpenAPI    string
+	Paths      map[string]PathItem
+	Components Components
+}
+
+// The operations of a path by lowercase http method. Path level
+// fields, such as shared parameters, aren't supported.
+type PathItem map[string]*Operation
+
+type Operation struct {
+	OperationId string
+	Summary     string
+	Description string
+	Deprecated  bool
+	Security    []map[string][]string
+	Parameters  []Parameter
+	RequestBody *RequestBody
+	Responses   map[string]Response
+}
+
+type Parameter struct {
+	Ref      string `json:"$ref"`
+	Name     string
+	In       string // "path", "query", "header" or "cookie"
+	Required bool
+	Schema   *Schema
+}
+
+type RequestBody struct {
+	Required bool
+	Content  map[string]MediaType
+}
+
+type Response struct {
+	Ref         string `json:"$ref"`
+	Description string
+	Content     map[string]MediaType
+}
+
+type MediaType struct {
+	Schema *Schema
+}
+
+type Schema struct {
+	Ref         string `json:"$ref"`
+	Type        string
+	Format      string
+	Description string
+	Enum        []string
+	Default     any
+	Items       *Schema
+	Properties  map[string]*Schema
+	Required    []string
+}
+
+type Components struct {
+	Schemas         map[string]*Schema
+	Parameters      map[string]Parameter
+	Responses       map[string]Response
+	SecuritySchemes map[string]any
+}
+
+// Parse a json OpenAPI document and check that its references can be resolved.
+func Parse(data []byte) (*Document, error) {
+	var d Document
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(d.OpenAPI, "3.") {
+		return nil, fmt.Errorf("Unsupported OpenAPI version %q", d.OpenAPI)
+	}
+
+	operationIds := map[string]bool{}
+	for _, path := range sortedKeys(d.Paths) {
+		for _, method := range sortedKeys(d.Paths[path]) {
+			operation := d.Paths[path][method]
+			if operation.OperationId == "" {
+				return nil, fmt.Errorf("%s %s has no operationId", method, path)
+			}
+			if operationIds[operation.OperationId] {
+				return nil, fmt.Errorf("Duplicate operationId %q", operation.OperationId)
+			}
+			operationIds[operation.OperationId] = true
+			for _, p := range operation.Parameters {
+				if _, err := d.Parameter(p); err != nil {
+					return nil, err
+				}
+			}
+			for _, r := range operation.Responses {
+				if _, err := d.Response(r); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return &d, nil
+}
+
+// The name of the component a reference points to (ex. Book in #/components/schemas/Book).
+func refName(ref, kind string) (string, error) {
+	prefix := "#/components/" + kind + "/"
+	if !strings.HasPrefix(ref, prefix) {
+		return "", fmt.Errorf("Unsupported reference %q", ref)
+	}
+	return strings.TrimPrefix(ref, prefix), nil
+}
+
+// Resolve a parameter that may be a reference to a component.
+func (d *Document) Parameter(p Parameter) (Parameter, error) {
+	if p.Ref == "" {
+		return p, nil
+	}
+	name, err := refName(p.Ref, "parameters")
+	if err != nil {
+		return Parameter{}, err
+	}
+	resolved, exists := d.Components.Parameters[name]
+	if !exists {
+		return Parameter{}, fmt.Errorf("Parameter %q not found", p.Ref)
+	}
+	return resolved, nil
+}
+
+// Resolve a response that may be a reference to a component.
+func (d *Document) Response(r Response) (Response, error) {
+	if r.Ref == "" {
+		return r, nil
+	}
+	name, err := refName(r.Ref, "responses")
+	if err != nil {
+		return Response{}, err
+	}
+	resolved, exists := d.Components.Responses[name]
+	if !exists {
+		return Response{}, fmt.Errorf("Response %q not found", r.Ref)
+	}
+	return resolved, nil
+}
+
+// Resolve a schema that may be a reference to a component.
+func (d *Document) Schema(s *Schema) (*Schema, error) {
+	if s == nil || s.Ref == "" {
+		return s, nil
+	}
+	name, err := refName(s.Ref, "schemas")
+	if err != nil {
+		return nil, err
+	}
+	resolved, exists := d.Components.Schemas[name]
+	if !exists {
+		return nil, fmt.Errorf("Schema %q not found", s.Ref)
+	}
+	return resolved, nil
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
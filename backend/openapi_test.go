@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aabiji/page/backend/epub"
+	"github.com/aabiji/page/backend/openapi"
+	"github.com/gorilla/mux"
+)
+
+// The go types of the schemas in openapi.json.
+var OPENAPI_SCHEMAS = map[string]any{
+	"Credentials":                 Credentials{},
+	"EmptyResponse":               EmptyResponse{},
+	"AccountResponse":             AccountResponse{},
+	"Settings":                    Settings{},
+	"PasswordChangeRequest":       PasswordChangeRequest{},
+	"EmailChangeRequest":          EmailChangeRequest{},
+	"EmailConfirmRequest":         EmailConfirmRequest{},
+	"PasswordResetRequest":        PasswordResetRequest{},
+	"PasswordResetConfirmRequest": PasswordResetConfirmRequest{},
+	"ProviderResponse":            ProviderResponse{},
+	"ApiTokenRequest":             ApiTokenRequest{},
+	"ApiTokenResponse":            ApiTokenResponse{},
+	"ShareRequest":                ShareRequest{},
+	"ShareResponse":               ShareResponse{},
+	"ErrorResponse":               ErrorResponse{},
+	"UploadResponse":              UploadResponse{},
+	"UserBookResponse":            UserBookResponse{},
+	"ProgressRequest":             ProgressRequest{},
+	"BookResponse":                BookResponse{},
+	"HealthResponse":              HealthResponse{},
+	"ReadinessResponse":           ReadinessResponse{},
+	"Series":                      Series{},
+	"SeriesBook":                  SeriesBook{},
+	"Report":                      epub.Report{},
+	"Issue":                       epub.Issue{},
+	"Section":                     epub.Section{},
+	"Metadata":                    epub.Metadata{},
+	"Creator":                     epub.Creator{},
+	"Identifier":                  epub.Identifier{},
+	"MetadataSeries":              epub.Series{},
+}
+
+func parseSpec(t *testing.T) *openapi.Document {
+	d, err := openapi.Parse(OPENAPI_SPEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// Every route must be documented, and every documented operation must have a route.
+func TestSpecMatchesRoutes(t *testing.T) {
+	d := parseSpec(t)
+	documented := map[string]bool{}
+	for path, item := range d.Paths {
+		for method := range item {
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+
+	routes := map[string]bool{}
+	router := newTestServer(t).handler.(*mux.Router)
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil // Static files are served for every method
+		}
+		for _, method := range methods {
+			routes[method+" "+path] = true
+		}
+		return nil
+	})
+
+	for route := range routes {
+		if !documented[route] {
+			t.Errorf("%s isn't documented in openapi.json", route)
+		}
+	}
+	for operation := range documented {
+		if !routes[operation] {
+			t.Errorf("%s is documented but has no route", operation)
+		}
+	}
+}
+
+// The json fields of a struct, and whether they're omitted when empty.
+func jsonFields(t reflect.Type) map[string]bool {
+	fields := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if !field.IsExported() || tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = strings.Contains(options, "omitempty")
+	}
+	return fields
+}
+
+// Every schema must have the same properties as the go type it describes.
+func TestSpecMatchesPayloads(t *testing.T) {
+	d := parseSpec(t)
+	for name, schema := range d.Components.Schemas {
+		value, exists := OPENAPI_SCHEMAS[name]
+		if !exists {
+			t.Errorf("Schema %s has no go type", name)
+			continue
+		}
+
+		required := map[string]bool{}
+		for _, property := range schema.Required {
+			required[property] = true
+		}
+		fields := jsonFields(reflect.TypeOf(value))
+		for property := range schema.Properties {
+			omitempty, exists := fields[property]
+			if !exists {
+				t.Errorf("%s.%s isn't a field of the go type", name, property)
+			} else if required[property] == omitempty {
+				t.Errorf("%s.%s should be required only if it's never omitted", name, property)
+			}
+		}
+		for field := range fields {
+			if _, exists := schema.Properties[field]; !exists {
+				t.Errorf("%s.%s isn't documented", name, field)
+			}
+		}
+	}
+}
+
+// The generated frontend client must be up to date, see go:generate in openapi.go.
+func TestGeneratedClient(t *testing.T) {
+	client, err := openapi.GenerateClient(parseSpec(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing, err := os.ReadFile("../frontend/src/lib/api.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(client, existing) {
+		t.Fatal("frontend/src/lib/api.ts is outdated, run go generate")
+	}
+}
+
+func TestServeSpec(t *testing.T) {
+	s := newTestServer(t)
+	w := s.request("GET", "/openapi.json", nil, 0)
+	assertEq(t, w.Code, http.StatusOK)
+	assertEq(t, w.Header().Get("Content-Type"), "application/json")
+	assertEq(t, w.Body.Bytes(), OPENAPI_SPEC)
+}
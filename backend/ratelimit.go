@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How many requests a key can make, refilled as a token bucket,
+// and how many failures in a row lock it out.
+type RateLimit struct {
+	Burst    int           // Requests that can be made at once
+	Interval time.Duration // Time it takes to get one more request back
+	Failures int           // Failures in a row before the key is locked out
+}
+
+// Logins and account creations are limited by the client's ip and by the email they're
+// for. Failures only lock the email out for the ip they're made from, so anyone can't
+// lock any user out, while guesses from many ips are still slowed down by the email's limit.
+var (
+	LOGIN_IP_LIMIT      = RateLimit{Burst: 20, Interval: 6 * time.Second, Failures: 20}
+	LOGIN_ACCOUNT_LIMIT = RateLimit{Burst: 10, Interval: 30 * time.Second}
+	LOGIN_CLIENT_LIMIT  = RateLimit{Burst: 10, Interval: 30 * time.Second, Failures: 5} // The email from an ip
+	// Password reset requests share the ip's limit, but have their own for the email,
+	// so they can't use up the account's logins or forget its failures
+	RESET_ACCOUNT_LIMIT = RateLimit{Burst: 3, Interval: 20 * time.Minute}
+)
+
+const (
+	LOCKOUT_BASE      = time.Minute    // Lockout after the first failures, doubled for every failure after
+	LOCKOUT_MAX       = time.Hour      // Longest lockout
+	RATE_LIMIT_MEMORY = 24 * time.Hour // How long idle keys and their failures are remembered
+	MAX_LOGIN_BODY    = 1 << 16        // Largest login request, in bytes
+)
+
+// Header holding the client's ip when the server is behind a proxy, such as X-Real-IP
+// or X-Forwarded-For, set by CLIENT_IP_HEADER. Without one, clients are told apart by
+// the address they connect from.
+var CLIENT_IP_HEADER = ""
+
+// State of a key's limit. A zero state is a key that hasn't been used.
+type limitState struct {
+	Tokens      float64 // Requests left, as of Updated
+	Updated     time.Time
+	Failures    int // Failures in a row
+	LockedUntil time.Time
+}
+
+// Take a request, returning how long to wait before retrying when
+// the key is locked out or has no requests left.
+func (limit RateLimit) take(state *limitState, now time.Time) time.Duration {
+	if now.Before(state.LockedUntil) {
+		return state.LockedUntil.Sub(now)
+	}
+	if state.Updated.IsZero() || now.Sub(state.Updated) > RATE_LIMIT_MEMORY {
+		*state = limitState{Tokens: float64(limit.Burst)}
+	} else if now.After(state.Updated) {
+		refilled := float64(now.Sub(state.Updated)) / float64(limit.Interval)
+		state.Tokens = min(float64(limit.Burst), state.Tokens+refilled)
+	}
+	state.Updated = now
+
+	if state.Tokens < 1 {
+		return time.Duration((1 - state.Tokens) * float64(limit.Interval))
+	}
+	state.Tokens--
+	return 0
+}
+
+// Return how long to wait before the key can take a request, without taking one.
+func (limit RateLimit) wait(state limitState, now time.Time) time.Duration {
+	return limit.take(&state, now)
+}
+
+// Record a failure, returning how long the key is locked out for when it's locked out.
+func (limit RateLimit) fail(state *limitState, now time.Time) time.Duration {
+	state.Failures++
+	if limit.Failures == 0 || state.Failures < limit.Failures {
+		return 0
+	}
+	lockout := LOCKOUT_MAX
+	if doublings := state.Failures - limit.Failures; doublings < 16 {
+		lockout = min(LOCKOUT_MAX, LOCKOUT_BASE<<doublings)
+	}
+	state.LockedUntil = now.Add(lockout)
+	return lockout
+}
+
+// Keeps track of the requests made with keys, such as the client's ip,
+// and of their failures. MemoryLimiter works for a single server, while
+// servers sharing a Postgres database can share their limits through DB.
+type Limiter interface {
+	// Return how long to wait before the key can take a request, like
+	// TakeRequest, but without taking one.
+	CheckRequest(ctx context.Context, key string, limit RateLimit, now time.Time) (time.Duration, error)
+	// Take one of the key's requests, returning how long to wait before
+	// retrying when the key is locked out or has no requests left.
+	TakeRequest(ctx context.Context, key string, limit RateLimit, now time.Time) (time.Duration, error)
+	// Record a failed attempt, returning how long the key is locked out for
+	// when the failure locks it out.
+	RecordFailure(ctx context.Context, key string, limit RateLimit, now time.Time) (time.Duration, error)
+	// Forget the key's failures after a successful attempt.
+	ResetFailures(ctx context.Context, key string) error
+}
+
+type MemoryLimiter struct {
+	mutex   sync.Mutex
+	states  map[string]*limitState
+	sweepAt int // Number of keys at which idle keys are removed
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{states: map[string]*limitState{}, sweepAt: 1024}
+}
+
+func (l *MemoryLimiter) state(key string, now time.Time) *limitState {
+	state, exists := l.states[key]
+	if exists {
+		return state
+	}
+
+	// Idle keys are the same as new keys, so they're removed once there are many keys
+	if len(l.states) >= l.sweepAt {
+		for key, state := range l.states {
+			if now.Sub(state.Updated) > RATE_LIMIT_MEMORY {
+				delete(l.states, key)
+			}
+		}
+		l.sweepAt = max(1024, 2*len(l.states))
+	}
+	state = &limitState{}
+	l.states[key] = state
+	return state
+}
+
+func (l *MemoryLimiter) CheckRequest(ctx context.Context, key string, limit RateLimit, now time.Time) (time.Duration, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	state, exists := l.states[key]
+	if !exists {
+		return 0, nil
+	}
+	return limit.wait(*state, now), nil
+}
+
+func (l *MemoryLimiter) TakeRequest(ctx context.Context, key string, limit RateLimit, now time.Time) (time.Duration, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return limit.take(l.state(key, now), now), nil
+}
+
+func (l *MemoryLimiter) RecordFailure(ctx context.Context, key string, limit RateLimit, now time.Time) (time.Duration, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return limit.fail(l.state(key, now), now), nil
+}
+
+func (l *MemoryLimiter) ResetFailures(ctx context.Context, key string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if state, exists := l.states[key]; exists {
+		state.Failures = 0
+	}
+	return nil
+}
+
+// Get the client's ip, see CLIENT_IP_HEADER.
+func clientIp(r *http.Request) string {
+	if CLIENT_IP_HEADER != "" {
+		// Proxies append the address they got the request from to X-Forwarded-For
+		values := strings.Split(r.Header.Get(CLIENT_IP_HEADER), ",")
+		if ip := strings.TrimSpace(values[len(values)-1]); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Limit logins and account creations by the client's ip and by the email of the
+// account, see LOGIN_IP_LIMIT, LOGIN_ACCOUNT_LIMIT and LOGIN_CLIENT_LIMIT. Invalid
+// credentials and emails that are taken count as failures, and too many failures
+// in a row lock the ip, or the account from the ip, out for longer and longer.
+// Limited requests get RATE_LIMITED along with a Retry-After header.
+func (s *Server) limitLogins(next http.Handler) http.Handler {
+	return s.limitByEmail("account:", LOGIN_ACCOUNT_LIMIT, next)
+}
+
+// Limit password reset requests like logins, see RESET_ACCOUNT_LIMIT, so they
+// can't be used to flood a user's inbox.
+func (s *Server) limitPasswordResets(next http.Handler) http.Handler {
+	return s.limitByEmail("reset:", RESET_ACCOUNT_LIMIT, next)
+}
+
+// Limit requests by the client's ip and by the email in their body, keyed by the prefix.
+func (s *Server) limitByEmail(prefix string, accountLimit RateLimit, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The handler reads the email again from the body
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MAX_LOGIN_BODY))
+		if err != nil {
+			respondWithError(w, r, ErrBadRequest.Wrap(err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var credentials Credentials
+		json.Unmarshal(body, &credentials)
+
+		ip := clientIp(r)
+		limits := map[string]RateLimit{"ip:" + ip: LOGIN_IP_LIMIT}
+		accountKeys := []string{}
+		if email := strings.ToLower(strings.TrimSpace(credentials.Email)); email != "" {
+			accountKeys = []string{prefix + email, prefix + email + "|" + ip}
+			limits[accountKeys[0]] = accountLimit
+			limits[accountKeys[1]] = LOGIN_CLIENT_LIMIT
+		}
+
+		// Requests are only taken once every key allows them, so limited
+		// requests can't use up the requests of the account's other clients
+		now := time.Now()
+		var wait time.Duration
+		for key, limit := range limits {
+			keyWait, err := s.limiter.CheckRequest(r.Context(), key, limit, now)
+			if err != nil {
+				respondWithError(w, r, err)
+				return
+			}
+			wait = max(wait, keyWait)
+		}
+		for key, limit := range limits {
+			if wait > 0 {
+				break
+			}
+			wait, err = s.limiter.TakeRequest(r.Context(), key, limit, now)
+			if err != nil {
+				respondWithError(w, r, err)
+				return
+			}
+		}
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			respondWithError(w, r, ErrRateLimited)
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		switch {
+		case recorder.status == http.StatusUnauthorized || recorder.status == http.StatusConflict:
+			for key, limit := range limits {
+				lockout, err := s.limiter.RecordFailure(r.Context(), key, limit, now)
+				if err != nil {
+					s.logger.Warn("Recording a failed login", "error", err)
+				} else if lockout > 0 {
+					s.logger.Warn("Locked out", "event", "login_lockout", "key", key,
+						"lockout", lockout, "path", r.URL.Path, "requestId", getRequestId(r))
+				}
+			}
+		case recorder.status < http.StatusBadRequest:
+			// Succeeding doesn't forget the ip's failures, which could be made guessing other accounts
+			for _, key := range accountKeys {
+				if err := s.limiter.ResetFailures(r.Context(), key); err != nil {
+					s.logger.Warn("Resetting failed logins", "error", err)
+				}
+			}
+		}
+	})
+}
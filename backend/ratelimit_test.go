@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testLimiter(t *testing.T, newLimiter func(t *testing.T) Limiter) {
+	limit := RateLimit{Burst: 2, Interval: time.Minute, Failures: 3}
+	now := time.Now().Truncate(time.Second)
+
+	t.Run("Requests", func(t *testing.T) {
+		l := newLimiter(t)
+		take := func(key string, at time.Time) time.Duration {
+			wait, err := l.TakeRequest(ctx, key, limit, at)
+			assertEq(t, err, nil)
+			return wait
+		}
+		check := func(key string, at time.Time) time.Duration {
+			wait, err := l.CheckRequest(ctx, key, limit, at)
+			assertEq(t, err, nil)
+			return wait
+		}
+		assertEq(t, take("a", now), time.Duration(0))
+		assertEq(t, take("a", now), time.Duration(0))
+		assertEq(t, take("a", now), time.Minute)
+		assertEq(t, take("b", now), time.Duration(0))
+
+		// Checking doesn't take requests
+		assertEq(t, check("a", now), time.Minute)
+		assertEq(t, check("b", now), time.Duration(0))
+		assertEq(t, check("b", now), time.Duration(0))
+		assertEq(t, check("unknown", now), time.Duration(0))
+		assertEq(t, take("b", now), time.Duration(0))
+		assertEq(t, check("b", now), time.Minute)
+
+		// Requests come back over time, up to the burst
+		assertEq(t, take("a", now.Add(30*time.Second)), 30*time.Second)
+		assertEq(t, take("a", now.Add(time.Minute)), time.Duration(0))
+		later := now.Add(time.Hour)
+		assertEq(t, take("a", later), time.Duration(0))
+		assertEq(t, take("a", later), time.Duration(0))
+		assertEq(t, take("a", later), time.Minute)
+	})
+
+	t.Run("Lockouts", func(t *testing.T) {
+		l := newLimiter(t)
+		fail := func(at time.Time) time.Duration {
+			lockout, err := l.RecordFailure(ctx, "a", limit, at)
+			assertEq(t, err, nil)
+			return lockout
+		}
+		take := func(at time.Time) time.Duration {
+			wait, err := l.TakeRequest(ctx, "a", limit, at)
+			assertEq(t, err, nil)
+			return wait
+		}
+
+		take(now)
+		assertEq(t, fail(now), time.Duration(0))
+		assertEq(t, fail(now), time.Duration(0))
+		assertEq(t, fail(now), LOCKOUT_BASE)
+		assertEq(t, take(now.Add(time.Second)), LOCKOUT_BASE-time.Second)
+
+		// Lockouts get longer with every failure in a row
+		now = now.Add(LOCKOUT_BASE)
+		assertEq(t, take(now), time.Duration(0))
+		assertEq(t, fail(now), 2*LOCKOUT_BASE)
+		for i := 0; i < 20; i++ {
+			fail(now)
+		}
+		assertEq(t, fail(now), LOCKOUT_MAX)
+
+		// Until an attempt succeeds, or the key has been idle for a while
+		assertEq(t, l.ResetFailures(ctx, "a"), nil)
+		assertEq(t, fail(now), time.Duration(0))
+		fail(now)
+		now = now.Add(RATE_LIMIT_MEMORY + time.Second)
+		assertEq(t, take(now), time.Duration(0))
+		assertEq(t, fail(now), time.Duration(0))
+		assertEq(t, l.ResetFailures(ctx, "unknown"), nil)
+	})
+}
+
+func TestMemoryLimiter(t *testing.T) {
+	testLimiter(t, func(t *testing.T) Limiter { return NewMemoryLimiter() })
+
+	// Idle keys are removed once there are many keys
+	l := NewMemoryLimiter()
+	now := time.Now()
+	for i := 0; i < 1024; i++ {
+		l.TakeRequest(ctx, fmt.Sprint(i), LOGIN_IP_LIMIT, now)
+	}
+	l.TakeRequest(ctx, "new", LOGIN_IP_LIMIT, now.Add(RATE_LIMIT_MEMORY+time.Second))
+	assertEq(t, len(l.states), 1)
+}
+
+// Runs against the database in PAGE_TEST_DATABASE_URL, like TestPostgresStore.
+func TestPostgresLimiter(t *testing.T) {
+	databaseUrl := os.Getenv("PAGE_TEST_DATABASE_URL")
+	if databaseUrl == "" {
+		t.Skip("PAGE_TEST_DATABASE_URL isn't set")
+	}
+
+	newLimiter := func(t *testing.T) *DB {
+		db, err := NewDatabase(databaseUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		if err := db.Exec(ctx, "TRUNCATE RateLimits;"); err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	testLimiter(t, func(t *testing.T) Limiter { return newLimiter(t) })
+
+	// Idle keys are removed when keys are added
+	db := newLimiter(t)
+	now := time.Now()
+	db.TakeRequest(ctx, "idle", LOGIN_IP_LIMIT, now)
+	db.TakeRequest(ctx, "new", LOGIN_IP_LIMIT, now.Add(RATE_LIMIT_MEMORY+time.Second))
+	var count int
+	assertEq(t, db.ExecScan(ctx, "SELECT COUNT(*) FROM RateLimits;", nil, &count), nil)
+	assertEq(t, count, 1)
+}
+
+func TestLoginRateLimit(t *testing.T) {
+	s := newTestServer(t)
+	logs := &bytes.Buffer{}
+	s.logger = slog.New(slog.NewTextHandler(logs, nil))
+	s.store.CreateUser(ctx, "reader@example.com", "hash")
+	post := func(url, email, password, ip string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"email": %q, "password": %q}`, email, password)
+		r := httptest.NewRequest("POST", url, strings.NewReader(body))
+		r.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		s.handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// Failures in a row lock the account out from the ip they're made from
+	for i := 1; i < LOGIN_CLIENT_LIMIT.Failures; i++ {
+		w := post("/api/v1/session", "reader@example.com", "wrong", "192.0.2.1")
+		assertError(t, w, ErrInvalidCredentials)
+	}
+	assertEq(t, strings.Contains(logs.String(), "login_lockout"), false)
+	w := post("/api/v1/session", "Reader@example.com", "wrong", "192.0.2.1")
+	assertError(t, w, ErrInvalidCredentials)
+	assertEq(t, strings.Contains(logs.String(), "event=login_lockout key=account:reader@example.com|192.0.2.1"), true)
+	w = post("/user/login", "reader@example.com", "hash", "192.0.2.1")
+	assertError(t, w, ErrRateLimited)
+	assertEq(t, w.Header().Get("Retry-After"), "60")
+	w = post("/api/v1/session", "other@example.com", "hash", "192.0.2.1")
+	assertError(t, w, ErrInvalidCredentials)
+
+	// But not from other ips, so anyone can't lock users out of their account
+	w = post("/api/v1/session", "reader@example.com", "hash", "198.51.100.1")
+	assertEq(t, w.Code, http.StatusOK)
+
+	// Limited requests don't take any of the account's requests, so a locked
+	// out ip can't use them up for the account's other clients
+	for i := 0; i < 2*LOGIN_ACCOUNT_LIMIT.Burst; i++ {
+		w = post("/api/v1/session", "reader@example.com", "wrong", "192.0.2.1")
+		assertError(t, w, ErrRateLimited)
+	}
+	w = post("/api/v1/session", "reader@example.com", "hash", "198.51.100.1")
+	assertEq(t, w.Code, http.StatusOK)
+
+	// Guesses from many ips are slowed down by the account's limit instead,
+	// which the allowed requests above took 7 of
+	for i := 7; i < LOGIN_ACCOUNT_LIMIT.Burst; i++ {
+		w = post("/api/v1/session", "reader@example.com", "wrong", fmt.Sprintf("192.0.2.%d", i))
+		assertError(t, w, ErrInvalidCredentials)
+	}
+	w = post("/api/v1/session", "reader@example.com", "hash", "198.51.100.1")
+	assertError(t, w, ErrRateLimited)
+	assertEq(t, w.Header().Get("Retry-After"), "30")
+	assertEq(t, strings.Count(logs.String(), "login_lockout"), 1)
+
+	// Succeeding forgets the account's failures
+	s.store.CreateUser(ctx, "writer@example.com", "hash")
+	for i := 0; i < 2*LOGIN_CLIENT_LIMIT.Failures-2; i++ {
+		if i == LOGIN_CLIENT_LIMIT.Failures-1 {
+			w = post("/api/v1/session", "writer@example.com", "hash", "198.51.100.2")
+			assertEq(t, w.Code, http.StatusOK)
+		}
+		w = post("/api/v1/session", "writer@example.com", "wrong", "198.51.100.2")
+		assertError(t, w, ErrInvalidCredentials)
+	}
+
+	// Each ip can only make so many requests at once, even when they don't fail
+	for i := 0; i < LOGIN_IP_LIMIT.Burst; i++ {
+		w = post("/api/v1/users", fmt.Sprintf("%d@example.com", i), "", "203.0.113.1")
+		assertError(t, w, ErrBadRequest)
+	}
+	w = post("/api/v1/users", "new@example.com", "hash", "203.0.113.1")
+	assertError(t, w, ErrRateLimited)
+	assertEq(t, w.Header().Get("Retry-After"), "6")
+
+	// Creating accounts with emails that are taken counts as failures
+	s.store.CreateUser(ctx, "taken@example.com", "hash")
+	for i := 1; i <= LOGIN_CLIENT_LIMIT.Failures; i++ {
+		w = post("/user/create", "taken@example.com", "hash", "203.0.113.2")
+		assertError(t, w, ErrDuplicateAccount)
+	}
+	w = post("/api/v1/session", "taken@example.com", "hash", "203.0.113.2")
+	assertError(t, w, ErrRateLimited)
+
+	// Password reset requests are limited by their own key for the email, so
+	// they neither lock the account out nor forget its failures
+	for i := 0; i < RESET_ACCOUNT_LIMIT.Burst; i++ {
+		w = post("/api/v1/password/reset", "writer@example.com", "", fmt.Sprintf("198.51.100.%d", i+10))
+		assertEq(t, w.Code, http.StatusAccepted)
+	}
+	w = post("/api/v1/password/reset", "Writer@example.com", "", "198.51.100.20")
+	assertError(t, w, ErrRateLimited)
+	assertEq(t, w.Header().Get("Retry-After"), "1200")
+	w = post("/api/v1/session", "writer@example.com", "wrong", "198.51.100.2")
+	assertError(t, w, ErrInvalidCredentials)
+	w = post("/api/v1/session", "writer@example.com", "hash", "198.51.100.2")
+	assertError(t, w, ErrRateLimited)
+	w = post("/api/v1/password/reset", "reader@example.com", "", "198.51.100.20")
+	assertEq(t, w.Code, http.StatusAccepted)
+}
+
+func TestClientIp(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.1")
+	assertEq(t, clientIp(r), "192.0.2.1")
+
+	CLIENT_IP_HEADER = "X-Forwarded-For"
+	defer func() { CLIENT_IP_HEADER = "" }()
+	assertEq(t, clientIp(r), "203.0.113.1")
+	r.Header.Del("X-Forwarded-For")
+	assertEq(t, clientIp(r), "192.0.2.1")
+}
@@ -1,228 +1,465 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/aabiji/page/backend/epub"
 	"github.com/gorilla/mux"
 )
 
-var database DB = NewDatabase()
 var FILE_UPLOAD_DIRECTORY string  // Directory where uploaded files will be stored
 const MAX_UPLOAD_SIZE = 100 << 20 // 100 megabyte limit on all uploaded files
-const (
-	USERID             = "userId"
-	NOT_FOUND          = "Entries not found"
-	BAD_CLIENT_REQUEST = "Bad client request"
-	INTERNAL_ERROR     = "Internal server error. Please try again"
-	DUPLICATE_ACCOUNT  = "Account already exists. Create a new one with a different email."
-	DUPLICATE_BOOK     = "Book is already in the user's collection."
-	ACCOUNT_NOT_FOUND  = "Account not found. Forgot your password?"
-)
+const USERID = "userId"
+
+// Content security policy for the files served from extracted books.
+// Book content can never run scripts, submit forms or load
+// resources from outside the server, even if it's opened directly.
+const STATIC_FILE_CSP = "default-src 'none'; img-src 'self' data:; media-src 'self'; " +
+	"style-src 'self' 'unsafe-inline'; font-src 'self' data:; form-action 'none'; sandbox"
 
-// GET /static/* (ex. /static/path/to/file.html)
+// GET /static/{token}/* (ex. /static/1700000000.signature/path/to/file.html)
 //
-// Serve requested file from disk to the client.
-func ServeFiles(router *mux.Router) {
+// Serve requested file from disk to the client. The token is signed for the
+// book directory the file is in, see StaticUrl in GET /api/v1/books/{id}.
+// The token is part of the path so that relative urls in the book's files work.
+func (s *Server) ServeFiles(router *mux.Router) {
 	route := "/static/"
 	fs := http.FileServer(http.Dir(epub.EXTRACT_DIRECTORY))
-	router.PathPrefix(route).Handler(http.StripPrefix(route, fs))
+	router.PathPrefix(route).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, file, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, route), "/")
+		file = path.Clean("/" + file)
+		directory, _, _ := strings.Cut(strings.TrimPrefix(file, "/"), "/")
+		if directory == "" || !s.verifyStaticToken(token, directory, time.Now()) {
+			respondWithError(w, r, ErrForbidden)
+			return
+		}
+
+		w.Header().Set("Content-Security-Policy", STATIC_FILE_CSP)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		request := r.Clone(r.Context())
+		request.URL.Path, request.URL.RawPath = file, ""
+		fs.ServeHTTP(w, request)
+	})
 }
 
-// POST /user/login
+// POST /api/v1/session
+// POST /user/login (deprecated)
 //
 // Request payload: {"email": "", "password": "", "confirm": ""}
 //
-// Response: An empty json response and a cookie containing the user's id.
+// Response: An empty json response and a cookie containing the user's session.
 //
 // Validate user login credentials and set a USERID cookie to manage client state.
-func AuthAccount(w http.ResponseWriter, r *http.Request) {
-	var user User
+func (s *Server) AuthAccount(w http.ResponseWriter, r *http.Request) {
+	var user Credentials
 	if err := getRequestJson(w, r, &user); err != nil {
-		respondWithError(w, BAD_CLIENT_REQUEST)
+		respondWithError(w, r, ErrBadRequest.Wrap(err))
 		return
 	}
 	if user.Email == "" || user.Password == "" {
-		respondWithError(w, BAD_CLIENT_REQUEST)
+		respondWithError(w, r, ErrBadRequest)
 		return
 	}
 
-	sql := "SELECT UserId FROM Users WHERE Email=$1 AND Password=$2;"
-	_, err := database.Read(sql, []any{user.Email, user.Password}, []any{&user.Id})
-	if err != nil && err.Error() == NOT_FOUND {
-		respondWithError(w, ACCOUNT_NOT_FOUND)
+	id, err := s.store.GetUserId(r.Context(), user.Email, user.Password)
+	if errors.Is(err, ErrNotFound) {
+		respondWithError(w, r, ErrInvalidCredentials.Wrap(err))
 		return
 	} else if err != nil {
-		respondWithError(w, INTERNAL_ERROR)
+		respondWithError(w, r, err)
+		return
+	}
+	account, err := s.store.GetUser(r.Context(), id)
+	if err != nil {
+		respondWithError(w, r, err)
 		return
 	}
 
-	setCookie(w, r, USERID, user.Id)
+	s.startSession(w, r, account)
+	json.NewEncoder(w).Encode(EmptyResponse{})
 }
 
-// POST /user/create
+// POST /api/v1/users
+// POST /user/create (deprecated)
 //
 // Request payload: {"email": "", "password": "", "confirm":""}
 //
-// Response: An empty json response and a cookie containing the user's id.
+// Response: An empty json response and a cookie containing the user's session.
 //
 // Validate and create new user account and set a USERID cookie to manage client state.
-func CreateAccount(w http.ResponseWriter, r *http.Request) {
-	var user User
+// The account is unverified until the user follows the link mailed to their email,
+// see POST /api/v1/email/confirm.
+func (s *Server) CreateAccount(w http.ResponseWriter, r *http.Request) {
+	var user Credentials
 	if err := getRequestJson(w, r, &user); err != nil {
-		respondWithError(w, BAD_CLIENT_REQUEST)
+		respondWithError(w, r, ErrBadRequest.Wrap(err))
 		return
 	}
-	if user.Email == "" || user.Password == "" {
-		respondWithError(w, BAD_CLIENT_REQUEST)
-		return
-	}
-
-	sql := "SELECT UserId FROM Users WHERE Email=$1;"
-	_, err := database.Read(sql, []any{user.Email}, []any{&user.Id})
-	if err == nil {
-		respondWithError(w, DUPLICATE_ACCOUNT)
+	if !isValidEmail(user.Email) || user.Password == "" {
+		respondWithError(w, r, ErrBadRequest)
 		return
 	}
 
-	sql = "INSERT INTO Users (Email, Password) VALUES ($1,$2) RETURNING UserId;"
-	err = database.ExecScan(sql, []any{user.Email, user.Password}, &user.Id)
+	var id int
+	var token string
+	err := s.store.WithTx(r.Context(), func(tx Store) error {
+		var err error
+		id, err = tx.CreateUser(r.Context(), user.Email, user.Password)
+		if errors.Is(err, ErrDuplicate) {
+			return ErrDuplicateAccount.Wrap(err)
+		} else if err != nil {
+			return err
+		}
+		token, err = newToken(r.Context(), tx, id, TOKEN_CONFIRM_EMAIL, user.Email, CONFIRM_EMAIL_LIFETIME)
+		return err
+	})
 	if err != nil {
-		respondWithError(w, INTERNAL_ERROR)
+		respondWithError(w, r, err)
 		return
 	}
 
-	setCookie(w, r, USERID, user.Id)
+	// The account works without the mail, which can be sent again
+	// with POST /api/v1/me/verification
+	if err := s.sendMail(r.Context(), confirmEmailMail(user.Email, token)); err != nil {
+		s.logger.Warn("Mailing the email confirmation", "error", err)
+	}
+	s.startSession(w, r, User{Id: id})
+	json.NewEncoder(w).Encode(EmptyResponse{})
 }
 
-// POST /user/remove
+// DELETE /api/v1/me
+// POST /user/delete (deprecated)
 //
 // Request payload:
-// Cookie with name set to "userId" and value set to the user's id.
+// Cookie with name set to "userId" and value set to the user's session.
 //
 // Response: Empty json reponse.
 //
-// Remove all rows in the Users table and the UserBooks table where
-// the "UserId" field matches the user id sent in the request cookie.
-func DeleteAccount(w http.ResponseWriter, r *http.Request) {
-	c, err := r.Cookie(USERID)
+// Remove the user's account along with every book in their collection.
+func (s *Server) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	userId, err := s.getUserId(r)
 	if err != nil {
-		respondWithError(w, BAD_CLIENT_REQUEST)
+		respondWithError(w, r, ErrUnauthenticated.Wrap(err))
 		return
 	}
 
-	usersDelete := "DELETE FROM Users WHERE UserId=$1;"
-	if err := database.Exec(usersDelete, c.Value); err != nil {
-		respondWithError(w, INTERNAL_ERROR)
-		return
-	}
-
-	booksDelete := "DELETE FROM UserBooks WHERE UserId=$1;"
-	if err := database.Exec(booksDelete, c.Value); err != nil {
-		respondWithError(w, INTERNAL_ERROR)
+	err = s.store.WithTx(r.Context(), func(tx Store) error {
+		if err := tx.DeleteUser(r.Context(), userId); err != nil {
+			return err
+		}
+		if err := tx.RemoveTokens(r.Context(), userId); err != nil {
+			return err
+		}
+		if err := tx.RemoveIdentities(r.Context(), userId); err != nil {
+			return err
+		}
+		if err := tx.RemoveApiTokens(r.Context(), userId); err != nil {
+			return err
+		}
+		if err := tx.RemoveShares(r.Context(), userId); err != nil {
+			return err
+		}
+		return tx.RemoveUserBooks(r.Context(), userId)
+	})
+	if err != nil {
+		respondWithError(w, r, err)
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]string{})
+	endSession(w, r)
+	json.NewEncoder(w).Encode(EmptyResponse{})
 }
 
-// POST /user/book/upload
+// POST /api/v1/me/books
+// POST /user/book/upload (deprecated)
 //
 // Request payload:
 // Multipart form data with field "file".
-// Cookie with name set to "userId" and value set to the user's id.
+// Cookie with name set to "userId" and value set to the user's session.
 //
-// Response: {"BookId": ""}
+// Response: {"BookId": "", "Validation": {"Issues": [{"Severity": "", "Code": "", "File": "", "Line": "", "Message": ""}]}}
 //
 // Upload a user selected epub file to the server. Add it to the user's collection
-// of books and return the generated bookId
-func UserUploadEpub(w http.ResponseWriter, r *http.Request) {
-	pageCount, bookId, err := receiveEpub(w, r)
+// of books and return the generated bookId along with the epub's validation report.
+// Epubs with fatal issues are rejected with the report as the error's details.
+// Books are only the same when their epubs are: uploading an epub that was
+// already uploaded adds the existing book, keeping the user's progress if it's
+// already in their collection, while other epubs are new books, even with the
+// same title.
+func (s *Server) UserUploadEpub(w http.ResponseWriter, r *http.Request) {
+	userId, err := s.getUserId(r)
+	if err != nil { // Cookie not found
+		respondWithError(w, r, ErrUnauthenticated.Wrap(err))
+		return
+	}
+
+	filename, hash, err := receiveEpub(w, r)
 	if err != nil {
-		respondWithError(w, err.Error())
+		respondWithError(w, r, err)
 		return
 	}
 
-	c, err := r.Cookie(USERID)
-	if err != nil { // Cookie not found
-		respondWithError(w, BAD_CLIENT_REQUEST)
+	bookId, report, err := s.addUploadedBook(r.Context(), userId, hash)
+	if errors.Is(err, ErrNotFound) {
+		bookId, report, err = s.ingestEpub(r.Context(), userId, filename, hash)
+		if errors.Is(err, ErrDuplicate) { // The same epub was uploaded at the same time
+			bookId, report, err = s.addUploadedBook(r.Context(), userId, hash)
+		}
+	} else {
+		os.Remove(filename)
+	}
+	if errors.Is(err, ErrInvalidEpub) {
+		respondWithErrorDetails(w, r, err, report)
+		return
+	} else if err != nil {
+		respondWithError(w, r, err)
 		return
 	}
 
-	sql := "SELECT UserId FROM UserBooks WHERE BookId=$1;"
-	if _, err := database.Read(sql, []any{bookId}, []any{&c.Value}); err == nil {
-		respondWithError(w, DUPLICATE_BOOK)
+	response := UploadResponse{BookId: bookId, Validation: report}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Add the book uploaded from the epub with the hash to the user's collection
+// and return its id along with its validation report. The book's files, report
+// and thumbnails are left as they are. Returns ErrNotFound if there's no such book.
+func (s *Server) addUploadedBook(ctx context.Context, userId int, hash string) (int, epub.Report, error) {
+	var book Book
+	var report epub.Report
+	err := s.store.WithTx(ctx, func(tx Store) error {
+		var err error
+		book, err = tx.GetBookByHash(ctx, hash)
+		if err != nil {
+			return err
+		}
+		report, err = tx.GetValidation(ctx, book.BookId)
+		if errors.Is(err, ErrNotFound) { // Uploaded before books were validated
+			report = epub.Report{Issues: []epub.Issue{}}
+		} else if err != nil {
+			return err
+		}
+
+		userBook := UserBook{UserId: userId, BookId: book.BookId, ScrollOffsets: make([]int, len(book.Files))}
+		_, err = tx.AddUserBook(ctx, userBook)
+		return err
+	})
+	return book.BookId, report, err
+}
+
+// Extract an uploaded epub and save it as a new book in the user's collection,
+// along with its validation report and thumbnails. Returns the book's id and
+// its validation report, which is set even when there's an error.
+func (s *Server) ingestEpub(ctx context.Context, userId int, filename, hash string) (int, epub.Report, error) {
+	e, err := openEpub(filename)
+	if err != nil {
+		return 0, e.Report, err
+	}
+
+	// The book, its validation report and the user's copy are saved together
+	var bookId int
+	err = s.store.WithTx(ctx, func(tx Store) error {
+		bookId, err = insertEpub(ctx, tx, e, hash)
+		if err != nil {
+			return err
+		}
+
+		userBook := UserBook{UserId: userId, BookId: bookId, ScrollOffsets: make([]int, len(e.Files))}
+		_, err = tx.AddUserBook(ctx, userBook)
+		return err
+	})
+	if err != nil {
+		os.Remove(filename)
+		os.RemoveAll(filepath.Join(epub.EXTRACT_DIRECTORY, e.Name))
+		return 0, e.Report, err
+	}
+
+	err = generateThumbnails(s.storage, bookId, e.CoverImagePath, e.Info.Title, e.Info.Author)
+	return bookId, e.Report, err
+}
+
+// PUT /api/v1/me/books/{id}?token={Token}
+// POST /user/book/add/{id}?token={Token} (deprecated)
+//
+// Request payload: Cookie with name set to "userId" and value set to the user's session.
+//
+// Response: {"CurrentPage": 0, "ScrollOffsets": [0]}
+//
+// Add a book that was already uploaded to the user's collection without uploading it
+// again. The token is created by a reader of the book with POST /api/v1/books/{id}/shares,
+// and isn't needed when the book is already in the collection. Adding a book is idempotent:
+// the status code is 201 if the book was added and 200 if it was already there,
+// in which case the user's progress is kept.
+func (s *Server) UserAddBook(w http.ResponseWriter, r *http.Request) {
+	userId, err := s.getUserId(r)
+	if err != nil {
+		respondWithError(w, r, ErrUnauthenticated.Wrap(err))
+		return
+	}
+	bookId, err := getPathId(r)
+	if err != nil {
+		respondWithError(w, r, ErrBadRequest.Wrap(err))
 		return
 	}
 
-	scrollOffsets := make([]int, pageCount)
-	sql = "INSERT INTO UserBooks (UserId, BookId, CurrentPage, ScrollOffsets) VALUES ($1,$2,$3,$4);"
-	if err := database.Exec(sql, c.Value, bookId, 0, scrollOffsets); err != nil {
-		respondWithError(w, INTERNAL_ERROR)
+	var added bool
+	var userBook UserBook
+	err = s.store.WithTx(r.Context(), func(tx Store) error {
+		userBook, err = tx.GetUserBook(r.Context(), userId, bookId)
+		if err == nil || !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		// Books can't be added without a token, so their ids can't be guessed
+		if err := verifyShare(r.Context(), tx, r.URL.Query().Get("token"), bookId); err != nil {
+			return err
+		}
+		book, err := tx.GetBook(r.Context(), bookId)
+		if errors.Is(err, ErrNotFound) {
+			return ErrBookNotFound.Wrap(err)
+		} else if err != nil {
+			return err
+		}
+
+		userBook = UserBook{UserId: userId, BookId: bookId, ScrollOffsets: make([]int, len(book.Files))}
+		added, err = tx.AddUserBook(r.Context(), userBook)
+		return err
+	})
+	if err != nil {
+		respondWithError(w, r, err)
 		return
 	}
 
-	response := map[string]int{"BookId": bookId}
+	if added {
+		w.WriteHeader(http.StatusCreated)
+	}
+	response := UserBookResponse{CurrentPage: userBook.CurrentPage, ScrollOffsets: userBook.ScrollOffsets}
 	json.NewEncoder(w).Encode(response)
 }
 
-// DELETE /user/book/remove/{id}
+// DELETE /api/v1/me/books/{id}
+// POST /user/book/remove/{id} (deprecated)
 //
-// Request payload: Cookie with name set to "userId" and value set to the user's id.
+// Request payload: Cookie with name set to "userId" and value set to the user's session.
 //
 // Response: Empty json response.
 //
 // Remove a book by id from the user's collection.
-func UserRemoveBook(w http.ResponseWriter, r *http.Request) {
-	bookId := mux.Vars(r)["id"]
-	c, err := r.Cookie(USERID)
+func (s *Server) UserRemoveBook(w http.ResponseWriter, r *http.Request) {
+	bookId, err := getPathId(r)
 	if err != nil {
-		respondWithError(w, BAD_CLIENT_REQUEST)
+		respondWithError(w, r, ErrBadRequest.Wrap(err))
+		return
+	}
+	userId, err := s.getUserId(r)
+	if err != nil {
+		respondWithError(w, r, ErrUnauthenticated.Wrap(err))
 		return
 	}
 
-	sql := "DELETE FROM UserBooks WHERE BookId=$1 AND UserId=$2;"
-	if err := database.Exec(sql, bookId, c.Value); err != nil {
-		respondWithError(w, INTERNAL_ERROR)
+	if err := s.store.RemoveUserBook(r.Context(), userId, bookId); err != nil {
+		respondWithError(w, r, err)
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]string{})
+	json.NewEncoder(w).Encode(EmptyResponse{})
 }
 
-// GET /user/book/get/{id}
+// GET /api/v1/me/books/{id}
+// GET /user/book/get/{id} (deprecated)
 //
-// Request payload: Cookie with name set to "userId" and value set to the user's id.
+// Request payload: Cookie with name set to "userId" and value set to the user's session.
 //
 // Response: {"CurrentPage": "", "ScrollOffsets": ""}
 //
 // Get user specific information related to specific book.
-func GetUserBookInfo(w http.ResponseWriter, r *http.Request) {
-	c, err := r.Cookie(USERID)
+func (s *Server) GetUserBookInfo(w http.ResponseWriter, r *http.Request) {
+	userId, err := s.getUserId(r)
 	if err != nil { // Cookie not found
-		respondWithError(w, BAD_CLIENT_REQUEST)
+		respondWithError(w, r, ErrUnauthenticated.Wrap(err))
+		return
+	}
+	bookId, err := getPathId(r)
+	if err != nil {
+		respondWithError(w, r, ErrBadRequest.Wrap(err))
 		return
 	}
-	bookId := mux.Vars(r)["id"]
 
-	currentPage := 0
-	scrollOffsets := []int{}
-	sql := "SELECT CurrentPage, ScrollOffsets FROM UserBooks WHERE UserId=$1 AND BookId=$2;"
-	_, err = database.Read(sql, []any{c.Value, bookId}, []any{&currentPage, &scrollOffsets})
+	userBook, err := s.store.GetUserBook(r.Context(), userId, bookId)
+	if errors.Is(err, ErrNotFound) {
+		respondWithError(w, r, ErrUserBookNotFound.Wrap(err))
+		return
+	} else if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+
+	response := UserBookResponse{
+		CurrentPage:   userBook.CurrentPage,
+		ScrollOffsets: userBook.ScrollOffsets,
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// PUT /api/v1/me/books/{id}/progress
+//
+// Request payload:
+// {"CurrentPage": 0, "ScrollOffsets": [0]}
+// Cookie with name set to "userId" and value set to the user's session.
+//
+// Response: {"CurrentPage": 0, "ScrollOffsets": [0]}
+//
+// Save the user's reading progress in a book from their collection.
+func (s *Server) SaveProgress(w http.ResponseWriter, r *http.Request) {
+	userId, err := s.getUserId(r)
 	if err != nil {
-		respondWithError(w, INTERNAL_ERROR)
+		respondWithError(w, r, ErrUnauthenticated.Wrap(err))
+		return
+	}
+	bookId, err := getPathId(r)
+	if err != nil {
+		respondWithError(w, r, ErrBadRequest.Wrap(err))
+		return
+	}
+	var progress ProgressRequest
+	if err := getRequestJson(w, r, &progress); err != nil {
+		respondWithError(w, r, ErrBadRequest.Wrap(err))
+		return
+	}
+	if progress.CurrentPage < 0 || progress.ScrollOffsets == nil {
+		respondWithError(w, r, ErrBadRequest)
 		return
 	}
 
-	response := map[string]any{
-		"CurrentPage":   currentPage,
-		"ScrollOffsets": scrollOffsets,
+	userBook := UserBook{
+		UserId:        userId,
+		BookId:        bookId,
+		CurrentPage:   progress.CurrentPage,
+		ScrollOffsets: progress.ScrollOffsets,
+	}
+	err = s.store.UpdateProgress(r.Context(), userBook)
+	if errors.Is(err, ErrNotFound) {
+		respondWithError(w, r, ErrUserBookNotFound.Wrap(err))
+		return
+	} else if err != nil {
+		respondWithError(w, r, err)
+		return
 	}
+
+	response := UserBookResponse{CurrentPage: progress.CurrentPage, ScrollOffsets: progress.ScrollOffsets}
 	json.NewEncoder(w).Encode(response)
 }
 
-// GET /book/get/{id}
+// GET /api/v1/books/{id}
+// GET /book/get/{id} (deprecated)
 //
 // Response:
 //
@@ -231,53 +468,230 @@ func GetUserBookInfo(w http.ResponseWriter, r *http.Request) {
 //	 	"CoverImagePath": "",
 //	 	"TableOfContents": [{"Path": "", "Section": ""}],
 //			"Info": {
-//				"Language": "",
-//				"Author": "",
 //				"Title": "",
-//				"Identifier": "",
-//				"Contributor": ""
+//				"Author": "",
+//				"Creators": [{"Name": "", "FileAs": "", "Role": ""}],
+//				"Contributors": [{"Name": "", "FileAs": "", "Role": ""}],
+//				"Identifiers": [{"Value": "", "Scheme": ""}],
+//				"Languages": [""],
+//				"Published": "",
+//				"Modified": "",
 //				"Rights": "",
 //				"Source": "",
 //				"Coverage": "",
 //				"Relation": "",
 //				"Publisher": "",
 //				"Description": "",
-//				"Date": "",
 //				"Subjects": [""],
-//			}
+//				"Series": [{"Name": "", "Index": 0, "Type": ""}],
+//			},
+//			"StaticUrl": "/static/{token}/"
 //	}
 //
-// Get detailed information about a book using it's unique id.
-func GetBook(w http.ResponseWriter, r *http.Request) {
-	bookId := mux.Vars(r)["id"]
+// Get detailed information about a book using it's unique id,
+// if it's in the user's collection (see requireReader).
+func (s *Server) GetBook(w http.ResponseWriter, r *http.Request) {
+	bookId, err := getPathId(r)
+	if err != nil {
+		respondWithError(w, r, ErrBadRequest.Wrap(err))
+		return
+	}
+
+	book, err := s.store.GetBook(r.Context(), bookId)
+	if errors.Is(err, ErrNotFound) {
+		respondWithError(w, r, ErrBookNotFound.Wrap(err))
+		return
+	} else if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+
+	response := BookResponse{
+		CoverImagePath:  book.CoverImagePath,
+		Files:           book.Files,
+		TableOfContents: book.TableOfContents,
+		Info:            book.Info,
+		StaticUrl:       s.signStaticUrl(bookDirectory(book), time.Now()),
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// GET /api/v1/books/{id}/validation
+// GET /book/{id}/validation (deprecated)
+//
+// Response: {"Issues": [{"Severity": "", "Code": "", "File": "", "Line": "", "Message": ""}]}
+//
+// Get the validation report generated when a book was uploaded.
+// Severity is one of "fatal", "error" or "warning".
+func (s *Server) GetBookValidation(w http.ResponseWriter, r *http.Request) {
+	bookId, err := getPathId(r)
+	if err != nil {
+		respondWithError(w, r, ErrBadRequest.Wrap(err))
+		return
+	}
+
+	report, err := s.store.GetValidation(r.Context(), bookId)
+	if errors.Is(err, ErrNotFound) {
+		respondWithError(w, r, ErrBookNotFound.Wrap(err))
+		return
+	} else if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(report)
+}
+
+// GET /api/v1/books/{id}/cover?size=small|medium|large
+// GET /book/{id}/cover?size=small|medium|large (deprecated)
+//
+// Response: The cover thumbnail as a jpeg image.
+//
+// Get a thumbnail of a book's cover. The size defaults to medium.
+// Thumbnails are generated when missing, for books uploaded before thumbnails existed.
+func (s *Server) GetBookCover(w http.ResponseWriter, r *http.Request) {
+	bookId, err := getPathId(r)
+	if err != nil {
+		respondWithError(w, r, ErrBadRequest.Wrap(err))
+		return
+	}
+
+	size := r.URL.Query().Get("size")
+	if size == "" {
+		size = "medium"
+	}
+	if _, exists := THUMBNAIL_SIZES[size]; !exists {
+		respondWithError(w, r, ErrBadRequest)
+		return
+	}
+
+	file, modified, err := s.storage.Get(thumbnailKey(bookId, size))
+	if os.IsNotExist(err) {
+		var book Book
+		book, err = s.store.GetBook(r.Context(), bookId)
+		if errors.Is(err, ErrNotFound) {
+			respondWithError(w, r, ErrBookNotFound.Wrap(err))
+			return
+		} else if err != nil {
+			respondWithError(w, r, err)
+			return
+		}
+
+		err = generateThumbnails(s.storage, bookId, book.CoverImagePath, book.Title, book.Info.Author)
+		if err != nil {
+			respondWithError(w, r, err)
+			return
+		}
+		file, modified, err = s.storage.Get(thumbnailKey(bookId, size))
+	}
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	// Only the book's readers can get its cover, so shared caches can't keep it
+	w.Header().Set("Cache-Control", "private, max-age=604800")
+	w.Header().Set("ETag", fmt.Sprintf(`"%d-%s-%d"`, bookId, size, modified.Unix()))
+	http.ServeContent(w, r, size+".jpg", modified, file)
+}
+
+// GET /api/v1/series
+// GET /series (deprecated)
+//
+// Request payload: Cookie with name set to "userId" and value set to the user's session.
+//
+// Response: [{"SeriesId": 0, "Name": "", "Books": [{"BookId": 0, "Title": "", "Position": 0}]}]
+//
+// Get the series of the books in the user's collection, along with only those
+// books, ordered by their position in the series.
+func (s *Server) GetAllSeries(w http.ResponseWriter, r *http.Request) {
+	userId, err := s.getUserId(r)
+	if err != nil {
+		respondWithError(w, r, ErrUnauthenticated.Wrap(err))
+		return
+	}
 
-	var imgPath string
-	var files []string
-	var toc, info []byte
-	sql := "SELECT CoverImagePath, Files, TableOfContents, Info FROM Books WHERE BookId=$1;"
-	_, err := database.Read(sql, []any{bookId}, []any{&imgPath, &files, &toc, &info})
+	series, err := s.store.GetAllSeries(r.Context(), userId)
 	if err != nil {
-		respondWithError(w, INTERNAL_ERROR)
+		respondWithError(w, r, err)
 		return
 	}
 
-	var tocObj []epub.Section
-	if err := json.Unmarshal(toc, &tocObj); err != nil {
-		respondWithError(w, INTERNAL_ERROR)
+	json.NewEncoder(w).Encode(series)
+}
+
+// GET /api/v1/series/{id}
+// GET /series/{id} (deprecated)
+//
+// Request payload: Cookie with name set to "userId" and value set to the user's session.
+//
+// Response: {"SeriesId": 0, "Name": "", "Books": [{"BookId": 0, "Title": "", "Position": 0}]}
+//
+// Get a series by id along with the books of the user's collection in it, ordered by
+// their position in the series. Series without any of the user's books aren't found.
+func (s *Server) GetSeries(w http.ResponseWriter, r *http.Request) {
+	userId, err := s.getUserId(r)
+	if err != nil {
+		respondWithError(w, r, ErrUnauthenticated.Wrap(err))
+		return
+	}
+	seriesId, err := getPathId(r)
+	if err != nil {
+		respondWithError(w, r, ErrBadRequest.Wrap(err))
 		return
 	}
 
-	var infoObj epub.Metadata
-	if err := json.Unmarshal(info, &infoObj); err != nil {
-		respondWithError(w, INTERNAL_ERROR)
+	series, err := s.store.GetSeries(r.Context(), userId, seriesId)
+	if errors.Is(err, ErrNotFound) {
+		respondWithError(w, r, ErrSeriesNotFound.Wrap(err))
+		return
+	} else if err != nil {
+		respondWithError(w, r, err)
 		return
 	}
 
-	response := map[string]any{
-		"CoverImagePath":  imgPath,
-		"Files":           files,
-		"TableOfContents": tocObj,
-		"Info":            infoObj,
+	json.NewEncoder(w).Encode(series)
+}
+
+// GET /healthz
+//
+// Response: {"Status": "ok"}
+//
+// Liveness check, which succeeds as long as the server is running.
+func (s *Server) Healthz(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(HealthResponse{Status: "ok"})
+}
+
+// GET /readyz
+//
+// Response: {"Database": "ok", "Storage": "ok"}
+//
+// Readiness check, which succeeds when the database can be reached and the storage
+// is writable. Failed checks are set to "unavailable" and the status code is 503.
+// Their errors are only logged, since they can reveal how the server is set up.
+func (s *Server) Readyz(w http.ResponseWriter, r *http.Request) {
+	response := ReadinessResponse{Database: "ok", Storage: "ok"}
+	ready := true
+
+	if err := s.store.Ping(r.Context()); err != nil {
+		s.logger.Error("Reaching the database", "error", err)
+		response.Database = "unavailable"
+		ready = false
+	}
+
+	key := ".readyz"
+	if err := s.storage.Put(key, []byte{}); err != nil {
+		s.logger.Error("Writing to the storage", "error", err)
+		response.Storage = "unavailable"
+		ready = false
+	} else {
+		s.storage.Delete(key)
+	}
+
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
 	}
 	json.NewEncoder(w).Encode(response)
 }
@@ -0,0 +1,659 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aabiji/page/backend/epub"
+)
+
+// Extract and upload files into temporary directories.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "page-test")
+	if err != nil {
+		panic(err)
+	}
+	epub.EXTRACT_DIRECTORY = filepath.Join(dir, "BOOKS")
+	FILE_UPLOAD_DIRECTORY = filepath.Join(dir, "FILES")
+	os.MkdirAll(epub.EXTRACT_DIRECTORY, os.ModePerm)
+	os.MkdirAll(FILE_UPLOAD_DIRECTORY, os.ModePerm)
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+type testServer struct {
+	*Server
+	store   *MemoryStore
+	handler http.Handler
+	mails   *bytes.Buffer // Mails sent by the server
+}
+
+func newTestServer(t *testing.T) testServer {
+	store := NewMemoryStore()
+	s := NewServer(store, NewDiskStorage(t.TempDir()), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	mails := &bytes.Buffer{}
+	s.mailer = NewFileMailer(mails)
+	return testServer{s, store, s.Handler(), mails}
+}
+
+// A USERID cookie for a session of the user.
+func (s testServer) sessionCookie(userId int) *http.Cookie {
+	user, _ := s.store.GetUser(ctx, userId)
+	user.Id = userId
+	return &http.Cookie{Name: USERID, Value: s.sessionValue(user, time.Now().Add(time.Hour))}
+}
+
+// Get the user whose session a response started, or 0 if it didn't.
+func (s testServer) sessionUser(w *httptest.ResponseRecorder) int {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == USERID {
+			userId, _ := s.verifySession(ctx, cookie.Value, time.Now())
+			return userId
+		}
+	}
+	return 0
+}
+
+// Send a request to the server as the user, or anonymously if userId is 0.
+func (s testServer) request(method, url string, body io.Reader, userId int) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, body)
+	if userId != 0 {
+		r.AddCookie(s.sessionCookie(userId))
+	}
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, r)
+	return w
+}
+
+// Upload a file to the server as the user.
+func (s testServer) upload(t *testing.T, filename string, contents []byte, userId int) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(contents)
+	form.Close()
+
+	r := httptest.NewRequest("POST", "/api/v1/me/books", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.AddCookie(s.sessionCookie(userId))
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, r)
+	return w
+}
+
+func decode[T any](t *testing.T, w *httptest.ResponseRecorder) T {
+	t.Helper()
+	var value T
+	if err := json.Unmarshal(w.Body.Bytes(), &value); err != nil {
+		t.Fatalf("%v: %s", err, w.Body.String())
+	}
+	return value
+}
+
+// Assert that the response is the error, with the error's status code.
+func assertError(t *testing.T, w *httptest.ResponseRecorder, err *APIError) {
+	t.Helper()
+	assertEq(t, w.Code, err.Status)
+	response := decode[map[string]any](t, w)
+	assertEq(t, response["code"], err.Code)
+	assertEq(t, response["message"], err.Message)
+	assertEq(t, response["requestId"], w.Header().Get(REQUEST_ID_HEADER))
+}
+
+func readDune(t *testing.T) []byte {
+	data, err := os.ReadFile("../test_files/Dune.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestAccounts(t *testing.T) {
+	s := newTestServer(t)
+	credentials := `{"email": "reader@example.com", "password": "hash"}`
+
+	w := s.request("POST", "/api/v1/users", bytes.NewBufferString(credentials), 0)
+	assertEq(t, w.Code, http.StatusOK)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != USERID || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteLaxMode {
+		t.Fatalf("Found cookies %v", cookies)
+	}
+	userId := s.sessionUser(w)
+
+	w = s.request("POST", "/api/v1/users", bytes.NewBufferString(credentials), 0)
+	assertError(t, w, ErrDuplicateAccount)
+
+	w = s.request("POST", "/api/v1/session", bytes.NewBufferString(credentials), 0)
+	assertEq(t, w.Code, http.StatusOK)
+	assertEq(t, s.sessionUser(w), userId)
+
+	wrong := `{"email": "reader@example.com", "password": "wrong"}`
+	w = s.request("POST", "/api/v1/session", bytes.NewBufferString(wrong), 0)
+	assertError(t, w, ErrInvalidCredentials)
+
+	for _, body := range []string{`{"email": ""}`, `not json`} {
+		w = s.request("POST", "/api/v1/session", bytes.NewBufferString(body), 0)
+		assertError(t, w, ErrBadRequest)
+		w = s.request("POST", "/api/v1/users", bytes.NewBufferString(body), 0)
+		assertError(t, w, ErrBadRequest)
+	}
+
+	s.store.AddUserBook(ctx, UserBook{UserId: userId, BookId: 1, ScrollOffsets: []int{}})
+	w = s.request("DELETE", "/api/v1/me", nil, userId)
+	assertEq(t, w.Code, http.StatusOK)
+	assertEq(t, w.Result().Cookies()[0].MaxAge, -1)
+	w = s.request("POST", "/api/v1/session", bytes.NewBufferString(credentials), 0)
+	assertError(t, w, ErrInvalidCredentials)
+	_, err := s.store.GetUserBook(ctx, userId, 1)
+	assertEq(t, err, ErrNotFound)
+
+	w = s.request("DELETE", "/api/v1/me", nil, 0)
+	assertError(t, w, ErrUnauthenticated)
+}
+
+func TestSessions(t *testing.T) {
+	s := newTestServer(t)
+	userId, _ := s.store.CreateUser(ctx, "reader@example.com", "hash")
+	get := func(value string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/v1/me", nil)
+		r.AddCookie(&http.Cookie{Name: USERID, Value: value})
+		w := httptest.NewRecorder()
+		s.handler.ServeHTTP(w, r)
+		return w
+	}
+	otherId, _ := s.store.CreateUser(ctx, "writer@example.com", "hash")
+	user, _ := s.store.GetUser(ctx, userId)
+	now := time.Now()
+	assertEq(t, get(s.sessionValue(user, now.Add(time.Minute))).Code, http.StatusOK)
+
+	// Cookies the server didn't sign, or whose session expired, are rejected
+	other := newTestServer(t)
+	other.store.CreateUser(ctx, "reader@example.com", "hash")
+	expires := strconv.FormatInt(now.Add(time.Minute).Unix(), 10)
+	later := strconv.FormatInt(now.Add(time.Hour).Unix(), 10)
+	signed := strings.Split(s.sessionValue(user, now.Add(time.Minute)), ".")
+	for _, value := range []string{
+		strconv.Itoa(userId),
+		strconv.Itoa(userId) + "." + expires,
+		strconv.Itoa(otherId) + "." + expires + "." + signed[2],
+		strconv.Itoa(userId) + "." + later + "." + signed[2],
+		other.sessionValue(user, now.Add(time.Minute)),
+		s.sessionValue(user, now.Add(-time.Second)),
+	} {
+		assertError(t, get(value), ErrUnauthenticated)
+	}
+
+	// As are sessions started before the password changed
+	s.store.UpdatePassword(ctx, userId, "new")
+	assertError(t, get(s.sessionValue(user, now.Add(time.Minute))), ErrUnauthenticated)
+	user, _ = s.store.GetUser(ctx, userId)
+	assertEq(t, get(s.sessionValue(user, now.Add(time.Minute))).Code, http.StatusOK)
+}
+
+func TestSigningKey(t *testing.T) {
+	key, err := signingKey("", true)
+	assertEq(t, len(key), MIN_SIGNING_KEY_SIZE)
+	assertEq(t, err, nil)
+	_, err = signingKey("", false)
+	assertEq(t, err != nil, true)
+	_, err = signingKey("short", true)
+	assertEq(t, err != nil, true)
+	key, err = signingKey(strings.Repeat("k", 32), false)
+	assertEq(t, string(key), strings.Repeat("k", 32))
+	assertEq(t, err, nil)
+}
+
+func TestUploadAndReadBook(t *testing.T) {
+	s := newTestServer(t)
+	userId, _ := s.store.CreateUser(ctx, "reader@example.com", "hash")
+
+	w := s.upload(t, "Dune.epub", readDune(t), userId)
+	assertEq(t, w.Code, http.StatusOK)
+	uploaded := decode[struct {
+		BookId     int
+		Validation epub.Report
+	}](t, w)
+	assertEq(t, uploaded.Validation, epub.Report{Issues: []epub.Issue{}})
+	bookId := strconv.Itoa(uploaded.BookId)
+
+	w = s.request("GET", "/api/v1/books/"+bookId, nil, userId)
+	assertEq(t, w.Code, http.StatusOK)
+	book := decode[struct {
+		CoverImagePath  string
+		Files           []string
+		TableOfContents []epub.Section
+		Info            epub.Metadata
+	}](t, w)
+	assertEq(t, book.Info.Title, "Dune")
+	assertEq(t, strings.HasSuffix(book.CoverImagePath, "-Dune/cover.jpeg"), true)
+	assertEq(t, len(book.Files), 10)
+	assertEq(t, len(book.TableOfContents), 4)
+
+	w = s.request("GET", "/api/v1/me/books/"+bookId, nil, userId)
+	assertEq(t, decode[map[string]any](t, w), map[string]any{
+		"CurrentPage":   float64(0),
+		"ScrollOffsets": []any{0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0},
+	})
+
+	w = s.request("GET", "/api/v1/books/"+bookId+"/validation", nil, userId)
+	assertEq(t, decode[epub.Report](t, w), epub.Report{Issues: []epub.Issue{}})
+
+	url := "/api/v1/me/books/" + bookId + "/progress"
+	progress := `{"CurrentPage": 2, "ScrollOffsets": [0, 0, 350, 0, 0, 0, 0, 0, 0, 0]}`
+	w = s.request("PUT", url, bytes.NewBufferString(progress), userId)
+	assertEq(t, w.Code, http.StatusOK)
+	w = s.request("GET", "/api/v1/me/books/"+bookId, nil, userId)
+	assertEq(t, decode[ProgressRequest](t, w), ProgressRequest{2, []int{0, 0, 350, 0, 0, 0, 0, 0, 0, 0}})
+
+	// Uploading the book again keeps the progress
+	w = s.upload(t, "Dune.epub", readDune(t), userId)
+	assertEq(t, w.Code, http.StatusOK)
+	assertEq(t, decode[UploadResponse](t, w).BookId, uploaded.BookId)
+	w = s.request("GET", "/api/v1/me/books/"+bookId, nil, userId)
+	assertEq(t, decode[ProgressRequest](t, w).CurrentPage, 2)
+	for _, body := range []string{`{"CurrentPage": -1, "ScrollOffsets": []}`, `{"CurrentPage": 1}`, `not json`} {
+		w = s.request("PUT", url, bytes.NewBufferString(body), userId)
+		assertError(t, w, ErrBadRequest)
+	}
+	w = s.request("PUT", "/api/v1/me/books/1000/progress", bytes.NewBufferString(progress), userId)
+	assertError(t, w, ErrUserBookNotFound)
+
+	w = s.request("DELETE", "/api/v1/me/books/"+bookId, nil, userId)
+	assertEq(t, w.Code, http.StatusOK)
+	w = s.request("GET", "/api/v1/me/books/"+bookId, nil, userId)
+	assertError(t, w, ErrUserBookNotFound)
+
+	w = s.request("GET", "/api/v1/books/1000", nil, userId)
+	assertError(t, w, ErrBookNotFound)
+	w = s.request("GET", "/api/v1/books/abc", nil, userId)
+	assertError(t, w, ErrBadRequest)
+	w = s.request("GET", "/api/v1/books/1000/validation", nil, userId)
+	assertError(t, w, ErrBookNotFound)
+	w = s.request("GET", "/api/v1/me/books/"+bookId, nil, 0)
+	assertError(t, w, ErrUnauthenticated)
+}
+
+func TestBookAccess(t *testing.T) {
+	s := newTestServer(t)
+	owner, _ := s.store.CreateUser(ctx, "owner@example.com", "hash")
+	other, _ := s.store.CreateUser(ctx, "other@example.com", "hash")
+	w := s.upload(t, "Dune.epub", readDune(t), owner)
+	bookId := strconv.Itoa(decode[UploadResponse](t, w).BookId)
+
+	for _, url := range []string{"/api/v1/books/", "/book/get/"} {
+		w = s.request("GET", url+bookId, nil, other)
+		assertError(t, w, ErrBookNotFound)
+		w = s.request("GET", url+bookId, nil, 0)
+		assertError(t, w, ErrUnauthenticated)
+	}
+	w = s.request("GET", "/api/v1/books/"+bookId+"/validation", nil, other)
+	assertError(t, w, ErrBookNotFound)
+	w = s.request("GET", "/api/v1/books/"+bookId+"/cover", nil, other)
+	assertError(t, w, ErrBookNotFound)
+
+	// The files are served from the signed url
+	w = s.request("GET", "/api/v1/books/"+bookId, nil, owner)
+	book := decode[BookResponse](t, w)
+	w = s.request("GET", book.StaticUrl+book.Files[0], nil, 0)
+	assertEq(t, w.Code, http.StatusOK)
+	w = s.request("GET", book.StaticUrl+book.CoverImagePath, nil, 0)
+	assertEq(t, w.Code, http.StatusOK)
+	w = s.request("GET", "/static/"+book.Files[0], nil, 0)
+	assertError(t, w, ErrForbidden)
+}
+
+func TestAddBook(t *testing.T) {
+	s := newTestServer(t)
+	owner, _ := s.store.CreateUser(ctx, "owner@example.com", "hash")
+	other, _ := s.store.CreateUser(ctx, "other@example.com", "hash")
+	w := s.upload(t, "Dune.epub", readDune(t), owner)
+	bookId := strconv.Itoa(decode[UploadResponse](t, w).BookId)
+	token := s.createShare(t, owner, bookId, `{}`).Token
+
+	// Books can only be added with their token
+	url := "/api/v1/me/books/" + bookId
+	for _, query := range []string{"", "?token=wrong"} {
+		w = s.request("PUT", url+query, nil, other)
+		assertError(t, w, ErrBookNotFound)
+	}
+	w = s.request("PUT", "/api/v1/me/books/1000?token="+token, nil, other)
+	assertError(t, w, ErrBookNotFound)
+	w = s.request("PUT", url+"?token="+token, nil, 0)
+	assertError(t, w, ErrUnauthenticated)
+
+	w = s.request("PUT", url+"?token="+token, nil, other)
+	assertEq(t, w.Code, http.StatusCreated)
+	w = s.request("POST", "/user/book/add/"+bookId+"?token="+token, nil, other)
+	assertEq(t, w.Code, http.StatusOK)
+	assertEq(t, w.Header().Get("Deprecation") != "", true)
+	assertEq(t, len(decode[UserBookResponse](t, w).ScrollOffsets), 10)
+	w = s.request("GET", "/api/v1/books/"+bookId, nil, other)
+	assertEq(t, w.Code, http.StatusOK)
+
+	// Adding the book again keeps the progress
+	progress := `{"CurrentPage": 3, "ScrollOffsets": [0, 0, 0, 0, 0, 0, 0, 0, 0, 0]}`
+	s.request("PUT", url+"/progress", bytes.NewBufferString(progress), other)
+	for _, userId := range []int{owner, other} {
+		w = s.request("PUT", url, nil, userId)
+		assertEq(t, w.Code, http.StatusOK)
+	}
+	assertEq(t, decode[UserBookResponse](t, w).CurrentPage, 3)
+}
+
+// Rewrite an epub with a zip comment, so it has the same contents in different bytes.
+func copyEpub(t *testing.T, data []byte, comment string) []byte {
+	t.Helper()
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var copied bytes.Buffer
+	z := zip.NewWriter(&copied)
+	for _, file := range archive.File {
+		if file.FileInfo().IsDir() {
+			continue // Their files create them
+		}
+		if err := z.Copy(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	z.SetComment(comment)
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return copied.Bytes()
+}
+
+func TestUploadSameTitle(t *testing.T) {
+	s := newTestServer(t)
+	owner, _ := s.store.CreateUser(ctx, "owner@example.com", "hash")
+	other, _ := s.store.CreateUser(ctx, "other@example.com", "hash")
+	w := s.upload(t, "Dune.epub", readDune(t), owner)
+	bookId := decode[UploadResponse](t, w).BookId
+	w = s.request("GET", "/api/v1/books/"+strconv.Itoa(bookId), nil, owner)
+	book := decode[BookResponse](t, w)
+	w = s.request("GET", "/api/v1/books/"+strconv.Itoa(bookId)+"/cover", nil, owner)
+	cover := w.Body.String()
+
+	// Another epub with the same title and filename is a separate book,
+	// which doesn't give access to the owner's
+	w = s.upload(t, "Dune.epub", copyEpub(t, readDune(t), "copy"), other)
+	assertEq(t, w.Code, http.StatusOK)
+	copyId := decode[UploadResponse](t, w).BookId
+	assertEq(t, copyId != bookId, true)
+	w = s.request("GET", "/api/v1/books/"+strconv.Itoa(bookId), nil, other)
+	assertError(t, w, ErrBookNotFound)
+	w = s.request("GET", "/api/v1/books/"+strconv.Itoa(copyId), nil, other)
+	assertEq(t, w.Code, http.StatusOK)
+	copied := decode[BookResponse](t, w)
+
+	// And isn't written over the owner's book
+	assertEq(t, bookDirectory(Book{Files: copied.Files}) != bookDirectory(Book{Files: book.Files}), true)
+	w = s.request("GET", "/api/v1/books/"+strconv.Itoa(bookId), nil, owner)
+	assertEq(t, decode[BookResponse](t, w).Files, book.Files)
+	w = s.request("GET", book.StaticUrl+book.Files[0], nil, 0)
+	assertEq(t, w.Code, http.StatusOK)
+	w = s.request("GET", "/api/v1/books/"+strconv.Itoa(bookId)+"/cover", nil, owner)
+	assertEq(t, w.Body.String(), cover)
+
+	// While the same epub is the same book, without keeping the uploaded file again
+	uploads, _ := os.ReadDir(FILE_UPLOAD_DIRECTORY)
+	w = s.upload(t, "Dune.epub", readDune(t), other)
+	assertEq(t, decode[UploadResponse](t, w).BookId, bookId)
+	again, _ := os.ReadDir(FILE_UPLOAD_DIRECTORY)
+	assertEq(t, len(again), len(uploads))
+	count, _ := s.store.CountBooks(ctx)
+	assertEq(t, count, 2)
+}
+
+func TestUploadCleanup(t *testing.T) {
+	s := newTestServer(t)
+	userId, _ := s.store.CreateUser(ctx, "reader@example.com", "hash")
+
+	// Uploads that aren't saved don't leave their files behind
+	uploads, _ := os.ReadDir(FILE_UPLOAD_DIRECTORY)
+	books, _ := os.ReadDir(epub.EXTRACT_DIRECTORY)
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "Dune.epub")
+	part.Write(readDune(t))
+	form.Close()
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	r := httptest.NewRequest("POST", "/api/v1/me/books", &body).WithContext(canceled)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.AddCookie(s.sessionCookie(userId))
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, r)
+	assertEq(t, w.Code, http.StatusInternalServerError)
+
+	count, _ := s.store.CountBooks(ctx)
+	assertEq(t, count, 0)
+	after, _ := os.ReadDir(FILE_UPLOAD_DIRECTORY)
+	assertEq(t, len(after), len(uploads))
+	after, _ = os.ReadDir(epub.EXTRACT_DIRECTORY)
+	assertEq(t, len(after), len(books))
+}
+
+func TestUploadRejectsInvalidFiles(t *testing.T) {
+	s := newTestServer(t)
+	userId, _ := s.store.CreateUser(ctx, "reader@example.com", "hash")
+
+	w := s.upload(t, "notes.txt", []byte("Not an epub"), userId)
+	assertError(t, w, ErrUnsupportedFile)
+
+	var archive bytes.Buffer
+	z := zip.NewWriter(&archive)
+	mimetype, _ := z.Create("mimetype")
+	mimetype.Write([]byte("application/epub+zip"))
+	z.Close()
+
+	w = s.upload(t, "Empty.epub", archive.Bytes(), userId)
+	assertEq(t, w.Code, ErrInvalidEpub.Status)
+	response := decode[struct {
+		Code    string
+		Details epub.Report
+	}](t, w)
+	assertEq(t, response.Code, ErrInvalidEpub.Code)
+	assertEq(t, response.Details.Fatal().Code, "CONTAINER_MISSING")
+
+	w = s.request("POST", "/api/v1/me/books", nil, userId)
+	assertError(t, w, ErrBadRequest)
+}
+
+func TestBookCover(t *testing.T) {
+	s := newTestServer(t)
+	userId, _ := s.store.CreateUser(ctx, "reader@example.com", "hash")
+	bookId, _ := s.store.InsertBook(ctx, Book{Title: "No cover", Info: epub.Metadata{Title: "No cover"}})
+	s.store.AddUserBook(ctx, UserBook{UserId: userId, BookId: bookId, ScrollOffsets: []int{}})
+	url := "/api/v1/books/" + strconv.Itoa(bookId) + "/cover"
+
+	// Thumbnails are generated when missing
+	w := s.request("GET", url+"?size=small", nil, userId)
+	assertEq(t, w.Code, http.StatusOK)
+	assertEq(t, w.Header().Get("Content-Type"), "image/jpeg")
+	assertEq(t, w.Header().Get("Cache-Control"), "private, max-age=604800")
+	etag := w.Header().Get("ETag")
+	if etag == "" || !bytes.HasPrefix(w.Body.Bytes(), []byte{0xff, 0xd8}) {
+		t.Fatalf("Invalid thumbnail with etag %q", etag)
+	}
+
+	r := httptest.NewRequest("GET", url+"?size=small", nil)
+	r.Header.Set("If-None-Match", etag)
+	r.AddCookie(s.sessionCookie(userId))
+	w = httptest.NewRecorder()
+	s.handler.ServeHTTP(w, r)
+	assertEq(t, w.Code, http.StatusNotModified)
+
+	w = s.request("GET", url+"?size=huge", nil, userId)
+	assertError(t, w, ErrBadRequest)
+	w = s.request("GET", "/api/v1/books/1000/cover", nil, userId)
+	assertError(t, w, ErrBookNotFound)
+	w = s.request("GET", url, nil, 0)
+	assertError(t, w, ErrUnauthenticated)
+}
+
+func TestSeries(t *testing.T) {
+	s := newTestServer(t)
+	series := []epub.Series{{Name: "Dune", Index: 1}}
+	bookId, _ := s.store.InsertBook(ctx, Book{Title: "Dune", Info: epub.Metadata{Title: "Dune", Series: series}})
+	userId, _ := s.store.CreateUser(ctx, "reader@example.com", "hash")
+	otherId, _ := s.store.CreateUser(ctx, "other@example.com", "hash")
+	s.store.AddUserBook(ctx, UserBook{UserId: userId, BookId: bookId, ScrollOffsets: []int{}})
+
+	w := s.request("GET", "/api/v1/series", nil, userId)
+	all := decode[[]Series](t, w)
+	assertEq(t, len(all), 1)
+	assertEq(t, all[0].Books, []SeriesBook{{bookId, "Dune", 1}})
+
+	w = s.request("GET", "/api/v1/series/"+strconv.Itoa(all[0].SeriesId), nil, userId)
+	assertEq(t, decode[Series](t, w), all[0])
+
+	w = s.request("GET", "/api/v1/series/1000", nil, userId)
+	assertError(t, w, ErrSeriesNotFound)
+
+	// Series are only listed for users that have some of their books
+	w = s.request("GET", "/api/v1/series", nil, otherId)
+	assertEq(t, decode[[]Series](t, w), []Series{})
+	w = s.request("GET", "/api/v1/series/"+strconv.Itoa(all[0].SeriesId), nil, otherId)
+	assertError(t, w, ErrSeriesNotFound)
+	w = s.request("GET", "/api/v1/series", nil, 0)
+	assertError(t, w, ErrUnauthenticated)
+}
+
+func TestLegacyRoutes(t *testing.T) {
+	s := newTestServer(t)
+	userId, _ := s.store.CreateUser(ctx, "reader@example.com", "hash")
+	s.store.AddUserBook(ctx, UserBook{UserId: userId, BookId: 7, ScrollOffsets: []int{}})
+	deprecation := fmt.Sprintf("@%d", LEGACY_DEPRECATION.Unix())
+
+	w := s.request("GET", "/user/book/get/7", nil, userId)
+	assertEq(t, w.Code, http.StatusOK)
+	assertEq(t, w.Header().Get("Deprecation"), deprecation)
+	assertEq(t, w.Header().Get("Link"), `</api/v1/me/books/7>; rel="successor-version"`)
+
+	w = s.request("GET", "/book/7/cover?size=small", nil, userId)
+	assertError(t, w, ErrBookNotFound)
+	assertEq(t, w.Header().Get("Link"), `</api/v1/books/7/cover?size=small>; rel="successor-version"`)
+
+	w = s.request("POST", "/user/book/remove/7", nil, userId)
+	assertEq(t, w.Code, http.StatusOK)
+	assertEq(t, w.Header().Get("Link"), `</api/v1/me/books/7>; rel="successor-version"`)
+	_, err := s.store.GetUserBook(ctx, userId, 7)
+	assertEq(t, err, ErrNotFound)
+
+	w = s.request("GET", "/api/v1/series", nil, 0)
+	assertEq(t, w.Header().Get("Deprecation"), "")
+	w = s.request("DELETE", "/user/book/remove/7", nil, userId)
+	assertError(t, w, ErrMethodNotAllowed)
+}
+
+func TestPreflightRequests(t *testing.T) {
+	handler := AllowRequests("http://localhost:5173", newTestServer(t).handler)
+	r := httptest.NewRequest("OPTIONS", "/api/v1/me/books/1", nil)
+	r.Header.Set("Origin", "http://localhost:5173")
+	r.Header.Set("Access-Control-Request-Method", "DELETE")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	assertEq(t, w.Code, http.StatusNoContent)
+	assertEq(t, w.Header().Get("Access-Control-Allow-Origin"), "http://localhost:5173")
+	assertEq(t, w.Header().Get("Access-Control-Allow-Methods"), "GET, POST, PUT, DELETE, OPTIONS")
+}
+
+func TestStaticFiles(t *testing.T) {
+	s := newTestServer(t)
+	dir := filepath.Join(epub.EXTRACT_DIRECTORY, "Static")
+	os.MkdirAll(dir, os.ModePerm)
+	os.WriteFile(filepath.Join(dir, "page.xhtml"), []byte("<p>Page</p>"), 0644)
+
+	other := filepath.Join(epub.EXTRACT_DIRECTORY, "Other")
+	os.MkdirAll(other, os.ModePerm)
+	os.WriteFile(filepath.Join(other, "page.xhtml"), []byte("<p>Other</p>"), 0644)
+
+	url := s.signStaticUrl("Static", time.Now())
+	w := s.request("GET", url+"Static/page.xhtml", nil, 0)
+	assertEq(t, w.Code, http.StatusOK)
+	assertEq(t, w.Body.String(), "<p>Page</p>")
+	assertEq(t, w.Header().Get("Content-Security-Policy"), STATIC_FILE_CSP)
+	assertEq(t, w.Header().Get("X-Content-Type-Options"), "nosniff")
+
+	// The url only gives access to the directory it was signed for.
+	// Paths escaping the directory are either redirected to their clean path or forbidden.
+	w = s.request("GET", url+"Other/page.xhtml", nil, 0)
+	assertError(t, w, ErrForbidden)
+	for _, file := range []string{"Static/..%2FOther/page.xhtml", "Static%2F..%2FOther%2Fpage.xhtml"} {
+		w = s.request("GET", url+file, nil, 0)
+		if w.Code == http.StatusOK || strings.Contains(w.Body.String(), "Other") {
+			t.Errorf("%s was served: %d %s", file, w.Code, w.Body.String())
+		}
+	}
+
+	expired := s.signStaticUrl("Static", time.Now().Add(-STATIC_URL_LIFETIME-time.Hour))
+	tampered := strings.Replace(url, "/static/", "/static/9", 1)
+	for _, url := range []string{expired, tampered, "/static/", "/static/token/"} {
+		w = s.request("GET", url+"Static/page.xhtml", nil, 0)
+		assertError(t, w, ErrForbidden)
+	}
+	assertEq(t, s.verifyStaticToken(strings.Split(url, "/")[2], "Static", time.Now()), true)
+}
+
+type unreachableStore struct {
+	*MemoryStore
+}
+
+func (unreachableStore) Ping(ctx context.Context) error {
+	return errors.New("Connection refused")
+}
+
+type readOnlyStorage struct {
+	*DiskStorage
+}
+
+func (readOnlyStorage) Put(key string, data []byte) error {
+	return errors.New("Read only file system")
+}
+
+func TestHealth(t *testing.T) {
+	s := newTestServer(t)
+	w := s.request("GET", "/healthz", nil, 0)
+	assertEq(t, w.Code, http.StatusOK)
+	w = s.request("GET", "/readyz", nil, 0)
+	assertEq(t, w.Code, http.StatusOK)
+	assertEq(t, decode[map[string]string](t, w), map[string]string{"Database": "ok", "Storage": "ok"})
+
+	// Why checks failed is logged, but not sent to the client
+	var output bytes.Buffer
+	storage := NewDiskStorage(t.TempDir())
+	logger := slog.New(slog.NewTextHandler(&output, nil))
+	unready := NewServer(unreachableStore{NewMemoryStore()}, readOnlyStorage{storage}, logger).Handler()
+	w = httptest.NewRecorder()
+	unready.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	assertEq(t, w.Code, http.StatusServiceUnavailable)
+	assertEq(t, decode[map[string]string](t, w), map[string]string{"Database": "unavailable", "Storage": "unavailable"})
+	for _, err := range []string{"Connection refused", "Read only file system"} {
+		if !strings.Contains(output.String(), err) {
+			t.Errorf("%q wasn't logged: %s", err, output.String())
+		}
+	}
+}
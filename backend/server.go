@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aabiji/page/backend/oidc"
+	"github.com/gorilla/mux"
+)
+
+// The prefix of the current version of the api. Breaking changes are only
+// made in a new version, served alongside this one (see the readme).
+const API_V1 = "/api/v1"
+
+// When the unversioned routes were deprecated, sent in their Deprecation header.
+var LEGACY_DEPRECATION = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+
+// The http server. Handlers access the database through the store,
+// so they can be tested without a live database.
+type Server struct {
+	store      Store
+	storage    Storage
+	logger     *slog.Logger
+	metrics    *Metrics
+	signingKey []byte // Key signing static urls and sessions, see access.go
+	mailer     Mailer
+	providers  []*oidc.Provider // OpenID Connect providers users can log in with, see login.go
+	limiter    Limiter          // Limits logins and account creations, see ratelimit.go
+	// Whether users must confirm they own their email before adding books
+	requireVerification bool
+}
+
+func NewServer(store Store, storage Storage, logger *slog.Logger) *Server {
+	return &Server{
+		store:      store,
+		storage:    storage,
+		logger:     logger,
+		metrics:    NewMetrics(),
+		signingKey: newSigningKey(),
+		limiter:    NewMemoryLimiter(),
+		mailer:     NewFileMailer(os.Stderr), // Mails can be read in the logs during development
+	}
+}
+
+func (s *Server) mapEndpoints(router *mux.Router) {
+	v1 := router.PathPrefix(API_V1).Subrouter()
+	v1.Handle("/session", s.limitLogins(http.HandlerFunc(s.AuthAccount))).Methods("POST")
+	v1.Handle("/users", s.limitLogins(http.HandlerFunc(s.CreateAccount))).Methods("POST")
+	v1.HandleFunc("/me", s.GetAccount).Methods("GET")
+	v1.HandleFunc("/me", s.DeleteAccount).Methods("DELETE")
+	v1.HandleFunc("/me/verification", s.ResendVerification).Methods("POST")
+	v1.HandleFunc("/me/password", s.ChangePassword).Methods("PUT")
+	v1.HandleFunc("/me/settings", s.UpdateSettings).Methods("PUT")
+	v1.HandleFunc("/me/email", s.ChangeEmail).Methods("PUT")
+	v1.HandleFunc("/email/confirm", s.ConfirmEmail).Methods("POST")
+	v1.Handle("/password/reset", s.limitPasswordResets(http.HandlerFunc(s.RequestPasswordReset))).Methods("POST")
+	v1.HandleFunc("/password/reset/confirm", s.ResetPassword).Methods("POST")
+	v1.HandleFunc("/auth/providers", s.GetProviders).Methods("GET")
+	v1.HandleFunc("/auth/{provider}/login", s.StartLogin).Methods("GET")
+	v1.HandleFunc("/auth/{provider}/callback", s.FinishLogin).Methods("GET")
+
+	v1.HandleFunc("/me/tokens", s.CreateApiToken).Methods("POST")
+	v1.HandleFunc("/me/tokens", s.GetApiTokens).Methods("GET")
+	v1.HandleFunc("/me/tokens/{id}", s.RevokeApiToken).Methods("DELETE")
+	v1.HandleFunc("/me/shares", s.GetShares).Methods("GET")
+	v1.HandleFunc("/me/shares/{id}", s.RevokeShare).Methods("DELETE")
+	v1.Handle("/books/{id}/shares", s.requireReader(http.HandlerFunc(s.CreateShare))).Methods("POST")
+
+	// Api tokens can only be used on the routes that require one of their scopes
+	read, write, progress := SCOPE_LIBRARY_READ, SCOPE_LIBRARY_WRITE, SCOPE_PROGRESS_WRITE
+	v1.Handle("/me/books", requireScope(write, s.requireVerified(http.HandlerFunc(s.UserUploadEpub)))).Methods("POST")
+	v1.Handle("/me/books/{id}", requireScope(read, http.HandlerFunc(s.GetUserBookInfo))).Methods("GET")
+	v1.Handle("/me/books/{id}", requireScope(write, s.requireVerified(http.HandlerFunc(s.UserAddBook)))).Methods("PUT")
+	v1.Handle("/me/books/{id}", requireScope(write, http.HandlerFunc(s.UserRemoveBook))).Methods("DELETE")
+	v1.Handle("/me/books/{id}/progress", requireScope(progress, http.HandlerFunc(s.SaveProgress))).Methods("PUT")
+
+	// Books can only be read by users that have them in their collection
+	v1.Handle("/books/{id}", requireScope(read, s.requireReader(http.HandlerFunc(s.GetBook)))).Methods("GET")
+	v1.Handle("/books/{id}/cover", requireScope(read, s.requireReader(http.HandlerFunc(s.GetBookCover)))).Methods("GET")
+	v1.Handle("/books/{id}/validation", requireScope(read, s.requireReader(http.HandlerFunc(s.GetBookValidation)))).Methods("GET")
+
+	v1.Handle("/series", requireScope(read, http.HandlerFunc(s.GetAllSeries))).Methods("GET")
+	v1.Handle("/series/{id}", requireScope(read, http.HandlerFunc(s.GetSeries))).Methods("GET")
+
+	s.mapLegacyEndpoints(router)
+
+	// Operational endpoints aren't part of the versioned api
+	router.HandleFunc("/healthz", s.Healthz).Methods("GET")
+	router.HandleFunc("/readyz", s.Readyz).Methods("GET")
+	router.HandleFunc("/metrics", s.GetMetrics).Methods("GET")
+	router.HandleFunc("/openapi.json", s.GetOpenAPI).Methods("GET")
+}
+
+// Keep serving the routes used before the api was versioned.
+// Their responses point to the api v1 route replacing them.
+func (s *Server) mapLegacyEndpoints(router *mux.Router) {
+	legacy := func(path string, handler http.Handler, method, successor string) {
+		router.Handle(path, deprecated(handler, API_V1+successor)).Methods(method)
+	}
+	legacy("/user/login", s.limitLogins(http.HandlerFunc(s.AuthAccount)), "POST", "/session")
+	legacy("/user/create", s.limitLogins(http.HandlerFunc(s.CreateAccount)), "POST", "/users")
+	legacy("/user/delete", http.HandlerFunc(s.DeleteAccount), "POST", "/me")
+
+	legacy("/user/book/upload", s.requireVerified(http.HandlerFunc(s.UserUploadEpub)), "POST", "/me/books")
+	legacy("/user/book/get/{id}", http.HandlerFunc(s.GetUserBookInfo), "GET", "/me/books/{id}")
+	legacy("/user/book/add/{id}", s.requireVerified(http.HandlerFunc(s.UserAddBook)), "POST", "/me/books/{id}")
+	legacy("/user/book/remove/{id}", http.HandlerFunc(s.UserRemoveBook), "POST", "/me/books/{id}")
+
+	legacy("/book/get/{id}", s.requireReader(http.HandlerFunc(s.GetBook)), "GET", "/books/{id}")
+	legacy("/book/{id}/cover", s.requireReader(http.HandlerFunc(s.GetBookCover)), "GET", "/books/{id}/cover")
+	legacy("/book/{id}/validation", s.requireReader(http.HandlerFunc(s.GetBookValidation)), "GET", "/books/{id}/validation")
+
+	legacy("/series", http.HandlerFunc(s.GetAllSeries), "GET", "/series")
+	legacy("/series/{id}", http.HandlerFunc(s.GetSeries), "GET", "/series/{id}")
+}
+
+// Mark the responses of a deprecated route, using the Deprecation header (RFC 9745)
+// and a Link header to the route replacing it, whose {id} is filled in from the request.
+func deprecated(handler http.Handler, successor string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		url := strings.ReplaceAll(successor, "{id}", mux.Vars(r)["id"])
+		if r.URL.RawQuery != "" {
+			url += "?" + r.URL.RawQuery
+		}
+		w.Header().Set("Deprecation", fmt.Sprintf("@%d", LEGACY_DEPRECATION.Unix()))
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, url))
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Create a http handler serving every endpoint along with the static files.
+func (s *Server) Handler() http.Handler {
+	router := mux.NewRouter()
+	router.Use(s.logRequests, s.measureRequests, s.authenticateTokens)
+	router.NotFoundHandler = s.logRequests(s.measureRequests(errorHandler(ErrRouteNotFound)))
+	router.MethodNotAllowedHandler = s.logRequests(s.measureRequests(errorHandler(ErrMethodNotAllowed)))
+	s.mapEndpoints(router)
+	s.ServeFiles(router)
+	return router
+}
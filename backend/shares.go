@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// How long share tokens stay valid for, in days.
+const (
+	SHARE_DAYS     = 7  // When no expiry is asked for
+	MAX_SHARE_DAYS = 90 // Longest a token can be valid for
+)
+
+// Check that a share token lets users add the book to their collection. Shares
+// stop working once they expire, are revoked, or the reader that created them
+// removes the book from their collection. Returns ErrBookNotFound otherwise, so
+// the ids of books can't be discovered.
+func verifyShare(ctx context.Context, tx Store, token string, bookId int) error {
+	if token == "" {
+		return ErrBookNotFound
+	}
+	share, err := tx.GetShare(ctx, hashToken(token))
+	if errors.Is(err, ErrNotFound) {
+		return ErrBookNotFound.Wrap(err)
+	} else if err != nil {
+		return err
+	}
+	if share.BookId != bookId || time.Now().After(share.Expires) {
+		return ErrBookNotFound
+	}
+
+	_, err = tx.GetUserBook(ctx, share.UserId, bookId)
+	if errors.Is(err, ErrNotFound) {
+		return ErrBookNotFound.Wrap(err)
+	}
+	return err
+}
+
+func shareResponse(share Share) ShareResponse {
+	return ShareResponse{
+		Id:      share.Id,
+		BookId:  share.BookId,
+		Created: share.Created.Unix(),
+		Expires: share.Expires.Unix(),
+	}
+}
+
+// POST /api/v1/books/{id}/shares
+//
+// Request payload:
+// {"ExpiresInDays": 0}
+// Cookie with name set to "userId" and value set to the user's session.
+//
+// Response: {"Id": 0, "BookId": 0, "Created": 0, "Expires": 0, "Token": ""} with the 201 status code.
+//
+// Create a token letting other users add a book in the user's collection to
+// theirs, see PUT /api/v1/me/books/{id}. Only a hash of the token is stored, so
+// it's only returned here. Tokens expire after ExpiresInDays, 7 by default.
+func (s *Server) CreateShare(w http.ResponseWriter, r *http.Request) {
+	userId, err := s.getUserId(r)
+	if err != nil {
+		respondWithError(w, r, ErrUnauthenticated.Wrap(err))
+		return
+	}
+	bookId, err := getPathId(r)
+	if err != nil {
+		respondWithError(w, r, ErrBadRequest.Wrap(err))
+		return
+	}
+	var request ShareRequest
+	if err := getRequestJson(w, r, &request); err != nil {
+		respondWithError(w, r, ErrBadRequest.Wrap(err))
+		return
+	}
+	if request.ExpiresInDays == 0 {
+		request.ExpiresInDays = SHARE_DAYS
+	}
+	if request.ExpiresInDays < 0 || request.ExpiresInDays > MAX_SHARE_DAYS {
+		respondWithError(w, r, ErrBadRequest)
+		return
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+	share := Share{UserId: userId, BookId: bookId, Hash: hashToken(token), Created: time.Now()}
+	share.Expires = share.Created.AddDate(0, 0, request.ExpiresInDays)
+	share.Id, err = s.store.CreateShare(r.Context(), share)
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+
+	response := shareResponse(share)
+	response.Token = token
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// GET /api/v1/me/shares
+//
+// Request payload: Cookie with name set to "userId" and value set to the user's session.
+//
+// Response: [{"Id": 0, "BookId": 0, "Created": 0, "Expires": 0}]
+//
+// Get the user's share tokens, oldest first, including those that expired.
+func (s *Server) GetShares(w http.ResponseWriter, r *http.Request) {
+	userId, err := s.getUserId(r)
+	if err != nil {
+		respondWithError(w, r, ErrUnauthenticated.Wrap(err))
+		return
+	}
+
+	shares, err := s.store.GetShares(r.Context(), userId)
+	if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+	response := []ShareResponse{}
+	for _, share := range shares {
+		response = append(response, shareResponse(share))
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// DELETE /api/v1/me/shares/{id}
+//
+// Request payload: Cookie with name set to "userId" and value set to the user's session.
+//
+// Response: Empty json response.
+//
+// Revoke one of the user's share tokens, which stops working right away.
+// Users that already added the book keep it.
+func (s *Server) RevokeShare(w http.ResponseWriter, r *http.Request) {
+	userId, err := s.getUserId(r)
+	if err != nil {
+		respondWithError(w, r, ErrUnauthenticated.Wrap(err))
+		return
+	}
+	id, err := getPathId(r)
+	if err != nil {
+		respondWithError(w, r, ErrBadRequest.Wrap(err))
+		return
+	}
+
+	err = s.store.RemoveShare(r.Context(), userId, id)
+	if errors.Is(err, ErrNotFound) {
+		respondWithError(w, r, ErrShareNotFound.Wrap(err))
+		return
+	} else if err != nil {
+		respondWithError(w, r, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(EmptyResponse{})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Share a book as the user, failing if the share isn't created.
+func (s testServer) createShare(t *testing.T, userId int, bookId, request string) ShareResponse {
+	t.Helper()
+	w := s.request("POST", "/api/v1/books/"+bookId+"/shares", bytes.NewBufferString(request), userId)
+	assertEq(t, w.Code, http.StatusCreated)
+	return decode[ShareResponse](t, w)
+}
+
+func TestCreateShare(t *testing.T) {
+	s := newTestServer(t)
+	owner, _ := s.store.CreateUser(ctx, "owner@example.com", "hash")
+	other, _ := s.store.CreateUser(ctx, "other@example.com", "hash")
+	w := s.upload(t, "Dune.epub", readDune(t), owner)
+	bookId := strconv.Itoa(decode[UploadResponse](t, w).BookId)
+
+	share := s.createShare(t, owner, bookId, `{}`)
+	assertEq(t, share.Expires, time.Unix(share.Created, 0).AddDate(0, 0, SHARE_DAYS).Unix())
+	share = s.createShare(t, owner, bookId, `{"ExpiresInDays": 30}`)
+	assertEq(t, share.Expires, time.Unix(share.Created, 0).AddDate(0, 0, 30).Unix())
+
+	// Only the hash is stored, so listing the shares doesn't return the secret
+	stored, _ := s.store.GetShares(ctx, owner)
+	assertEq(t, stored[1].Hash, hashToken(share.Token))
+	w = s.request("GET", "/api/v1/me/shares", nil, owner)
+	shares := decode[[]ShareResponse](t, w)
+	assertEq(t, len(shares), 2)
+	share.Token = ""
+	assertEq(t, shares[1], share)
+
+	invalid := []string{`{"ExpiresInDays": -1}`, `{"ExpiresInDays": ` + strconv.Itoa(MAX_SHARE_DAYS+1) + `}`, `not json`}
+	for _, body := range invalid {
+		w := s.request("POST", "/api/v1/books/"+bookId+"/shares", bytes.NewBufferString(body), owner)
+		assertError(t, w, ErrBadRequest)
+	}
+
+	// Only the book's readers can share it
+	w = s.request("POST", "/api/v1/books/"+bookId+"/shares", bytes.NewBufferString(`{}`), other)
+	assertError(t, w, ErrBookNotFound)
+	w = s.request("POST", "/api/v1/books/"+bookId+"/shares", bytes.NewBufferString(`{}`), 0)
+	assertError(t, w, ErrUnauthenticated)
+}
+
+func TestShareStopsWorking(t *testing.T) {
+	s := newTestServer(t)
+	owner, _ := s.store.CreateUser(ctx, "owner@example.com", "hash")
+	other, _ := s.store.CreateUser(ctx, "other@example.com", "hash")
+	w := s.upload(t, "Dune.epub", readDune(t), owner)
+	bookId := strconv.Itoa(decode[UploadResponse](t, w).BookId)
+	url := "/api/v1/me/books/" + bookId + "?token="
+
+	// Expired shares
+	share := s.createShare(t, owner, bookId, `{}`)
+	stored, _ := s.store.GetShare(ctx, hashToken(share.Token))
+	stored.Hash = hashToken("expired")
+	stored.Expires = time.Now().Add(-time.Minute)
+	s.store.CreateShare(ctx, stored)
+	w = s.request("PUT", url+"expired", nil, other)
+	assertError(t, w, ErrBookNotFound)
+
+	// Revoked shares, which only their creator can revoke
+	revoke := "/api/v1/me/shares/" + strconv.Itoa(share.Id)
+	w = s.request("DELETE", revoke, nil, other)
+	assertError(t, w, ErrShareNotFound)
+	w = s.request("DELETE", revoke, nil, owner)
+	assertEq(t, w.Code, http.StatusOK)
+	w = s.request("DELETE", revoke, nil, owner)
+	assertError(t, w, ErrShareNotFound)
+	w = s.request("PUT", url+share.Token, nil, other)
+	assertError(t, w, ErrBookNotFound)
+
+	// Shares of books their creator removed
+	share = s.createShare(t, owner, bookId, `{}`)
+	w = s.request("DELETE", "/api/v1/me/books/"+bookId, nil, owner)
+	assertEq(t, w.Code, http.StatusOK)
+	w = s.request("PUT", url+share.Token, nil, other)
+	assertError(t, w, ErrBookNotFound)
+}
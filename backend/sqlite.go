@@ -0,0 +1,732 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aabiji/page/backend/epub"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SQLite implementation of the UserStore, BookStore and UserBookStore, for single
+// user and embedded deployments. The schema mirrors the postgres schema,
+// with jsonb and array columns stored as json text and times as unix timestamps.
+type SQLiteDB struct {
+	pool  *sql.DB
+	conns sqlQuerier // The pool, or the transaction the queries are part of
+}
+
+// Queries shared by connection pools and transactions.
+type sqlQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// Open a SQLite database file, creating it along with its tables if needed.
+// The filename ":memory:" opens a database that only lives in memory.
+func NewSQLiteDatabase(filename string) (*SQLiteDB, error) {
+	dsn := filename + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	conns, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows one writer at a time, and every
+	// connection to ":memory:" would open a different database
+	conns.SetMaxOpenConns(1)
+
+	tables := []string{`
+    CREATE TABLE IF NOT EXISTS Users (
+        UserId integer PRIMARY KEY AUTOINCREMENT,
+        Email text UNIQUE NOT NULL,
+        Password text NOT NULL
+    );`, `
+    CREATE TABLE IF NOT EXISTS Books (
+        BookId integer PRIMARY KEY AUTOINCREMENT,
+        Title text NOT NULL,
+        CoverImagePath text NOT NULL,
+        Files text NOT NULL,
+        TableOfContents text NOT NULL,
+        Info text NOT NULL
+    );`, `
+    CREATE TABLE IF NOT EXISTS UserBooks (
+        UserId integer NOT NULL,
+        BookId integer NOT NULL,
+        CurrentPage integer NOT NULL,
+        ScrollOffsets text NOT NULL
+    );`, `
+    -- Books could be added to a collection more than once before (UserId, BookId) was unique
+    DELETE FROM UserBooks WHERE rowid NOT IN (
+        SELECT MAX(rowid) FROM UserBooks GROUP BY UserId, BookId
+    );`, `
+    CREATE UNIQUE INDEX IF NOT EXISTS UserBooksKey ON UserBooks (UserId, BookId);`, `
+    CREATE TABLE IF NOT EXISTS Tokens (
+        Hash text PRIMARY KEY,
+        UserId integer NOT NULL,
+        Purpose text NOT NULL,
+        Email text NOT NULL,
+        Expires integer NOT NULL
+    );`, `
+    CREATE TABLE IF NOT EXISTS ApiTokens (
+        Id integer PRIMARY KEY AUTOINCREMENT,
+        UserId integer NOT NULL,
+        Name text NOT NULL,
+        Hash text UNIQUE NOT NULL,
+        Scopes text NOT NULL,
+        Created integer NOT NULL,
+        Expires integer NOT NULL, -- 0 when the token never expires
+        LastUsed integer NOT NULL -- 0 when the token was never used
+    );`, `
+    CREATE TABLE IF NOT EXISTS Shares (
+        Id integer PRIMARY KEY AUTOINCREMENT,
+        UserId integer NOT NULL,
+        BookId integer NOT NULL,
+        Hash text UNIQUE NOT NULL,
+        Created integer NOT NULL,
+        Expires integer NOT NULL
+    );`, `
+    CREATE TABLE IF NOT EXISTS Identities (
+        Provider text NOT NULL,
+        Subject text NOT NULL,
+        UserId integer NOT NULL,
+        PRIMARY KEY (Provider, Subject)
+    );`, `
+    CREATE TABLE IF NOT EXISTS Series (
+        SeriesId integer PRIMARY KEY AUTOINCREMENT,
+        Name text UNIQUE NOT NULL
+    );`, `
+    CREATE TABLE IF NOT EXISTS BookSeries (
+        BookId integer NOT NULL,
+        SeriesId integer NOT NULL,
+        Position real NOT NULL,
+        PRIMARY KEY (BookId, SeriesId)
+    );`, `
+    CREATE TABLE IF NOT EXISTS Validation (
+        BookId integer PRIMARY KEY,
+        Report text NOT NULL
+    );`}
+	ctx, cancel := context.WithTimeout(context.Background(), QUERY_TIMEOUT)
+	defer cancel()
+	for _, table := range tables {
+		if _, err := conns.ExecContext(ctx, table); err != nil {
+			conns.Close()
+			return nil, err
+		}
+	}
+
+	// Users created before emails were verified are considered verified
+	if err := addColumn(ctx, conns, "Users", "Verified", "integer NOT NULL DEFAULT 1"); err != nil {
+		conns.Close()
+		return nil, err
+	}
+
+	if err := addColumn(ctx, conns, "Users", "UseReaderTheme", "integer NOT NULL DEFAULT 0"); err != nil {
+		conns.Close()
+		return nil, err
+	}
+
+	if err := addColumn(ctx, conns, "Users", "Sessions", "integer NOT NULL DEFAULT 0"); err != nil {
+		conns.Close()
+		return nil, err
+	}
+
+	// Columns added with ALTER TABLE can't be UNIQUE, so the hash is unique through an index
+	if err := addColumn(ctx, conns, "Books", "Hash", "text"); err != nil {
+		conns.Close()
+		return nil, err
+	}
+	if _, err := conns.ExecContext(ctx, "CREATE UNIQUE INDEX IF NOT EXISTS BooksHash ON Books (Hash);"); err != nil {
+		conns.Close()
+		return nil, err
+	}
+
+	return &SQLiteDB{pool: conns, conns: conns}, nil
+}
+
+// Add a column to a table that was created before the column existed.
+func addColumn(ctx context.Context, conns *sql.DB, table, column, definition string) error {
+	var count int
+	query := "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name=?;"
+	if err := conns.QueryRowContext(ctx, query, table, column).Scan(&count); err != nil || count > 0 {
+		return err
+	}
+	_, err := conns.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", table, column, definition))
+	return err
+}
+
+func (db *SQLiteDB) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, QUERY_TIMEOUT)
+	defer cancel()
+	return db.pool.PingContext(ctx)
+}
+
+func (db *SQLiteDB) PoolStats() PoolStats {
+	stats := db.pool.Stats()
+	return PoolStats{
+		MaxConns:      stats.MaxOpenConnections,
+		TotalConns:    stats.OpenConnections,
+		IdleConns:     stats.Idle,
+		AcquiredConns: stats.InUse,
+		WaitCount:     stats.WaitCount,
+	}
+}
+
+func (db *SQLiteDB) Close() error {
+	return db.pool.Close()
+}
+
+// Run fn in a transaction, which is committed if fn returns
+// nil and rolled back otherwise. Nested calls join the outer transaction.
+func (db *SQLiteDB) WithTx(ctx context.Context, fn func(tx Store) error) error {
+	if _, inTx := db.conns.(*sql.Tx); inTx {
+		return fn(db)
+	}
+
+	tx, err := db.pool.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // No-op after commit
+
+	if err := fn(&SQLiteDB{pool: db.pool, conns: tx}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Execute a query with a timeout.
+func (db *SQLiteDB) exec(ctx context.Context, query string, args ...any) error {
+	ctx, cancel := context.WithTimeout(ctx, QUERY_TIMEOUT)
+	defer cancel()
+	_, err := db.conns.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Execute a query returning a single row with a timeout and scan the row into dest.
+func (db *SQLiteDB) scanRow(ctx context.Context, query string, args []any, dest ...any) error {
+	ctx, cancel := context.WithTimeout(ctx, QUERY_TIMEOUT)
+	defer cancel()
+	return db.conns.QueryRowContext(ctx, query, args...).Scan(dest...)
+}
+
+// Map a missing row to ErrNotFound.
+func sqliteNotFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Encode a value as json text to be stored in a text column.
+func jsonText(value any) (string, error) {
+	encoded, err := json.Marshal(value)
+	return string(encoded), err
+}
+
+func (db *SQLiteDB) CreateUser(ctx context.Context, email, password string) (int, error) {
+	var id int
+	query := `
+    INSERT INTO Users (Email, Password, Verified) VALUES (?, ?, 0)
+    ON CONFLICT (Email) DO NOTHING
+    RETURNING UserId;`
+	err := db.scanRow(ctx, query, []any{email, password}, &id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrDuplicate
+	}
+	return id, err
+}
+
+func (db *SQLiteDB) GetUserId(ctx context.Context, email, password string) (int, error) {
+	var id int
+	query := "SELECT UserId FROM Users WHERE Email=? AND Password=?;"
+	err := db.scanRow(ctx, query, []any{email, password}, &id)
+	return id, sqliteNotFound(err)
+}
+
+func (db *SQLiteDB) GetUser(ctx context.Context, userId int) (User, error) {
+	user := User{Id: userId}
+	query := "SELECT Email, Password, Verified, Sessions, UseReaderTheme FROM Users WHERE UserId=?;"
+	err := db.scanRow(ctx, query, []any{userId}, &user.Email, &user.Password, &user.Verified, &user.Sessions, &user.Settings.UseReaderTheme)
+	return user, sqliteNotFound(err)
+}
+
+func (db *SQLiteDB) GetUserByEmail(ctx context.Context, email string) (User, error) {
+	user := User{Email: email}
+	query := "SELECT UserId, Password, Verified, Sessions, UseReaderTheme FROM Users WHERE Email=?;"
+	err := db.scanRow(ctx, query, []any{email}, &user.Id, &user.Password, &user.Verified, &user.Sessions, &user.Settings.UseReaderTheme)
+	return user, sqliteNotFound(err)
+}
+
+func (db *SQLiteDB) VerifyEmail(ctx context.Context, userId int, email string) error {
+	var id int
+	query := "UPDATE Users SET Email=?, Verified=1 WHERE UserId=? RETURNING UserId;"
+	err := db.scanRow(ctx, query, []any{email, userId}, &id)
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE {
+		return ErrDuplicate
+	}
+	return sqliteNotFound(err)
+}
+
+func (db *SQLiteDB) UpdatePassword(ctx context.Context, userId int, password string) error {
+	var id int
+	query := "UPDATE Users SET Password=?, Sessions=Sessions+1 WHERE UserId=? RETURNING UserId;"
+	err := db.scanRow(ctx, query, []any{password, userId}, &id)
+	return sqliteNotFound(err)
+}
+
+func (db *SQLiteDB) UpdateSettings(ctx context.Context, userId int, settings Settings) error {
+	var id int
+	query := "UPDATE Users SET UseReaderTheme=? WHERE UserId=? RETURNING UserId;"
+	err := db.scanRow(ctx, query, []any{settings.UseReaderTheme, userId}, &id)
+	return sqliteNotFound(err)
+}
+
+func (db *SQLiteDB) CountUsers(ctx context.Context) (int, error) {
+	var count int
+	err := db.scanRow(ctx, "SELECT COUNT(*) FROM Users;", []any{}, &count)
+	return count, err
+}
+
+func (db *SQLiteDB) DeleteUser(ctx context.Context, userId int) error {
+	err := db.exec(ctx, "DELETE FROM Users WHERE UserId=?;", userId)
+	return err
+}
+
+func (db *SQLiteDB) InsertBook(ctx context.Context, book Book) (int, error) {
+	info, err := jsonText(book.Info)
+	if err != nil {
+		return 0, err
+	}
+	toc, err := jsonText(book.TableOfContents)
+	if err != nil {
+		return 0, err
+	}
+	files, err := jsonText(book.Files)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int
+	query := `
+    INSERT INTO Books
+    (Title, Hash, CoverImagePath, Files, TableOfContents, Info)
+    VALUES (?, NULLIF(?, ''), ?, ?, ?, ?)
+    ON CONFLICT (Hash) DO NOTHING
+    RETURNING BookId;`
+	err = db.scanRow(ctx, query, []any{book.Title, book.Hash, book.CoverImagePath, files, toc, info}, &id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrDuplicate
+	} else if err != nil {
+		return 0, err
+	}
+
+	if err := db.insertBookSeries(ctx, id, book.Info.Series); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// Add a book to each series it belongs to, creating the series if needed.
+func (db *SQLiteDB) insertBookSeries(ctx context.Context, bookId int, series []epub.Series) error {
+	for _, s := range series {
+		var seriesId int
+		query := `
+        INSERT INTO Series (Name) VALUES (?)
+        ON CONFLICT (Name) DO UPDATE SET Name=excluded.Name
+        RETURNING SeriesId;`
+		if err := db.scanRow(ctx, query, []any{s.Name}, &seriesId); err != nil {
+			return err
+		}
+
+		query = `
+        INSERT INTO BookSeries (BookId, SeriesId, Position) VALUES (?, ?, ?)
+        ON CONFLICT DO NOTHING;`
+		if err := db.exec(ctx, query, bookId, seriesId, s.Index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *SQLiteDB) CountBooks(ctx context.Context) (int, error) {
+	var count int
+	err := db.scanRow(ctx, "SELECT COUNT(*) FROM Books;", []any{}, &count)
+	return count, err
+}
+
+func (db *SQLiteDB) GetBook(ctx context.Context, bookId int) (Book, error) {
+	return db.getBook(ctx, "BookId=?", bookId)
+}
+
+func (db *SQLiteDB) GetBookByHash(ctx context.Context, hash string) (Book, error) {
+	return db.getBook(ctx, "Hash=?", hash)
+}
+
+// Get the book matching the condition on the Books table.
+func (db *SQLiteDB) getBook(ctx context.Context, condition string, param any) (Book, error) {
+	var book Book
+	var files, toc, info string
+	query := `
+    SELECT BookId, Title, COALESCE(Hash, ''), CoverImagePath, Files, TableOfContents, Info
+    FROM Books WHERE ` + condition + ";"
+	read := []any{&book.BookId, &book.Title, &book.Hash, &book.CoverImagePath, &files, &toc, &info}
+	if err := db.scanRow(ctx, query, []any{param}, read...); err != nil {
+		return Book{}, sqliteNotFound(err)
+	}
+
+	if err := json.Unmarshal([]byte(files), &book.Files); err != nil {
+		return Book{}, err
+	}
+	if err := json.Unmarshal([]byte(toc), &book.TableOfContents); err != nil {
+		return Book{}, err
+	}
+	if err := json.Unmarshal([]byte(info), &book.Info); err != nil {
+		return Book{}, err
+	}
+	return book, nil
+}
+
+func (db *SQLiteDB) SetValidation(ctx context.Context, bookId int, report epub.Report) error {
+	encoded, err := jsonText(report)
+	if err != nil {
+		return err
+	}
+
+	query := `
+    INSERT INTO Validation (BookId, Report) VALUES (?, ?)
+    ON CONFLICT (BookId) DO UPDATE SET Report=excluded.Report;`
+	err = db.exec(ctx, query, bookId, encoded)
+	return err
+}
+
+func (db *SQLiteDB) GetValidation(ctx context.Context, bookId int) (epub.Report, error) {
+	var report epub.Report
+	var encoded string
+	query := "SELECT Report FROM Validation WHERE BookId=?;"
+	if err := db.scanRow(ctx, query, []any{bookId}, &encoded); err != nil {
+		return report, sqliteNotFound(err)
+	}
+	err := json.Unmarshal([]byte(encoded), &report)
+	return report, err
+}
+
+// Get series along with the books in the user's collection ordered by their
+// position in the series. Get every series of the collection when seriesId is 0.
+func (db *SQLiteDB) readSeries(ctx context.Context, userId, seriesId int) ([]Series, error) {
+	query := `
+    SELECT Series.SeriesId, Series.Name, Books.BookId, Books.Title, BookSeries.Position
+    FROM Series
+    JOIN BookSeries ON BookSeries.SeriesId = Series.SeriesId
+    JOIN Books ON Books.BookId = BookSeries.BookId
+    JOIN UserBooks ON UserBooks.BookId = Books.BookId AND UserBooks.UserId = ?2
+    WHERE ?1 = 0 OR Series.SeriesId = ?1
+    ORDER BY Series.Name, Series.SeriesId, BookSeries.Position, Books.Title;`
+
+	ctx, cancel := context.WithTimeout(ctx, QUERY_TIMEOUT)
+	defer cancel()
+	rows, err := db.conns.QueryContext(ctx, query, seriesId, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	series := []Series{}
+	for rows.Next() {
+		var id int
+		var name string
+		var book SeriesBook
+		if err := rows.Scan(&id, &name, &book.BookId, &book.Title, &book.Position); err != nil {
+			return nil, err
+		}
+
+		if len(series) == 0 || series[len(series)-1].SeriesId != id {
+			series = append(series, Series{SeriesId: id, Name: name})
+		}
+		last := &series[len(series)-1]
+		last.Books = append(last.Books, book)
+	}
+	return series, rows.Err()
+}
+
+func (db *SQLiteDB) GetAllSeries(ctx context.Context, userId int) ([]Series, error) {
+	return db.readSeries(ctx, userId, 0)
+}
+
+func (db *SQLiteDB) GetSeries(ctx context.Context, userId, seriesId int) (Series, error) {
+	series, err := db.readSeries(ctx, userId, seriesId)
+	if err != nil {
+		return Series{}, err
+	}
+	if seriesId == 0 || len(series) == 0 {
+		return Series{}, ErrNotFound
+	}
+	return series[0], nil
+}
+
+func (db *SQLiteDB) AddUserBook(ctx context.Context, userBook UserBook) (bool, error) {
+	offsets, err := jsonText(userBook.ScrollOffsets)
+	if err != nil {
+		return false, err
+	}
+
+	var bookId int
+	query := `
+    INSERT INTO UserBooks (UserId, BookId, CurrentPage, ScrollOffsets) VALUES (?,?,?,?)
+    ON CONFLICT (UserId, BookId) DO NOTHING RETURNING BookId;`
+	args := []any{userBook.UserId, userBook.BookId, userBook.CurrentPage, offsets}
+	err = db.scanRow(ctx, query, args, &bookId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (db *SQLiteDB) GetUserBook(ctx context.Context, userId, bookId int) (UserBook, error) {
+	userBook := UserBook{UserId: userId, BookId: bookId}
+	var offsets string
+	query := "SELECT CurrentPage, ScrollOffsets FROM UserBooks WHERE UserId=? AND BookId=?;"
+	if err := db.scanRow(ctx, query, []any{userId, bookId}, &userBook.CurrentPage, &offsets); err != nil {
+		return UserBook{}, sqliteNotFound(err)
+	}
+	err := json.Unmarshal([]byte(offsets), &userBook.ScrollOffsets)
+	return userBook, err
+}
+
+func (db *SQLiteDB) UpdateProgress(ctx context.Context, userBook UserBook) error {
+	offsets, err := jsonText(userBook.ScrollOffsets)
+	if err != nil {
+		return err
+	}
+
+	var bookId int
+	query := "UPDATE UserBooks SET CurrentPage=?, ScrollOffsets=? WHERE UserId=? AND BookId=? RETURNING BookId;"
+	args := []any{userBook.CurrentPage, offsets, userBook.UserId, userBook.BookId}
+	return sqliteNotFound(db.scanRow(ctx, query, args, &bookId))
+}
+
+func (db *SQLiteDB) RemoveUserBook(ctx context.Context, userId, bookId int) error {
+	err := db.exec(ctx, "DELETE FROM UserBooks WHERE BookId=? AND UserId=?;", bookId, userId)
+	return err
+}
+
+func (db *SQLiteDB) RemoveUserBooks(ctx context.Context, userId int) error {
+	err := db.exec(ctx, "DELETE FROM UserBooks WHERE UserId=?;", userId)
+	return err
+}
+
+func (db *SQLiteDB) CreateToken(ctx context.Context, token Token) error {
+	query := "DELETE FROM Tokens WHERE UserId=? AND Purpose=?;"
+	if err := db.exec(ctx, query, token.UserId, token.Purpose); err != nil {
+		return err
+	}
+	query = "INSERT INTO Tokens (Hash, UserId, Purpose, Email, Expires) VALUES (?, ?, ?, ?, ?);"
+	return db.exec(ctx, query, token.Hash, token.UserId, token.Purpose, token.Email, token.Expires.Unix())
+}
+
+func (db *SQLiteDB) UseToken(ctx context.Context, hash, purpose string) (Token, error) {
+	token := Token{Hash: hash, Purpose: purpose}
+	var expires int64
+	query := "DELETE FROM Tokens WHERE Hash=? AND Purpose=? RETURNING UserId, Email, Expires;"
+	if err := db.scanRow(ctx, query, []any{hash, purpose}, &token.UserId, &token.Email, &expires); err != nil {
+		return Token{}, sqliteNotFound(err)
+	}
+	token.Expires = time.Unix(expires, 0)
+	return token, nil
+}
+
+func (db *SQLiteDB) RemoveTokens(ctx context.Context, userId int) error {
+	err := db.exec(ctx, "DELETE FROM Tokens WHERE UserId=?;", userId)
+	return err
+}
+
+func (db *SQLiteDB) AddIdentity(ctx context.Context, identity Identity) error {
+	var userId int
+	query := `
+    INSERT INTO Identities (Provider, Subject, UserId) VALUES (?, ?, ?)
+    ON CONFLICT (Provider, Subject) DO NOTHING
+    RETURNING UserId;`
+	err := db.scanRow(ctx, query, []any{identity.Provider, identity.Subject, identity.UserId}, &userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (db *SQLiteDB) GetIdentityUser(ctx context.Context, provider, subject string) (int, error) {
+	var userId int
+	query := "SELECT UserId FROM Identities WHERE Provider=? AND Subject=?;"
+	err := db.scanRow(ctx, query, []any{provider, subject}, &userId)
+	return userId, sqliteNotFound(err)
+}
+
+func (db *SQLiteDB) RemoveIdentities(ctx context.Context, userId int) error {
+	err := db.exec(ctx, "DELETE FROM Identities WHERE UserId=?;", userId)
+	return err
+}
+
+// Store zero times as 0.
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func fromUnixTime(seconds int64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0)
+}
+
+func (db *SQLiteDB) CreateApiToken(ctx context.Context, token ApiToken) (int, error) {
+	scopes, err := jsonText(token.Scopes)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int
+	query := `
+    INSERT INTO ApiTokens (UserId, Name, Hash, Scopes, Created, Expires, LastUsed)
+    VALUES (?, ?, ?, ?, ?, ?, ?)
+    RETURNING Id;`
+	args := []any{
+		token.UserId, token.Name, token.Hash, scopes,
+		unixTime(token.Created), unixTime(token.Expires), unixTime(token.LastUsed),
+	}
+	err = db.scanRow(ctx, query, args, &id)
+	return id, err
+}
+
+const API_TOKEN_COLUMNS = "Id, UserId, Name, Hash, Scopes, Created, Expires, LastUsed"
+
+// Scan a row of the ApiTokens table with the API_TOKEN_COLUMNS.
+func scanApiToken(scan func(dest ...any) error) (ApiToken, error) {
+	var token ApiToken
+	var scopes string
+	var created, expires, lastUsed int64
+	err := scan(&token.Id, &token.UserId, &token.Name, &token.Hash, &scopes, &created, &expires, &lastUsed)
+	if err != nil {
+		return ApiToken{}, err
+	}
+	if err := json.Unmarshal([]byte(scopes), &token.Scopes); err != nil {
+		return ApiToken{}, err
+	}
+	token.Created, token.Expires, token.LastUsed = fromUnixTime(created), fromUnixTime(expires), fromUnixTime(lastUsed)
+	return token, nil
+}
+
+func (db *SQLiteDB) GetApiToken(ctx context.Context, hash string) (ApiToken, error) {
+	ctx, cancel := context.WithTimeout(ctx, QUERY_TIMEOUT)
+	defer cancel()
+	row := db.conns.QueryRowContext(ctx, "SELECT "+API_TOKEN_COLUMNS+" FROM ApiTokens WHERE Hash=?;", hash)
+	token, err := scanApiToken(row.Scan)
+	return token, sqliteNotFound(err)
+}
+
+func (db *SQLiteDB) GetApiTokens(ctx context.Context, userId int) ([]ApiToken, error) {
+	ctx, cancel := context.WithTimeout(ctx, QUERY_TIMEOUT)
+	defer cancel()
+	rows, err := db.conns.QueryContext(ctx, "SELECT "+API_TOKEN_COLUMNS+" FROM ApiTokens WHERE UserId=? ORDER BY Id;", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []ApiToken{}
+	for rows.Next() {
+		token, err := scanApiToken(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (db *SQLiteDB) SetApiTokenUsed(ctx context.Context, id int, used time.Time) error {
+	err := db.exec(ctx, "UPDATE ApiTokens SET LastUsed=? WHERE Id=?;", unixTime(used), id)
+	return err
+}
+
+func (db *SQLiteDB) RemoveApiToken(ctx context.Context, userId, id int) error {
+	var removed int
+	query := "DELETE FROM ApiTokens WHERE UserId=? AND Id=? RETURNING Id;"
+	err := db.scanRow(ctx, query, []any{userId, id}, &removed)
+	return sqliteNotFound(err)
+}
+
+func (db *SQLiteDB) RemoveApiTokens(ctx context.Context, userId int) error {
+	err := db.exec(ctx, "DELETE FROM ApiTokens WHERE UserId=?;", userId)
+	return err
+}
+
+func (db *SQLiteDB) CreateShare(ctx context.Context, share Share) (int, error) {
+	var id int
+	query := `
+    INSERT INTO Shares (UserId, BookId, Hash, Created, Expires)
+    VALUES (?, ?, ?, ?, ?)
+    RETURNING Id;`
+	args := []any{share.UserId, share.BookId, share.Hash, unixTime(share.Created), unixTime(share.Expires)}
+	err := db.scanRow(ctx, query, args, &id)
+	return id, err
+}
+
+const SHARE_COLUMNS = "Id, UserId, BookId, Hash, Created, Expires"
+
+// Scan a row of the Shares table with the SHARE_COLUMNS.
+func scanShare(scan func(dest ...any) error) (Share, error) {
+	var share Share
+	var created, expires int64
+	if err := scan(&share.Id, &share.UserId, &share.BookId, &share.Hash, &created, &expires); err != nil {
+		return Share{}, err
+	}
+	share.Created, share.Expires = fromUnixTime(created), fromUnixTime(expires)
+	return share, nil
+}
+
+func (db *SQLiteDB) GetShare(ctx context.Context, hash string) (Share, error) {
+	ctx, cancel := context.WithTimeout(ctx, QUERY_TIMEOUT)
+	defer cancel()
+	row := db.conns.QueryRowContext(ctx, "SELECT "+SHARE_COLUMNS+" FROM Shares WHERE Hash=?;", hash)
+	share, err := scanShare(row.Scan)
+	return share, sqliteNotFound(err)
+}
+
+func (db *SQLiteDB) GetShares(ctx context.Context, userId int) ([]Share, error) {
+	ctx, cancel := context.WithTimeout(ctx, QUERY_TIMEOUT)
+	defer cancel()
+	rows, err := db.conns.QueryContext(ctx, "SELECT "+SHARE_COLUMNS+" FROM Shares WHERE UserId=? ORDER BY Id;", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := []Share{}
+	for rows.Next() {
+		share, err := scanShare(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	return shares, rows.Err()
+}
+
+func (db *SQLiteDB) RemoveShare(ctx context.Context, userId, id int) error {
+	var removed int
+	query := "DELETE FROM Shares WHERE UserId=? AND Id=? RETURNING Id;"
+	err := db.scanRow(ctx, query, []any{userId, id}, &removed)
+	return sqliteNotFound(err)
+}
+
+func (db *SQLiteDB) RemoveShares(ctx context.Context, userId int) error {
+	err := db.exec(ctx, "DELETE FROM Shares WHERE UserId=?;", userId)
+	return err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage for files generated by the server, such as cover thumbnails.
+// Keys are slash separated paths (ex. "covers/1/small.jpg").
+type Storage interface {
+	Put(key string, data []byte) error
+	Get(key string) (io.ReadSeekCloser, time.Time, error)
+	Delete(key string) error
+	// Total size in bytes of the stored files.
+	Size() (int64, error)
+}
+
+// Storage backed by a directory on disk.
+type DiskStorage struct {
+	root string
+}
+
+func NewDiskStorage(root string) *DiskStorage {
+	return &DiskStorage{root: root}
+}
+
+func (s *DiskStorage) path(key string) string {
+	key = filepath.FromSlash(strings.TrimPrefix(key, "/"))
+	return filepath.Join(s.root, filepath.Clean(string(os.PathSeparator)+key))
+}
+
+// Atomically write data to the file at key.
+func (s *DiskStorage) Put(key string, data []byte) error {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := io.Copy(file, bytes.NewReader(data)); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// Open the file at key along with its modification time.
+// The error satisfies os.IsNotExist when the file doesn't exist.
+func (s *DiskStorage) Get(key string) (io.ReadSeekCloser, time.Time, error) {
+	file, err := os.Open(s.path(key))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, time.Time{}, err
+	}
+	return file, info.ModTime(), nil
+}
+
+// Remove the file at key, or every file under key if it's a directory.
+func (s *DiskStorage) Delete(key string) error {
+	return os.RemoveAll(s.path(key))
+}
+
+func (s *DiskStorage) Size() (int64, error) {
+	return directorySize(s.root)
+}
+
+// Total size in bytes of the files in a directory and its subdirectories.
+func directorySize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.Type().IsRegular() {
+			var info fs.FileInfo
+			info, err = entry.Info()
+			if err == nil {
+				size += info.Size()
+			}
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // Removed while walking the directory
+		}
+		return err
+	})
+	return size, err
+}
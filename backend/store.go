@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aabiji/page/backend/epub"
+)
+
+// The longest a single query is allowed to run for.
+const QUERY_TIMEOUT = 10 * time.Second
+
+var (
+	ErrNotFound  = errors.New("Entry not found")
+	ErrDuplicate = errors.New("Entry already exists")
+)
+
+type User struct {
+	Id       int
+	Email    string
+	Password string // Hashed by the frontend, see Credentials
+	Verified bool   // Whether the user confirmed they own their email
+	Sessions int    // Bumped when the password changes, which ends the user's sessions
+	Settings Settings
+}
+
+// The user's preferences, which apply on every device they use.
+type Settings struct {
+	UseReaderTheme bool // Whether books are shown with the reader's theme rather than their own
+}
+
+type Book struct {
+	BookId          int
+	Title           string
+	Hash            string // SHA-256 of the uploaded epub, empty for books uploaded before hashes
+	CoverImagePath  string
+	Files           []string
+	TableOfContents []epub.Section
+	Info            epub.Metadata
+}
+
+// A book in a user's collection along with the user's reading progress.
+type UserBook struct {
+	UserId        int
+	BookId        int
+	CurrentPage   int
+	ScrollOffsets []int
+}
+
+// A single use token mailed to a user, see account.go.
+type Token struct {
+	Hash    string // Hash of the token, the token itself isn't stored
+	UserId  int
+	Purpose string // What the token can be used for, ex. TOKEN_RESET_PASSWORD
+	Email   string // The address the token was mailed to
+	Expires time.Time
+}
+
+// A personal access token letting scripts and other clients
+// use the api as a user, see apitokens.go.
+type ApiToken struct {
+	Id       int
+	UserId   int
+	Name     string   // Chosen by the user to tell their tokens apart
+	Hash     string   // Hash of the token, the token itself isn't stored
+	Scopes   []string // What the token can be used for, ex. SCOPE_LIBRARY_READ
+	Created  time.Time
+	Expires  time.Time // Zero when the token never expires
+	LastUsed time.Time // Zero when the token was never used
+}
+
+// A link letting other users add a book to a reader's collection, see access.go.
+type Share struct {
+	Id      int
+	UserId  int // The reader that shared the book
+	BookId  int
+	Hash    string // Hash of the token, the token itself isn't stored
+	Created time.Time
+	Expires time.Time
+}
+
+// An account at an OpenID Connect provider that a user logs in with, see login.go.
+type Identity struct {
+	Provider string // Name of the provider in OIDC_PROVIDERS
+	Subject  string // The user's id at the provider
+	UserId   int
+}
+
+type SeriesBook struct {
+	BookId   int
+	Title    string
+	Position float64
+}
+
+type Series struct {
+	SeriesId int
+	Name     string
+	Books    []SeriesBook
+}
+
+type UserStore interface {
+	// Create an unverified user and return their id. Returns ErrDuplicate if the email is taken.
+	CreateUser(ctx context.Context, email, password string) (int, error)
+	// Get the id of the user with matching credentials. Returns ErrNotFound if there's none.
+	GetUserId(ctx context.Context, email, password string) (int, error)
+	// Get a user by their id or email. Returns ErrNotFound if there's none.
+	GetUser(ctx context.Context, userId int) (User, error)
+	GetUserByEmail(ctx context.Context, email string) (User, error)
+	// Set a user's email to one they confirmed they own, which verifies them.
+	// Returns ErrDuplicate if the email is taken.
+	VerifyEmail(ctx context.Context, userId int, email string) error
+	// Set a user's password and bump User.Sessions, so their sessions end.
+	UpdatePassword(ctx context.Context, userId int, password string) error
+	UpdateSettings(ctx context.Context, userId int, settings Settings) error
+	DeleteUser(ctx context.Context, userId int) error
+	CountUsers(ctx context.Context) (int, error)
+}
+
+type BookStore interface {
+	// Insert a book along with the series it belongs to and return its id.
+	// Books with the same title are different books, only their hash is unique:
+	// returns ErrDuplicate if a book with the same hash was already inserted.
+	InsertBook(ctx context.Context, book Book) (int, error)
+	GetBook(ctx context.Context, bookId int) (Book, error)
+	// Get the book uploaded from an epub with the hash, see Book.Hash.
+	GetBookByHash(ctx context.Context, hash string) (Book, error)
+	// Save the validation report of a book, replacing any previous report.
+	SetValidation(ctx context.Context, bookId int, report epub.Report) error
+	GetValidation(ctx context.Context, bookId int) (epub.Report, error)
+	CountBooks(ctx context.Context) (int, error)
+}
+
+type UserBookStore interface {
+	// Get the series of the books in the user's collection, along with only those
+	// books, ordered by their position in the series. Other series aren't returned.
+	GetAllSeries(ctx context.Context, userId int) ([]Series, error)
+	GetSeries(ctx context.Context, userId, seriesId int) (Series, error)
+	// Add a book to the user's collection and return true. Returns false,
+	// keeping the user's progress, if the book is already in their collection.
+	AddUserBook(ctx context.Context, userBook UserBook) (bool, error)
+	GetUserBook(ctx context.Context, userId, bookId int) (UserBook, error)
+	// Save the user's reading progress in a book.
+	// Returns ErrNotFound if the book isn't in the user's collection.
+	UpdateProgress(ctx context.Context, userBook UserBook) error
+	RemoveUserBook(ctx context.Context, userId, bookId int) error
+	// Remove every book from a user's collection.
+	RemoveUserBooks(ctx context.Context, userId int) error
+}
+
+type TokenStore interface {
+	// Save a token, replacing the user's previous tokens with the same purpose.
+	CreateToken(ctx context.Context, token Token) error
+	// Remove a token and return it, so that it can only be used once.
+	// Returns ErrNotFound if there's no token with the hash and purpose.
+	UseToken(ctx context.Context, hash, purpose string) (Token, error)
+	// Remove every token of a user.
+	RemoveTokens(ctx context.Context, userId int) error
+}
+
+type ApiTokenStore interface {
+	// Save a token and return its id.
+	CreateApiToken(ctx context.Context, token ApiToken) (int, error)
+	// Get a token by its hash. Returns ErrNotFound if there's none.
+	GetApiToken(ctx context.Context, hash string) (ApiToken, error)
+	// Get every token of a user, oldest first.
+	GetApiTokens(ctx context.Context, userId int) ([]ApiToken, error)
+	// Record when a token was last used.
+	SetApiTokenUsed(ctx context.Context, id int, used time.Time) error
+	// Remove a user's token. Returns ErrNotFound if the user has no token with the id.
+	RemoveApiToken(ctx context.Context, userId, id int) error
+	// Remove every token of a user.
+	RemoveApiTokens(ctx context.Context, userId int) error
+}
+
+type ShareStore interface {
+	// Save a share and return its id.
+	CreateShare(ctx context.Context, share Share) (int, error)
+	// Get a share by its token's hash. Returns ErrNotFound if there's none.
+	GetShare(ctx context.Context, hash string) (Share, error)
+	// Get every share of a user, oldest first.
+	GetShares(ctx context.Context, userId int) ([]Share, error)
+	// Remove a user's share. Returns ErrNotFound if the user has no share with the id.
+	RemoveShare(ctx context.Context, userId, id int) error
+	// Remove every share of a user.
+	RemoveShares(ctx context.Context, userId int) error
+}
+
+type IdentityStore interface {
+	// Link an identity to a user. Returns ErrDuplicate if the identity is already linked.
+	AddIdentity(ctx context.Context, identity Identity) error
+	// Get the id of the user an identity is linked to. Returns ErrNotFound if it isn't linked.
+	GetIdentityUser(ctx context.Context, provider, subject string) (int, error)
+	// Unlink every identity of a user.
+	RemoveIdentities(ctx context.Context, userId int) error
+}
+
+// Statistics about a database's connection pool.
+type PoolStats struct {
+	MaxConns      int
+	TotalConns    int
+	IdleConns     int
+	AcquiredConns int
+	WaitCount     int64 // Number of times a connection had to be waited for
+}
+
+// A store implementing every store interface.
+type Store interface {
+	UserStore
+	BookStore
+	UserBookStore
+	TokenStore
+	ApiTokenStore
+	ShareStore
+	IdentityStore
+	// Run fn in a transaction, which is committed if fn returns nil
+	// and rolled back otherwise. Stores passed to fn must not be used after fn returns.
+	WithTx(ctx context.Context, fn func(tx Store) error) error
+	// Check that the database can be reached.
+	Ping(ctx context.Context) error
+	Close() error
+}
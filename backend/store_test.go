@@ -0,0 +1,531 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aabiji/page/backend/epub"
+)
+
+var ctx = context.Background()
+
+func assertEq(t *testing.T, a any, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("Found %v, want %v", a, b)
+	}
+}
+
+// Run the same suite against every store implementation.
+// newStore must return an empty store.
+func testStore(t *testing.T, newStore func(t *testing.T) Store) {
+	t.Run("Users", func(t *testing.T) {
+		s := newStore(t)
+		id, err := s.CreateUser(ctx, "reader@example.com", "hash")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = s.CreateUser(ctx, "reader@example.com", "other")
+		assertEq(t, err, ErrDuplicate)
+
+		found, err := s.GetUserId(ctx, "reader@example.com", "hash")
+		assertEq(t, found, id)
+		assertEq(t, err, nil)
+		count, err := s.CountUsers(ctx)
+		assertEq(t, count, 1)
+		assertEq(t, err, nil)
+		_, err = s.GetUserId(ctx, "reader@example.com", "wrong")
+		assertEq(t, err, ErrNotFound)
+
+		user, err := s.GetUser(ctx, id)
+		assertEq(t, user, User{Id: id, Email: "reader@example.com", Password: "hash"})
+		assertEq(t, err, nil)
+		user, err = s.GetUserByEmail(ctx, "reader@example.com")
+		assertEq(t, user.Id, id)
+		assertEq(t, err, nil)
+		_, err = s.GetUser(ctx, id+1000)
+		assertEq(t, err, ErrNotFound)
+		_, err = s.GetUserByEmail(ctx, "writer@example.com")
+		assertEq(t, err, ErrNotFound)
+
+		other, _ := s.CreateUser(ctx, "writer@example.com", "hash")
+		assertEq(t, s.VerifyEmail(ctx, id, "writer@example.com"), ErrDuplicate)
+		assertEq(t, s.VerifyEmail(ctx, id, "new@example.com"), nil)
+		assertEq(t, s.UpdatePassword(ctx, id, "new"), nil)
+		assertEq(t, s.UpdateSettings(ctx, id, Settings{UseReaderTheme: true}), nil)
+		user, _ = s.GetUser(ctx, id)
+		settings := Settings{UseReaderTheme: true}
+		assertEq(t, user, User{Id: id, Email: "new@example.com", Password: "new", Verified: true, Sessions: 1, Settings: settings})
+		user, _ = s.GetUserByEmail(ctx, "new@example.com")
+		assertEq(t, user.Settings, settings)
+		assertEq(t, user.Sessions, 1)
+		found, err = s.GetUserId(ctx, "new@example.com", "new")
+		assertEq(t, found, id)
+		assertEq(t, err, nil)
+		assertEq(t, s.UpdatePassword(ctx, id+1000, "new"), ErrNotFound)
+		assertEq(t, s.UpdateSettings(ctx, id+1000, settings), ErrNotFound)
+		assertEq(t, s.VerifyEmail(ctx, id+1000, "other@example.com"), ErrNotFound)
+
+		if err := s.DeleteUser(ctx, other); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.DeleteUser(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.GetUserId(ctx, "new@example.com", "new")
+		assertEq(t, err, ErrNotFound)
+	})
+
+	t.Run("Tokens", func(t *testing.T) {
+		s := newStore(t)
+		expires := time.Unix(time.Now().Add(time.Hour).Unix(), 0)
+		token := Token{Hash: "a", UserId: 1, Purpose: "reset", Email: "reader@example.com", Expires: expires}
+		for _, tk := range []Token{token, {Hash: "b", UserId: 1, Purpose: "confirm", Expires: expires}} {
+			if err := s.CreateToken(ctx, tk); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Tokens can only be used once, for their purpose
+		_, err := s.UseToken(ctx, "a", "confirm")
+		assertEq(t, err, ErrNotFound)
+		found, err := s.UseToken(ctx, "a", "reset")
+		assertEq(t, found.Expires.Equal(expires), true)
+		found.Expires = expires
+		assertEq(t, found, token)
+		assertEq(t, err, nil)
+		_, err = s.UseToken(ctx, "a", "reset")
+		assertEq(t, err, ErrNotFound)
+
+		// New tokens replace the previous token with the same purpose
+		s.CreateToken(ctx, Token{Hash: "c", UserId: 1, Purpose: "confirm", Expires: expires})
+		_, err = s.UseToken(ctx, "b", "confirm")
+		assertEq(t, err, ErrNotFound)
+
+		s.CreateToken(ctx, Token{Hash: "d", UserId: 2, Purpose: "confirm", Expires: expires})
+		assertEq(t, s.RemoveTokens(ctx, 1), nil)
+		_, err = s.UseToken(ctx, "c", "confirm")
+		assertEq(t, err, ErrNotFound)
+		_, err = s.UseToken(ctx, "d", "confirm")
+		assertEq(t, err, nil)
+	})
+
+	t.Run("ApiTokens", func(t *testing.T) {
+		s := newStore(t)
+		created := time.Unix(time.Now().Unix(), 0)
+		token := ApiToken{
+			UserId:  1,
+			Name:    "Sync",
+			Hash:    "a",
+			Scopes:  []string{"library:read", "progress:write"},
+			Created: created,
+			Expires: created.Add(time.Hour),
+		}
+		id, err := s.CreateApiToken(ctx, token)
+		assertEq(t, err, nil)
+		token.Id = id
+		other, _ := s.CreateApiToken(ctx, ApiToken{UserId: 1, Name: "Backup", Hash: "b", Scopes: []string{}, Created: created})
+		s.CreateApiToken(ctx, ApiToken{UserId: 2, Name: "Sync", Hash: "c", Scopes: []string{}, Created: created})
+
+		found, err := s.GetApiToken(ctx, "a")
+		assertEq(t, err, nil)
+		assertEq(t, found.Created.Equal(created) && found.Expires.Equal(token.Expires), true)
+		found.Created, found.Expires = token.Created, token.Expires
+		assertEq(t, found, token)
+		_, err = s.GetApiToken(ctx, "d")
+		assertEq(t, err, ErrNotFound)
+
+		used := created.Add(time.Minute)
+		assertEq(t, s.SetApiTokenUsed(ctx, id, used), nil)
+		tokens, err := s.GetApiTokens(ctx, 1)
+		assertEq(t, err, nil)
+		assertEq(t, len(tokens), 2)
+		assertEq(t, tokens[0].LastUsed.Equal(used), true)
+		assertEq(t, tokens[1].Id, other)
+		assertEq(t, tokens[1].Expires.IsZero() && tokens[1].LastUsed.IsZero(), true)
+
+		// Users can only remove their own tokens
+		assertEq(t, s.RemoveApiToken(ctx, 2, id), ErrNotFound)
+		assertEq(t, s.RemoveApiToken(ctx, 1, id), nil)
+		_, err = s.GetApiToken(ctx, "a")
+		assertEq(t, err, ErrNotFound)
+		assertEq(t, s.RemoveApiTokens(ctx, 1), nil)
+		tokens, _ = s.GetApiTokens(ctx, 1)
+		assertEq(t, len(tokens), 0)
+		_, err = s.GetApiToken(ctx, "c")
+		assertEq(t, err, nil)
+	})
+
+	t.Run("Shares", func(t *testing.T) {
+		s := newStore(t)
+		created := time.Unix(time.Now().Unix(), 0)
+		share := Share{UserId: 1, BookId: 3, Hash: "a", Created: created, Expires: created.Add(time.Hour)}
+		id, err := s.CreateShare(ctx, share)
+		assertEq(t, err, nil)
+		share.Id = id
+		other, _ := s.CreateShare(ctx, Share{UserId: 1, BookId: 4, Hash: "b", Created: created, Expires: created})
+		s.CreateShare(ctx, Share{UserId: 2, BookId: 3, Hash: "c", Created: created, Expires: created})
+
+		found, err := s.GetShare(ctx, "a")
+		assertEq(t, err, nil)
+		assertEq(t, found.Created.Equal(created) && found.Expires.Equal(share.Expires), true)
+		found.Created, found.Expires = share.Created, share.Expires
+		assertEq(t, found, share)
+		_, err = s.GetShare(ctx, "d")
+		assertEq(t, err, ErrNotFound)
+
+		shares, err := s.GetShares(ctx, 1)
+		assertEq(t, err, nil)
+		assertEq(t, len(shares), 2)
+		assertEq(t, shares[0].Id, id)
+		assertEq(t, shares[1].Id, other)
+		assertEq(t, shares[1].BookId, 4)
+
+		// Users can only remove their own shares
+		assertEq(t, s.RemoveShare(ctx, 2, id), ErrNotFound)
+		assertEq(t, s.RemoveShare(ctx, 1, id), nil)
+		_, err = s.GetShare(ctx, "a")
+		assertEq(t, err, ErrNotFound)
+		assertEq(t, s.RemoveShares(ctx, 1), nil)
+		shares, _ = s.GetShares(ctx, 1)
+		assertEq(t, len(shares), 0)
+		_, err = s.GetShare(ctx, "c")
+		assertEq(t, err, nil)
+	})
+
+	t.Run("Identities", func(t *testing.T) {
+		s := newStore(t)
+		assertEq(t, s.AddIdentity(ctx, Identity{"company", "42", 1}), nil)
+		assertEq(t, s.AddIdentity(ctx, Identity{"other", "42", 2}), nil)
+		assertEq(t, s.AddIdentity(ctx, Identity{"company", "42", 2}), ErrDuplicate)
+
+		userId, err := s.GetIdentityUser(ctx, "company", "42")
+		assertEq(t, userId, 1)
+		assertEq(t, err, nil)
+		_, err = s.GetIdentityUser(ctx, "company", "43")
+		assertEq(t, err, ErrNotFound)
+
+		assertEq(t, s.RemoveIdentities(ctx, 1), nil)
+		_, err = s.GetIdentityUser(ctx, "company", "42")
+		assertEq(t, err, ErrNotFound)
+		userId, _ = s.GetIdentityUser(ctx, "other", "42")
+		assertEq(t, userId, 2)
+	})
+
+	t.Run("Books", func(t *testing.T) {
+		s := newStore(t)
+		book := Book{
+			Title:           "Dune",
+			Hash:            hashToken("Dune.epub"),
+			CoverImagePath:  "Dune/cover.jpeg",
+			Files:           []string{"Dune/part1.xhtml", "Dune/part2.xhtml"},
+			TableOfContents: []epub.Section{{Name: "Book 1", Path: "Dune/part1.xhtml"}},
+			Info: epub.Metadata{
+				Title:     "Dune",
+				Author:    "Frank Herbert",
+				Languages: []string{"en"},
+				Subjects:  []string{""},
+			},
+		}
+		id, err := s.InsertBook(ctx, book)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Books are only unique by their hash, not by their title
+		other, err := s.InsertBook(ctx, Book{Title: "Dune"})
+		assertEq(t, other != id, true)
+		assertEq(t, err, nil)
+		_, err = s.InsertBook(ctx, Book{Title: "Dune (copy)", Hash: book.Hash})
+		assertEq(t, err, ErrDuplicate)
+		count, err := s.CountBooks(ctx)
+		assertEq(t, count, 2)
+		assertEq(t, err, nil)
+
+		found, err := s.GetBook(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		book.BookId = id
+		assertEq(t, found, book)
+
+		_, err = s.GetBook(ctx, id+1000)
+		assertEq(t, err, ErrNotFound)
+		found, err = s.GetBookByHash(ctx, book.Hash)
+		assertEq(t, found, book)
+		assertEq(t, err, nil)
+		_, err = s.GetBookByHash(ctx, "unknown")
+		assertEq(t, err, ErrNotFound)
+		_, err = s.GetBookByHash(ctx, "")
+		assertEq(t, err, ErrNotFound)
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		s := newStore(t)
+		_, err := s.GetValidation(ctx, 1)
+		assertEq(t, err, ErrNotFound)
+
+		first := epub.Report{Issues: []epub.Issue{
+			{Severity: epub.ERROR, Code: "BROKEN_LINK", File: "a.xhtml", Line: 3, Message: "Broken"},
+		}}
+		second := epub.Report{Issues: []epub.Issue{}}
+		for _, report := range []epub.Report{first, second} {
+			if err := s.SetValidation(ctx, 1, report); err != nil {
+				t.Fatal(err)
+			}
+			found, err := s.GetValidation(ctx, 1)
+			assertEq(t, found, report)
+			assertEq(t, err, nil)
+		}
+	})
+
+	t.Run("Series", func(t *testing.T) {
+		s := newStore(t)
+		series, err := s.GetAllSeries(ctx, 1)
+		assertEq(t, series, []Series{})
+		assertEq(t, err, nil)
+
+		ids := map[string]int{}
+		books := []struct {
+			title  string
+			series []epub.Series
+		}{
+			{"Children of Dune", []epub.Series{{Name: "Dune", Index: 3}}},
+			{"Dune", []epub.Series{{Name: "Dune", Index: 1}, {Name: "Classics", Index: 1}}},
+			{"Dune Messiah", []epub.Series{{Name: "Dune", Index: 2}}},
+			{"Standalone", nil},
+		}
+		for _, b := range books {
+			id, err := s.InsertBook(ctx, Book{Title: b.title, Info: epub.Metadata{Title: b.title, Series: b.series}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids[b.title] = id
+			s.AddUserBook(ctx, UserBook{UserId: 1, BookId: id, ScrollOffsets: []int{}})
+		}
+
+		series, err = s.GetAllSeries(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEq(t, len(series), 2)
+		assertEq(t, series[0].Name, "Classics")
+		assertEq(t, series[0].Books, []SeriesBook{{ids["Dune"], "Dune", 1}})
+		assertEq(t, series[1].Name, "Dune")
+		assertEq(t, series[1].Books, []SeriesBook{
+			{ids["Dune"], "Dune", 1},
+			{ids["Dune Messiah"], "Dune Messiah", 2},
+			{ids["Children of Dune"], "Children of Dune", 3},
+		})
+
+		found, err := s.GetSeries(ctx, 1, series[1].SeriesId)
+		assertEq(t, found, series[1])
+		assertEq(t, err, nil)
+		_, err = s.GetSeries(ctx, 1, series[1].SeriesId+1000)
+		assertEq(t, err, ErrNotFound)
+
+		// Users only get the series of the books in their collection, with only those books
+		s.AddUserBook(ctx, UserBook{UserId: 2, BookId: ids["Dune Messiah"], ScrollOffsets: []int{}})
+		series, err = s.GetAllSeries(ctx, 2)
+		assertEq(t, err, nil)
+		assertEq(t, len(series), 1)
+		assertEq(t, series[0].Books, []SeriesBook{{ids["Dune Messiah"], "Dune Messiah", 2}})
+		_, err = s.GetSeries(ctx, 2, found.SeriesId-1)
+		assertEq(t, err, ErrNotFound)
+		series, err = s.GetAllSeries(ctx, 3)
+		assertEq(t, series, []Series{})
+	})
+
+	t.Run("UserBooks", func(t *testing.T) {
+		s := newStore(t)
+		userBook := UserBook{UserId: 1, BookId: 2, CurrentPage: 3, ScrollOffsets: []int{0, 10, 20}}
+		for _, ub := range []UserBook{userBook, {UserId: 1, BookId: 3, ScrollOffsets: []int{}}} {
+			added, err := s.AddUserBook(ctx, ub)
+			assertEq(t, added, true)
+			assertEq(t, err, nil)
+		}
+
+		found, err := s.GetUserBook(ctx, 1, 2)
+		assertEq(t, found, userBook)
+		assertEq(t, err, nil)
+		_, err = s.GetUserBook(ctx, 2, 2)
+		assertEq(t, err, ErrNotFound)
+
+		userBook.CurrentPage, userBook.ScrollOffsets = 1, []int{5, 0, 0}
+		assertEq(t, s.UpdateProgress(ctx, userBook), nil)
+		found, _ = s.GetUserBook(ctx, 1, 2)
+		assertEq(t, found, userBook)
+		assertEq(t, s.UpdateProgress(ctx, UserBook{UserId: 2, BookId: 2}), ErrNotFound)
+
+		// Adding a book again keeps the progress, while other users can add it too
+		added, err := s.AddUserBook(ctx, UserBook{UserId: 1, BookId: 2, ScrollOffsets: []int{0, 0, 0}})
+		assertEq(t, added, false)
+		assertEq(t, err, nil)
+		found, _ = s.GetUserBook(ctx, 1, 2)
+		assertEq(t, found, userBook)
+		added, _ = s.AddUserBook(ctx, UserBook{UserId: 2, BookId: 2, ScrollOffsets: []int{}})
+		assertEq(t, added, true)
+
+		if err := s.RemoveUserBook(ctx, 1, 2); err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.GetUserBook(ctx, 1, 2)
+		assertEq(t, err, ErrNotFound)
+		_, err = s.GetUserBook(ctx, 2, 2)
+		assertEq(t, err, nil)
+
+		if err := s.RemoveUserBooks(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.GetUserBook(ctx, 1, 3)
+		assertEq(t, err, ErrNotFound)
+	})
+
+	t.Run("Transactions", func(t *testing.T) {
+		s := newStore(t)
+		failure := errors.New("Failure")
+		err := s.WithTx(ctx, func(tx Store) error {
+			if _, err := tx.CreateUser(ctx, "reader@example.com", "hash"); err != nil {
+				return err
+			}
+			if _, err := tx.InsertBook(ctx, Book{Title: "Dune"}); err != nil {
+				return err
+			}
+			return failure
+		})
+		assertEq(t, err, failure)
+		_, err = s.GetUserId(ctx, "reader@example.com", "hash")
+		assertEq(t, err, ErrNotFound)
+		_, err = s.GetBook(ctx, 1)
+		assertEq(t, err, ErrNotFound)
+
+		// Nested transactions join the outer transaction
+		var userId int
+		err = s.WithTx(ctx, func(tx Store) error {
+			return tx.WithTx(ctx, func(tx Store) error {
+				userId, err = tx.CreateUser(ctx, "reader@example.com", "hash")
+				return err
+			})
+		})
+		assertEq(t, err, nil)
+		found, err := s.GetUserId(ctx, "reader@example.com", "hash")
+		assertEq(t, found, userId)
+		assertEq(t, err, nil)
+
+		// Nothing is committed once the context is canceled
+		canceled, cancel := context.WithCancel(ctx)
+		err = s.WithTx(canceled, func(tx Store) error {
+			cancel()
+			tx.CreateUser(ctx, "writer@example.com", "hash")
+			return nil
+		})
+		if err == nil {
+			t.Fatal("Committed a transaction with a canceled context")
+		}
+		_, err = s.GetUserId(ctx, "writer@example.com", "hash")
+		assertEq(t, err, ErrNotFound)
+	})
+}
+
+// Check that reopening a database keeps its data. Tables are
+// created when the database is opened, so opening must be idempotent.
+// open must return the same database every time it's called.
+func testReopen(t *testing.T, open func(t *testing.T) Store) {
+	s := open(t)
+	userId, err := s.CreateUser(ctx, "reader@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := []epub.Series{{Name: "Dune", Index: 1.5}}
+	bookId, err := s.InsertBook(ctx, Book{Title: "Dune", Info: epub.Metadata{Title: "Dune", Series: series}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = open(t)
+	defer s.Close()
+	found, err := s.GetUserId(ctx, "reader@example.com", "hash")
+	assertEq(t, found, userId)
+	assertEq(t, err, nil)
+	book, err := s.GetBook(ctx, bookId)
+	assertEq(t, book.Info.Series, series)
+	assertEq(t, err, nil)
+
+	// Ids keep increasing after reopening
+	newId, err := s.CreateUser(ctx, "writer@example.com", "hash")
+	assertEq(t, newId > userId, true)
+	assertEq(t, err, nil)
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store { return NewMemoryStore() })
+}
+
+// Runs against the database in PAGE_TEST_DATABASE_URL, whose tables are emptied.
+func TestPostgresStore(t *testing.T) {
+	databaseUrl := os.Getenv("PAGE_TEST_DATABASE_URL")
+	if databaseUrl == "" {
+		t.Skip("PAGE_TEST_DATABASE_URL isn't set")
+	}
+
+	testStore(t, func(t *testing.T) Store {
+		db, err := NewDatabase(databaseUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+
+		sql := "TRUNCATE Users, Books, UserBooks, Tokens, ApiTokens, Shares, Identities, Series, BookSeries, Validation RESTART IDENTITY;"
+		if err := db.Exec(ctx, sql); err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		db, err := NewDatabase(databaseUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Exec(ctx, "TRUNCATE Users, Books, UserBooks, Tokens, ApiTokens, Shares, Identities, Series, BookSeries, Validation RESTART IDENTITY;")
+		db.Close()
+
+		testReopen(t, func(t *testing.T) Store {
+			db, err := NewDatabase(databaseUrl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		})
+	})
+}
+
+func TestSQLiteStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		db, err := NewSQLiteDatabase(filepath.Join(t.TempDir(), "page.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "page.db")
+		testReopen(t, func(t *testing.T) Store {
+			db, err := NewSQLiteDatabase(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		})
+	})
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	_ "image/gif"
+	_ "image/png"
+
+	"github.com/aabiji/page/backend/epub"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	_ "golang.org/x/image/webp"
+)
+
+// Width in pixels of each cover thumbnail size.
+// The height is derived from the aspect ratio of the cover.
+var THUMBNAIL_SIZES = map[string]int{
+	"small":  160,
+	"medium": 320,
+	"large":  640,
+}
+
+// Largest cover that's decoded, in pixels, so that small
+// files can't decode into images that exhaust the memory.
+const MAX_COVER_PIXELS = 40_000_000
+
+// Background colors used for generated placeholder covers.
+var placeholderColors = []color.RGBA{
+	{0x2e, 0x4a, 0x62, 0xff}, {0x7a, 0x3b, 0x3b, 0xff}, {0x3d, 0x5a, 0x3d, 0xff},
+	{0x5b, 0x4a, 0x72, 0xff}, {0x8a, 0x6d, 0x2f, 0xff}, {0x33, 0x33, 0x33, 0xff},
+}
+
+func thumbnailKey(bookId int, size string) string {
+	return fmt.Sprintf("covers/%d/%s.jpg", bookId, size)
+}
+
+// Parse a css hex color (ex. "#fff" or "#a0b1c2").
+func parseHexColor(s string) (color.RGBA, bool) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "#")
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+	if len(s) != 6 {
+		return color.RGBA{}, false
+	}
+
+	value, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return color.RGBA{}, false
+	}
+	return color.RGBA{uint8(value >> 16), uint8(value >> 8), uint8(value), 0xff}, true
+}
+
+// Split text into lines that are at most width characters long.
+func wrapText(text string, width int) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		if len(word) > width {
+			word = word[:width]
+		}
+		if line != "" && len(line)+1+len(word) > width {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// Generate a cover displaying the book's title and author.
+// The background color is derived from the title when background is nil.
+func placeholderCover(title, author string, background *color.RGBA) image.Image {
+	const width, height, margin, scale = 200, 300, 14, 3
+	face := basicfont.Face7x13
+
+	if background == nil {
+		hash := fnv.New32a()
+		hash.Write([]byte(title))
+		background = &placeholderColors[hash.Sum32()%uint32(len(placeholderColors))]
+	}
+	luminance := 0.299*float64(background.R) + 0.587*float64(background.G) + 0.114*float64(background.B)
+	textColor := image.White
+	if luminance > 150 {
+		textColor = image.Black
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+
+	drawer := font.Drawer{Dst: canvas, Src: textColor, Face: face}
+	charsPerLine := (width - 2*margin) / face.Advance
+	lineHeight := face.Height + 4
+
+	drawLines := func(lines []string, y int) {
+		for _, line := range lines {
+			lineWidth := drawer.MeasureString(line).Round()
+			drawer.Dot = fixed.P((width-lineWidth)/2, y)
+			drawer.DrawString(line)
+			y += lineHeight
+		}
+	}
+
+	titleLines := wrapText(title, charsPerLine)
+	if len(titleLines) > 8 {
+		titleLines = titleLines[:8]
+	}
+	drawLines(titleLines, height/4)
+
+	authorLines := wrapText(author, charsPerLine)
+	if len(authorLines) > 2 {
+		authorLines = authorLines[:2]
+	}
+	drawLines(authorLines, height-margin-lineHeight*len(authorLines))
+
+	// Scale up so that the text stays crisp in the larger thumbnails
+	scaled := image.NewRGBA(image.Rect(0, 0, width*scale, height*scale))
+	draw.NearestNeighbor.Scale(scaled, scaled.Bounds(), canvas, canvas.Bounds(), draw.Src, nil)
+	return scaled
+}
+
+// Rasterize a simple svg cover. Svg covers usually wrap a raster image
+// (<image xlink:href="">), otherwise use the fill of the svg's first shape
+// as the background of a placeholder cover.
+func decodeSVG(coverPath string, data []byte, title, author string) (image.Image, error) {
+	var background *color.RGBA
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		element, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		for _, attr := range element.Attr {
+			if element.Name.Local == "image" && attr.Name.Local == "href" {
+				return decodeSVGImage(coverPath, attr.Value)
+			}
+			if attr.Name.Local == "fill" && background == nil {
+				if c, ok := parseHexColor(attr.Value); ok {
+					background = &c
+				}
+			}
+		}
+	}
+
+	return placeholderCover(title, author, background), nil
+}
+
+// Decode the raster image referenced by an svg <image> element, either as a
+// data uri or as a path relative to the svg file, which must be in the same book.
+// coverPath is the path of the svg file, relative to epub.EXTRACT_DIRECTORY.
+func decodeSVGImage(coverPath, href string) (image.Image, error) {
+	var data []byte
+	var err error
+
+	if strings.HasPrefix(href, "data:") {
+		_, encoded, found := strings.Cut(href, ";base64,")
+		if !found {
+			return nil, fmt.Errorf("Unsupported data uri in svg cover")
+		}
+		data, err = base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	} else {
+		book, svgPath, _ := strings.Cut(coverPath, "/")
+		resolved := epub.ResolvePath(svgPath, href)
+		if book == "" || resolved == "" {
+			return nil, fmt.Errorf("The svg cover's image %q isn't in the book", href)
+		}
+		data, err = os.ReadFile(filepath.Join(epub.EXTRACT_DIRECTORY, book, filepath.FromSlash(resolved)))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeImage(data)
+}
+
+// Decode an image, unless it's larger than MAX_COVER_PIXELS.
+func decodeImage(data []byte) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width <= 0 || config.Height <= 0 || int64(config.Width)*int64(config.Height) > MAX_COVER_PIXELS {
+		return nil, fmt.Errorf("The cover is %dx%d pixels", config.Width, config.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// Decode the cover image found in the extracted epub. Fall back
+// to a placeholder cover if the book has no cover or it can't be decoded.
+func decodeCover(coverPath, title, author string) image.Image {
+	if coverPath == "" {
+		return placeholderCover(title, author, nil)
+	}
+
+	path := filepath.Join(epub.EXTRACT_DIRECTORY, filepath.FromSlash(coverPath))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return placeholderCover(title, author, nil)
+	}
+
+	var img image.Image
+	trimmed := bytes.TrimSpace(data)
+	if strings.HasSuffix(strings.ToLower(path), ".svg") || bytes.HasPrefix(trimmed, []byte("<")) {
+		img, err = decodeSVG(coverPath, data, title, author)
+	} else {
+		img, err = decodeImage(data)
+	}
+
+	if err != nil || img.Bounds().Dx() == 0 || img.Bounds().Dy() == 0 {
+		return placeholderCover(title, author, nil)
+	}
+	return img
+}
+
+// Scale an image to a width, keeping its aspect ratio, and encode it as a jpeg.
+func encodeThumbnail(img image.Image, width int) ([]byte, error) {
+	bounds := img.Bounds()
+	if bounds.Dx() < width { // Never upscale
+		width = bounds.Dx()
+	}
+	height := max(1, bounds.Dy()*width/bounds.Dx())
+
+	// Jpegs have no transparency, so draw transparent covers onto white
+	thumbnail := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(thumbnail, thumbnail.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(thumbnail, thumbnail.Bounds(), img, bounds, draw.Over, nil)
+
+	var buffer bytes.Buffer
+	if err := jpeg.Encode(&buffer, thumbnail, &jpeg.Options{Quality: 85}); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Generate every thumbnail size for a book's cover and save them in storage.
+// coverPath is the url path to the cover image inside the extracted epub.
+func generateThumbnails(storage Storage, bookId int, coverPath, title, author string) error {
+	cover := decodeCover(coverPath, title, author)
+
+	for size, width := range THUMBNAIL_SIZES {
+		data, err := encodeThumbnail(cover, width)
+		if err != nil {
+			return err
+		}
+		if err := storage.Put(thumbnailKey(bookId, size), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aabiji/page/backend/epub"
+)
+
+// Write a file relative to epub.EXTRACT_DIRECTORY.
+func writeExtracted(t *testing.T, path string, data []byte) {
+	t.Helper()
+	path = filepath.Join(epub.EXTRACT_DIRECTORY, filepath.FromSlash(path))
+	os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func encodePng(t *testing.T, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	img.Set(0, 0, color.RGBA{0xff, 0, 0, 0xff})
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, img); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestDecodeSvgCover(t *testing.T) {
+	svg := func(href string) []byte {
+		return []byte(`<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink">
+		  <image width="600" height="800" xlink:href="` + href + `"/></svg>`)
+	}
+	writeExtracted(t, "SvgBook/OEBPS/Images/art.png", encodePng(t, 30, 40))
+	writeExtracted(t, "SvgBook/OEBPS/Text/cover.svg", svg("../Images/art.png"))
+	writeExtracted(t, "OtherBook/cover.png", encodePng(t, 50, 50))
+	writeExtracted(t, "SvgBook/OEBPS/escape.svg", svg("../../OtherBook/cover.png"))
+
+	img := decodeCover("SvgBook/OEBPS/Text/cover.svg", "Title", "Author")
+	assertEq(t, img.Bounds(), image.Rect(0, 0, 30, 40))
+
+	// Images outside of the book aren't used, the placeholder is
+	placeholder := placeholderCover("Title", "Author", nil).Bounds()
+	img = decodeCover("SvgBook/OEBPS/escape.svg", "Title", "Author")
+	assertEq(t, img.Bounds(), placeholder)
+}
+
+func TestDecodeHugeCover(t *testing.T) {
+	// A small png whose header claims it's far larger than it is
+	data := encodePng(t, 1, 1)
+	header := data[16:29] // IHDR data, after the signature, the length and the type
+	binary.BigEndian.PutUint32(header[0:4], 100_000)
+	binary.BigEndian.PutUint32(header[4:8], 100_000)
+	binary.BigEndian.PutUint32(data[29:33], crc32.ChecksumIEEE(data[12:29]))
+
+	_, err := decodeImage(data)
+	if err == nil {
+		t.Fatal("Decoded a 100000x100000 image")
+	}
+	writeExtracted(t, "HugeBook/cover.png", data)
+	img := decodeCover("HugeBook/cover.png", "Title", "Author")
+	assertEq(t, img.Bounds(), placeholderCover("Title", "Author", nil).Bounds())
+}
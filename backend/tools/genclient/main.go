@@ -0,0 +1,34 @@
+// Generate the frontend's typescript api client from the OpenAPI document.
+//
+// Usage: go run ./tools/genclient -spec openapi.json -out ../frontend/src/lib/api.ts
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/aabiji/page/backend/openapi"
+)
+
+func main() {
+	spec := flag.String("spec", "openapi.json", "Path to the OpenAPI document")
+	out := flag.String("out", "../frontend/src/lib/api.ts", "Path to the generated client")
+	flag.Parse()
+
+	data, err := os.ReadFile(*spec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	document, err := openapi.Parse(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client, err := openapi.GenerateClient(document)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*out, client, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,38 @@
+// Run an OpenID Connect provider signing in a single user without asking
+// for credentials, to try logging in with OIDC_PROVIDERS locally.
+//
+// Usage: go run ./tools/mockidp -addr localhost:9000 -email reader@example.com
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/aabiji/page/backend/oidc/oidctest"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:9000", "Address to listen on")
+	clientId := flag.String("client-id", "page", "Client id the server is registered with")
+	clientSecret := flag.String("client-secret", "secret", "Client secret the server is registered with")
+	subject := flag.String("subject", "1", "Id of the signed in user")
+	email := flag.String("email", "reader@example.com", "Email of the signed in user")
+	verified := flag.Bool("verified", true, "Whether the email is verified")
+	flag.Parse()
+
+	provider := oidctest.New("http://"+*addr, *clientId, *clientSecret)
+	provider.SetUser(oidctest.User{Subject: *subject, Email: *email, EmailVerified: *verified})
+
+	log.Printf("Running provider at %s, start the server with OIDC_PROVIDERS set to:", provider.Issuer)
+	json.NewEncoder(os.Stderr).Encode([]map[string]string{{
+		"Name":         "mock",
+		"DisplayName":  "Mock provider",
+		"Issuer":       provider.Issuer,
+		"ClientId":     *clientId,
+		"ClientSecret": *clientSecret,
+	}})
+	log.Fatal(http.ListenAndServe(*addr, provider))
+}
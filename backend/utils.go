@@ -1,38 +1,87 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aabiji/page/backend/epub"
+	"github.com/gorilla/mux"
 )
 
-// Add json containing an error value to the http response and set the appropriate response code.
-func respondWithError(w http.ResponseWriter, err string) {
-	errorCode := http.StatusOK
-	if err == INTERNAL_ERROR {
-		errorCode = http.StatusInternalServerError
-	} else if err == BAD_CLIENT_REQUEST {
-		errorCode = http.StatusBadRequest
-	}
+// How long a session stays valid for, before the user has to log in again.
+const SESSION_LIFETIME = 30 * 24 * time.Hour
+
+func (s *Server) sessionSignature(userId string, sessions int, expires string) string {
+	return s.sign("session", userId, strconv.Itoa(sessions), expires)
+}
 
-	w.WriteHeader(errorCode)
-	response := map[string]string{"Server error": err}
-	json.NewEncoder(w).Encode(response)
+// The value of the USERID cookie for a session: the user's id, when the
+// session expires and a signature, so the cookie can't be forged. The signature
+// covers User.Sessions, so sessions end when the user's password changes.
+func (s *Server) sessionValue(user User, expires time.Time) string {
+	id, expiresText := strconv.Itoa(user.Id), strconv.FormatInt(expires.Unix(), 10)
+	return id + "." + expiresText + "." + s.sessionSignature(id, user.Sessions, expiresText)
+}
+
+// Start a session for the user by setting the USERID cookie. Scripts can't read
+// the cookie and other sites can't send it along with their requests.
+func (s *Server) startSession(w http.ResponseWriter, r *http.Request, user User) {
+	expires := time.Now().Add(SESSION_LIFETIME)
+	cookie := http.Cookie{
+		Name: USERID, Value: s.sessionValue(user, expires), Path: "/", Expires: expires,
+		HttpOnly: true, SameSite: http.SameSiteLaxMode, Secure: r.TLS != nil,
+	}
+	http.SetCookie(w, &cookie)
 }
 
-// Add cookie header to the http response sent to the client.
-func setCookie(w http.ResponseWriter, r *http.Request, name, value string) {
-	future := time.Now().Add(100000 * time.Hour)
-	cookie := http.Cookie{Name: name, Value: value, Path: "/", HttpOnly: false, Expires: future}
+// End the session by removing the USERID cookie.
+func endSession(w http.ResponseWriter, r *http.Request) {
+	cookie := http.Cookie{
+		Name: USERID, Value: "", Path: "/", MaxAge: -1,
+		HttpOnly: true, SameSite: http.SameSiteLaxMode, Secure: r.TLS != nil,
+	}
 	http.SetCookie(w, &cookie)
-	json.NewEncoder(w).Encode(map[string]string{})
+}
+
+// Get the user id of a USERID cookie, checking that the server signed it
+// and that the session hasn't expired or been ended by a password change.
+func (s *Server) verifySession(ctx context.Context, value string, now time.Time) (int, error) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return 0, errors.New("Malformed session")
+	}
+	userId, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, errors.New("Malformed session")
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || now.Unix() >= expires {
+		return 0, errors.New("The session expired")
+	}
+
+	user, err := s.store.GetUser(ctx, userId)
+	if errors.Is(err, ErrNotFound) {
+		return 0, errors.New("Invalid session signature")
+	} else if err != nil {
+		return 0, err
+	}
+	expected := s.sessionSignature(parts[0], user.Sessions, parts[1])
+	if !hmac.Equal([]byte(parts[2]), []byte(expected)) {
+		return 0, errors.New("Invalid session signature")
+	}
+	return userId, nil
 }
 
 // Get json payload from the body of a POST request.
@@ -51,96 +100,123 @@ func getRequestJson[T any](w http.ResponseWriter, r *http.Request, data *T) erro
 
 // Receive a file sent from a frontend request and save it on disk.
 func receiveFile(w http.ResponseWriter, r *http.Request) (string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_UPLOAD_SIZE)
 	if err := r.ParseMultipartForm(MAX_UPLOAD_SIZE); err != nil {
-		return "", errors.New(BAD_CLIENT_REQUEST)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return "", ErrUploadTooLarge.Wrap(err)
+		}
+		return "", ErrBadRequest.Wrap(err)
 	}
 
 	file, handler, err := r.FormFile("file")
 	if err != nil {
-		return "", errors.New(BAD_CLIENT_REQUEST)
+		return "", ErrBadRequest.Wrap(err)
 	}
 	defer file.Close()
 
-	filename := filepath.Join(FILE_UPLOAD_DIRECTORY, handler.Filename)
-	localFile, err := os.Create(filename)
+	// Uploads get unique names, so they're never written over other uploads or
+	// their extracted files, which are named after them (ex. 123-Dune.epub)
+	localFile, err := os.CreateTemp(FILE_UPLOAD_DIRECTORY, "*-"+filepath.Base(handler.Filename))
 	if err != nil {
-		return "", errors.New(INTERNAL_ERROR)
+		return "", err
 	}
 	defer localFile.Close()
 
 	if _, err := io.Copy(localFile, file); err != nil {
-		return "", errors.New(INTERNAL_ERROR)
+		os.Remove(localFile.Name())
+		return "", err
 	}
 
-	return filename, nil
+	return localFile.Name(), nil
 }
 
-// Receive an epub file sent from a frontend request.
-// Insert relavent extracted information from the epub file into the database.
-// Return the number of pages in the epub, the id of the newly inserted row and a portential error.
-func receiveEpub(w http.ResponseWriter, r *http.Request) (int, int, error) {
+// Get the id of the user making the request from the USERID cookie,
+// or from the api token the request was authenticated with.
+func (s *Server) getUserId(r *http.Request) (int, error) {
+	if token, found := r.Context().Value(apiTokenKey{}).(ApiToken); found {
+		return token.UserId, nil
+	}
+	c, err := r.Cookie(USERID)
+	if err != nil {
+		return 0, err
+	}
+	userId, err := s.verifySession(r.Context(), c.Value, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	recordUser(r, userId)
+	return userId, nil
+}
+
+// Get the id in the request's url path (ex. 1 in /book/get/1).
+func getPathId(r *http.Request) (int, error) {
+	return strconv.Atoi(mux.Vars(r)["id"])
+}
+
+// Receive an epub file sent from a frontend request and return the path
+// to the uploaded file along with the SHA-256 hash of its contents.
+func receiveEpub(w http.ResponseWriter, r *http.Request) (string, string, error) {
 	filename, err := receiveFile(w, r)
 	if err != nil {
-		return 0, 0, err
+		return "", "", err
 	}
 
 	fileparts := strings.Split(filename, ".")
 	if fileparts[len(fileparts)-1] != "epub" {
 		os.Remove(filename)
-		return 0, 0, errors.New(BAD_CLIENT_REQUEST)
+		return "", "", ErrUnsupportedFile.Wrap(fmt.Errorf("%s isn't an epub", filename))
 	}
 
-	e, err := epub.New(filename)
+	file, err := os.Open(filename)
 	if err != nil {
 		os.Remove(filename)
-		return 0, 0, errors.New(INTERNAL_ERROR)
+		return "", "", err
 	}
-
-	id, err := insertBook(e)
-	if err != nil {
-		return 0, 0, errors.New(INTERNAL_ERROR)
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		os.Remove(filename)
+		return "", "", err
 	}
-
-	return len(e.Files), id, nil
+	return filename, hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-// Get the BookId of a book with a given title
-func getBook(title string) (int, error) {
-	var id int
-	sql := "SELECT BookId FROM Books WHERE Title=$1;"
-	if _, err := database.Read(sql, []any{title}, []any{&id}); err != nil {
-		return 0, err
+// Parse an uploaded epub file, which is removed on errors.
+// The returned epub's validation report is set even when there's an error.
+func openEpub(filename string) (epub.Epub, error) {
+	e, err := epub.New(filename)
+	if errors.Is(err, epub.ErrEncrypted) {
+		os.Remove(filename)
+		return e, ErrDrmProtected.Wrap(err)
+	} else if errors.Is(err, epub.ErrInvalid) {
+		os.Remove(filename)
+		return e, ErrInvalidEpub.Wrap(err)
+	} else if err != nil {
+		os.Remove(filename)
+		return e, err
 	}
-	return id, nil
+	return e, nil
 }
 
-// Insert a new entry to the Books table in the database
-// and return the id of the newly inserted row.
-func insertBook(e epub.Epub) (int, error) {
-	info, err := json.Marshal(e.Info)
+// Insert relavent extracted information from the epub file with the hash into
+// the database along with its validation report and return the book's id.
+func insertEpub(ctx context.Context, store Store, e epub.Epub, hash string) (int, error) {
+	book := Book{
+		Title:           e.Info.Title,
+		Hash:            hash,
+		CoverImagePath:  e.CoverImagePath,
+		Files:           e.Files,
+		TableOfContents: e.TableOfContents,
+		Info:            e.Info,
+	}
+	id, err := store.InsertBook(ctx, book)
 	if err != nil {
-		return 0, errors.New(INTERNAL_ERROR)
-	}
-	toc, err := json.Marshal(e.TableOfContents)
-	if err != nil {
-		return 0, errors.New(INTERNAL_ERROR)
-	}
-
-	var id int
-	id, err = getBook(e.Info.Title)
-	if err == nil { // A book with the same title has already been inserted.
-		return id, nil
+		return 0, err
 	}
 
-	sql := `
-    INSERT INTO Books 
-    (Title, CoverImagePath, Files, TableOfContents, Info) 
-    VALUES ($1, $2, $3, $4, $5)
-    RETURNING BookId;`
-	insert := []any{e.Info.Title, e.CoverImagePath, e.Files, toc, info}
-	if err := database.ExecScan(sql, insert, &id); err != nil {
+	if err := store.SetValidation(ctx, id, e.Report); err != nil {
 		return 0, err
 	}
-
 	return id, nil
 }
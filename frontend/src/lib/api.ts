@@ -0,0 +1,390 @@
+// Generated from backend/openapi.json by backend/tools/genclient. Don't edit.
+// Regenerate it by running go generate in the backend directory.
+
+import { ApiError, backendOrigin, callApi } from "./utils";
+
+export interface AccountResponse {
+    Email: string;
+    Settings: Settings;
+    // Whether the user confirmed they own their email.
+    Verified: boolean;
+}
+
+export interface ApiTokenRequest {
+    // The token never expires when omitted.
+    ExpiresInDays?: number;
+    Name: string;
+    Scopes: ("library:read" | "library:write" | "progress:write")[];
+}
+
+export interface ApiTokenResponse {
+    // Unix timestamp.
+    Created: number;
+    // Unix timestamp, omitted when the token never expires.
+    Expires?: number;
+    Id: number;
+    // Unix timestamp, omitted when the token was never used.
+    LastUsed?: number;
+    Name: string;
+    Scopes: string[];
+    // The secret, only returned when the token is created.
+    Token?: string;
+}
+
+export interface BookResponse {
+    CoverImagePath: string;
+    Files: string[];
+    Info: Metadata;
+    // Signed url path the book's files are served from until it expires, followed by their path.
+    StaticUrl: string;
+    TableOfContents: Section[];
+}
+
+export interface Creator {
+    FileAs: string;
+    Name: string;
+    Role: string;
+}
+
+export interface Credentials {
+    email: string;
+    // SHA256 hash of the password.
+    password: string;
+}
+
+export interface EmailChangeRequest {
+    // Only used once confirmed with the link mailed to it.
+    Email: string;
+    // SHA256 hash of the password.
+    Password: string;
+}
+
+export interface EmailConfirmRequest {
+    Token: string;
+}
+
+export interface EmptyResponse {
+}
+
+export interface ErrorResponse {
+    code: string;
+    // Details about the error, which depend on the code.
+    details: any;
+    message: string;
+    requestId: string;
+}
+
+export interface HealthResponse {
+    Status: string;
+}
+
+export interface Identifier {
+    Scheme: string;
+    Value: string;
+}
+
+export interface Issue {
+    Code: string;
+    File: string;
+    Line?: number;
+    Message: string;
+    Severity: "fatal" | "error" | "warning";
+}
+
+export interface Metadata {
+    Author: string;
+    Contributors: Creator[];
+    Coverage: string;
+    Creators: Creator[];
+    Description: string;
+    Identifiers: Identifier[];
+    Languages: string[];
+    Modified?: string;
+    Published?: string;
+    Publisher: string;
+    Relation: string;
+    Rights: string;
+    Series: MetadataSeries[];
+    Source: string;
+    Subjects: string[];
+    Title: string;
+}
+
+export interface MetadataSeries {
+    Index: number;
+    Name: string;
+    Type: string;
+}
+
+export interface PasswordChangeRequest {
+    // SHA256 hash of the password.
+    CurrentPassword: string;
+    // SHA256 hash of the password.
+    NewPassword: string;
+}
+
+export interface PasswordResetConfirmRequest {
+    // SHA256 hash of the password.
+    Password: string;
+    Token: string;
+}
+
+export interface PasswordResetRequest {
+    Email: string;
+}
+
+export interface ProgressRequest {
+    // Index of the file being read.
+    CurrentPage: number;
+    // Vertical scroll offset within each of the book's files.
+    ScrollOffsets: number[];
+}
+
+export interface ProviderResponse {
+    DisplayName: string;
+    // Identifies the provider in its login url.
+    Name: string;
+}
+
+export interface ReadinessResponse {
+    // "ok" or "unavailable" when the check failed.
+    Database: string;
+    // "ok" or "unavailable" when the check failed.
+    Storage: string;
+}
+
+export interface Report {
+    Issues: Issue[];
+}
+
+export interface Section {
+    Name: string;
+    Path: string;
+}
+
+export interface Series {
+    Books: SeriesBook[];
+    Name: string;
+    SeriesId: number;
+}
+
+export interface SeriesBook {
+    BookId: number;
+    Position: number;
+    Title: string;
+}
+
+// The user's preferences, which apply on every device they use.
+export interface Settings {
+    // Whether books are shown with the reader's theme rather than their own.
+    UseReaderTheme: boolean;
+}
+
+export interface ShareRequest {
+    // At most 90, the token expires after 7 days when omitted.
+    ExpiresInDays?: number;
+}
+
+export interface ShareResponse {
+    BookId: number;
+    // Unix timestamp.
+    Created: number;
+    // Unix timestamp.
+    Expires: number;
+    Id: number;
+    // The secret, only returned when the share is created.
+    Token?: string;
+}
+
+export interface UploadResponse {
+    BookId: number;
+    Validation: Report;
+}
+
+export interface UserBookResponse {
+    CurrentPage: number;
+    ScrollOffsets: number[];
+}
+
+// Get the OpenID Connect providers users can log in with.
+export function getProviders(): Promise<ProviderResponse[] | ApiError> {
+    let url = `${backendOrigin}/api/v1/auth/providers`;
+    return callApi(url, "GET");
+}
+
+// Get a book's files, table of contents and metadata.
+export function getBook(id: number): Promise<BookResponse | ApiError> {
+    let url = `${backendOrigin}/api/v1/books/${id}`;
+    return callApi(url, "GET");
+}
+
+// Create a token letting other users add a book in the user's collection to theirs.
+export function createShare(id: number, body: ShareRequest): Promise<ShareResponse | ApiError> {
+    let url = `${backendOrigin}/api/v1/books/${id}/shares`;
+    return callApi(url, "POST", body);
+}
+
+// Get the validation report generated when a book was uploaded.
+export function getBookValidation(id: number): Promise<Report | ApiError> {
+    let url = `${backendOrigin}/api/v1/books/${id}/validation`;
+    return callApi(url, "GET");
+}
+
+// Make an email the user's email with the token from the link mailed to it.
+export function confirmEmail(body: EmailConfirmRequest): Promise<EmptyResponse | ApiError> {
+    let url = `${backendOrigin}/api/v1/email/confirm`;
+    return callApi(url, "POST", body);
+}
+
+// Remove the user's account along with every book in their collection.
+export function deleteAccount(): Promise<EmptyResponse | ApiError> {
+    let url = `${backendOrigin}/api/v1/me`;
+    return callApi(url, "DELETE");
+}
+
+// Get the user's email, whether they confirmed that they own it and their settings.
+export function getAccount(): Promise<AccountResponse | ApiError> {
+    let url = `${backendOrigin}/api/v1/me`;
+    return callApi(url, "GET");
+}
+
+// Upload an epub and add it to the user's collection.
+export function uploadBook(body: FormData): Promise<UploadResponse | ApiError> {
+    let url = `${backendOrigin}/api/v1/me/books`;
+    return callApi(url, "POST", body, true);
+}
+
+// Remove a book from the user's collection.
+export function removeUserBook(id: number): Promise<EmptyResponse | ApiError> {
+    let url = `${backendOrigin}/api/v1/me/books/${id}`;
+    return callApi(url, "DELETE");
+}
+
+// Get the user's reading progress in a book.
+export function getUserBook(id: number): Promise<UserBookResponse | ApiError> {
+    let url = `${backendOrigin}/api/v1/me/books/${id}`;
+    return callApi(url, "GET");
+}
+
+// Add a book that was already uploaded to the user's collection.
+export function addBook(id: number, token?: string): Promise<UserBookResponse | ApiError> {
+    let url = `${backendOrigin}/api/v1/me/books/${id}`;
+    let query = new URLSearchParams();
+    if (token !== undefined) query.set("token", String(token));
+    if (query.size > 0) url += `?${query}`;
+    return callApi(url, "PUT");
+}
+
+// Save the user's reading progress in a book.
+export function saveProgress(id: number, body: ProgressRequest): Promise<UserBookResponse | ApiError> {
+    let url = `${backendOrigin}/api/v1/me/books/${id}/progress`;
+    return callApi(url, "PUT", body);
+}
+
+// Change the user's email, which requires their password.
+export function changeEmail(body: EmailChangeRequest): Promise<EmptyResponse | ApiError> {
+    let url = `${backendOrigin}/api/v1/me/email`;
+    return callApi(url, "PUT", body);
+}
+
+// Change the user's password, which requires their current password.
+export function changePassword(body: PasswordChangeRequest): Promise<EmptyResponse | ApiError> {
+    let url = `${backendOrigin}/api/v1/me/password`;
+    return callApi(url, "PUT", body);
+}
+
+// Replace the user's settings, which apply on every device they use.
+export function updateSettings(body: Settings): Promise<Settings | ApiError> {
+    let url = `${backendOrigin}/api/v1/me/settings`;
+    return callApi(url, "PUT", body);
+}
+
+// Get the user's share tokens, oldest first, including those that expired.
+export function getShares(): Promise<ShareResponse[] | ApiError> {
+    let url = `${backendOrigin}/api/v1/me/shares`;
+    return callApi(url, "GET");
+}
+
+// Revoke one of the user's share tokens, which stops working right away.
+export function revokeShare(id: number): Promise<EmptyResponse | ApiError> {
+    let url = `${backendOrigin}/api/v1/me/shares/${id}`;
+    return callApi(url, "DELETE");
+}
+
+// Get the user's api tokens, oldest first, along with when they were last used.
+export function getApiTokens(): Promise<ApiTokenResponse[] | ApiError> {
+    let url = `${backendOrigin}/api/v1/me/tokens`;
+    return callApi(url, "GET");
+}
+
+// Create an api token for scripts and other clients.
+export function createApiToken(body: ApiTokenRequest): Promise<ApiTokenResponse | ApiError> {
+    let url = `${backendOrigin}/api/v1/me/tokens`;
+    return callApi(url, "POST", body);
+}
+
+// Revoke one of the user's api tokens, which stops working right away.
+export function revokeApiToken(id: number): Promise<EmptyResponse | ApiError> {
+    let url = `${backendOrigin}/api/v1/me/tokens/${id}`;
+    return callApi(url, "DELETE");
+}
+
+// Mail a new link confirming the user's email to them.
+export function resendVerification(): Promise<EmptyResponse | ApiError> {
+    let url = `${backendOrigin}/api/v1/me/verification`;
+    return callApi(url, "POST");
+}
+
+// Mail a link to reset the password of the account with the email.
+export function requestPasswordReset(body: PasswordResetRequest): Promise<EmptyResponse | ApiError> {
+    let url = `${backendOrigin}/api/v1/password/reset`;
+    return callApi(url, "POST", body);
+}
+
+// Set the user's password with the token from the link mailed to them.
+export function resetPassword(body: PasswordResetConfirmRequest): Promise<EmptyResponse | ApiError> {
+    let url = `${backendOrigin}/api/v1/password/reset/confirm`;
+    return callApi(url, "POST", body);
+}
+
+// Get the series of the books in the user's collection, along with only those books, ordered by their position in the series.
+export function getAllSeries(): Promise<Series[] | ApiError> {
+    let url = `${backendOrigin}/api/v1/series`;
+    return callApi(url, "GET");
+}
+
+// Get a series along with the books of the user's collection in it, ordered by their position in the series.
+export function getSeries(id: number): Promise<Series | ApiError> {
+    let url = `${backendOrigin}/api/v1/series/${id}`;
+    return callApi(url, "GET");
+}
+
+// Validate the user's credentials and set the userId cookie.
+export function login(body: Credentials): Promise<EmptyResponse | ApiError> {
+    let url = `${backendOrigin}/api/v1/session`;
+    return callApi(url, "POST", body);
+}
+
+// Create a user account and set the userId cookie.
+export function createAccount(body: Credentials): Promise<EmptyResponse | ApiError> {
+    let url = `${backendOrigin}/api/v1/users`;
+    return callApi(url, "POST", body);
+}
+
+// Liveness check, which succeeds as long as the server is running.
+export function healthz(): Promise<HealthResponse | ApiError> {
+    let url = `${backendOrigin}/healthz`;
+    return callApi(url, "GET");
+}
+
+// Get this document.
+export function getOpenAPI(): Promise<object | ApiError> {
+    let url = `${backendOrigin}/openapi.json`;
+    return callApi(url, "GET");
+}
+
+// Readiness check, which succeeds when the database can be reached and the storage is writable.
+export function readyz(): Promise<ReadinessResponse | ApiError> {
+    let url = `${backendOrigin}/readyz`;
+    return callApi(url, "GET");
+}
@@ -1,40 +1,67 @@
 import { goto } from "$app/navigation";
 
-export const serverError   = "Server error";
 export const backendOrigin = "http://localhost:8080";
 
 // Key names used to store user data in localStorage
 export const BooksKey    = "User:Books";
-export const SettingsKey = "User:Settings";
 export const BookKey     = (id: number) => `Book:${id}`;
 export const UserBookKey = (id: number) => `Userbook:${id}`;
 
 // JSON structure for book info returned by backend API at endpoint /book/get/{id}
 interface Section { Name: string, Path: string };
+interface Creator { Name: string, FileAs: string, Role: string };
+interface Identifier { Value: string, Scheme: string };
+interface Series { Name: string, Index: number, Type: string };
 interface Info {
-    Author: string,     Title: string,    Contributor: string,
-    Coverage: string,   Date: string,     Description: string,
-    Identifier: string, Language: string, Publisher: string,
-    Relation: string,   Rights: string,   Source: string,
-    Subjects: string[],
+    Title: string,             Author: string,
+    Creators: Creator[],       Contributors: Creator[],
+    Identifiers: Identifier[], Languages: string[],
+    Published?: string,        Modified?: string,
+    Coverage: string,          Description: string,
+    Publisher: string,         Relation: string,
+    Rights: string,            Source: string,
+    Subjects: string[],        Series: Series[],
 };
 export class Book {
     CoverImagePath: string = "";
     TableOfContents: Section[] = [{Name: "", Path: ""}];
-    Info: Info = {Author: "", Title: "", Contributor: "", Coverage: "",
-                  Date: "", Description: "", Identifier: "", Language: "",
-                  Publisher: "", Relation: "", Rights: "", Source: "", Subjects: [""]};
+    Info: Info = {Title: "", Author: "", Creators: [], Contributors: [],
+                  Identifiers: [], Languages: [], Coverage: "", Description: "",
+                  Publisher: "", Relation: "", Rights: "", Source: "", Subjects: [""], Series: []};
 }
 
+// Error codes returned by the backend API, see backend/errors.go
+export type ErrorCode =
+    "BAD_REQUEST" | "INVALID_TOKEN" | "UNAUTHENTICATED" | "INVALID_CREDENTIALS" | "EXTERNAL_LOGIN_FAILED" |
+    "FORBIDDEN" | "EMAIL_UNVERIFIED" | "INSUFFICIENT_SCOPE" |
+    "ROUTE_NOT_FOUND" | "BOOK_NOT_FOUND" | "USER_BOOK_NOT_FOUND" | "SERIES_NOT_FOUND" | "API_TOKEN_NOT_FOUND" | "SHARE_NOT_FOUND" |
+    "METHOD_NOT_ALLOWED" | "DUPLICATE_ACCOUNT" | "UPLOAD_TOO_LARGE" |
+    "UNSUPPORTED_FILE" | "INVALID_EPUB" | "DRM_PROTECTED" | "RATE_LIMITED" | "INTERNAL_ERROR";
+
+// JSON structure of the errors returned by the backend API
+export class ApiError {
+    status: number = 0;
+    code: ErrorCode = "INTERNAL_ERROR";
+    message: string = "";
+    details: any = null;
+    requestId: string = "";
+}
+
+// Call the backend API and return the json response,
+// or an ApiError if the request failed.
 export async function callApi(url: string, method: string, json: object = {}, isFile: boolean=false): Promise<any> {
     let data = isFile ? json : JSON.stringify(json);
     let payload = {
         method: method,
         credentials: "include",
-        body: method == "POST" ? data : null,
+        body: method == "POST" || method == "PUT" ? data : null,
     };
     const response = await fetch(url, payload as RequestInit);
-    return response.json();
+    const body = await response.json();
+    if (!response.ok) {
+        return Object.assign(new ApiError(), body, { status: response.status });
+    }
+    return body;
 }
 
 export async function downloadFile(url: string): Promise<string> {
@@ -45,24 +72,32 @@ export async function downloadFile(url: string): Promise<string> {
     return response.text();
 }
 
-// Redirect to auth page if user has not authenticated
-export function redirectIfNotAuth() {
-    if (document.cookie == "") {
+// Redirect to auth page if user has not authenticated. Scripts can't read
+// the session cookie, so the backend is asked whether the session is valid.
+export async function redirectIfNotAuth() {
+    let response = await callApi(`${backendOrigin}/api/v1/me`, "GET");
+    if (response instanceof ApiError && response.status == 401) {
         goto("/auth");
     }
 }
 
-export function staticFileUrl(file: string): string {
+// Url of a file in a book, using the book's signed StaticUrl
+// returned by the backend API at endpoint /api/v1/books/{id}.
+export function staticFileUrl(staticUrl: string, file: string): string {
     file = file.replace(window.location.origin+"/", "");
-    return `${backendOrigin}/static/${file}`;
+    return `${backendOrigin}${staticUrl}${file}`;
 }
 
-export function coverImagePath(file: string): string {
-    return file == "" ? "default-cover-image.png" : staticFileUrl(file);
+export function coverThumbnailUrl(bookId: number, size: "small" | "medium" | "large"): string {
+    return `${backendOrigin}/api/v1/books/${bookId}/cover?size=${size}`;
 }
 
-export function removeCookie(name: string) {
-    document.cookie = `${name}=; Max-Age=-99999999;`;
+// Passwords are hashed before they're sent to the backend
+export async function hashSHA256(data: string): Promise<string> {
+    let encoded = new TextEncoder().encode(data);
+    let buffer = await window.crypto.subtle.digest("SHA-256", encoded);
+    let hash = Array.from(new Uint8Array(buffer));
+    return hash.map(byte => byte.toString(16).padStart(2, "0")).join("");
 }
 
 export function cacheGet(key: string): any {
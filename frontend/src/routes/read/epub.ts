@@ -3,6 +3,8 @@ import * as utils from "$lib/utils";
 export class EpubViewer {
     // HTMl/XHTML files within the epub file.
     files: string[];
+    // Signed url path the files are served from, which expires.
+    staticUrl: string;
     // Vertical scrolling offsets within the HTML/XHTML files.
     scrolls: number[];
     // The amount to vertically scroll at once.
@@ -17,6 +19,8 @@ export class EpubViewer {
     containerMidPoint: number;
     // HTMLElement used to hold all the rendered epub content.
     renderContainer: HTMLElement;
+    // Whether to remove the book styles that fight the reader's theme, from the user's settings.
+    useReaderTheme: boolean = false;
     // The default CSS to apply for when the epub's XHTML/HTML files don't have adequate CSS.
     defaultCss: string = `
         body {
@@ -41,9 +45,10 @@ export class EpubViewer {
         }
     `;
 
-    constructor(scrollOffsets: number[], files: string[], pageIdx: number, container?: HTMLElement) {
+    constructor(scrollOffsets: number[], files: string[], staticUrl: string, pageIdx: number, container?: HTMLElement) {
         this.pad = 10;
         this.files = files;
+        this.staticUrl = staticUrl;
         this.pageIdx = pageIdx;
         this.scrolls = scrollOffsets;
         this.renderContainer = container!;
@@ -70,7 +75,25 @@ export class EpubViewer {
         return all_imgs as HTMLElement[];
     }
 
+    // The book's css references its fonts and images using /static/ urls,
+    // which need to resolve against the backend rather than the srcdoc iframe
+    // and be signed like the book's other files.
+    private resolveStaticUrls(doc: Document) {
+        let base = doc.createElement("base");
+        base.href = `${utils.backendOrigin}/`;
+        doc.head.prepend(base);
+
+        for (let style of Array.from(doc.getElementsByTagName("style"))) {
+            let css = style.textContent ?? "";
+            style.textContent = css.replaceAll('url("/static/', `url("${utils.staticFileUrl(this.staticUrl, "")}`);
+        }
+    }
+
     private injectDefaultCSS(doc: Document) {
+        if (this.useReaderTheme) {
+            doc.head.querySelectorAll('style[data-page="theme"]').forEach((s) => s.remove());
+        }
+
         let style = doc.createElement("style");
         style.textContent = this.defaultCss;
         doc.head.appendChild(style);
@@ -92,7 +115,7 @@ export class EpubViewer {
         let images = this.getImagesInDocument(doc);
         for (let image of images) {
             let source = image.getAttribute(sourceAttr)!;
-            image.setAttribute(sourceAttr, utils.staticFileUrl(source));
+            image.setAttribute(sourceAttr, utils.staticFileUrl(this.staticUrl, source));
         }
 
         // NOTE: for now, all links are disabled
@@ -152,10 +175,14 @@ export class EpubViewer {
     private renderPage(content: string, elementId: string) {
         let contentType = this.files[this.pageIdx].endsWith(".html") ? "text/html" : "application/xhtml+xml";
         let doc = new DOMParser().parseFromString(content, contentType as DOMParserSupportedType);
+        this.resolveStaticUrls(doc);
         this.injectDefaultCSS(doc);
         this.correctLinks(doc);
 
+        // The book's html isn't trusted, so its scripts can't run. The iframe keeps
+        // its origin so that the reader can still measure and scroll the page.
         let iframe = document.createElement("iframe");
+        iframe.setAttribute("sandbox", "allow-same-origin");
         iframe.srcdoc = doc.documentElement.innerHTML;
         iframe.scrolling = "no";
         iframe.onload = () => {
@@ -179,7 +206,7 @@ export class EpubViewer {
     // elementId specifies the optional element to jump to when rendering iframe contents.
     async render(elementId: string = "") {
         this.renderContainer.innerHTML = "";
-        let url = utils.staticFileUrl(this.files[this.pageIdx]);
+        let url = utils.staticFileUrl(this.staticUrl, this.files[this.pageIdx]);
         const html = await utils.downloadFile(url);
         let view = this.renderPage(html, elementId);
         this.renderContainer.appendChild(view);
@@ -1,6 +1,7 @@
 #!/bin/bash
 export EPUB_EXTRACT_DIRECTORY=""
 export FILE_UPLOAD_DIRECTORY=""
+export DEVELOPMENT=true
 cd backend &&
 go build &&
 ./page &